@@ -0,0 +1,104 @@
+// Command hl7send sends HL7 v2 messages recorded in files to an MLLP listener over one connection, and prints the
+// acknowledgement of each. It is used to try the HL7 interface with the sample messages in hl7/testdata:
+//
+//	go run ./cmd/hl7send -addr localhost:2575 hl7/testdata/*.hl7
+//
+// A file may hold several messages, each starting with its MSH segment. Segments may be on lines of their own.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gcchr-system/core/hl7"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:2575", "Address of the MLLP listener.")
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for each acknowledgement.")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: hl7send [-addr host:port] [-timeout 10s] file...")
+		os.Exit(2)
+	}
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	accepted, failed := 0, 0
+	for _, file := range flag.Args() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, msg := range splitMessages(string(data)) {
+			if err := hl7.WriteMessage(conn, []byte(msg)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			conn.SetReadDeadline(time.Now().Add(*timeout))
+			ack, err := hl7.ReadMessage(r)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			code, text := acknowledgement(ack)
+			if code == hl7.AckAccept {
+				accepted++
+			} else {
+				failed++
+			}
+			fmt.Printf("%-45s %s %s\n", file, code, text)
+		}
+	}
+	fmt.Printf("%d accepted, %d failed\n", accepted, failed)
+}
+
+// splitMessages returns the messages of a file, with their segments ending in carriage returns.
+func splitMessages(data string) []string {
+	var messages []string
+	var segments []string
+	flush := func() {
+		if len(segments) > 0 {
+			messages = append(messages, strings.Join(segments, "\r")+"\r")
+			segments = nil
+		}
+	}
+	lines := strings.FieldsFunc(data, func(r rune) bool { return r == '\r' || r == '\n' })
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "MSH") {
+			flush()
+		}
+		segments = append(segments, line)
+	}
+	flush()
+	return messages
+}
+
+// acknowledgement returns the code and the text of the MSA segment of the acknowledgement.
+func acknowledgement(ack []byte) (string, string) {
+	msg, err := hl7.Parse(ack)
+	if err != nil {
+		return "??", err.Error()
+	}
+	msa := msg.Segment("MSA")
+	if msa == nil {
+		return "??", "the acknowledgement has no MSA segment"
+	}
+	return msa.Value(1), msa.Value(3)
+}
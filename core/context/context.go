@@ -6,7 +6,9 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+	scopesKey  privateKey = "scopes"
 )
 
 type privateKey string
@@ -23,3 +25,35 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// WithScopes restricts the request to the scopes of the API token it was authenticated with.
+func WithScopes(ctx context.Context, scopes []models.Scope) context.Context {
+	if scopes == nil {
+		scopes = []models.Scope{}
+	}
+	return context.WithValue(ctx, scopesKey, scopes)
+}
+
+// Scopes returns the scopes of the API token of the request.
+// It returns nil for requests authenticated with a session, which are not limited by scopes.
+func Scopes(ctx context.Context) []models.Scope {
+	if temp := ctx.Value(scopesKey); temp != nil {
+		if scopes, ok := temp.([]models.Scope); ok {
+			return scopes
+		}
+	}
+	return nil
+}
@@ -4,6 +4,9 @@ import (
 	"gcchr-system/core/views"
 
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"gcchr-system/core/models"
 
@@ -12,34 +15,248 @@ import (
 
 type Admin struct {
 	AdminDashboardView *views.View
+	SecurityView       *views.View
+	ClinicView         *views.View
+	AuditView          *views.View
 	logger             *logrus.Entry
 	us                 models.UserService
+	settings           models.SettingsService
+	audit              models.AuditService
+	hl7                models.HL7MessageService
 }
 
-func NewAdmin(us models.UserService, logger *logrus.Entry) *Admin {
+func NewAdmin(us models.UserService, settings models.SettingsService, audit models.AuditService,
+	hl7 models.HL7MessageService, logger *logrus.Entry) *Admin {
 	return &Admin{
 		AdminDashboardView: views.NewView("bootstrap", "admin/dashboard"),
+		SecurityView:       views.NewView("bootstrap", "admin/security"),
+		ClinicView:         views.NewView("bootstrap", "admin/clinic"),
+		AuditView:          views.NewView("bootstrap", "admin/audit"),
 		logger:             logger,
 		us:                 us,
+		settings:           settings,
+		audit:              audit,
+		hl7:                hl7,
 	}
 }
 
 type AdminDashboardData struct {
 	Physicians []models.User
+	Staff      []models.User
+	Reception  []models.User
+	Admins     []models.User
+	// FailedHL7Messages counts the messages waiting for review.
+	FailedHL7Messages int
 }
 
 // GET /admin/dashboard
 func (a *Admin) Dashboard(w http.ResponseWriter, r *http.Request) {
 	a.logger.Infoln("Rendering admin dashboard")
-	physicians, err := a.us.ByUserRole(models.UserRolePhysician)
+	dashData := AdminDashboardData{}
+	lists := []struct {
+		role  models.UserRole
+		users *[]models.User
+	}{
+		{models.UserRolePhysician, &dashData.Physicians},
+		{models.UserRoleStaff, &dashData.Staff},
+		{models.UserRoleReception, &dashData.Reception},
+		{models.UserRoleAdmin, &dashData.Admins},
+	}
+	for _, l := range lists {
+		users, err := a.us.ByUserRole(l.role)
+		if err != nil {
+			a.logger.Errorf("Error while fetching users with role %s: %+v", l.role, err)
+			http.Error(w, "Something went wrong while fetching users.", http.StatusInternalServerError)
+			return
+		}
+		a.logger.Debugf("Fetched %d users with role %s.", len(users), l.role)
+		*l.users = users
+	}
+	_, failed, err := a.hl7.Find(models.HL7MessageFilter{Status: models.HL7MessageFailed, PerPage: 1})
 	if err != nil {
-		a.logger.Errorf("Error while fetching physicians: %+v", err)
-		http.Error(w, "Something went wrong while fetching Physicians.", http.StatusInternalServerError)
+		a.logger.Errorf("Error while counting failed HL7 messages: %+v", err)
 	}
-	a.logger.Debugf("Fetched %d physicians.", len(physicians))
-	dashData := AdminDashboardData{}
-	dashData.Physicians = physicians
+	dashData.FailedHL7Messages = failed
 	var vd views.Data
 	vd.Yield = dashData
 	a.AdminDashboardView.Render(w, r, vd)
 }
+
+type SecurityForm struct {
+	TwoFactorRoles   []models.UserRole `schema:"two_factor_roles"`
+	UserRolesOptions []models.UserRole `schema:"-"`
+}
+
+// TwoFactorRequired is used by the security template to check the boxes of the selected roles.
+func (f *SecurityForm) TwoFactorRequired(role models.UserRole) bool {
+	return models.UserRoleExists(role, f.TwoFactorRoles)
+}
+
+// Security renders the security settings.
+// GET /admin/security
+func (a *Admin) Security(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	form := SecurityForm{UserRolesOptions: models.UserRolesList()}
+	vd.Yield = &form
+	security, err := a.settings.Security()
+	if err != nil {
+		a.logger.Errorf("Error while fetching security settings: %v", err)
+		vd.SetAlert(err)
+		a.SecurityView.Render(w, r, vd)
+		return
+	}
+	form.TwoFactorRoles = security.TwoFactorRoles
+	a.SecurityView.Render(w, r, vd)
+}
+
+// SaveSecurity processes the security settings form.
+// POST /admin/security
+func (a *Admin) SaveSecurity(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	form := SecurityForm{UserRolesOptions: models.UserRolesList()}
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.SecurityView.Render(w, r, vd)
+		return
+	}
+	security := models.SecuritySettings{TwoFactorRoles: form.TwoFactorRoles}
+	if err := a.settings.SaveSecurity(&security); err != nil {
+		vd.SetAlert(err)
+		a.SecurityView.Render(w, r, vd)
+		return
+	}
+	a.logger.Infof("Two factor authentication is now required for roles: %v", security.TwoFactorRoles)
+	views.RedirectAlert(w, r, "/admin/security", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Security settings saved.",
+	})
+}
+
+type ClinicForm struct {
+	Name      string         `schema:"name"`
+	Address   models.Address `schema:"address"`
+	Contact   models.Contact `schema:"contact"`
+	TaxNumber string         `schema:"tax_number"`
+}
+
+// Clinic renders the details of the clinic printed on prescriptions and invoices.
+// GET /admin/clinic
+func (a *Admin) Clinic(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ClinicForm
+	vd.Yield = &form
+	clinic, err := a.settings.Clinic()
+	if err != nil {
+		a.logger.Errorf("Error while fetching clinic settings: %v", err)
+		vd.SetAlert(err)
+		a.ClinicView.Render(w, r, vd)
+		return
+	}
+	form.Name = clinic.Name
+	form.Address = clinic.Address
+	form.Contact = clinic.Contact
+	form.TaxNumber = clinic.TaxNumber
+	a.ClinicView.Render(w, r, vd)
+}
+
+// SaveClinic processes the clinic details form.
+// POST /admin/clinic
+func (a *Admin) SaveClinic(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ClinicForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.ClinicView.Render(w, r, vd)
+		return
+	}
+	clinic := models.ClinicSettings{Name: form.Name, Address: form.Address, Contact: form.Contact,
+		TaxNumber: form.TaxNumber}
+	if err := a.settings.SaveClinic(&clinic); err != nil {
+		vd.SetAlert(err)
+		a.ClinicView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/admin/clinic", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Clinic details saved.",
+	})
+}
+
+type AuditForm struct {
+	Action models.AuditAction `schema:"action"`
+	Actor  string             `schema:"actor"`
+	Target string             `schema:"target"`
+	// From and To are dates in the format of a date input, To is inclusive.
+	From string `schema:"from"`
+	To   string `schema:"to"`
+	Page int    `schema:"page"`
+}
+
+type AuditData struct {
+	Form          AuditForm
+	ActionOptions []models.AuditAction
+	Entries       []models.AuditEntry
+	Total         int
+	Page          int
+	Pages         int
+}
+
+func (d *AuditData) HasPrev() bool { return d.Page > 1 }
+func (d *AuditData) HasNext() bool { return d.Page < d.Pages }
+func (d *AuditData) Prev() int     { return d.Page - 1 }
+func (d *AuditData) Next() int     { return d.Page + 1 }
+
+// PageLink returns the URL of another page of the audit log with the same filters.
+func (d *AuditData) PageLink(page int) string {
+	v := url.Values{}
+	v.Set("action", string(d.Form.Action))
+	v.Set("actor", d.Form.Actor)
+	v.Set("target", d.Form.Target)
+	v.Set("from", d.Form.From)
+	v.Set("to", d.Form.To)
+	v.Set("page", strconv.Itoa(page))
+	return "/admin/audit?" + v.Encode()
+}
+
+// Audit renders a page of the audit log, filtered by the query parameters.
+// GET /admin/audit
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data := AuditData{ActionOptions: models.AuditActionsList()}
+	vd.Yield = &data
+	if err := parseURLParams(r, &data.Form); err != nil {
+		vd.SetAlert(err)
+		a.AuditView.Render(w, r, vd)
+		return
+	}
+	filter := models.AuditFilter{
+		Action:  data.Form.Action,
+		Actor:   data.Form.Actor,
+		Target:  data.Form.Target,
+		Page:    data.Form.Page,
+		PerPage: models.DefaultAuditPageSize,
+	}
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if from, err := time.ParseInLocation(dateFormat, data.Form.From, time.Local); err == nil {
+		filter.From = from
+	}
+	if to, err := time.ParseInLocation(dateFormat, data.Form.To, time.Local); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+	entries, total, err := a.audit.Query(filter)
+	if err != nil {
+		a.logger.Errorf("Error while querying the audit log: %v", err)
+		vd.SetAlert(err)
+		a.AuditView.Render(w, r, vd)
+		return
+	}
+	data.Entries = entries
+	data.Total = total
+	data.Page = filter.Page
+	data.Pages = (total + filter.PerPage - 1) / filter.PerPage
+	a.AuditView.Render(w, r, vd)
+}
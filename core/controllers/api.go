@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// API serves the JSON API under /api/v1. It uses the same services as the HTML controllers.
+type API struct {
+	us     models.UserService
+	ss     models.SessionService
+	tfs    models.TwoFactorService
+	ps     models.PatientService
+	ds     models.DiagnosisCodeService
+	audit  models.AuditService
+	logger *logrus.Entry
+}
+
+func NewAPI(us models.UserService, ss models.SessionService, tfs models.TwoFactorService, ps models.PatientService,
+	ds models.DiagnosisCodeService, audit models.AuditService, logger *logrus.Entry) *API {
+	return &API{
+		us:     us,
+		ss:     ss,
+		tfs:    tfs,
+		ps:     ps,
+		ds:     ds,
+		audit:  audit,
+		logger: logger,
+	}
+}
+
+// UserResponse is the representation of a user in the API, without any secrets.
+type UserResponse struct {
+	Id                 bson.ObjectId     `json:"id"`
+	Name               string            `json:"name"`
+	Username           string            `json:"username"`
+	UserRoles          []models.UserRole `json:"user_roles"`
+	RegistrationNumber string            `json:"registration_number,omitempty"`
+	Contact            models.Contact    `json:"contact"`
+	Addresses          []models.Address  `json:"addresses"`
+	Created            time.Time         `json:"created"`
+	Updated            time.Time         `json:"updated"`
+	LastLogin          time.Time         `json:"last_login"`
+	Disabled           bool              `json:"disabled"`
+	Locked             bool              `json:"locked"`
+	TwoFactorEnabled   bool              `json:"two_factor_enabled"`
+	MustChangePassword bool              `json:"must_change_password"`
+}
+
+func newUserResponse(user *models.User) UserResponse {
+	return UserResponse{
+		Id:                 user.Id,
+		Name:               user.Name,
+		Username:           user.Username,
+		UserRoles:          user.UserRoles,
+		RegistrationNumber: user.RegistrationNumber,
+		Contact:            user.Contact,
+		Addresses:          user.Addresses,
+		Created:            user.Created,
+		Updated:            user.Updated,
+		LastLogin:          user.LastLogin,
+		Disabled:           user.Disabled,
+		Locked:             user.Locked(),
+		TwoFactorEnabled:   user.TOTPEnabled,
+		MustChangePassword: user.MustChangePassword,
+	}
+}
+
+type APILoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Code is the TOTP or recovery code, required for users with two factor authentication.
+	Code string `json:"code"`
+}
+
+type APILoginResponse struct {
+	Token   string       `json:"token"`
+	Expires time.Time    `json:"expires"`
+	User    UserResponse `json:"user"`
+}
+
+// Login starts a session and returns its token, to be sent as "Authorization: Bearer <token>".
+// POST /api/v1/login
+func (a *API) Login(w http.ResponseWriter, r *http.Request) {
+	var req APILoginRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	user, err := a.us.Authenticate(req.Username, req.Password, clientIP(r))
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	if user.TOTPEnabled {
+		if err := a.tfs.WithActor(models.ActorOf(user, clientIP(r))).Verify(user, req.Code); err != nil {
+			a.record(models.ActorOf(user, clientIP(r)), models.AuditLoginFailed, user, "second factor failed")
+			a.error(w, err)
+			return
+		}
+	} else {
+		required, err := a.tfs.Required(user)
+		if err != nil {
+			a.error(w, err)
+			return
+		}
+		// Enrollment needs an authenticator app, so it is only offered by the login page.
+		if required {
+			a.error(w, models.ErrTwoFactorRequired)
+			return
+		}
+	}
+	session, err := a.ss.Start(user, clientIP(r), r.UserAgent())
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	a.record(models.ActorOf(user, clientIP(r)), models.AuditLogin, user, "")
+	user.LastLogin = time.Now()
+	if err := a.us.Update(user); err != nil {
+		a.logger.Errorf("Error while updating last login of user %s: %v", user.Username, err)
+	}
+	views.RenderJSON(w, http.StatusOK, APILoginResponse{
+		Token:   session.Token,
+		Expires: session.Expires,
+		User:    newUserResponse(user),
+	})
+}
+
+// Me returns the signed in user.
+// GET /api/v1/me
+func (a *API) Me(w http.ResponseWriter, r *http.Request) {
+	views.RenderJSON(w, http.StatusOK, newUserResponse(context.User(r.Context())))
+}
+
+// Users lists all users, or the users with the role of the role query parameter.
+// GET /api/v1/users
+func (a *API) Users(w http.ResponseWriter, r *http.Request) {
+	var users []models.User
+	var err error
+	if role := r.URL.Query().Get("role"); role != "" {
+		users, err = a.us.ByUserRole(models.UserRole(role))
+	} else {
+		users, err = a.us.All()
+	}
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	resp := make([]UserResponse, len(users))
+	for i := range users {
+		resp[i] = newUserResponse(&users[i])
+	}
+	views.RenderJSON(w, http.StatusOK, resp)
+}
+
+// User returns a single user.
+// GET /api/v1/users/:id
+func (a *API) User(w http.ResponseWriter, r *http.Request) {
+	user, err := a.us.ById(mux.Vars(r)["id"])
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+type APIUserRequest struct {
+	Name               *string            `json:"name"`
+	Username           *string            `json:"username"`
+	Password           *string            `json:"password"`
+	UserRoles          *[]models.UserRole `json:"user_roles"`
+	RegistrationNumber *string            `json:"registration_number"`
+	Contact            *models.Contact    `json:"contact"`
+	Addresses          *[]models.Address  `json:"addresses"`
+	Disabled           *bool              `json:"disabled"`
+}
+
+// apply sets the fields present in the request on the user.
+func (req *APIUserRequest) apply(user *models.User) {
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	if req.Username != nil {
+		user.Username = *req.Username
+	}
+	if req.Password != nil {
+		user.Password = *req.Password
+	}
+	if req.UserRoles != nil {
+		user.UserRoles = *req.UserRoles
+	}
+	if req.RegistrationNumber != nil {
+		user.RegistrationNumber = strings.TrimSpace(*req.RegistrationNumber)
+	}
+	if req.Contact != nil {
+		user.Contact = *req.Contact
+	}
+	if req.Addresses != nil {
+		user.Addresses = nonEmptyAddresses(*req.Addresses)
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+}
+
+// CreateUser creates a user from the fields of the request.
+// POST /api/v1/users
+func (a *API) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req APIUserRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	var user models.User
+	req.apply(&user)
+	if err := a.users(r).Create(&user); err != nil {
+		a.error(w, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusCreated, newUserResponse(&user))
+}
+
+// UpdateUser changes the fields present in the request, other fields are kept.
+// Disabling a user or setting their password ends their sessions.
+// PATCH /api/v1/users/:id
+// PUT /api/v1/users/:id
+func (a *API) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.us.ById(mux.Vars(r)["id"])
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	var req APIUserRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	req.apply(user)
+	if err := a.users(r).Update(user); err != nil {
+		a.error(w, err)
+		return
+	}
+	if user.Disabled || req.Password != nil {
+		a.endSessions(user)
+	}
+	views.RenderJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+// DeleteUser deletes a user and ends their sessions.
+// DELETE /api/v1/users/:id
+func (a *API) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.us.ById(mux.Vars(r)["id"])
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	if err := a.users(r).Delete(user.Id.Hex()); err != nil {
+		a.error(w, err)
+		return
+	}
+	a.endSessions(user)
+	views.RenderJSON(w, http.StatusNoContent, nil)
+}
+
+// NotFound answers requests to unknown API paths.
+func (a *API) NotFound(w http.ResponseWriter, r *http.Request) {
+	views.RenderJSONError(w, http.StatusNotFound, "Resource not found")
+}
+
+func (a *API) users(r *http.Request) models.UserService {
+	return a.us.WithActor(requestActor(r))
+}
+
+func (a *API) endSessions(user *models.User) {
+	if err := a.ss.DeleteByUserId(user.Id.Hex()); err != nil {
+		a.logger.Errorf("Error while ending sessions of user %s: %v", user.Username, err)
+	}
+}
+
+// decode parses the JSON body of the request into dst.
+// If false is returned, the error response has already been written.
+func (a *API) decode(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		views.RenderJSONError(w, http.StatusBadRequest, "The request body is not valid JSON")
+		return false
+	}
+	return true
+}
+
+// record adds an entry to the audit log, failures are only logged.
+func (a *API) record(actor models.Actor, action models.AuditAction, target *models.User, detail string) {
+	if err := a.audit.Record(actor, action, target, nil, detail); err != nil {
+		a.logger.Errorf("Error while recording audit entry %s: %v", action, err)
+	}
+}
+
+// error writes the error as JSON. Messages of errors which are not public are only logged.
+func (a *API) error(w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case models.MongoErrNotFound.Error(), models.ErrIDInvalid.Error(), models.ErrNotFound.Error():
+		views.RenderJSONError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	pErr, ok := err.(views.PublicError)
+	if !ok {
+		a.logger.Errorf("Error while serving API request: %v", err)
+		views.RenderJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+		return
+	}
+	status := http.StatusBadRequest
+	switch err {
+	case models.ErrInvalidCredentials, models.ErrTwoFactorCodeInvalid:
+		status = http.StatusUnauthorized
+	case models.ErrTooManyLoginAttempts:
+		status = http.StatusTooManyRequests
+	case models.ErrUserDisabled, models.ErrTwoFactorRequired:
+		status = http.StatusForbidden
+	case models.ErrUsernameTaken, models.ErrMRNTaken:
+		status = http.StatusConflict
+	}
+	views.RenderJSONError(w, status, pErr.Public())
+}
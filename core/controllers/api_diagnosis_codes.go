@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/gorilla/mux"
+)
+
+// DiagnosisCodes searches the ICD-10 codes by code prefix or by the words of their titles with the q query
+// parameter, returning at most limit codes. It serves the typeahead of the diagnoses of encounters.
+// GET /api/v1/diagnosis-codes
+func (a *API) DiagnosisCodes(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	codes := a.ds.Search(r.URL.Query().Get("q"), limit)
+	if codes == nil {
+		codes = []models.DiagnosisCode{}
+	}
+	views.RenderJSON(w, http.StatusOK, codes)
+}
+
+// DiagnosisCode returns a single ICD-10 code, written with or without the dot.
+// GET /api/v1/diagnosis-codes/:code
+func (a *API) DiagnosisCode(w http.ResponseWriter, r *http.Request) {
+	code, ok := a.ds.Lookup(mux.Vars(r)["code"])
+	if !ok {
+		views.RenderJSONError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, code)
+}
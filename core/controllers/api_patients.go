@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/gorilla/mux"
+)
+
+// Patients searches patients with the q query parameter, returning at most limit patients.
+// GET /api/v1/patients
+func (a *API) Patients(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	patients, err := a.ps.Search(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	if patients == nil {
+		patients = []models.Patient{}
+	}
+	views.RenderJSON(w, http.StatusOK, patients)
+}
+
+// Patient returns a single patient.
+// GET /api/v1/patients/:id
+func (a *API) Patient(w http.ResponseWriter, r *http.Request) {
+	patient, err := a.ps.ById(mux.Vars(r)["id"])
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, patient)
+}
+
+// CreatePatient registers a patient. The medical record number is assigned unless the request has one.
+// POST /api/v1/patients
+func (a *API) CreatePatient(w http.ResponseWriter, r *http.Request) {
+	var patient models.Patient
+	if !a.decode(w, r, &patient) {
+		return
+	}
+	patient.Id = ""
+	patient.RegisteredBy = context.User(r.Context()).Id
+	if err := a.ps.Create(&patient); err != nil {
+		a.error(w, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusCreated, patient)
+}
+
+// UpdatePatient changes the fields present in the request, other fields are kept.
+// PATCH /api/v1/patients/:id
+// PUT /api/v1/patients/:id
+func (a *API) UpdatePatient(w http.ResponseWriter, r *http.Request) {
+	patient, err := a.ps.ById(mux.Vars(r)["id"])
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	id, mrn := patient.Id, patient.MRN
+	if !a.decode(w, r, patient) {
+		return
+	}
+	patient.Id = id
+	patient.MRN = mrn
+	if err := a.ps.Update(patient); err != nil {
+		a.error(w, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, patient)
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// apiTokenLifetimes are the lifetimes in days users can choose from for a new token.
+var apiTokenLifetimes = []int{7, 30, 90, 180, 365}
+
+type APITokens struct {
+	IndexView   *views.View
+	CreatedView *views.View
+	ts          models.APITokenService
+	us          models.UserService
+	audit       models.AuditService
+	logger      *logrus.Entry
+}
+
+func NewAPITokens(ts models.APITokenService, us models.UserService, audit models.AuditService, logger *logrus.Entry) *APITokens {
+	return &APITokens{
+		IndexView:   views.NewView("bootstrap", "tokens/index"),
+		CreatedView: views.NewView("bootstrap", "tokens/created"),
+		ts:          ts,
+		us:          us,
+		audit:       audit,
+		logger:      logger,
+	}
+}
+
+type APITokenForm struct {
+	Name          string         `schema:"name"`
+	Scopes        []models.Scope `schema:"scopes"`
+	ExpiresInDays int            `schema:"expires_in_days"`
+}
+
+type APITokensData struct {
+	Owner *models.User
+	// Path is the page of the tokens of the owner, the form and revoke actions are relative to it.
+	Path           string
+	Tokens         []models.APIToken
+	Form           APITokenForm
+	ScopeOptions   []models.Scope
+	LifetimeOption []int
+}
+
+// HasScope is used by the template to keep the checked scopes of the form.
+func (d *APITokensData) HasScope(scope models.Scope) bool {
+	return models.ScopeExists(scope, d.Form.Scopes)
+}
+
+type APITokenCreatedData struct {
+	Token *models.APIToken
+	Path  string
+}
+
+// Index lists the API tokens of the signed in user.
+// GET /profile/tokens
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	t.render(w, r, context.User(r.Context()), "/profile/tokens", nil, APITokenForm{ExpiresInDays: 90})
+}
+
+// Create issues a new API token for the signed in user.
+// POST /profile/tokens
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	t.create(w, r, context.User(r.Context()), "/profile/tokens")
+}
+
+// Revoke deletes an API token of the signed in user.
+// POST /profile/tokens/:tid/revoke
+func (t *APITokens) Revoke(w http.ResponseWriter, r *http.Request) {
+	t.revoke(w, r, context.User(r.Context()), "/profile/tokens")
+}
+
+// UserIndex lists the API tokens of a user, for admins managing service accounts.
+// GET /admin/users/:id/tokens
+func (t *APITokens) UserIndex(w http.ResponseWriter, r *http.Request) {
+	owner, err := t.owner(w, r)
+	if err != nil {
+		return
+	}
+	t.render(w, r, owner, userPath(owner)+"/tokens", nil, APITokenForm{ExpiresInDays: 90})
+}
+
+// UserCreate issues a new API token for a user.
+// POST /admin/users/:id/tokens
+func (t *APITokens) UserCreate(w http.ResponseWriter, r *http.Request) {
+	owner, err := t.owner(w, r)
+	if err != nil {
+		return
+	}
+	t.create(w, r, owner, userPath(owner)+"/tokens")
+}
+
+// UserRevoke deletes an API token of a user.
+// POST /admin/users/:id/tokens/:tid/revoke
+func (t *APITokens) UserRevoke(w http.ResponseWriter, r *http.Request) {
+	owner, err := t.owner(w, r)
+	if err != nil {
+		return
+	}
+	t.revoke(w, r, owner, userPath(owner)+"/tokens")
+}
+
+func (t *APITokens) render(w http.ResponseWriter, r *http.Request, owner *models.User, path string, alert error,
+	form APITokenForm) {
+	var vd views.Data
+	data := APITokensData{
+		Owner:          owner,
+		Path:           path,
+		Form:           form,
+		ScopeOptions:   models.ScopesList(),
+		LifetimeOption: apiTokenLifetimes,
+	}
+	vd.Yield = &data
+	tokens, err := t.ts.ByUserId(owner.Id.Hex())
+	if err != nil {
+		t.logger.Errorf("Error while fetching API tokens of user %s: %v", owner.Username, err)
+		alert = err
+	}
+	data.Tokens = tokens
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	t.IndexView.Render(w, r, vd)
+}
+
+func (t *APITokens) create(w http.ResponseWriter, r *http.Request, owner *models.User, path string) {
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		t.render(w, r, owner, path, err, form)
+		return
+	}
+	expires := time.Now().AddDate(0, 0, form.ExpiresInDays)
+	token, err := t.ts.Issue(owner, form.Name, form.Scopes, expires, context.User(r.Context()))
+	if err != nil {
+		t.render(w, r, owner, path, err, form)
+		return
+	}
+	t.record(r, models.AuditTokenCreate, owner, token)
+	t.CreatedView.Render(w, r, APITokenCreatedData{Token: token, Path: path})
+}
+
+func (t *APITokens) revoke(w http.ResponseWriter, r *http.Request, owner *models.User, path string) {
+	id := mux.Vars(r)["tid"]
+	token, err := t.ts.ById(id)
+	if err == nil {
+		err = t.ts.Revoke(owner.Id.Hex(), id)
+	}
+	if err != nil {
+		t.logger.Errorf("Error while revoking API token %s: %v", id, err)
+		views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: "The token could not be revoked.",
+		})
+		return
+	}
+	t.record(r, models.AuditTokenRevoke, owner, token)
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("The token %s has been revoked.", token.Name),
+	})
+}
+
+// owner fetches the user with the id from the request path.
+// If an error is returned, the response has already been written.
+func (t *APITokens) owner(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	user, err := t.us.ById(mux.Vars(r)["id"])
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			t.logger.Errorf("Error while fetching user: %v", err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (t *APITokens) record(r *http.Request, action models.AuditAction, owner *models.User, token *models.APIToken) {
+	scopes := make([]string, len(token.Scopes))
+	for i, s := range token.Scopes {
+		scopes[i] = string(s)
+	}
+	detail := fmt.Sprintf("%s (%s)", token.Name, strings.Join(scopes, ", "))
+	if err := t.audit.Record(requestActor(r), action, owner, nil, detail); err != nil {
+		t.logger.Errorf("Error while recording audit entry %s: %v", action, err)
+	}
+}
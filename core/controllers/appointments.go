@@ -0,0 +1,698 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// sessionsPerDay is the number of sessions per weekday offered by the availability form.
+const sessionsPerDay = 2
+
+// Appointments is the per physician calendar, used by reception to book appointments.
+type Appointments struct {
+	CalendarView     *views.View
+	NewView          *views.View
+	ShowView         *views.View
+	AvailabilityView *views.View
+	as               models.AppointmentService
+	schedule         models.ScheduleService
+	us               models.UserService
+	ps               models.PatientService
+	logger           *logrus.Entry
+}
+
+func NewAppointments(as models.AppointmentService, schedule models.ScheduleService, us models.UserService,
+	ps models.PatientService, logger *logrus.Entry) *Appointments {
+	return &Appointments{
+		CalendarView:     views.NewView("bootstrap", "appointments/calendar"),
+		NewView:          views.NewView("bootstrap", "appointments/new"),
+		ShowView:         views.NewView("bootstrap", "appointments/show"),
+		AvailabilityView: views.NewView("bootstrap", "appointments/availability"),
+		as:               as,
+		schedule:         schedule,
+		us:               us,
+		ps:               ps,
+		logger:           logger,
+	}
+}
+
+type CalendarData struct {
+	Physicians []models.User
+	Physician  *models.User
+	Day        *models.DaySchedule
+	// Patients are the patients of the appointments of the day, by their id.
+	Patients map[bson.ObjectId]models.Patient
+	CanBook  bool
+	Now      time.Time
+}
+
+// Date returns the day of the calendar as the value of a date input.
+func (d *CalendarData) Date() string {
+	return d.Day.Date.Format(dateFormat)
+}
+
+// DayLink returns the calendar of the physician days after the shown day, days may be negative.
+func (d *CalendarData) DayLink(days int) string {
+	return calendarPath(d.Physician.Id, d.Day.Date.AddDate(0, 0, days))
+}
+
+// PhysicianLink returns the calendar of the physician on the shown day.
+func (d *CalendarData) PhysicianLink(physician models.User) string {
+	return calendarPath(physician.Id, d.Day.Date)
+}
+
+// BookLink returns the booking form for the slot, or an empty string if it can not be booked.
+func (d *CalendarData) BookLink(slot models.Slot) string {
+	if !d.CanBook || !slot.Free() || slot.Start.Before(d.Now) {
+		return ""
+	}
+	q := url.Values{}
+	q.Set("physician", d.Physician.Id.Hex())
+	q.Set("start", slot.Start.Format(dateTimeFormat))
+	return "/appointments/new?" + q.Encode()
+}
+
+// PatientName returns the name and medical record number of the patient with the id.
+func (d *CalendarData) PatientName(id bson.ObjectId) string {
+	p, ok := d.Patients[id]
+	if !ok {
+		return "Unknown patient"
+	}
+	return fmt.Sprintf("%s (%s)", p.FullName(), p.MRN)
+}
+
+// Calendar shows the slots and appointments of a physician on a day, today and the first physician by default.
+// GET /appointments?physician=:id&date=2006-01-02
+func (a *Appointments) Calendar(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	physicians, err := a.physicians()
+	if err != nil {
+		a.logger.Errorf("Error while fetching physicians: %v", err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	data := CalendarData{
+		Physicians: physicians,
+		CanBook:    canEditPatients(context.User(r.Context())),
+		Now:        time.Now(),
+	}
+	vd.Yield = &data
+	if len(physicians) == 0 {
+		a.CalendarView.Render(w, r, vd)
+		return
+	}
+	data.Physician = &physicians[0]
+	query := r.URL.Query()
+	for i := range physicians {
+		if physicians[i].Id.Hex() == query.Get("physician") {
+			data.Physician = &physicians[i]
+		}
+	}
+	date := time.Now()
+	if d := query.Get("date"); d != "" {
+		if date, err = time.ParseInLocation(dateFormat, d, time.Local); err != nil {
+			date = time.Now()
+		}
+	}
+	day, err := a.as.Day(data.Physician.Id.Hex(), date)
+	if err != nil {
+		a.logger.Errorf("Error while fetching the day of physician %s: %v", data.Physician.Username, err)
+		vd.SetAlert(err)
+		day = &models.DaySchedule{Date: models.StartOfDay(date)}
+	}
+	data.Day = day
+	data.Patients = a.patientsOf(day.Appointments)
+	a.CalendarView.Render(w, r, vd)
+}
+
+type AppointmentForm struct {
+	PhysicianId string        `schema:"physician"`
+	Start       string        `schema:"start"`
+	MRN         string        `schema:"mrn"`
+	Reason      string        `schema:"reason"`
+	Physicians  []models.User `schema:"-"`
+}
+
+// New renders the booking form, prefilled from the query parameters physician, start and mrn.
+// GET /appointments/new
+func (a *Appointments) New(w http.ResponseWriter, r *http.Request) {
+	var form AppointmentForm
+	if err := parseURLParams(r, &form); err != nil {
+		a.logger.Errorln(err)
+	}
+	var vd views.Data
+	vd.Yield = &form
+	physicians, err := a.physicians()
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	form.Physicians = physicians
+	a.NewView.Render(w, r, vd)
+}
+
+// Create books an appointment.
+// POST /appointments
+func (a *Appointments) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AppointmentForm
+	vd.Yield = &form
+	form.Physicians, _ = a.physicians()
+	if err := parseForm(r, &form); err != nil {
+		a.logger.Errorln(err)
+		vd.SetAlert(err)
+		a.NewView.Render(w, r, vd)
+		return
+	}
+	patient, err := a.ps.ByMRN(form.MRN)
+	if err != nil {
+		if err.Error() == models.MongoErrNotFound.Error() {
+			err = models.ErrPatientRequired
+		}
+		vd.SetAlert(err)
+		a.NewView.Render(w, r, vd)
+		return
+	}
+	if !bson.IsObjectIdHex(form.PhysicianId) {
+		vd.SetAlert(models.ErrPhysicianInvalid)
+		a.NewView.Render(w, r, vd)
+		return
+	}
+	start, err := time.ParseInLocation(dateTimeFormat, form.Start, time.Local)
+	if err != nil {
+		vd.SetAlert(models.ErrAppointmentTimesInvalid)
+		a.NewView.Render(w, r, vd)
+		return
+	}
+	availability, err := a.schedule.Availability(form.PhysicianId)
+	if err != nil {
+		vd.SetAlert(err)
+		a.NewView.Render(w, r, vd)
+		return
+	}
+	appointment := models.Appointment{
+		PatientId:   patient.Id,
+		PhysicianId: bson.ObjectIdHex(form.PhysicianId),
+		Start:       start,
+		End:         start.Add(availability.SlotLength()),
+		Reason:      form.Reason,
+		BookedBy:    context.User(r.Context()).Id,
+	}
+	if err := a.as.Create(&appointment); err != nil {
+		vd.SetAlert(err)
+		a.NewView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, calendarPath(appointment.PhysicianId, appointment.Start), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Appointment booked for %s at %s.", patient.FullName(), start.Format("02 Jan 2006 15:04")),
+	})
+}
+
+type AppointmentData struct {
+	Appointment *models.Appointment
+	Patient     *models.Patient
+	Physician   *models.User
+	CanChange   bool
+	// CanStartEncounter is true for physicians and admins while the appointment is booked.
+	CanStartEncounter bool
+}
+
+// CalendarLink returns the calendar of the day of the appointment.
+func (d *AppointmentData) CalendarLink() string {
+	return calendarPath(d.Appointment.PhysicianId, d.Appointment.Start)
+}
+
+// StartInput is the start of the appointment as the value of a datetime input.
+func (d *AppointmentData) StartInput() string {
+	return d.Appointment.Start.Format(dateTimeFormat)
+}
+
+// Show renders an appointment with the forms to reschedule, cancel or mark it as a no-show.
+// GET /appointments/:id
+func (a *Appointments) Show(w http.ResponseWriter, r *http.Request) {
+	appointment, err := a.appointmentByID(w, r)
+	if err != nil {
+		return
+	}
+	a.renderShow(w, r, appointment, nil)
+}
+
+func (a *Appointments) renderShow(w http.ResponseWriter, r *http.Request, appointment *models.Appointment, alert error) {
+	var vd views.Data
+	user := context.User(r.Context())
+	booked := appointment.Status == models.AppointmentBooked
+	data := AppointmentData{
+		Appointment:       appointment,
+		CanChange:         canEditPatients(user) && booked,
+		CanStartEncounter: canAddend(user) && booked,
+	}
+	vd.Yield = &data
+	var err error
+	if data.Patient, err = a.ps.ById(appointment.PatientId.Hex()); err != nil {
+		a.logger.Errorf("Error while fetching patient of appointment %s: %v", appointment.Id.Hex(), err)
+		data.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if data.Physician, err = a.us.ById(appointment.PhysicianId.Hex()); err != nil {
+		a.logger.Errorf("Error while fetching physician of appointment %s: %v", appointment.Id.Hex(), err)
+		data.Physician = &models.User{Name: "Unknown physician"}
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	a.ShowView.Render(w, r, vd)
+}
+
+type RescheduleForm struct {
+	Start string `schema:"start"`
+}
+
+// Reschedule moves an appointment to another time, keeping its length.
+// POST /appointments/:id/reschedule
+func (a *Appointments) Reschedule(w http.ResponseWriter, r *http.Request) {
+	appointment, err := a.appointmentByID(w, r)
+	if err != nil {
+		return
+	}
+	var form RescheduleForm
+	if err := parseForm(r, &form); err != nil {
+		a.renderShow(w, r, appointment, err)
+		return
+	}
+	start, err := time.ParseInLocation(dateTimeFormat, form.Start, time.Local)
+	if err != nil {
+		a.renderShow(w, r, appointment, models.ErrAppointmentTimesInvalid)
+		return
+	}
+	moved := *appointment
+	if err := a.as.Reschedule(&moved, start); err != nil {
+		a.renderShow(w, r, appointment, err)
+		return
+	}
+	views.RedirectAlert(w, r, appointmentPath(&moved), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Appointment rescheduled to " + moved.Start.Format("02 Jan 2006 15:04") + ".",
+	})
+}
+
+type CancelAppointmentForm struct {
+	Reason string `schema:"reason"`
+}
+
+// Cancel cancels a booked appointment, which frees its slot.
+// POST /appointments/:id/cancel
+func (a *Appointments) Cancel(w http.ResponseWriter, r *http.Request) {
+	appointment, err := a.appointmentByID(w, r)
+	if err != nil {
+		return
+	}
+	var form CancelAppointmentForm
+	if err := parseForm(r, &form); err != nil {
+		a.renderShow(w, r, appointment, err)
+		return
+	}
+	if err := a.as.Cancel(appointment, form.Reason); err != nil {
+		a.renderShow(w, r, appointment, err)
+		return
+	}
+	views.RedirectAlert(w, r, calendarPath(appointment.PhysicianId, appointment.Start), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The appointment has been cancelled.",
+	})
+}
+
+// NoShow records that the patient did not come to the appointment.
+// POST /appointments/:id/no-show
+func (a *Appointments) NoShow(w http.ResponseWriter, r *http.Request) {
+	appointment, err := a.appointmentByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := a.as.MarkNoShow(appointment); err != nil {
+		a.renderShow(w, r, appointment, err)
+		return
+	}
+	views.RedirectAlert(w, r, calendarPath(appointment.PhysicianId, appointment.Start), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The appointment has been marked as a no-show.",
+	})
+}
+
+type SessionForm struct {
+	Weekday time.Weekday `schema:"weekday"`
+	Start   string       `schema:"start"`
+	End     string       `schema:"end"`
+}
+
+type AvailabilityForm struct {
+	SlotMinutes int           `schema:"slot_minutes"`
+	Sessions    []SessionForm `schema:"sessions"`
+}
+
+type AvailabilityData struct {
+	Physician  *models.User
+	Form       AvailabilityForm
+	Exceptions []models.ScheduleException
+	CanManage  bool
+	// CanManageHolidays is true for users who can close the clinic for all physicians.
+	CanManageHolidays bool
+}
+
+// SessionRow is a row of the availability form.
+type SessionRow struct {
+	Index   int
+	Session SessionForm
+}
+
+// Weekdays returns the rows of the availability form grouped by weekday, starting with monday.
+func (d *AvailabilityData) Weekdays() [][]SessionRow {
+	var days [][]SessionRow
+	for i := 0; i < 7; i++ {
+		weekday := time.Weekday((i + 1) % 7)
+		var rows []SessionRow
+		for _, s := range d.Form.Sessions {
+			if s.Weekday == weekday && len(rows) < sessionsPerDay {
+				rows = append(rows, SessionRow{Session: s})
+			}
+		}
+		for len(rows) < sessionsPerDay {
+			rows = append(rows, SessionRow{Session: SessionForm{Weekday: weekday}})
+		}
+		for j := range rows {
+			rows[j].Index = i*sessionsPerDay + j
+		}
+		days = append(days, rows)
+	}
+	return days
+}
+
+// Availability shows the weekly sessions of a physician and their leaves and the clinic holidays ahead.
+// GET /physicians/:id/availability
+func (a *Appointments) Availability(w http.ResponseWriter, r *http.Request) {
+	physician, err := a.physicianByID(w, r)
+	if err != nil {
+		return
+	}
+	availability, err := a.schedule.Availability(physician.Id.Hex())
+	if err != nil {
+		a.logger.Errorf("Error while fetching availability of %s: %v", physician.Username, err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	form := AvailabilityForm{SlotMinutes: availability.SlotMinutes}
+	for _, s := range availability.Sessions {
+		form.Sessions = append(form.Sessions, SessionForm{Weekday: s.Weekday, Start: s.Start.String(), End: s.End.String()})
+	}
+	a.renderAvailability(w, r, physician, form, nil)
+}
+
+// SaveAvailability replaces the weekly sessions of a physician.
+// POST /physicians/:id/availability
+func (a *Appointments) SaveAvailability(w http.ResponseWriter, r *http.Request) {
+	physician, err := a.physicianByID(w, r)
+	if err != nil {
+		return
+	}
+	if !canManageSchedule(context.User(r.Context()), physician) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var form AvailabilityForm
+	if err := parseForm(r, &form); err != nil {
+		a.renderAvailability(w, r, physician, form, err)
+		return
+	}
+	availability := models.Availability{PhysicianId: physician.Id, SlotMinutes: form.SlotMinutes}
+	for _, s := range form.Sessions {
+		if s.Start == "" && s.End == "" {
+			continue
+		}
+		start, err := models.ParseTimeOfDay(s.Start)
+		if err != nil {
+			a.renderAvailability(w, r, physician, form, err)
+			return
+		}
+		end, err := models.ParseTimeOfDay(s.End)
+		if err != nil {
+			a.renderAvailability(w, r, physician, form, err)
+			return
+		}
+		availability.Sessions = append(availability.Sessions, models.WeeklySession{Weekday: s.Weekday, Start: start, End: end})
+	}
+	if err := a.schedule.SaveAvailability(&availability); err != nil {
+		a.renderAvailability(w, r, physician, form, err)
+		return
+	}
+	views.RedirectAlert(w, r, availabilityPath(physician.Id), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The weekly sessions have been saved.",
+	})
+}
+
+func (a *Appointments) renderAvailability(w http.ResponseWriter, r *http.Request, physician *models.User,
+	form AvailabilityForm, alert error) {
+	user := context.User(r.Context())
+	var vd views.Data
+	data := AvailabilityData{
+		Physician:         physician,
+		Form:              form,
+		CanManage:         canManageSchedule(user, physician),
+		CanManageHolidays: canEditPatients(user),
+	}
+	vd.Yield = &data
+	today := models.StartOfDay(time.Now())
+	exceptions, err := a.schedule.Exceptions(physician.Id.Hex(), today, today.AddDate(1, 0, 0))
+	if err != nil {
+		a.logger.Errorf("Error while fetching schedule exceptions of %s: %v", physician.Username, err)
+		alert = err
+	}
+	data.Exceptions = exceptions
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	a.AvailabilityView.Render(w, r, vd)
+}
+
+type ScheduleExceptionForm struct {
+	Kind   models.ScheduleExceptionKind `schema:"kind"`
+	From   string                       `schema:"from"`
+	To     string                       `schema:"to"`
+	Reason string                       `schema:"reason"`
+}
+
+// CreateException adds a leave of the physician, or a holiday of the whole clinic.
+// POST /physicians/:id/exceptions
+func (a *Appointments) CreateException(w http.ResponseWriter, r *http.Request) {
+	physician, err := a.physicianByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	var form ScheduleExceptionForm
+	if err := parseForm(r, &form); err != nil {
+		a.renderAvailability(w, r, physician, a.availabilityForm(physician), err)
+		return
+	}
+	if !canManageSchedule(user, physician) || (form.Kind == models.ScheduleExceptionHoliday && !canEditPatients(user)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	exception := models.ScheduleException{
+		Kind:        form.Kind,
+		PhysicianId: physician.Id,
+		Reason:      form.Reason,
+		CreatedBy:   user.Id,
+	}
+	exception.From, _ = time.ParseInLocation(dateFormat, form.From, time.Local)
+	exception.To, _ = time.ParseInLocation(dateFormat, form.To, time.Local)
+	if exception.To.IsZero() {
+		exception.To = exception.From
+	}
+	if err := a.schedule.CreateException(&exception); err != nil {
+		a.renderAvailability(w, r, physician, a.availabilityForm(physician), err)
+		return
+	}
+	alert := views.Alert{Level: views.AlertLevelSuccess, Message: fmt.Sprintf("The %s has been added.", exception.Kind)}
+	if booked := a.bookedDuring(physician, &exception); booked > 0 {
+		alert = views.Alert{
+			Level: views.AlertLevelWarning,
+			Message: fmt.Sprintf("The %s has been added, but %d booked appointments of %s fall into it. "+
+				"Please reschedule or cancel them.", exception.Kind, booked, physician.Name),
+		}
+	}
+	views.RedirectAlert(w, r, availabilityPath(physician.Id), http.StatusFound, alert)
+}
+
+// DeleteException removes a leave of the physician, or a holiday.
+// POST /physicians/:id/exceptions/:eid/delete
+func (a *Appointments) DeleteException(w http.ResponseWriter, r *http.Request) {
+	physician, err := a.physicianByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	exception, err := a.schedule.ExceptionById(mux.Vars(r)["eid"])
+	if err == nil {
+		allowed := canManageSchedule(user, physician)
+		if exception.Kind == models.ScheduleExceptionHoliday {
+			allowed = canEditPatients(user)
+		} else if exception.PhysicianId != physician.Id {
+			allowed = false
+		}
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		err = a.schedule.DeleteException(exception.Id.Hex())
+	}
+	if err != nil {
+		a.logger.Errorf("Error while deleting schedule exception: %v", err)
+		views.RedirectAlert(w, r, availabilityPath(physician.Id), http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: "The exception could not be removed.",
+		})
+		return
+	}
+	views.RedirectAlert(w, r, availabilityPath(physician.Id), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("The %s has been removed.", exception.Kind),
+	})
+}
+
+func (a *Appointments) availabilityForm(physician *models.User) AvailabilityForm {
+	var form AvailabilityForm
+	availability, err := a.schedule.Availability(physician.Id.Hex())
+	if err != nil {
+		return form
+	}
+	form.SlotMinutes = availability.SlotMinutes
+	for _, s := range availability.Sessions {
+		form.Sessions = append(form.Sessions, SessionForm{Weekday: s.Weekday, Start: s.Start.String(), End: s.End.String()})
+	}
+	return form
+}
+
+// bookedDuring counts the booked appointments of the physician on the days of the exception.
+func (a *Appointments) bookedDuring(physician *models.User, exception *models.ScheduleException) int {
+	appointments, err := a.as.ByPhysician(physician.Id.Hex(), exception.From, exception.To.AddDate(0, 0, 1))
+	if err != nil {
+		a.logger.Errorf("Error while fetching appointments of %s: %v", physician.Username, err)
+		return 0
+	}
+	booked := 0
+	for _, appointment := range appointments {
+		if appointment.Status == models.AppointmentBooked {
+			booked++
+		}
+	}
+	return booked
+}
+
+// physicians returns the active physicians.
+func (a *Appointments) physicians() ([]models.User, error) {
+	return activePhysicians(a.us)
+}
+
+// activePhysicians returns the physicians whose accounts are not disabled.
+func activePhysicians(us models.UserService) ([]models.User, error) {
+	users, err := us.ByUserRole(models.UserRolePhysician)
+	if err != nil {
+		return nil, err
+	}
+	var physicians []models.User
+	for _, u := range users {
+		if !u.Disabled {
+			physicians = append(physicians, u)
+		}
+	}
+	return physicians, nil
+}
+
+// patientsOf fetches the patients of the appointments. Patients which can not be fetched are left out.
+func (a *Appointments) patientsOf(appointments []models.Appointment) map[bson.ObjectId]models.Patient {
+	patients := make(map[bson.ObjectId]models.Patient)
+	for _, appointment := range appointments {
+		if _, ok := patients[appointment.PatientId]; ok {
+			continue
+		}
+		patient, err := a.ps.ById(appointment.PatientId.Hex())
+		if err != nil {
+			a.logger.Errorf("Error while fetching patient %s: %v", appointment.PatientId.Hex(), err)
+			continue
+		}
+		patients[patient.Id] = *patient
+	}
+	return patients
+}
+
+// appointmentByID fetches the appointment with the id from the request path.
+// If an error is returned, the response has already been written.
+func (a *Appointments) appointmentByID(w http.ResponseWriter, r *http.Request) (*models.Appointment, error) {
+	id := mux.Vars(r)["id"]
+	appointment, err := a.as.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Appointment not found", http.StatusNotFound)
+		default:
+			a.logger.Errorf("Error while fetching appointment %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return appointment, nil
+}
+
+// physicianByID fetches the physician with the id from the request path.
+// If an error is returned, the response has already been written.
+func (a *Appointments) physicianByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id := mux.Vars(r)["id"]
+	user, err := a.us.ById(id)
+	if err == nil && !user.HasRole(models.UserRolePhysician) {
+		err = models.MongoErrNotFound
+	}
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Physician not found", http.StatusNotFound)
+		default:
+			a.logger.Errorf("Error while fetching physician %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func appointmentPath(appointment *models.Appointment) string {
+	return "/appointments/" + appointment.Id.Hex()
+}
+
+func availabilityPath(physicianId bson.ObjectId) string {
+	return "/physicians/" + physicianId.Hex() + "/availability"
+}
+
+func calendarPath(physicianId bson.ObjectId, date time.Time) string {
+	q := url.Values{}
+	q.Set("physician", physicianId.Hex())
+	q.Set("date", date.Format(dateFormat))
+	return "/appointments?" + q.Encode()
+}
+
+// canManageSchedule reports whether the user may change the sessions and leaves of the physician.
+// Reception and admins manage all physicians, physicians only their own.
+func canManageSchedule(user *models.User, physician *models.User) bool {
+	if user == nil {
+		return false
+	}
+	return canEditPatients(user) || user.Id == physician.Id
+}
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"net/http"
+
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Catalogue is the list of billable services and their prices, kept by admins.
+type Catalogue struct {
+	IndexView *views.View
+	EditView  *views.View
+	cs        models.CatalogueService
+	logger    *logrus.Entry
+}
+
+func NewCatalogue(cs models.CatalogueService, logger *logrus.Entry) *Catalogue {
+	return &Catalogue{
+		IndexView: views.NewView("bootstrap", "catalogue/index", "catalogue/form"),
+		EditView:  views.NewView("bootstrap", "catalogue/edit", "catalogue/form"),
+		cs:        cs,
+		logger:    logger,
+	}
+}
+
+type CatalogueForm struct {
+	Code string `schema:"code"`
+	Name string `schema:"name"`
+	// Price is entered in rupees, like 250.50.
+	Price   string  `schema:"price"`
+	TaxRate float64 `schema:"tax_rate"`
+	Active  bool    `schema:"active"`
+	// Item is nil when adding a new service.
+	Item *models.CatalogueItem `schema:"-"`
+}
+
+func newCatalogueForm(item *models.CatalogueItem) CatalogueForm {
+	return CatalogueForm{
+		Code:    item.Code,
+		Name:    item.Name,
+		Price:   item.Price.String(),
+		TaxRate: item.TaxRate,
+		Active:  item.Active,
+		Item:    item,
+	}
+}
+
+// Action is the path the form is submitted to.
+func (f *CatalogueForm) Action() string {
+	if f.Item == nil {
+		return "/admin/catalogue"
+	}
+	return "/admin/catalogue/" + f.Item.Id.Hex() + "/update"
+}
+
+// apply sets the fields of the form on the service.
+func (f *CatalogueForm) apply(item *models.CatalogueItem) error {
+	price, err := models.ParseMoney(f.Price)
+	if err != nil {
+		return err
+	}
+	item.Code = f.Code
+	item.Name = f.Name
+	item.Price = price
+	item.TaxRate = f.TaxRate
+	item.Active = f.Active
+	return nil
+}
+
+type CatalogueData struct {
+	Items []models.CatalogueItem
+	Form  CatalogueForm
+}
+
+// Index lists the services with a form to add a new one.
+// GET /admin/catalogue
+func (c *Catalogue) Index(w http.ResponseWriter, r *http.Request) {
+	c.renderIndex(w, r, CatalogueForm{Active: true}, nil)
+}
+
+// Create adds a service to the catalogue.
+// POST /admin/catalogue
+func (c *Catalogue) Create(w http.ResponseWriter, r *http.Request) {
+	var form CatalogueForm
+	if err := parseForm(r, &form); err != nil {
+		c.logger.Errorln(err)
+		c.renderIndex(w, r, form, err)
+		return
+	}
+	var item models.CatalogueItem
+	if err := form.apply(&item); err != nil {
+		c.renderIndex(w, r, form, err)
+		return
+	}
+	if err := c.cs.Create(&item); err != nil {
+		c.renderIndex(w, r, form, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/admin/catalogue", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: item.Name + " has been added.",
+	})
+}
+
+func (c *Catalogue) renderIndex(w http.ResponseWriter, r *http.Request, form CatalogueForm, alert error) {
+	var vd views.Data
+	data := CatalogueData{Form: form}
+	vd.Yield = &data
+	var err error
+	if data.Items, err = c.cs.All(); err != nil {
+		c.logger.Errorf("Error while fetching the catalogue: %v", err)
+		vd.SetAlert(err)
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	c.IndexView.Render(w, r, vd)
+}
+
+// Edit renders the form to change a service. Invoices already issued keep the old price.
+// GET /admin/catalogue/:id/edit
+func (c *Catalogue) Edit(w http.ResponseWriter, r *http.Request) {
+	item, err := c.itemByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	form := newCatalogueForm(item)
+	vd.Yield = &form
+	c.EditView.Render(w, r, vd)
+}
+
+// Update saves the changes to a service.
+// POST /admin/catalogue/:id/update
+func (c *Catalogue) Update(w http.ResponseWriter, r *http.Request) {
+	item, err := c.itemByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	form := CatalogueForm{Item: item}
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		c.logger.Errorln(err)
+		vd.SetAlert(err)
+		c.EditView.Render(w, r, vd)
+		return
+	}
+	if err := form.apply(item); err != nil {
+		vd.SetAlert(err)
+		c.EditView.Render(w, r, vd)
+		return
+	}
+	if err := c.cs.Update(item); err != nil {
+		vd.SetAlert(err)
+		c.EditView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/admin/catalogue", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: item.Name + " has been saved.",
+	})
+}
+
+// itemByID fetches the service with the id from the request path.
+// If an error is returned, the response has already been written.
+func (c *Catalogue) itemByID(w http.ResponseWriter, r *http.Request) (*models.CatalogueItem, error) {
+	id := mux.Vars(r)["id"]
+	item, err := c.cs.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Service not found", http.StatusNotFound)
+		default:
+			c.logger.Errorf("Error while fetching service %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return item, nil
+}
@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Chart keeps the allergy, problem and medication lists of patients, which are shown on every encounter screen.
+type Chart struct {
+	ShowView *views.View
+	cs       models.ChartService
+	ps       models.PatientService
+	logger   *logrus.Entry
+}
+
+func NewChart(cs models.ChartService, ps models.PatientService, logger *logrus.Entry) *Chart {
+	return &Chart{
+		ShowView: views.NewView("bootstrap", "chart/show", "chart/summary"),
+		cs:       cs,
+		ps:       ps,
+		logger:   logger,
+	}
+}
+
+type AllergyForm struct {
+	Substance string                 `schema:"substance"`
+	Reaction  string                 `schema:"reaction"`
+	Severity  models.AllergySeverity `schema:"severity"`
+}
+
+type ProblemForm struct {
+	Description string `schema:"description"`
+	Onset       string `schema:"onset"`
+}
+
+type CurrentMedicationForm struct {
+	Name      string `schema:"name"`
+	Dose      string `schema:"dose"`
+	Frequency string `schema:"frequency"`
+	Started   string `schema:"started"`
+}
+
+// ChartDayForm is the day a problem is resolved or a medication stopped, today if empty.
+type ChartDayForm struct {
+	Day string `schema:"day"`
+}
+
+func (f *ChartDayForm) day() (time.Time, error) {
+	if f.Day == "" {
+		now := time.Now()
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local), nil
+	}
+	return parseDay(f.Day)
+}
+
+type ChartData struct {
+	Patient    *models.Patient
+	Chart      *models.Chart
+	Allergy    AllergyForm
+	Problem    ProblemForm
+	Medication CurrentMedicationForm
+	// Today is the default day problems are resolved and medications stopped.
+	Today string
+}
+
+// Severities are the choices of the severity select field.
+func (d *ChartData) Severities() []models.AllergySeverity {
+	return models.AllergySeveritiesList()
+}
+
+// Show renders the lists of the patient with the forms to add to them.
+// GET /patients/:id/chart
+func (c *Chart) Show(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, c.ps, c.logger)
+	if err != nil {
+		return
+	}
+	c.render(w, r, &ChartData{Patient: patient}, nil)
+}
+
+func (c *Chart) render(w http.ResponseWriter, r *http.Request, data *ChartData, alert error) {
+	var vd views.Data
+	vd.Yield = data
+	data.Today = time.Now().Format(dateFormat)
+	var err error
+	if data.Chart, err = c.cs.Chart(data.Patient.Id.Hex()); err != nil {
+		c.logger.Errorf("Error while fetching the chart of patient %s: %v", data.Patient.MRN, err)
+		data.Chart = &models.Chart{PatientId: data.Patient.Id}
+		vd.SetAlert(err)
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	c.ShowView.Render(w, r, vd)
+}
+
+// CreateAllergy records an allergy of the patient.
+// POST /patients/:id/allergies
+func (c *Chart) CreateAllergy(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, c.ps, c.logger)
+	if err != nil {
+		return
+	}
+	data := ChartData{Patient: patient}
+	if err := parseForm(r, &data.Allergy); err != nil {
+		c.logger.Errorln(err)
+		c.render(w, r, &data, err)
+		return
+	}
+	allergy := models.Allergy{
+		PatientId:  patient.Id,
+		Substance:  data.Allergy.Substance,
+		Reaction:   data.Allergy.Reaction,
+		Severity:   data.Allergy.Severity,
+		RecordedBy: context.User(r.Context()).Id,
+	}
+	if err := c.cs.CreateAllergy(&allergy); err != nil {
+		c.render(w, r, &data, err)
+		return
+	}
+	c.redirect(w, r, patient, fmt.Sprintf("The allergy to %s has been recorded.", allergy.Substance))
+}
+
+// DeleteAllergy removes an allergy recorded by mistake or refuted.
+// POST /allergies/:id/delete
+func (c *Chart) DeleteAllergy(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	allergy, err := c.cs.AllergyById(id)
+	if err != nil {
+		c.notFound(w, "allergy", id, err)
+		return
+	}
+	patient := &models.Patient{Id: allergy.PatientId}
+	if err := c.cs.DeleteAllergy(id); err != nil {
+		c.logger.Errorf("Error while deleting allergy %s: %v", id, err)
+		redirectError(w, r, chartPath(patient), err)
+		return
+	}
+	c.logger.Infof("User %s removed the allergy to %s of patient %s", context.User(r.Context()).Username,
+		allergy.Substance, allergy.PatientId.Hex())
+	c.redirect(w, r, patient, fmt.Sprintf("The allergy to %s has been removed.", allergy.Substance))
+}
+
+// CreateProblem adds an active problem to the problem list of the patient.
+// POST /patients/:id/problems
+func (c *Chart) CreateProblem(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, c.ps, c.logger)
+	if err != nil {
+		return
+	}
+	data := ChartData{Patient: patient}
+	if err := parseForm(r, &data.Problem); err != nil {
+		c.logger.Errorln(err)
+		c.render(w, r, &data, err)
+		return
+	}
+	problem := models.Problem{
+		PatientId:   patient.Id,
+		Description: data.Problem.Description,
+		RecordedBy:  context.User(r.Context()).Id,
+	}
+	if problem.Onset, err = parseDay(data.Problem.Onset); err != nil {
+		c.render(w, r, &data, err)
+		return
+	}
+	if err := c.cs.CreateProblem(&problem); err != nil {
+		c.render(w, r, &data, err)
+		return
+	}
+	c.redirect(w, r, patient, fmt.Sprintf("%s has been added to the problems.", problem.Description))
+}
+
+// ResolveProblem marks a problem resolved.
+// POST /problems/:id/resolve
+func (c *Chart) ResolveProblem(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	problem, err := c.cs.ProblemById(id)
+	if err != nil {
+		c.notFound(w, "problem", id, err)
+		return
+	}
+	patient := &models.Patient{Id: problem.PatientId}
+	var form ChartDayForm
+	if err := parseForm(r, &form); err != nil {
+		c.logger.Errorln(err)
+		redirectError(w, r, chartPath(patient), err)
+		return
+	}
+	day, err := form.day()
+	if err == nil {
+		err = c.cs.ResolveProblem(problem, day)
+	}
+	if err != nil {
+		redirectError(w, r, chartPath(patient), err)
+		return
+	}
+	c.redirect(w, r, patient, fmt.Sprintf("%s has been resolved.", problem.Description))
+}
+
+// CreateMedication adds a medication the patient takes.
+// POST /patients/:id/medications
+func (c *Chart) CreateMedication(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, c.ps, c.logger)
+	if err != nil {
+		return
+	}
+	data := ChartData{Patient: patient}
+	if err := parseForm(r, &data.Medication); err != nil {
+		c.logger.Errorln(err)
+		c.render(w, r, &data, err)
+		return
+	}
+	medication := models.CurrentMedication{
+		PatientId:  patient.Id,
+		Name:       data.Medication.Name,
+		Dose:       data.Medication.Dose,
+		Frequency:  data.Medication.Frequency,
+		RecordedBy: context.User(r.Context()).Id,
+	}
+	if medication.Started, err = parseDay(data.Medication.Started); err != nil {
+		c.render(w, r, &data, err)
+		return
+	}
+	if err := c.cs.CreateMedication(&medication); err != nil {
+		c.render(w, r, &data, err)
+		return
+	}
+	c.redirect(w, r, patient, fmt.Sprintf("%s has been added to the medications.", medication.Name))
+}
+
+// StopMedication marks a medication stopped.
+// POST /medications/:id/stop
+func (c *Chart) StopMedication(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	medication, err := c.cs.MedicationById(id)
+	if err != nil {
+		c.notFound(w, "medication", id, err)
+		return
+	}
+	patient := &models.Patient{Id: medication.PatientId}
+	var form ChartDayForm
+	if err := parseForm(r, &form); err != nil {
+		c.logger.Errorln(err)
+		redirectError(w, r, chartPath(patient), err)
+		return
+	}
+	day, err := form.day()
+	if err == nil {
+		err = c.cs.StopMedication(medication, day)
+	}
+	if err != nil {
+		redirectError(w, r, chartPath(patient), err)
+		return
+	}
+	c.redirect(w, r, patient, fmt.Sprintf("%s has been stopped.", medication.Name))
+}
+
+func (c *Chart) redirect(w http.ResponseWriter, r *http.Request, patient *models.Patient, message string) {
+	views.RedirectAlert(w, r, chartPath(patient), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: message,
+	})
+}
+
+// notFound writes the response for an error fetching the entry of a list.
+func (c *Chart) notFound(w http.ResponseWriter, entry, id string, err error) {
+	switch err.Error() {
+	case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+		http.Error(w, strings.Title(entry)+" not found", http.StatusNotFound)
+	default:
+		c.logger.Errorf("Error while fetching %s %s: %v", entry, id, err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+	}
+}
+
+func chartPath(patient *models.Patient) string {
+	return "/patients/" + patient.Id.Hex() + "/chart"
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	chartWidth   = 600
+	chartHeight  = 160
+	chartPadding = 12
+)
+
+// TrendChart is a line chart of values over time. It is laid out on the server and drawn as SVG by the
+// "trendChart" template, so that pages with charts work without scripts.
+type TrendChart struct {
+	Width  int
+	Height int
+	Points []ChartPoint
+	// Band shades the normal range when HasBand is true.
+	HasBand    bool
+	BandY      float64
+	BandHeight float64
+	// Lines are reference lines drawn behind the points, like percentile curves.
+	Lines []TrendLine
+}
+
+// TrendLine is a line of a TrendChart, with its label shown when hovering it.
+type TrendLine struct {
+	Label  string
+	Points []ChartPoint
+}
+
+// ChartLine is a labelled line of values to be drawn by a TrendChart.
+type ChartLine struct {
+	Label  string
+	Values []ChartValue
+}
+
+type ChartPoint struct {
+	X, Y  float64
+	Label string
+	// Flagged points are drawn in red.
+	Flagged bool
+}
+
+// ChartValue is a value to be drawn by a TrendChart.
+type ChartValue struct {
+	Time    time.Time
+	Value   float64
+	Label   string
+	Flagged bool
+}
+
+// newTrendChart lays out the values, which must be sorted by time, with the normal range between low and high.
+// Either bound may be nil.
+func newTrendChart(values []ChartValue, low, high *float64) *TrendChart {
+	return newTrendChartWithLines(values, nil, low, high)
+}
+
+// newTrendChartWithLines lays out the values like newTrendChart, with the lines behind them. The values of the
+// lines must be sorted by time too, and the chart spans them as well as the values.
+func newTrendChartWithLines(values []ChartValue, lines []ChartLine, low, high *float64) *TrendChart {
+	chart := &TrendChart{Width: chartWidth, Height: chartHeight}
+	if len(values) == 0 {
+		return chart
+	}
+	min, max := values[0].Value, values[0].Value
+	first, last := values[0].Time, values[len(values)-1].Time
+	for _, v := range values {
+		min = math.Min(min, v.Value)
+		max = math.Max(max, v.Value)
+	}
+	for _, l := range lines {
+		for _, v := range l.Values {
+			min = math.Min(min, v.Value)
+			max = math.Max(max, v.Value)
+		}
+		if len(l.Values) > 0 {
+			if t := l.Values[0].Time; t.Before(first) {
+				first = t
+			}
+			if t := l.Values[len(l.Values)-1].Time; t.After(last) {
+				last = t
+			}
+		}
+	}
+	if low != nil {
+		min = math.Min(min, *low)
+	}
+	if high != nil {
+		max = math.Max(max, *high)
+	}
+	// A margin keeps points off the edges, and a flat line in the middle.
+	margin := (max - min) * 0.1
+	if margin == 0 {
+		margin = math.Max(math.Abs(max)*0.1, 1)
+	}
+	min, max = min-margin, max+margin
+	span := last.Sub(first).Seconds()
+	x := func(t time.Time) float64 {
+		if span == 0 {
+			return float64(chartWidth) / 2
+		}
+		return chartPadding + t.Sub(first).Seconds()/span*(chartWidth-2*chartPadding)
+	}
+	y := func(v float64) float64 {
+		return chartPadding + (max-v)/(max-min)*(chartHeight-2*chartPadding)
+	}
+	for _, v := range values {
+		chart.Points = append(chart.Points, ChartPoint{
+			X:       round1(x(v.Time)),
+			Y:       round1(y(v.Value)),
+			Label:   v.Label,
+			Flagged: v.Flagged,
+		})
+	}
+	for _, l := range lines {
+		line := TrendLine{Label: l.Label}
+		for _, v := range l.Values {
+			line.Points = append(line.Points, ChartPoint{X: round1(x(v.Time)), Y: round1(y(v.Value)), Label: v.Label})
+		}
+		chart.Lines = append(chart.Lines, line)
+	}
+	if low != nil || high != nil {
+		top, bottom := 0.0, float64(chartHeight)
+		if high != nil {
+			top = y(*high)
+		}
+		if low != nil {
+			bottom = y(*low)
+		}
+		chart.HasBand = true
+		chart.BandY = round1(top)
+		chart.BandHeight = round1(bottom - top)
+	}
+	return chart
+}
+
+// Polyline returns the points of the chart as the value of the points attribute of an SVG polyline.
+func (c *TrendChart) Polyline() string {
+	return polyline(c.Points)
+}
+
+// Polyline returns the points of the line as the value of the points attribute of an SVG polyline.
+func (l *TrendLine) Polyline() string {
+	return polyline(l.Points)
+}
+
+func polyline(chartPoints []ChartPoint) string {
+	points := make([]string, len(chartPoints))
+	for i, p := range chartPoints {
+		points[i] = fmt.Sprintf("%g,%g", p.X, p.Y)
+	}
+	return strings.Join(points, " ")
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// maxDiagnosisCodesSize is the largest code table accepted, in bytes.
+const maxDiagnosisCodesSize = 20 << 20
+
+// Diagnoses lets admins load new versions of the ICD-10 code table, and clinicians report on the diagnoses of
+// signed encounters.
+type Diagnoses struct {
+	CodesView  *views.View
+	ReportView *views.View
+	ds         models.DiagnosisCodeService
+	es         models.EncounterService
+	logger     *logrus.Entry
+}
+
+func NewDiagnoses(ds models.DiagnosisCodeService, es models.EncounterService, logger *logrus.Entry) *Diagnoses {
+	return &Diagnoses{
+		CodesView:  views.NewView("bootstrap", "diagnoses/codes"),
+		ReportView: views.NewView("bootstrap", "diagnoses/report"),
+		ds:         ds,
+		es:         es,
+		logger:     logger,
+	}
+}
+
+type DiagnosisCodesData struct {
+	Codes   *models.CodeSet
+	Query   string
+	Results []models.DiagnosisCode
+}
+
+// Codes renders the code set in use, with a search to try it out and a form to upload a new version.
+// GET /admin/diagnosis-codes
+func (d *Diagnoses) Codes(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data := DiagnosisCodesData{Codes: d.ds.CodeSet(), Query: r.URL.Query().Get("q")}
+	if data.Query != "" {
+		data.Results = data.Codes.Search(data.Query, 0)
+	}
+	vd.Yield = &data
+	d.CodesView.Render(w, r, vd)
+}
+
+// Upload replaces the code table with the uploaded file and uses it straight away.
+// POST /admin/diagnosis-codes
+func (d *Diagnoses) Upload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxDiagnosisCodesSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		d.logger.Errorf("Error while reading uploaded diagnosis codes: %v", err)
+		redirectError(w, r, "/admin/diagnosis-codes", models.ErrDocumentRequired)
+		return
+	}
+	defer file.Close()
+	name := strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename))
+	codes, err := d.ds.Replace(file, name)
+	if err != nil {
+		d.logger.Errorf("Error while replacing the diagnosis codes: %v", err)
+		redirectError(w, r, "/admin/diagnosis-codes", err)
+		return
+	}
+	d.logger.Infof("User %s loaded diagnosis codes %s", context.User(r.Context()).Username, codes.Version)
+	d.loaded(w, r, codes)
+}
+
+// Reload reads the code file again, for tables replaced on the server itself.
+// POST /admin/diagnosis-codes/reload
+func (d *Diagnoses) Reload(w http.ResponseWriter, r *http.Request) {
+	codes, err := d.ds.Reload()
+	if err != nil {
+		d.logger.Errorf("Error while reloading the diagnosis codes: %v", err)
+		redirectError(w, r, "/admin/diagnosis-codes", models.ErrDiagnosisCodesUnreadable)
+		return
+	}
+	d.logger.Infof("User %s reloaded diagnosis codes %s", context.User(r.Context()).Username, codes.Version)
+	d.loaded(w, r, codes)
+}
+
+func (d *Diagnoses) loaded(w http.ResponseWriter, r *http.Request, codes *models.CodeSet) {
+	views.RedirectAlert(w, r, "/admin/diagnosis-codes", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Now using " + codes.Version + ".",
+	})
+}
+
+type DiagnosisReportData struct {
+	Report *models.DiagnosisReport
+}
+
+// From returns the first day of the report, for the period form.
+func (d *DiagnosisReportData) From() string {
+	return d.Report.From.Format(dateFormat)
+}
+
+// To returns the last day of the report, for the period form.
+func (d *DiagnosisReportData) To() string {
+	return d.Report.To.Format(dateFormat)
+}
+
+// Report renders the number of signed encounters by diagnosis code, or by category with by=category, over the days
+// from one date to another. It reports on the current month by default.
+// GET /reports/diagnoses?from=:date&to=:date&by=category
+func (d *Diagnoses) Report(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	query := r.URL.Query()
+	to := models.StartOfDay(time.Now())
+	from := to.AddDate(0, 0, 1-to.Day())
+	if query.Get("from") != "" || query.Get("to") != "" {
+		first, err := parseDay(query.Get("from"))
+		last, lastErr := parseDay(query.Get("to"))
+		if err == nil {
+			err = lastErr
+		}
+		if err != nil {
+			vd.SetAlert(err)
+		} else {
+			if !first.IsZero() {
+				from = first
+			}
+			if !last.IsZero() {
+				to = last
+			}
+		}
+	}
+	report, err := d.es.DiagnosisReport(from, to, query.Get("by") == "category")
+	if err != nil {
+		if err != models.ErrReportPeriodInvalid {
+			d.logger.Errorf("Error while counting the diagnoses from %s to %s: %v", from.Format(dateFormat),
+				to.Format(dateFormat), err)
+		}
+		vd.SetAlert(err)
+		report = &models.DiagnosisReport{From: from, To: to, ByCategory: query.Get("by") == "category"}
+	}
+	vd.Yield = &DiagnosisReportData{Report: report}
+	d.ReportView.Render(w, r, vd)
+}
@@ -0,0 +1,285 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// maxDocumentFieldSize is the largest value accepted for the fields sent along with an uploaded document.
+const maxDocumentFieldSize = 1 << 10
+
+// Documents keeps scanned referrals, consent forms, ID cards and images of patients.
+type Documents struct {
+	IndexView *views.View
+	ds        models.DocumentService
+	ps        models.PatientService
+	es        models.EncounterService
+	logger    *logrus.Entry
+}
+
+func NewDocuments(ds models.DocumentService, ps models.PatientService, es models.EncounterService,
+	logger *logrus.Entry) *Documents {
+	return &Documents{
+		IndexView: views.NewView("bootstrap", "documents/index"),
+		ds:        ds,
+		ps:        ps,
+		es:        es,
+		logger:    logger,
+	}
+}
+
+type DocumentsData struct {
+	Patient    *models.Patient
+	Documents  []models.Document
+	Encounters []models.Encounter
+	Categories []models.DocumentCategory
+	// Encounter is the encounter new documents are attached to by default.
+	Encounter string
+	MaxSizeMB int64
+	CanDelete bool
+}
+
+// Index renders the documents of the patient the user may see, with the form to upload another.
+// The encounter of the query is selected in the form.
+// GET /patients/:id/documents
+func (d *Documents) Index(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, d.ps, d.logger)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = d.documentsData(r, patient, &vd)
+	d.IndexView.Render(w, r, vd)
+}
+
+func (d *Documents) documentsData(r *http.Request, patient *models.Patient, vd *views.Data) *DocumentsData {
+	user := context.User(r.Context())
+	data := DocumentsData{
+		Patient:   patient,
+		Encounter: r.URL.Query().Get("encounter"),
+		MaxSizeMB: d.ds.MaxSize() >> 20,
+		CanDelete: user != nil && user.HasRole(models.UserRoleAdmin),
+	}
+	documents, err := d.ds.ByPatient(patient.Id.Hex())
+	if err != nil {
+		d.logger.Errorf("Error while fetching documents of patient %s: %v", patient.MRN, err)
+		vd.SetAlert(err)
+	}
+	for _, doc := range documents {
+		if canViewDocument(user, &doc) {
+			data.Documents = append(data.Documents, doc)
+		}
+	}
+	for _, c := range models.DocumentCategoriesList() {
+		if canViewEncounters(user) || !c.Clinical() {
+			data.Categories = append(data.Categories, c)
+		}
+	}
+	if canViewEncounters(user) {
+		if data.Encounters, err = d.es.ByPatient(patient.Id.Hex()); err != nil {
+			d.logger.Errorf("Error while fetching encounters of patient %s: %v", patient.MRN, err)
+			vd.SetAlert(err)
+		}
+	}
+	return &data
+}
+
+// Upload stores a document of the patient. The multipart form is read as a stream, the fields have to come
+// before the file, so that the content is never held in memory.
+// POST /patients/:id/documents
+func (d *Documents) Upload(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, d.ps, d.logger)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	doc := models.Document{PatientId: patient.Id, UploadedBy: user.Id}
+	r.Body = http.MaxBytesReader(w, r.Body, d.ds.MaxSize()+1<<20)
+	if err := d.upload(r, user, &doc); err != nil {
+		if err == errDocumentForbidden {
+			d.logger.Warnf("User %s tried to upload a clinical document for patient %s", user.Username, patient.MRN)
+		} else if _, ok := err.(views.PublicError); !ok {
+			d.logger.Errorf("Error while uploading a document for patient %s: %v", patient.MRN, err)
+		}
+		var vd views.Data
+		vd.Yield = d.documentsData(r, patient, &vd)
+		if err == errDocumentForbidden {
+			vd.AlertError("You do not have permission to upload clinical documents.")
+		} else {
+			vd.SetAlert(err)
+		}
+		d.IndexView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("%s has been uploaded.", doc.Title),
+	}
+	views.RedirectAlert(w, r, documentsPath(patient), http.StatusFound, alert)
+}
+
+// errDocumentForbidden is returned by upload if the user may not see the document.
+var errDocumentForbidden = fmt.Errorf("controllers: document not allowed for the user")
+
+// upload reads the fields of the form into the document and streams the file into the document service.
+func (d *Documents) upload(r *http.Request, user *models.User, doc *models.Document) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return models.ErrDocumentRequired
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return models.ErrDocumentRequired
+		}
+		if err != nil {
+			return err
+		}
+		if part.FormName() == "file" {
+			if part.FileName() == "" {
+				return models.ErrDocumentRequired
+			}
+			if !canViewDocument(user, doc) {
+				return errDocumentForbidden
+			}
+			doc.FileName = part.FileName()
+			return d.ds.Upload(doc, part)
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxDocumentFieldSize))
+		if err != nil {
+			return err
+		}
+		switch part.FormName() {
+		case "category":
+			doc.Category = models.DocumentCategory(value)
+		case "title":
+			doc.Title = string(value)
+		case "encounter":
+			if len(value) == 0 {
+				continue
+			}
+			if !bson.IsObjectIdHex(string(value)) {
+				return models.ErrDocumentEncounterInvalid
+			}
+			doc.EncounterId = bson.ObjectIdHex(string(value))
+		}
+	}
+}
+
+// Download sends the document as an attachment.
+// GET /documents/:id/download
+func (d *Documents) Download(w http.ResponseWriter, r *http.Request) {
+	doc, err := d.documentByID(w, r)
+	if err != nil {
+		return
+	}
+	d.serve(w, r, doc, "attachment")
+}
+
+// Image sends an image document to be shown in a page. Other documents have to be downloaded.
+// GET /images/:id
+func (d *Documents) Image(w http.ResponseWriter, r *http.Request) {
+	doc, err := d.documentByID(w, r)
+	if err != nil {
+		return
+	}
+	if !doc.IsImage() {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	d.serve(w, r, doc, "inline")
+}
+
+// serve streams the content of the document, after checking the user may see it.
+func (d *Documents) serve(w http.ResponseWriter, r *http.Request, doc *models.Document, disposition string) {
+	user := context.User(r.Context())
+	if !canViewDocument(user, doc) {
+		d.logger.Warnf("User %s was denied document %s", user.Username, doc.Id.Hex())
+		http.Error(w, "You do not have permission to see this document", http.StatusForbidden)
+		return
+	}
+	content, err := d.ds.Open(doc)
+	if err != nil {
+		d.logger.Errorf("Error while opening document %s: %v", doc.Id.Hex(), err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+	h := w.Header()
+	h.Set("Content-Type", doc.ContentType)
+	h.Set("Content-Length", strconv.FormatInt(doc.Size, 10))
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": doc.FileName}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, content); err != nil {
+		d.logger.Errorf("Error while sending document %s: %v", doc.Id.Hex(), err)
+		return
+	}
+	d.logger.Infof("User %s downloaded document %s of patient %s", user.Username, doc.Id.Hex(),
+		doc.PatientId.Hex())
+}
+
+// Delete removes a document uploaded by mistake.
+// POST /documents/:id/delete
+func (d *Documents) Delete(w http.ResponseWriter, r *http.Request) {
+	doc, err := d.documentByID(w, r)
+	if err != nil {
+		return
+	}
+	patient := &models.Patient{Id: doc.PatientId}
+	if err := d.ds.Remove(doc); err != nil {
+		d.logger.Errorf("Error while deleting document %s: %v", doc.Id.Hex(), err)
+		redirectError(w, r, documentsPath(patient), err)
+		return
+	}
+	d.logger.Infof("User %s deleted document %s of patient %s", context.User(r.Context()).Username,
+		doc.Id.Hex(), doc.PatientId.Hex())
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("%s has been deleted.", doc.Title),
+	}
+	views.RedirectAlert(w, r, documentsPath(patient), http.StatusFound, alert)
+}
+
+// documentByID fetches the document with the id from the request path.
+// If an error is returned, the response has already been written.
+func (d *Documents) documentByID(w http.ResponseWriter, r *http.Request) (*models.Document, error) {
+	id := mux.Vars(r)["id"]
+	doc, err := d.ds.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Document not found", http.StatusNotFound)
+		default:
+			d.logger.Errorf("Error while fetching document %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+// canViewDocument reports whether the user may see the document. Reception only sees the documents it scans in,
+// not the clinical record.
+func canViewDocument(user *models.User, doc *models.Document) bool {
+	if canViewEncounters(user) {
+		return true
+	}
+	return user != nil && user.HasRole(models.UserRoleReception) && !doc.Clinical()
+}
+
+func documentsPath(patient *models.Patient) string {
+	return "/patients/" + patient.Id.Hex() + "/documents"
+}
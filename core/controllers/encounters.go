@@ -0,0 +1,343 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// diagnosisRows is the number of empty diagnosis rows offered by the encounter form.
+const diagnosisRows = 3
+
+// Encounters are the clinical notes of the visits of patients.
+type Encounters struct {
+	ShowView *views.View
+	es       models.EncounterService
+	prs      models.PrescriptionService
+	ls       models.LabService
+	ds       models.DocumentService
+	cs       models.ChartService
+	as       models.AppointmentService
+	vs       models.VitalsService
+	ps       models.PatientService
+	us       models.UserService
+	logger   *logrus.Entry
+}
+
+func NewEncounters(es models.EncounterService, prs models.PrescriptionService, ls models.LabService,
+	ds models.DocumentService, cs models.ChartService, as models.AppointmentService, vs models.VitalsService,
+	ps models.PatientService, us models.UserService, logger *logrus.Entry) *Encounters {
+	return &Encounters{
+		ShowView: views.NewView("bootstrap", "encounters/show", "lab/parts", "chart/summary", "vitals/parts"),
+		es:       es,
+		prs:      prs,
+		ls:       ls,
+		ds:       ds,
+		cs:       cs,
+		as:       as,
+		vs:       vs,
+		ps:       ps,
+		us:       us,
+		logger:   logger,
+	}
+}
+
+type EncounterForm struct {
+	Date       string             `schema:"date"`
+	Subjective string             `schema:"subjective"`
+	Objective  string             `schema:"objective"`
+	Assessment string             `schema:"assessment"`
+	Plan       string             `schema:"plan"`
+	Vitals     models.Vitals      `schema:"vitals"`
+	Diagnoses  []models.Diagnosis `schema:"diagnoses"`
+	// Primary is the row of the primary diagnosis.
+	Primary string `schema:"primary"`
+}
+
+func newEncounterForm(encounter *models.Encounter) EncounterForm {
+	form := EncounterForm{
+		Date:       encounter.Date.Format(dateTimeFormat),
+		Subjective: encounter.Subjective,
+		Objective:  encounter.Objective,
+		Assessment: encounter.Assessment,
+		Plan:       encounter.Plan,
+		Vitals:     encounter.Vitals,
+		Diagnoses:  encounter.Diagnoses,
+	}
+	for i, d := range encounter.Diagnoses {
+		if d.Primary {
+			form.Primary = strconv.Itoa(i)
+		}
+	}
+	return form
+}
+
+// IsPrimary tells whether the diagnosis in the row is the primary one.
+func (f *EncounterForm) IsPrimary(row int) bool {
+	return f.Primary == strconv.Itoa(row)
+}
+
+// DiagnosisRows returns the diagnoses of the form, followed by empty rows for new ones.
+func (f *EncounterForm) DiagnosisRows() []models.Diagnosis {
+	rows := append([]models.Diagnosis(nil), f.Diagnoses...)
+	for i := 0; i < diagnosisRows; i++ {
+		rows = append(rows, models.Diagnosis{})
+	}
+	return rows
+}
+
+// apply sets the fields of the form on the encounter.
+func (f *EncounterForm) apply(encounter *models.Encounter) error {
+	if f.Date != "" {
+		date, err := time.ParseInLocation(dateTimeFormat, f.Date, time.Local)
+		if err != nil {
+			return models.ErrAppointmentTimesInvalid
+		}
+		encounter.Date = date
+	}
+	encounter.Subjective = strings.TrimSpace(f.Subjective)
+	encounter.Objective = strings.TrimSpace(f.Objective)
+	encounter.Assessment = strings.TrimSpace(f.Assessment)
+	encounter.Plan = strings.TrimSpace(f.Plan)
+	encounter.Vitals = f.Vitals
+	for i := range f.Diagnoses {
+		f.Diagnoses[i].Primary = f.IsPrimary(i)
+	}
+	encounter.Diagnoses = f.Diagnoses
+	return nil
+}
+
+type EncounterData struct {
+	Encounter *models.Encounter
+	Patient   *models.Patient
+	Physician *models.User
+	Form      EncounterForm
+	// Prescriptions are the prescriptions written during the encounter.
+	Prescriptions []models.Prescription
+	// LabOrders are the lab tests ordered during the encounter.
+	LabOrders []models.LabOrder
+	// Documents are the documents attached to the encounter.
+	Documents []models.Document
+	// Chart is the allergy, problem and medication lists of the patient.
+	Chart *models.Chart
+	// CanEdit is true while the encounter is a draft and the user may sign it.
+	CanEdit bool
+	// CanAddend is true for signed encounters and physicians or admins.
+	CanAddend bool
+	// CanPrescribe is true for physicians and admins.
+	CanPrescribe bool
+}
+
+// Create starts a draft encounter for the patient. The physician is the signed in physician,
+// or the physician of the appointment the encounter is started from. The vitals taken at check-in today are
+// copied into the encounter.
+// POST /patients/:id/encounters
+func (e *Encounters) Create(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, e.ps, e.logger)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	encounter := models.Encounter{
+		PatientId: patient.Id,
+		CreatedBy: user.Id,
+	}
+	if user.HasRole(models.UserRolePhysician) {
+		encounter.PhysicianId = user.Id
+	}
+	var appointment *models.Appointment
+	if id := r.FormValue("appointment"); id != "" {
+		appointment, err = e.as.ById(id)
+		if err != nil || appointment.PatientId != patient.Id {
+			redirectError(w, r, patientPath(patient), models.ErrEncounterAppointmentInvalid)
+			return
+		}
+		encounter.AppointmentId = appointment.Id
+		if encounter.PhysicianId == "" {
+			encounter.PhysicianId = appointment.PhysicianId
+		}
+	}
+	if encounter.PhysicianId == "" {
+		redirectError(w, r, patientPath(patient), models.ErrPhysicianInvalid)
+		return
+	}
+	if record, err := e.vs.Latest(patient.Id.Hex(), models.StartOfDay(time.Now())); err != nil {
+		e.logger.Errorf("Error while fetching the vitals of patient %s: %v", patient.MRN, err)
+	} else if record != nil {
+		encounter.Vitals = record.Vitals
+	}
+	if err := e.es.Create(&encounter); err != nil {
+		e.logger.Errorf("Error while creating an encounter for patient %s: %v", patient.MRN, err)
+		redirectError(w, r, patientPath(patient), err)
+		return
+	}
+	if appointment != nil && appointment.Status == models.AppointmentBooked {
+		if err := e.as.Complete(appointment); err != nil {
+			e.logger.Errorf("Error while completing appointment %s: %v", appointment.Id.Hex(), err)
+		}
+	}
+	views.RedirectAlert(w, r, encounterPath(&encounter), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The encounter has been started.",
+	})
+}
+
+// Show renders a draft encounter as a form for its physician, and as the signed note with its addenda otherwise.
+// GET /encounters/:id
+func (e *Encounters) Show(w http.ResponseWriter, r *http.Request) {
+	encounter, err := e.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	e.renderShow(w, r, encounter, newEncounterForm(encounter), nil)
+}
+
+// Update saves the changes to a draft encounter.
+// POST /encounters/:id/update
+func (e *Encounters) Update(w http.ResponseWriter, r *http.Request) {
+	encounter, err := e.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	if !encounter.CanSign(context.User(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var form EncounterForm
+	if err := parseForm(r, &form); err != nil {
+		e.logger.Errorln(err)
+		e.renderShow(w, r, encounter, form, err)
+		return
+	}
+	if err := form.apply(encounter); err != nil {
+		e.renderShow(w, r, encounter, form, err)
+		return
+	}
+	if err := e.es.Update(encounter); err != nil {
+		e.renderShow(w, r, encounter, form, err)
+		return
+	}
+	views.RedirectAlert(w, r, encounterPath(encounter), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The encounter has been saved.",
+	})
+}
+
+// Sign locks the encounter. Only its physician or an admin can sign it.
+// POST /encounters/:id/sign
+func (e *Encounters) Sign(w http.ResponseWriter, r *http.Request) {
+	encounter, err := e.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := e.es.Sign(encounter, context.User(r.Context())); err != nil {
+		e.renderShow(w, r, encounter, newEncounterForm(encounter), err)
+		return
+	}
+	views.RedirectAlert(w, r, encounterPath(encounter), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The encounter has been signed.",
+	})
+}
+
+// Addend adds an addendum to a signed encounter.
+// POST /encounters/:id/addenda
+func (e *Encounters) Addend(w http.ResponseWriter, r *http.Request) {
+	encounter, err := e.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !canAddend(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := e.es.Addend(encounter, user, r.FormValue("text")); err != nil {
+		e.renderShow(w, r, encounter, newEncounterForm(encounter), err)
+		return
+	}
+	views.RedirectAlert(w, r, encounterPath(encounter), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The addendum has been added.",
+	})
+}
+
+func (e *Encounters) renderShow(w http.ResponseWriter, r *http.Request, encounter *models.Encounter,
+	form EncounterForm, alert error) {
+	user := context.User(r.Context())
+	var vd views.Data
+	data := EncounterData{
+		Encounter: encounter,
+		Form:      form,
+		CanEdit:   !encounter.Signed() && encounter.CanSign(user),
+		CanAddend: encounter.Signed() && canAddend(user),
+		// Prescribing uses the same roles as adding addenda.
+		CanPrescribe: canAddend(user),
+	}
+	vd.Yield = &data
+	var err error
+	if data.Prescriptions, err = e.prs.ByEncounter(encounter.Id.Hex()); err != nil {
+		e.logger.Errorf("Error while fetching prescriptions of encounter %s: %v", encounter.Id.Hex(), err)
+	}
+	if data.LabOrders, err = e.ls.ByEncounter(encounter.Id.Hex()); err != nil {
+		e.logger.Errorf("Error while fetching lab orders of encounter %s: %v", encounter.Id.Hex(), err)
+	}
+	if data.Documents, err = e.ds.ByEncounter(encounter.Id.Hex()); err != nil {
+		e.logger.Errorf("Error while fetching documents of encounter %s: %v", encounter.Id.Hex(), err)
+	}
+	if data.Chart, err = e.cs.Chart(encounter.PatientId.Hex()); err != nil {
+		e.logger.Errorf("Error while fetching the chart of patient %s: %v", encounter.PatientId.Hex(), err)
+	}
+	if data.Patient, err = e.ps.ById(encounter.PatientId.Hex()); err != nil {
+		e.logger.Errorf("Error while fetching patient of encounter %s: %v", encounter.Id.Hex(), err)
+		data.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if data.Physician, err = e.us.ById(encounter.PhysicianId.Hex()); err != nil {
+		e.logger.Errorf("Error while fetching physician of encounter %s: %v", encounter.Id.Hex(), err)
+		data.Physician = &models.User{Name: "Unknown physician"}
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	e.ShowView.Render(w, r, vd)
+}
+
+// encounterByID fetches the encounter with the id from the request path.
+// If an error is returned, the response has already been written.
+func (e *Encounters) encounterByID(w http.ResponseWriter, r *http.Request) (*models.Encounter, error) {
+	id := mux.Vars(r)["id"]
+	encounter, err := e.es.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Encounter not found", http.StatusNotFound)
+		default:
+			e.logger.Errorf("Error while fetching encounter %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return encounter, nil
+}
+
+func encounterPath(encounter *models.Encounter) string {
+	return "/encounters/" + encounter.Id.Hex()
+}
+
+// canViewEncounters reports whether the user may read clinical notes. Reception can not.
+func canViewEncounters(user *models.User) bool {
+	return user != nil && user.HasRole(models.UserRoleAdmin, models.UserRolePhysician, models.UserRoleStaff)
+}
+
+// canAddend reports whether the user may start encounters and add addenda to signed ones.
+func canAddend(user *models.User) bool {
+	return user != nil && user.HasRole(models.UserRoleAdmin, models.UserRolePhysician)
+}
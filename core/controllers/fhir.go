@@ -0,0 +1,454 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gcchr-system/core/fhir"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// maxFHIRCount is the most resources on a page of search results.
+const maxFHIRCount = 100
+
+// FHIR serves patients, physicians and encounters as FHIR R4 resources, for exchanging records with hospitals.
+// It is read only and authenticated like the JSON API.
+type FHIR struct {
+	ps        models.PatientService
+	us        models.UserService
+	es        models.EncounterService
+	published time.Time
+	logger    *logrus.Entry
+}
+
+func NewFHIR(ps models.PatientService, us models.UserService, es models.EncounterService,
+	logger *logrus.Entry) *FHIR {
+	return &FHIR{
+		ps:        ps,
+		us:        us,
+		es:        es,
+		published: time.Now(),
+		logger:    logger,
+	}
+}
+
+// Metadata returns the CapabilityStatement of the server. It is public, so that clients can discover it.
+// GET /fhir/metadata
+func (f *FHIR) Metadata(w http.ResponseWriter, r *http.Request) {
+	views.RenderFHIR(w, http.StatusOK, fhir.NewCapabilityStatement(fhirBase(r), f.published))
+}
+
+// Patient returns a patient.
+// GET /fhir/Patient/:id
+func (f *FHIR) Patient(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	patient, err := f.ps.ById(id)
+	if err != nil {
+		f.readError(w, "Patient", id, err)
+		return
+	}
+	views.RenderFHIR(w, http.StatusOK, fhir.NewPatient(patient))
+}
+
+// SearchPatients searches patients by identifier, name and birth date.
+// GET /fhir/Patient
+func (f *FHIR) SearchPatients(w http.ResponseWriter, r *http.Request) {
+	search, ok := f.newSearch(w, r, "Patient")
+	if !ok {
+		return
+	}
+	filter := models.PatientFilter{Name: search.get("name"), Page: search.page, PerPage: search.perPage()}
+	if id := search.get("_id"); id != "" {
+		if !bson.IsObjectIdHex(id) {
+			search.render(w, 0)
+			return
+		}
+		filter.Id = bson.ObjectIdHex(id)
+	}
+	if value := search.get("identifier"); value != "" {
+		system, code := fhir.ParseToken(value)
+		filter.Identifier.Value = code
+		if system != "" {
+			if filter.Identifier.System, ok = fhir.ParseIdentifierSystem(system); !ok {
+				search.render(w, 0)
+				return
+			}
+		}
+	}
+	birth, ok := search.date(w, "birthdate")
+	if !ok {
+		return
+	}
+	filter.BornFrom, filter.BornTo = birth.From, birth.To
+	patients, total, err := f.ps.Find(filter)
+	if err != nil {
+		f.searchError(w, "Patient", err)
+		return
+	}
+	for i := range patients {
+		search.add("Patient", patients[i].Id, fhir.NewPatient(&patients[i]))
+	}
+	search.render(w, total)
+}
+
+// Practitioner returns a physician.
+// GET /fhir/Practitioner/:id
+func (f *FHIR) Practitioner(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	user, err := f.us.ById(id)
+	if err == nil && !user.HasRole(models.UserRolePhysician) {
+		err = models.MongoErrNotFound
+	}
+	if err != nil {
+		f.readError(w, "Practitioner", id, err)
+		return
+	}
+	views.RenderFHIR(w, http.StatusOK, fhir.NewPractitioner(user))
+}
+
+// SearchPractitioners searches physicians by identifier and name.
+// GET /fhir/Practitioner
+func (f *FHIR) SearchPractitioners(w http.ResponseWriter, r *http.Request) {
+	search, ok := f.newSearch(w, r, "Practitioner")
+	if !ok {
+		return
+	}
+	physicians, err := f.us.ByUserRole(models.UserRolePhysician)
+	if err != nil {
+		f.searchError(w, "Practitioner", err)
+		return
+	}
+	// There are few physicians, so they are filtered here instead of in the database.
+	id, name := search.get("_id"), search.get("name")
+	system, code := fhir.ParseToken(search.get("identifier"))
+	var matching []models.User
+	for _, u := range physicians {
+		if id != "" && u.Id.Hex() != id {
+			continue
+		}
+		if name != "" && !models.NameStartsWith(u.Name, name) {
+			continue
+		}
+		if code != "" && !((system == "" || system == fhir.SystemUsername) && u.Username == strings.ToLower(code) ||
+			(system == "" || system == fhir.SystemRegistration) && u.RegistrationNumber == code) {
+			continue
+		}
+		matching = append(matching, u)
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Id < matching[j].Id
+	})
+	start := (search.page - 1) * search.perPage()
+	for i := start; i < len(matching) && i < start+search.perPage(); i++ {
+		search.add("Practitioner", matching[i].Id, fhir.NewPractitioner(&matching[i]))
+	}
+	search.render(w, len(matching))
+}
+
+// Encounter returns an encounter.
+// GET /fhir/Encounter/:id
+func (f *FHIR) Encounter(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	encounter, err := f.es.ById(id)
+	if err != nil {
+		f.readError(w, "Encounter", id, err)
+		return
+	}
+	views.RenderFHIR(w, http.StatusOK, fhir.NewEncounter(encounter))
+}
+
+// SearchEncounters searches encounters by patient, physician and date. Patients can also be given by an
+// identifier, with the chained parameter patient.identifier.
+// GET /fhir/Encounter
+func (f *FHIR) SearchEncounters(w http.ResponseWriter, r *http.Request) {
+	search, ok := f.newSearch(w, r, "Encounter")
+	if !ok {
+		return
+	}
+	filter := models.EncounterFilter{Page: search.page, PerPage: search.perPage()}
+	if id, given := search.reference("_id", ""); given {
+		if filter.Id = id; id == "" {
+			search.render(w, 0)
+			return
+		}
+	}
+	patient, given := search.reference("patient", "Patient")
+	if !given {
+		patient, given = search.reference("subject", "Patient")
+	}
+	if given {
+		if patient == "" {
+			search.render(w, 0)
+			return
+		}
+		filter.PatientIds = []bson.ObjectId{patient}
+	}
+	if value := search.get("patient.identifier"); value != "" {
+		ids, err := f.patientsByIdentifier(value)
+		if err != nil {
+			f.searchError(w, "Encounter", err)
+			return
+		}
+		if given {
+			ids = intersectIds(ids, filter.PatientIds)
+		}
+		if len(ids) == 0 {
+			search.render(w, 0)
+			return
+		}
+		filter.PatientIds = ids
+	}
+	physician, given := search.reference("practitioner", "Practitioner")
+	if !given {
+		physician, given = search.reference("participant", "Practitioner")
+	}
+	if given {
+		if physician == "" {
+			search.render(w, 0)
+			return
+		}
+		filter.PhysicianId = physician
+	}
+	date, ok := search.date(w, "date")
+	if !ok {
+		return
+	}
+	filter.From, filter.To = date.From, date.To
+	encounters, total, err := f.es.Find(filter)
+	if err != nil {
+		f.searchError(w, "Encounter", err)
+		return
+	}
+	for i := range encounters {
+		search.add("Encounter", encounters[i].Id, fhir.NewEncounter(&encounters[i]))
+	}
+	search.render(w, total)
+}
+
+// patientsByIdentifier returns the ids of the patients with the identifier token.
+func (f *FHIR) patientsByIdentifier(value string) ([]bson.ObjectId, error) {
+	system, code := fhir.ParseToken(value)
+	filter := models.PatientFilter{Identifier: models.Identifier{Value: code}, PerPage: maxFHIRCount}
+	if system != "" {
+		var ok bool
+		if filter.Identifier.System, ok = fhir.ParseIdentifierSystem(system); !ok {
+			return nil, nil
+		}
+	}
+	patients, _, err := f.ps.Find(filter)
+	ids := make([]bson.ObjectId, 0, len(patients))
+	for _, p := range patients {
+		ids = append(ids, p.Id)
+	}
+	return ids, err
+}
+
+func intersectIds(a, b []bson.ObjectId) []bson.ObjectId {
+	var ids []bson.ObjectId
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				ids = append(ids, x)
+			}
+		}
+	}
+	return ids
+}
+
+// NotSupported answers requests for resource types and operations which are not supported, and requests
+// changing resources, which are read only.
+func (f *FHIR) NotSupported(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		views.RenderOperationOutcome(w, http.StatusMethodNotAllowed, fhir.IssueNotSupported,
+			"Resources can only be read and searched")
+		return
+	}
+	views.RenderOperationOutcome(w, http.StatusNotFound, fhir.IssueNotSupported,
+		"The resource type or operation is not supported, see /fhir/metadata")
+}
+
+func (f *FHIR) readError(w http.ResponseWriter, resourceType, id string, err error) {
+	switch err.Error() {
+	case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+		views.RenderOperationOutcome(w, http.StatusNotFound, fhir.IssueNotFound,
+			"Resource "+resourceType+"/"+id+" is not known")
+	default:
+		f.logger.Errorf("Error while reading %s/%s: %v", resourceType, id, err)
+		views.RenderOperationOutcome(w, http.StatusInternalServerError, fhir.IssueException, views.AlertMessageGeneric)
+	}
+}
+
+func (f *FHIR) searchError(w http.ResponseWriter, resourceType string, err error) {
+	f.logger.Errorf("Error while searching %s resources: %v", resourceType, err)
+	views.RenderOperationOutcome(w, http.StatusInternalServerError, fhir.IssueException, views.AlertMessageGeneric)
+}
+
+// fhirSearch is a search request for a resource type, building the bundle of its results.
+type fhirSearch struct {
+	resourceType string
+	base         string
+	// params are the supported parameters of the request, repeated in the links of the bundle.
+	params url.Values
+	count  int
+	page   int
+	bundle fhir.Bundle
+}
+
+// newSearch reads the paging parameters of a search. Parameters which are not supported are ignored, unless the
+// client asks for strict handling with "Prefer: handling=strict". If false is returned, the response has already
+// been written.
+func (f *FHIR) newSearch(w http.ResponseWriter, r *http.Request, resourceType string) (*fhirSearch, bool) {
+	search := &fhirSearch{
+		resourceType: resourceType,
+		base:         fhirBase(r),
+		params:       url.Values{},
+		count:        fhir.DefaultCount,
+		page:         1,
+	}
+	strict := strings.Contains(r.Header.Get("Prefer"), "handling=strict")
+	for name, values := range r.URL.Query() {
+		if !fhir.SupportsParam(resourceType, name) {
+			if strict {
+				views.RenderOperationOutcome(w, http.StatusBadRequest, fhir.IssueNotSupported,
+					"The search parameter "+name+" is not supported for "+resourceType)
+				return nil, false
+			}
+			continue
+		}
+		search.params[name] = values
+	}
+	if format := search.params.Get(fhir.ParamFormat); format != "" && !strings.Contains(format, "json") {
+		views.RenderOperationOutcome(w, http.StatusNotAcceptable, fhir.IssueNotSupported,
+			"Resources are only available as JSON")
+		return nil, false
+	}
+	if value := search.params.Get(fhir.ParamCount); value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			views.RenderOperationOutcome(w, http.StatusBadRequest, fhir.IssueInvalid,
+				"_count must be a number from 0 to "+strconv.Itoa(maxFHIRCount))
+			return nil, false
+		}
+		if count > maxFHIRCount {
+			count = maxFHIRCount
+		}
+		search.count = count
+	}
+	if value := search.params.Get(fhir.ParamPage); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			views.RenderOperationOutcome(w, http.StatusBadRequest, fhir.IssueInvalid, "_page must be 1 or more")
+			return nil, false
+		}
+		search.page = page
+	}
+	search.params.Del(fhir.ParamCount)
+	search.params.Del(fhir.ParamPage)
+	return search, true
+}
+
+// get returns the value of the search parameter.
+func (s *fhirSearch) get(name string) string {
+	return strings.TrimSpace(s.params.Get(name))
+}
+
+// perPage returns the page size to fetch. A count of 0 only asks for the number of results, which still needs a
+// page to be fetched.
+func (s *fhirSearch) perPage() int {
+	if s.count == 0 {
+		return 1
+	}
+	return s.count
+}
+
+// reference returns the id of a reference parameter to a resource of the type, or of the _id parameter if the
+// type is empty. The id is empty if the parameter was given but can not match any resource.
+func (s *fhirSearch) reference(name, resourceType string) (bson.ObjectId, bool) {
+	value := s.get(name)
+	if value == "" {
+		return "", false
+	}
+	if resourceType != "" {
+		var ok bool
+		if value, ok = fhir.ParseReference(value, resourceType); !ok {
+			return "", true
+		}
+	}
+	if !bson.IsObjectIdHex(value) {
+		return "", true
+	}
+	return bson.ObjectIdHex(value), true
+}
+
+// date returns the range of the date parameter, which may be given more than once to limit both ends. If false
+// is returned, the response has already been written.
+func (s *fhirSearch) date(w http.ResponseWriter, name string) (fhir.DateRange, bool) {
+	var span fhir.DateRange
+	for _, value := range s.params[name] {
+		d, err := fhir.ParseDate(strings.TrimSpace(value), time.Local)
+		if err != nil {
+			views.RenderOperationOutcome(w, http.StatusBadRequest, fhir.IssueInvalid,
+				"The "+name+" parameter "+value+" is not a date like 2024-03-01, ge2024-03-01 or lt2024-04")
+			return span, false
+		}
+		span = span.Intersect(d)
+	}
+	return span, true
+}
+
+// add adds a resource of the page to the bundle.
+func (s *fhirSearch) add(resourceType string, id bson.ObjectId, resource interface{}) {
+	if s.count > 0 {
+		s.bundle.Add(s.base+"/"+resourceType+"/"+id.Hex(), resource)
+	}
+}
+
+// render writes the bundle with the number of all results, and links to the other pages.
+func (s *fhirSearch) render(w http.ResponseWriter, total int) {
+	entries := s.bundle.Entry
+	s.bundle = fhir.NewSearchSet(total)
+	s.bundle.Entry = entries
+	s.link("self", s.page)
+	if s.count > 0 {
+		last := (total + s.count - 1) / s.count
+		if last < 1 {
+			last = 1
+		}
+		s.link("first", 1)
+		if s.page > 1 {
+			s.link("previous", s.page-1)
+		}
+		if s.page < last {
+			s.link("next", s.page+1)
+		}
+		s.link("last", last)
+	}
+	views.RenderFHIR(w, http.StatusOK, s.bundle)
+}
+
+func (s *fhirSearch) link(relation string, page int) {
+	params := url.Values{}
+	for name, values := range s.params {
+		params[name] = values
+	}
+	params.Set(fhir.ParamCount, strconv.Itoa(s.count))
+	params.Set(fhir.ParamPage, strconv.Itoa(page))
+	s.bundle.Link = append(s.bundle.Link, fhir.BundleLink{
+		Relation: relation,
+		URL:      s.base + "/" + s.resourceType + "?" + params.Encode(),
+	})
+}
+
+// fhirBase returns the base URL of the FHIR API, which resources are read from.
+func fhirBase(r *http.Request) string {
+	return baseURL(r) + strings.TrimSuffix(views.FHIRPrefix, "/")
+}
@@ -1,12 +1,26 @@
 package controllers
 
 import (
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 )
 
+const (
+	// dateFormat is the format of the value of date inputs.
+	dateFormat = "2006-01-02"
+	// dateTimeFormat is the format of the value of datetime-local inputs.
+	dateTimeFormat = "2006-01-02T15:04"
+)
+
 func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
@@ -30,3 +44,64 @@ func parseValues(values url.Values, dst interface{}) error {
 	}
 	return nil
 }
+
+// parseDay parses the value of a date input, an empty value as the zero time.
+func parseDay(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	day, err := time.ParseInLocation(dateFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, models.ErrDateInvalid
+	}
+	return day, nil
+}
+
+// redirectError redirects to the path with the error as alert, the public message of model errors or a generic one.
+func redirectError(w http.ResponseWriter, r *http.Request, path string, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, path, http.StatusFound, *vd.Alert)
+}
+
+// clientIP returns the IP address of the client which sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// baseURL returns the scheme and host the request was sent to, for absolute links.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// requestActor returns the signed in user and IP address of the request, for the audit log.
+func requestActor(r *http.Request) models.Actor {
+	return models.ActorOf(context.User(r.Context()), clientIP(r))
+}
+
+// patientByID fetches the patient with the id from the request path.
+// If an error is returned, the response has already been written.
+func patientByID(w http.ResponseWriter, r *http.Request, ps models.PatientService,
+	logger *logrus.Entry) (*models.Patient, error) {
+	id := mux.Vars(r)["id"]
+	patient, err := ps.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Patient not found", http.StatusNotFound)
+		default:
+			logger.Errorf("Error while fetching patient %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return patient, nil
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/hl7"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// HL7 lets admins review the messages received over the HL7 interface which failed, and process them again once
+// the cause is fixed.
+type HL7 struct {
+	IndexView *views.View
+	ShowView  *views.View
+	receiver  *hl7.Receiver
+	ms        models.HL7MessageService
+	logger    *logrus.Entry
+}
+
+func NewHL7(receiver *hl7.Receiver, ms models.HL7MessageService, logger *logrus.Entry) *HL7 {
+	return &HL7{
+		IndexView: views.NewView("bootstrap", "hl7/index"),
+		ShowView:  views.NewView("bootstrap", "hl7/show"),
+		receiver:  receiver,
+		ms:        ms,
+		logger:    logger,
+	}
+}
+
+type HL7MessagesForm struct {
+	Status models.HL7MessageStatus `schema:"status"`
+	Page   int                     `schema:"page"`
+}
+
+type HL7MessagesData struct {
+	Form          HL7MessagesForm
+	StatusOptions []models.HL7MessageStatus
+	Messages      []models.HL7Message
+	Total         int
+	Page          int
+	Pages         int
+}
+
+func (d *HL7MessagesData) HasPrev() bool { return d.Page > 1 }
+func (d *HL7MessagesData) HasNext() bool { return d.Page < d.Pages }
+func (d *HL7MessagesData) Prev() int     { return d.Page - 1 }
+func (d *HL7MessagesData) Next() int     { return d.Page + 1 }
+
+// PageLink returns the URL of another page of the messages with the same status.
+func (d *HL7MessagesData) PageLink(page int) string {
+	v := url.Values{}
+	v.Set("status", string(d.Form.Status))
+	v.Set("page", strconv.Itoa(page))
+	return "/admin/hl7?" + v.Encode()
+}
+
+// Index renders a page of the messages which failed, those waiting for review unless another status is asked for.
+// GET /admin/hl7
+func (h *HL7) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data := HL7MessagesData{StatusOptions: models.HL7MessageStatusList()}
+	vd.Yield = &data
+	if err := parseURLParams(r, &data.Form); err != nil {
+		vd.SetAlert(err)
+		h.IndexView.Render(w, r, vd)
+		return
+	}
+	if _, ok := r.URL.Query()["status"]; !ok {
+		data.Form.Status = models.HL7MessageFailed
+	}
+	filter := models.HL7MessageFilter{
+		Status:  data.Form.Status,
+		Page:    data.Form.Page,
+		PerPage: models.DefaultHL7MessagePageSize,
+	}
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	messages, total, err := h.ms.Find(filter)
+	if err != nil {
+		h.logger.Errorf("Error while fetching HL7 messages: %v", err)
+		vd.SetAlert(err)
+		h.IndexView.Render(w, r, vd)
+		return
+	}
+	data.Messages = messages
+	data.Total = total
+	data.Page = filter.Page
+	data.Pages = (total + filter.PerPage - 1) / filter.PerPage
+	h.IndexView.Render(w, r, vd)
+}
+
+// Show renders a message with its error and its segments.
+// GET /admin/hl7/{id}
+func (h *HL7) Show(w http.ResponseWriter, r *http.Request) {
+	message, err := h.messageByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = message
+	h.ShowView.Render(w, r, vd)
+}
+
+// Retry processes the message again, after the patient or the lab order it failed on was fixed.
+// POST /admin/hl7/{id}/retry
+func (h *HL7) Retry(w http.ResponseWriter, r *http.Request) {
+	message, err := h.messageByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	path := hl7MessagePath(message)
+	if err := h.receiver.Retry(message, user); err != nil {
+		if _, ok := err.(*hl7.Error); ok {
+			views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+				Level:   views.AlertLevelError,
+				Message: "The message failed again. " + err.Error() + ".",
+			})
+			return
+		}
+		h.logger.Errorf("Error while processing HL7 message %s again: %v", message.Id.Hex(), err)
+		redirectError(w, r, path, err)
+		return
+	}
+	h.logger.Infof("User %s processed HL7 message %s again", user.Username, message.Id.Hex())
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The message was processed.",
+	})
+}
+
+// Dismiss takes the message off the queue without processing it, for messages sent by mistake or entered by hand.
+// POST /admin/hl7/{id}/dismiss
+func (h *HL7) Dismiss(w http.ResponseWriter, r *http.Request) {
+	message, err := h.messageByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if err := h.ms.Resolve(message, models.HL7MessageDismissed, user); err != nil {
+		h.logger.Errorf("Error while dismissing HL7 message %s: %v", message.Id.Hex(), err)
+		redirectError(w, r, hl7MessagePath(message), err)
+		return
+	}
+	h.logger.Infof("User %s dismissed HL7 message %s", user.Username, message.Id.Hex())
+	views.RedirectAlert(w, r, "/admin/hl7", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The message was dismissed.",
+	})
+}
+
+// messageByID fetches the message with the id from the request path.
+// If an error is returned, the response has already been written.
+func (h *HL7) messageByID(w http.ResponseWriter, r *http.Request) (*models.HL7Message, error) {
+	id := mux.Vars(r)["id"]
+	message, err := h.ms.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Message not found", http.StatusNotFound)
+		default:
+			h.logger.Errorf("Error while fetching HL7 message %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+func hl7MessagePath(message *models.HL7Message) string {
+	return "/admin/hl7/" + message.Id.Hex()
+}
@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// dueDays is the number of days the list of doses due covers.
+const dueDays = 7
+
+// Immunizations records the vaccines given to patients and lists the doses due by the immunization schedule.
+type Immunizations struct {
+	IndexView *views.View
+	DueView   *views.View
+	CardView  *views.View
+	is        models.ImmunizationService
+	ps        models.PatientService
+	us        models.UserService
+	settings  models.SettingsService
+	logger    *logrus.Entry
+}
+
+func NewImmunizations(is models.ImmunizationService, ps models.PatientService, us models.UserService,
+	settings models.SettingsService, logger *logrus.Entry) *Immunizations {
+	return &Immunizations{
+		IndexView: views.NewView("bootstrap", "immunizations/index", "immunizations/parts"),
+		DueView:   views.NewView("bootstrap", "immunizations/due", "immunizations/parts"),
+		CardView:  views.NewView("print", "immunizations/card", "immunizations/parts"),
+		is:        is,
+		ps:        ps,
+		us:        us,
+		settings:  settings,
+		logger:    logger,
+	}
+}
+
+type ImmunizationForm struct {
+	// Dose is the code of the vaccine and the number of the dose, like PENTA:2.
+	Dose      string               `schema:"dose"`
+	Given     string               `schema:"given"`
+	LotNumber string               `schema:"lot_number"`
+	Site      models.InjectionSite `schema:"site"`
+	GivenBy   string               `schema:"given_by"`
+	Elsewhere string               `schema:"elsewhere"`
+	Notes     string               `schema:"notes"`
+}
+
+// apply sets the dose, day and giver of the form on the immunization.
+func (f *ImmunizationForm) apply(immunization *models.Immunization) error {
+	i := strings.LastIndex(f.Dose, ":")
+	if i < 0 {
+		return models.ErrVaccineDoseInvalid
+	}
+	number, err := strconv.Atoi(f.Dose[i+1:])
+	if err != nil {
+		return models.ErrVaccineDoseInvalid
+	}
+	immunization.VaccineCode, immunization.Dose = f.Dose[:i], number
+	if immunization.Given, err = parseDay(f.Given); err != nil {
+		return err
+	}
+	immunization.LotNumber = f.LotNumber
+	immunization.Site = f.Site
+	immunization.Elsewhere = f.Elsewhere
+	immunization.Notes = strings.TrimSpace(f.Notes)
+	if bson.IsObjectIdHex(f.GivenBy) {
+		immunization.GivenBy = bson.ObjectIdHex(f.GivenBy)
+	}
+	return nil
+}
+
+type ImmunizationData struct {
+	Record      *models.ImmunizationRecord
+	Form        ImmunizationForm
+	Vaccinators []models.User
+	Clinic      *models.ClinicSettings
+	// Schedule is the name of the immunization schedule.
+	Schedule string
+	// CanRecord is true for clinical users, CanDelete for admins.
+	CanRecord bool
+	CanDelete bool
+	users     map[bson.ObjectId]string
+}
+
+// DoseOption is a choice of the dose select field.
+type DoseOption struct {
+	Value  string
+	Name   string
+	Status models.DoseStatus
+}
+
+// DoseOptions are the doses not given yet, the doses due first.
+func (d *ImmunizationData) DoseOptions() []DoseOption {
+	var options []DoseOption
+	for _, f := range d.Record.Doses {
+		if f.Status != models.DoseGiven {
+			options = append(options, DoseOption{
+				Value:  fmt.Sprintf("%s:%d", f.Vaccine.Code, f.Number),
+				Name:   f.Name(),
+				Status: f.Status,
+			})
+		}
+	}
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Status.Pending() && !options[j].Status.Pending()
+	})
+	return options
+}
+
+// Sites are the choices of the site select field.
+func (d *ImmunizationData) Sites() []models.InjectionSite {
+	return models.InjectionSitesList()
+}
+
+// GivenBy returns who gave the dose at the clinic, or where it was given.
+func (d *ImmunizationData) GivenBy(immunization *models.Immunization) string {
+	if immunization.Elsewhere != "" {
+		return immunization.Elsewhere
+	}
+	if name, ok := d.users[immunization.GivenBy]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Age returns the age of the patient on the day of the record.
+func (d *ImmunizationData) Age() string {
+	return childAge(d.Record.Patient, d.Record.Day)
+}
+
+type DueData struct {
+	From  time.Time
+	Until time.Time
+	Doses []models.DueDose
+	// Previous and Next are the first days of the weeks before and after.
+	Previous string
+	Next     string
+}
+
+// Age returns the age of the patient on the first day of the list.
+func (d *DueData) Age(patient models.Patient) string {
+	return childAge(&patient, d.From)
+}
+
+// Index renders the doses of the schedule for the patient with the doses given and the form to record one.
+// GET /patients/:id/immunizations
+func (im *Immunizations) Index(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, im.ps, im.logger)
+	if err != nil {
+		return
+	}
+	data := ImmunizationData{Form: ImmunizationForm{Given: time.Now().Format(dateFormat)}}
+	if user := context.User(r.Context()); user.HasRole(models.UserRolePhysician, models.UserRoleStaff) {
+		data.Form.GivenBy = user.Id.Hex()
+	}
+	im.render(w, r, patient, &data, nil)
+}
+
+func (im *Immunizations) render(w http.ResponseWriter, r *http.Request, patient *models.Patient,
+	data *ImmunizationData, alert error) {
+	var vd views.Data
+	vd.Yield = data
+	if err := im.load(r, patient, data); err != nil {
+		vd.SetAlert(err)
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	im.IndexView.Render(w, r, vd)
+}
+
+// load fills the data with the immunization record of the patient and the names of the staff.
+func (im *Immunizations) load(r *http.Request, patient *models.Patient, data *ImmunizationData) error {
+	user := context.User(r.Context())
+	data.CanRecord = canViewEncounters(user)
+	data.CanDelete = user.HasRole(models.UserRoleAdmin)
+	data.Schedule = im.is.Schedule().Name
+	var err error
+	if data.Record, err = im.is.Record(patient, time.Now()); err != nil {
+		im.logger.Errorf("Error while fetching immunizations of patient %s: %v", patient.MRN, err)
+		data.Record = &models.ImmunizationRecord{Patient: patient, Day: models.StartOfDay(time.Now())}
+		return err
+	}
+	users, err := im.us.All()
+	if err != nil {
+		im.logger.Errorf("Error while fetching users: %v", err)
+		return err
+	}
+	data.users = make(map[bson.ObjectId]string, len(users))
+	for _, u := range users {
+		data.users[u.Id] = u.Name
+		if !u.Disabled && u.HasRole(models.UserRolePhysician, models.UserRoleStaff) {
+			data.Vaccinators = append(data.Vaccinators, u)
+		}
+	}
+	sort.Slice(data.Vaccinators, func(i, j int) bool {
+		return data.Vaccinators[i].Name < data.Vaccinators[j].Name
+	})
+	return nil
+}
+
+// Create records a dose given to the patient.
+// POST /patients/:id/immunizations
+func (im *Immunizations) Create(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, im.ps, im.logger)
+	if err != nil {
+		return
+	}
+	var data ImmunizationData
+	if err := parseForm(r, &data.Form); err != nil {
+		im.logger.Errorln(err)
+		im.render(w, r, patient, &data, err)
+		return
+	}
+	immunization := models.Immunization{
+		PatientId:  patient.Id,
+		RecordedBy: context.User(r.Context()).Id,
+	}
+	if err := data.Form.apply(&immunization); err != nil {
+		im.render(w, r, patient, &data, err)
+		return
+	}
+	if err := im.is.Create(&immunization); err != nil {
+		im.render(w, r, patient, &data, err)
+		return
+	}
+	name := immunization.VaccineCode
+	if v := im.is.Schedule().Vaccine(immunization.VaccineCode); v != nil {
+		name = v.Name
+	}
+	views.RedirectAlert(w, r, immunizationsPath(patient), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Dose %d of %s has been recorded.", immunization.Dose, name),
+	})
+}
+
+// Delete removes an immunization recorded by mistake.
+// POST /immunizations/:id/delete
+func (im *Immunizations) Delete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	immunization, err := im.is.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Immunization not found", http.StatusNotFound)
+		default:
+			im.logger.Errorf("Error while fetching immunization %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return
+	}
+	patient := &models.Patient{Id: immunization.PatientId}
+	if err := im.is.Delete(id); err != nil {
+		im.logger.Errorf("Error while deleting immunization %s: %v", id, err)
+		redirectError(w, r, immunizationsPath(patient), err)
+		return
+	}
+	im.logger.Infof("User %s removed dose %d of %s given to patient %s", context.User(r.Context()).Username,
+		immunization.Dose, immunization.VaccineCode, immunization.PatientId.Hex())
+	views.RedirectAlert(w, r, immunizationsPath(patient), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The immunization has been removed.",
+	})
+}
+
+// Card renders the printable immunization card of the patient.
+// GET /patients/:id/immunizations/card
+func (im *Immunizations) Card(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, im.ps, im.logger)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var data ImmunizationData
+	vd.Yield = &data
+	if err := im.load(r, patient, &data); err != nil {
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	if data.Clinic, err = im.settings.Clinic(); err != nil {
+		im.logger.Errorf("Error while fetching clinic settings: %v", err)
+		data.Clinic = &models.ClinicSettings{}
+	}
+	im.CardView.Render(w, r, vd)
+}
+
+// Due lists the doses of all patients which are overdue, due, or become due in the week starting on the day, today
+// if none is given.
+// GET /immunizations/due
+func (im *Immunizations) Due(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	from, err := parseDay(r.URL.Query().Get("from"))
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	if from.IsZero() {
+		from = models.StartOfDay(time.Now())
+	}
+	data := DueData{
+		From:     from,
+		Until:    from.AddDate(0, 0, dueDays-1),
+		Previous: from.AddDate(0, 0, -dueDays).Format(dateFormat),
+		Next:     from.AddDate(0, 0, dueDays).Format(dateFormat),
+	}
+	vd.Yield = &data
+	if data.Doses, err = im.is.DueBy(data.From, data.Until); err != nil {
+		im.logger.Errorf("Error while listing the doses due: %v", err)
+		vd.SetAlert(err)
+	}
+	im.DueView.Render(w, r, vd)
+}
+
+func immunizationsPath(patient *models.Patient) string {
+	return "/patients/" + patient.Id.Hex() + "/immunizations"
+}
+
+// childAge returns the age of the patient in months below two years, in years from then on.
+func childAge(patient *models.Patient, t time.Time) string {
+	months := patient.AgeMonths(t)
+	switch {
+	case months < 1:
+		return plural(int(t.Sub(patient.DateOfBirth).Hours()/24), "day")
+	case months < 24:
+		return plural(months, "month")
+	}
+	return plural(patient.Age(t), "year")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
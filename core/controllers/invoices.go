@@ -0,0 +1,527 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// Invoices are the bills of encounters, their payments and the daily cash report of reception.
+type Invoices struct {
+	IndexView   *views.View
+	NewView     *views.View
+	ShowView    *views.View
+	PrintView   *views.View
+	ReceiptView *views.View
+	ReportView  *views.View
+	is          models.InvoiceService
+	cs          models.CatalogueService
+	es          models.EncounterService
+	ps          models.PatientService
+	us          models.UserService
+	settings    models.SettingsService
+	logger      *logrus.Entry
+}
+
+func NewInvoices(is models.InvoiceService, cs models.CatalogueService, es models.EncounterService,
+	ps models.PatientService, us models.UserService, settings models.SettingsService, logger *logrus.Entry) *Invoices {
+	return &Invoices{
+		IndexView:   views.NewView("bootstrap", "invoices/index"),
+		NewView:     views.NewView("bootstrap", "invoices/new"),
+		ShowView:    views.NewView("bootstrap", "invoices/show", "invoices/sheet"),
+		PrintView:   views.NewView("print", "invoices/print", "invoices/sheet"),
+		ReceiptView: views.NewView("print", "invoices/receipt"),
+		ReportView:  views.NewView("bootstrap", "invoices/report"),
+		is:          is,
+		cs:          cs,
+		es:          es,
+		ps:          ps,
+		us:          us,
+		settings:    settings,
+		logger:      logger,
+	}
+}
+
+type InvoiceForm struct {
+	Lines []InvoiceLineForm `schema:"lines"`
+	Notes string            `schema:"notes"`
+	// Items are the services offered, every one gets a row of the form.
+	Items     []models.CatalogueItem `schema:"-"`
+	Encounter *models.Encounter      `schema:"-"`
+	Patient   *models.Patient        `schema:"-"`
+	Physician *models.User           `schema:"-"`
+}
+
+type InvoiceLineForm struct {
+	Item     string `schema:"item"`
+	Quantity int    `schema:"quantity"`
+	// Discount is entered in rupees, like 50.
+	Discount string `schema:"discount"`
+}
+
+// InvoiceFormRow is a service of the catalogue with the quantity and discount entered for it.
+type InvoiceFormRow struct {
+	Index int
+	Item  models.CatalogueItem
+	Line  InvoiceLineForm
+}
+
+// Rows returns a row for every service offered, with the values submitted before.
+func (f *InvoiceForm) Rows() []InvoiceFormRow {
+	rows := make([]InvoiceFormRow, len(f.Items))
+	for i, item := range f.Items {
+		rows[i] = InvoiceFormRow{Index: i, Item: item}
+		if i < len(f.Lines) && f.Lines[i].Item == item.Id.Hex() {
+			rows[i].Line = f.Lines[i]
+		}
+	}
+	return rows
+}
+
+// lines returns the lines of the invoice entered in the form.
+func (f *InvoiceForm) lines() ([]models.InvoiceLine, error) {
+	var lines []models.InvoiceLine
+	for _, l := range f.Lines {
+		if l.Quantity == 0 {
+			continue
+		}
+		if !bson.IsObjectIdHex(l.Item) {
+			return nil, models.ErrInvoiceItemInvalid
+		}
+		discount, err := models.ParseMoney(l.Discount)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, models.InvoiceLine{
+			ItemId:   bson.ObjectIdHex(l.Item),
+			Quantity: l.Quantity,
+			Discount: discount,
+		})
+	}
+	return lines, nil
+}
+
+type InvoiceData struct {
+	Invoice   *models.Invoice
+	Patient   *models.Patient
+	Encounter *models.Encounter
+	Clinic    *models.ClinicSettings
+	Payments  []models.Payment
+	// Receivers are the names of the users who received the payments, by their id.
+	Receivers map[bson.ObjectId]string
+	// CanCancel is true for admins while nothing was paid.
+	CanCancel bool
+}
+
+// MethodOptions are the choices of the payment method select field.
+func (d *InvoiceData) MethodOptions() []models.PaymentMethod {
+	return models.PaymentMethodsList()
+}
+
+// ReceivedBy returns the name of the user who received the payment.
+func (d *InvoiceData) ReceivedBy(payment models.Payment) string {
+	return d.Receivers[payment.ReceivedBy]
+}
+
+type InvoiceIndexData struct {
+	Day      time.Time
+	Invoices []models.Invoice
+	Patients map[bson.ObjectId]models.Patient
+}
+
+// PatientName returns the name and medical record number of the patient with the id.
+func (d *InvoiceIndexData) PatientName(id bson.ObjectId) string {
+	return patientName(d.Patients, id)
+}
+
+// Date is the value of the date input.
+func (d *InvoiceIndexData) Date() string {
+	return d.Day.Format(dateFormat)
+}
+
+// Total returns the sum of the invoices which are not cancelled.
+func (d *InvoiceIndexData) Total() models.Money {
+	var sum models.Money
+	for _, invoice := range d.Invoices {
+		if !invoice.Cancelled {
+			sum += invoice.Total
+		}
+	}
+	return sum
+}
+
+// Index lists the invoices of a day, today by default.
+// GET /invoices?date=:date
+func (i *Invoices) Index(w http.ResponseWriter, r *http.Request) {
+	day := dayParam(r)
+	var vd views.Data
+	data := InvoiceIndexData{Day: day, Patients: make(map[bson.ObjectId]models.Patient)}
+	vd.Yield = &data
+	var err error
+	if data.Invoices, err = i.is.ByDay(day); err != nil {
+		i.logger.Errorf("Error while fetching the invoices of %s: %v", day.Format(dateFormat), err)
+		vd.SetAlert(err)
+	}
+	for _, invoice := range data.Invoices {
+		if patient, err := i.ps.ById(invoice.PatientId.Hex()); err == nil {
+			data.Patients[patient.Id] = *patient
+		}
+	}
+	i.IndexView.Render(w, r, vd)
+}
+
+// New renders the form to bill the encounter with the services of the catalogue.
+// GET /encounters/:id/invoices/new
+func (i *Invoices) New(w http.ResponseWriter, r *http.Request) {
+	encounter, err := i.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	i.renderNew(w, r, &InvoiceForm{Encounter: encounter}, nil)
+}
+
+// Create bills the encounter.
+// POST /encounters/:id/invoices
+func (i *Invoices) Create(w http.ResponseWriter, r *http.Request) {
+	encounter, err := i.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	form := InvoiceForm{Encounter: encounter}
+	if err := parseForm(r, &form); err != nil {
+		i.logger.Errorln(err)
+		i.renderNew(w, r, &form, err)
+		return
+	}
+	lines, err := form.lines()
+	if err != nil {
+		i.renderNew(w, r, &form, err)
+		return
+	}
+	invoice := models.Invoice{
+		EncounterId: encounter.Id,
+		Lines:       lines,
+		Notes:       form.Notes,
+		CreatedBy:   context.User(r.Context()).Id,
+	}
+	if err := i.is.Create(&invoice); err != nil {
+		i.renderNew(w, r, &form, err)
+		return
+	}
+	views.RedirectAlert(w, r, invoicePath(&invoice), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Invoice %s has been created.", invoice.Number),
+	})
+}
+
+func (i *Invoices) renderNew(w http.ResponseWriter, r *http.Request, form *InvoiceForm, alert error) {
+	var vd views.Data
+	vd.Yield = form
+	items, err := i.cs.All()
+	if err != nil {
+		i.logger.Errorf("Error while fetching the catalogue: %v", err)
+		vd.SetAlert(err)
+	}
+	for _, item := range items {
+		if item.Active {
+			form.Items = append(form.Items, item)
+		}
+	}
+	if form.Patient, err = i.ps.ById(form.Encounter.PatientId.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching patient of encounter %s: %v", form.Encounter.Id.Hex(), err)
+		form.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if form.Physician, err = i.us.ById(form.Encounter.PhysicianId.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching physician of encounter %s: %v", form.Encounter.Id.Hex(), err)
+		form.Physician = &models.User{Name: "Unknown physician"}
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	i.NewView.Render(w, r, vd)
+}
+
+// Show renders an invoice with its payments and the form to record a payment.
+// GET /invoices/:id
+func (i *Invoices) Show(w http.ResponseWriter, r *http.Request) {
+	i.render(w, r, i.ShowView)
+}
+
+// Print renders the printable invoice, addressed to the billing address of the patient.
+// GET /invoices/:id/print
+func (i *Invoices) Print(w http.ResponseWriter, r *http.Request) {
+	i.render(w, r, i.PrintView)
+}
+
+func (i *Invoices) render(w http.ResponseWriter, r *http.Request, view *views.View) {
+	invoice, err := i.invoiceByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	var vd views.Data
+	data := InvoiceData{
+		Invoice:   invoice,
+		Receivers: make(map[bson.ObjectId]string),
+		CanCancel: user.HasRole(models.UserRoleAdmin) && invoice.Paid == 0 && !invoice.Cancelled,
+	}
+	vd.Yield = &data
+	if data.Patient, err = i.ps.ById(invoice.PatientId.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching patient of invoice %s: %v", invoice.Number, err)
+		data.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if data.Encounter, err = i.es.ById(invoice.EncounterId.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching encounter of invoice %s: %v", invoice.Number, err)
+		data.Encounter = &models.Encounter{}
+	}
+	if data.Clinic, err = i.settings.Clinic(); err != nil {
+		i.logger.Errorf("Error while fetching clinic settings: %v", err)
+		data.Clinic = &models.ClinicSettings{}
+	}
+	if data.Payments, err = i.is.Payments(invoice.Id.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching payments of invoice %s: %v", invoice.Number, err)
+		vd.SetAlert(err)
+	}
+	for _, p := range data.Payments {
+		if _, ok := data.Receivers[p.ReceivedBy]; !ok {
+			data.Receivers[p.ReceivedBy] = i.userName(p.ReceivedBy)
+		}
+	}
+	view.Render(w, r, vd)
+}
+
+type PaymentForm struct {
+	// Amount is entered in rupees, like 250.50.
+	Amount    string               `schema:"amount"`
+	Method    models.PaymentMethod `schema:"method"`
+	Reference string               `schema:"reference"`
+}
+
+// Pay records a payment of the invoice. Invoices can be paid in parts.
+// POST /invoices/:id/payments
+func (i *Invoices) Pay(w http.ResponseWriter, r *http.Request) {
+	invoice, err := i.invoiceByID(w, r)
+	if err != nil {
+		return
+	}
+	path := invoicePath(invoice)
+	var form PaymentForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	amount, err := models.ParseMoney(form.Amount)
+	if err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	payment := models.Payment{
+		Amount:     amount,
+		Method:     form.Method,
+		Reference:  form.Reference,
+		ReceivedBy: context.User(r.Context()).Id,
+	}
+	if err := i.is.Pay(invoice, &payment); err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Payment of ₹ %s received, receipt %s.", payment.Amount, payment.ReceiptNumber),
+	})
+}
+
+// Cancel cancels an invoice without payments, for example to bill the encounter again.
+// POST /invoices/:id/cancel
+func (i *Invoices) Cancel(w http.ResponseWriter, r *http.Request) {
+	invoice, err := i.invoiceByID(w, r)
+	if err != nil {
+		return
+	}
+	path := invoicePath(invoice)
+	if err := i.is.Cancel(invoice, r.FormValue("reason"), context.User(r.Context())); err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Invoice %s has been cancelled.", invoice.Number),
+	})
+}
+
+type ReceiptData struct {
+	Payment    *models.Payment
+	Invoice    *models.Invoice
+	Patient    *models.Patient
+	Clinic     *models.ClinicSettings
+	ReceivedBy string
+}
+
+// Receipt renders the printable receipt of a payment.
+// GET /payments/:id/receipt
+func (i *Invoices) Receipt(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	payment, err := i.is.Payment(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Payment not found", http.StatusNotFound)
+		default:
+			i.logger.Errorf("Error while fetching payment %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return
+	}
+	var vd views.Data
+	data := ReceiptData{Payment: payment, ReceivedBy: i.userName(payment.ReceivedBy)}
+	vd.Yield = &data
+	if data.Invoice, err = i.is.ById(payment.InvoiceId.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching invoice of payment %s: %v", payment.ReceiptNumber, err)
+		data.Invoice = &models.Invoice{}
+	}
+	if data.Patient, err = i.ps.ById(payment.PatientId.Hex()); err != nil {
+		i.logger.Errorf("Error while fetching patient of payment %s: %v", payment.ReceiptNumber, err)
+		data.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if data.Clinic, err = i.settings.Clinic(); err != nil {
+		i.logger.Errorf("Error while fetching clinic settings: %v", err)
+		data.Clinic = &models.ClinicSettings{}
+	}
+	i.ReceiptView.Render(w, r, vd)
+}
+
+type CashReportData struct {
+	Report   *models.CashReport
+	Patients map[bson.ObjectId]models.Patient
+	// Receivers are the names of the users who received the payments, by their id.
+	Receivers map[bson.ObjectId]string
+}
+
+// Date is the value of the date input.
+func (d *CashReportData) Date() string {
+	return d.Report.Day.Format(dateFormat)
+}
+
+// PatientName returns the name and medical record number of the patient with the id.
+func (d *CashReportData) PatientName(id bson.ObjectId) string {
+	return patientName(d.Patients, id)
+}
+
+// ReceivedBy returns the name of the user who received the payment.
+func (d *CashReportData) ReceivedBy(payment models.Payment) string {
+	return d.Receivers[payment.ReceivedBy]
+}
+
+// Report renders the payments received on a day by method, for closing the cash register.
+// GET /invoices/report?date=:date
+func (i *Invoices) Report(w http.ResponseWriter, r *http.Request) {
+	day := dayParam(r)
+	report, err := i.is.CashReport(day)
+	if err != nil {
+		i.logger.Errorf("Error while fetching the payments of %s: %v", day.Format(dateFormat), err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	data := CashReportData{
+		Report:    report,
+		Patients:  make(map[bson.ObjectId]models.Patient),
+		Receivers: make(map[bson.ObjectId]string),
+	}
+	vd.Yield = &data
+	for _, p := range report.Payments {
+		if _, ok := data.Patients[p.PatientId]; !ok {
+			if patient, err := i.ps.ById(p.PatientId.Hex()); err == nil {
+				data.Patients[patient.Id] = *patient
+			}
+		}
+		if _, ok := data.Receivers[p.ReceivedBy]; !ok {
+			data.Receivers[p.ReceivedBy] = i.userName(p.ReceivedBy)
+		}
+	}
+	i.ReportView.Render(w, r, vd)
+}
+
+// userName returns the name of the user with the id, for lists of payments.
+func (i *Invoices) userName(id bson.ObjectId) string {
+	if !id.Valid() {
+		return ""
+	}
+	user, err := i.us.ById(id.Hex())
+	if err != nil {
+		i.logger.Errorf("Error while fetching user %s: %v", id.Hex(), err)
+		return "Unknown user"
+	}
+	return user.Name
+}
+
+// encounterByID fetches the encounter with the id from the request path.
+// If an error is returned, the response has already been written.
+func (i *Invoices) encounterByID(w http.ResponseWriter, r *http.Request) (*models.Encounter, error) {
+	id := mux.Vars(r)["id"]
+	encounter, err := i.es.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Encounter not found", http.StatusNotFound)
+		default:
+			i.logger.Errorf("Error while fetching encounter %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return encounter, nil
+}
+
+// invoiceByID fetches the invoice with the id from the request path.
+// If an error is returned, the response has already been written.
+func (i *Invoices) invoiceByID(w http.ResponseWriter, r *http.Request) (*models.Invoice, error) {
+	id := mux.Vars(r)["id"]
+	invoice, err := i.is.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Invoice not found", http.StatusNotFound)
+		default:
+			i.logger.Errorf("Error while fetching invoice %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return invoice, nil
+}
+
+func invoicePath(invoice *models.Invoice) string {
+	return "/invoices/" + invoice.Id.Hex()
+}
+
+// dayParam returns the day of the date query parameter, today if it is missing or invalid.
+func dayParam(r *http.Request) time.Time {
+	day, err := time.ParseInLocation(dateFormat, r.URL.Query().Get("date"), time.Local)
+	if err != nil {
+		return models.StartOfDay(time.Now())
+	}
+	return day
+}
+
+// patientName returns the name and medical record number of the patient with the id.
+func patientName(patients map[bson.ObjectId]models.Patient, id bson.ObjectId) string {
+	p, ok := patients[id]
+	if !ok {
+		return "Unknown patient"
+	}
+	return fmt.Sprintf("%s (%s)", p.FullName(), p.MRN)
+}
+
+// canBill reports whether the user may bill encounters and record payments: reception and admins.
+func canBill(user *models.User) bool {
+	return user != nil && user.HasRole(models.UserRoleAdmin, models.UserRoleReception)
+}
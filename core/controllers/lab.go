@@ -0,0 +1,448 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// maxLabImportSize is the largest CSV file of results accepted, in bytes.
+const maxLabImportSize = 5 << 20
+
+// Lab lets physicians order lab tests during encounters and staff enter or import their results.
+type Lab struct {
+	NewView     *views.View
+	IndexView   *views.View
+	ShowView    *views.View
+	PatientView *views.View
+	ImportView  *views.View
+	ls          models.LabService
+	cs          models.ChartService
+	es          models.EncounterService
+	ps          models.PatientService
+	us          models.UserService
+	logger      *logrus.Entry
+}
+
+func NewLab(ls models.LabService, cs models.ChartService, es models.EncounterService, ps models.PatientService,
+	us models.UserService, logger *logrus.Entry) *Lab {
+	return &Lab{
+		NewView:     views.NewView("bootstrap", "lab/new", "chart/summary"),
+		IndexView:   views.NewView("bootstrap", "lab/index", "lab/parts"),
+		ShowView:    views.NewView("bootstrap", "lab/show", "lab/parts"),
+		PatientView: views.NewView("bootstrap", "lab/patient", "lab/parts"),
+		ImportView:  views.NewView("bootstrap", "lab/import"),
+		ls:          ls,
+		cs:          cs,
+		es:          es,
+		ps:          ps,
+		us:          us,
+		logger:      logger,
+	}
+}
+
+type LabOrderForm struct {
+	Tests     []string          `schema:"tests"`
+	Notes     string            `schema:"notes"`
+	Options   []models.LabTest  `schema:"-"`
+	Encounter *models.Encounter `schema:"-"`
+	Patient   *models.Patient   `schema:"-"`
+	Chart     *models.Chart     `schema:"-"`
+}
+
+// Checked reports whether the test with the code is selected.
+func (f *LabOrderForm) Checked(code string) bool {
+	for _, t := range f.Tests {
+		if t == code {
+			return true
+		}
+	}
+	return false
+}
+
+// New renders the form to order lab tests during the encounter.
+// GET /encounters/:id/lab-orders/new
+func (l *Lab) New(w http.ResponseWriter, r *http.Request) {
+	encounter, err := l.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	form := LabOrderForm{Encounter: encounter}
+	l.renderNew(w, r, &form, nil)
+}
+
+// Create orders the selected lab tests.
+// POST /encounters/:id/lab-orders
+func (l *Lab) Create(w http.ResponseWriter, r *http.Request) {
+	encounter, err := l.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	form := LabOrderForm{Encounter: encounter}
+	if err := parseForm(r, &form); err != nil {
+		l.logger.Errorln(err)
+		l.renderNew(w, r, &form, err)
+		return
+	}
+	order := models.LabOrder{
+		EncounterId: encounter.Id,
+		PhysicianId: prescriber(context.User(r.Context()), encounter),
+		Notes:       form.Notes,
+	}
+	for _, code := range form.Tests {
+		order.Tests = append(order.Tests, models.LabOrderTest{Code: code})
+	}
+	if err := l.ls.Create(&order); err != nil {
+		l.renderNew(w, r, &form, err)
+		return
+	}
+	views.RedirectAlert(w, r, labOrderPath(&order), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Lab order " + order.Number + " has been placed.",
+	})
+}
+
+func (l *Lab) renderNew(w http.ResponseWriter, r *http.Request, form *LabOrderForm, alert error) {
+	var vd views.Data
+	vd.Yield = form
+	form.Options = l.ls.Tests().All()
+	var err error
+	if form.Patient, err = l.ps.ById(form.Encounter.PatientId.Hex()); err != nil {
+		l.logger.Errorf("Error while fetching patient of encounter %s: %v", form.Encounter.Id.Hex(), err)
+		form.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if form.Chart, err = l.cs.Chart(form.Encounter.PatientId.Hex()); err != nil {
+		l.logger.Errorf("Error while fetching the chart of patient %s: %v", form.Encounter.PatientId.Hex(), err)
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	l.NewView.Render(w, r, vd)
+}
+
+type LabIndexData struct {
+	Orders   []models.LabOrder
+	Patients map[bson.ObjectId]models.Patient
+}
+
+// PatientName returns the name and medical record number of the patient with the id.
+func (d *LabIndexData) PatientName(id bson.ObjectId) string {
+	return patientName(d.Patients, id)
+}
+
+// Index lists the orders waiting for results, oldest first.
+// GET /lab-orders
+func (l *Lab) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data := LabIndexData{Patients: make(map[bson.ObjectId]models.Patient)}
+	vd.Yield = &data
+	var err error
+	if data.Orders, err = l.ls.Pending(); err != nil {
+		l.logger.Errorf("Error while fetching pending lab orders: %v", err)
+		vd.SetAlert(err)
+	}
+	for _, o := range data.Orders {
+		if _, ok := data.Patients[o.PatientId]; ok {
+			continue
+		}
+		if p, err := l.ps.ById(o.PatientId.Hex()); err == nil {
+			data.Patients[o.PatientId] = *p
+		} else {
+			l.logger.Errorf("Error while fetching patient of lab order %s: %v", o.Number, err)
+		}
+	}
+	l.IndexView.Render(w, r, vd)
+}
+
+// LabResultRow is an analyte of an order with its result, or a field to enter it.
+type LabResultRow struct {
+	Index   int
+	Analyte models.LabAnalyte
+	Result  *models.LabResult
+	Value   string
+}
+
+type LabOrderData struct {
+	Order     *models.LabOrder
+	Patient   *models.Patient
+	Physician *models.User
+	Rows      []LabResultRow
+	// Collected is the time of collection entered in the form.
+	Collected string
+	// CanEnter is true for clinical staff while analytes are missing results.
+	CanEnter bool
+}
+
+type LabResultsForm struct {
+	Collected string               `schema:"collected"`
+	Results   []LabResultFieldForm `schema:"results"`
+}
+
+type LabResultFieldForm struct {
+	Analyte string `schema:"analyte"`
+	Value   string `schema:"value"`
+}
+
+// results returns the results with a value, collected at the time of the form.
+func (f *LabResultsForm) results() ([]models.LabResult, error) {
+	var collected time.Time
+	if f.Collected != "" {
+		var err error
+		if collected, err = time.ParseInLocation(dateTimeFormat, f.Collected, time.Local); err != nil {
+			return nil, models.ErrLabCollectedFormat
+		}
+	}
+	var results []models.LabResult
+	for _, field := range f.Results {
+		value := strings.TrimSpace(field.Value)
+		if value == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, models.ErrLabValueInvalid
+		}
+		results = append(results, models.LabResult{AnalyteCode: field.Analyte, Value: v, Collected: collected})
+	}
+	return results, nil
+}
+
+// Show renders the order with its results and a form to enter the missing ones.
+// GET /lab-orders/:id
+func (l *Lab) Show(w http.ResponseWriter, r *http.Request) {
+	order, err := l.orderByID(w, r)
+	if err != nil {
+		return
+	}
+	l.renderShow(w, r, order, LabResultsForm{Collected: time.Now().Format(dateTimeFormat)}, nil)
+}
+
+// Results saves the results entered for the order.
+// POST /lab-orders/:id/results
+func (l *Lab) Results(w http.ResponseWriter, r *http.Request) {
+	order, err := l.orderByID(w, r)
+	if err != nil {
+		return
+	}
+	var form LabResultsForm
+	if err := parseForm(r, &form); err != nil {
+		l.logger.Errorln(err)
+		l.renderShow(w, r, order, form, err)
+		return
+	}
+	results, err := form.results()
+	if err != nil {
+		l.renderShow(w, r, order, form, err)
+		return
+	}
+	if err := l.ls.RecordResults(order, results, context.User(r.Context())); err != nil {
+		l.renderShow(w, r, order, form, err)
+		return
+	}
+	views.RedirectAlert(w, r, labOrderPath(order), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The results have been saved.",
+	})
+}
+
+func (l *Lab) renderShow(w http.ResponseWriter, r *http.Request, order *models.LabOrder, form LabResultsForm,
+	alert error) {
+	var vd views.Data
+	data := LabOrderData{Order: order, Collected: form.Collected}
+	vd.Yield = &data
+	results, err := l.ls.OrderResults(order.Id.Hex())
+	if err != nil {
+		l.logger.Errorf("Error while fetching results of lab order %s: %v", order.Number, err)
+		vd.SetAlert(err)
+	}
+	entered := make(map[string]string)
+	for _, f := range form.Results {
+		entered[f.Analyte] = f.Value
+	}
+	for i, a := range l.ls.Tests().Ordered(order) {
+		row := LabResultRow{Index: i, Analyte: a, Value: entered[a.Code]}
+		for j := range results {
+			if results[j].AnalyteCode == a.Code {
+				row.Result = &results[j]
+			}
+		}
+		if row.Result == nil {
+			data.CanEnter = canViewEncounters(context.User(r.Context()))
+		}
+		data.Rows = append(data.Rows, row)
+	}
+	if data.Patient, err = l.ps.ById(order.PatientId.Hex()); err != nil {
+		l.logger.Errorf("Error while fetching patient of lab order %s: %v", order.Number, err)
+		data.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if data.Physician, err = l.us.ById(order.PhysicianId.Hex()); err != nil {
+		l.logger.Errorf("Error while fetching physician of lab order %s: %v", order.Number, err)
+		data.Physician = &models.User{Name: "Unknown physician"}
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	l.ShowView.Render(w, r, vd)
+}
+
+// LabTrend is the history of one analyte of a patient.
+type LabTrend struct {
+	Analyte models.LabAnalyte
+	// Results are the results of the analyte, newest first.
+	Results []models.LabResult
+	Chart   *TrendChart
+}
+
+// Latest returns the newest result.
+func (t *LabTrend) Latest() *models.LabResult {
+	return &t.Results[0]
+}
+
+type LabPatientData struct {
+	Patient *models.Patient
+	Orders  []models.LabOrder
+	Trends  []LabTrend
+}
+
+// Patient renders the results of the patient with a trend chart per analyte, in the order of the lab tests.
+// GET /patients/:id/lab
+func (l *Lab) Patient(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, l.ps, l.logger)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	data := LabPatientData{Patient: patient}
+	vd.Yield = &data
+	if data.Orders, err = l.ls.ByPatient(patient.Id.Hex()); err != nil {
+		l.logger.Errorf("Error while fetching lab orders of patient %s: %v", patient.MRN, err)
+		vd.SetAlert(err)
+	}
+	results, err := l.ls.Results(patient.Id.Hex())
+	if err != nil {
+		l.logger.Errorf("Error while fetching lab results of patient %s: %v", patient.MRN, err)
+		vd.SetAlert(err)
+	}
+	byAnalyte := make(map[string][]models.LabResult)
+	for _, res := range results {
+		byAnalyte[res.AnalyteCode] = append(byAnalyte[res.AnalyteCode], res)
+	}
+	for _, test := range l.ls.Tests().All() {
+		for _, a := range test.Analytes {
+			if len(byAnalyte[a.Code]) > 0 {
+				data.Trends = append(data.Trends, newLabTrend(a, byAnalyte[a.Code]))
+			}
+		}
+	}
+	l.PatientView.Render(w, r, vd)
+}
+
+// newLabTrend charts the results, which are sorted oldest first, against the range of the newest result.
+func newLabTrend(analyte models.LabAnalyte, results []models.LabResult) LabTrend {
+	values := make([]ChartValue, len(results))
+	for i, res := range results {
+		values[i] = ChartValue{
+			Time:    res.Collected,
+			Value:   res.Value,
+			Label:   res.Collected.Format("02 Jan 2006") + ": " + res.ValueString() + " " + res.Unit,
+			Flagged: res.Flag != "",
+		}
+	}
+	latest := results[len(results)-1]
+	trend := LabTrend{
+		Analyte: analyte,
+		Chart:   newTrendChart(values, latest.Low, latest.High),
+	}
+	for i := len(results) - 1; i >= 0; i-- {
+		trend.Results = append(trend.Results, results[i])
+	}
+	return trend
+}
+
+type LabImportData struct {
+	Report *models.LabImport
+}
+
+// ImportForm renders the form to upload a CSV file of results.
+// GET /lab/import
+func (l *Lab) ImportForm(w http.ResponseWriter, r *http.Request) {
+	l.ImportView.Render(w, r, &LabImportData{})
+}
+
+// Import saves the results of an uploaded CSV file and reports the lines which could not be imported.
+// POST /lab/import
+func (l *Lab) Import(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data := LabImportData{}
+	vd.Yield = &data
+	r.Body = http.MaxBytesReader(w, r.Body, maxLabImportSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		l.logger.Errorf("Error while reading uploaded lab results: %v", err)
+		vd.SetAlert(models.ErrLabImportColumns)
+		l.ImportView.Render(w, r, vd)
+		return
+	}
+	defer file.Close()
+	if data.Report, err = l.ls.Import(file, context.User(r.Context())); err != nil {
+		l.logger.Errorf("Error while importing lab results: %v", err)
+		vd.SetAlert(err)
+		l.ImportView.Render(w, r, vd)
+		return
+	}
+	level, message := views.AlertLevelSuccess, "The results have been imported."
+	if len(data.Report.Errors) > 0 {
+		level, message = views.AlertLevelWarning, "Some lines could not be imported, see below."
+	}
+	vd.Alert = &views.Alert{Level: level, Message: message}
+	l.ImportView.Render(w, r, vd)
+}
+
+// orderByID fetches the lab order with the id from the request path.
+// If an error is returned, the response has already been written.
+func (l *Lab) orderByID(w http.ResponseWriter, r *http.Request) (*models.LabOrder, error) {
+	id := mux.Vars(r)["id"]
+	order, err := l.ls.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Lab order not found", http.StatusNotFound)
+		default:
+			l.logger.Errorf("Error while fetching lab order %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+// encounterByID fetches the encounter with the id from the request path.
+// If an error is returned, the response has already been written.
+func (l *Lab) encounterByID(w http.ResponseWriter, r *http.Request) (*models.Encounter, error) {
+	id := mux.Vars(r)["id"]
+	encounter, err := l.es.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Encounter not found", http.StatusNotFound)
+		default:
+			l.logger.Errorf("Error while fetching encounter %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return encounter, nil
+}
+
+func labOrderPath(order *models.LabOrder) string {
+	return "/lab-orders/" + order.Id.Hex()
+}
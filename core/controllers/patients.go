@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+)
+
+// identifierRows is the number of identifier rows offered by the patient form.
+const identifierRows = 3
+
+// Patients is the patient registry used by reception staff.
+type Patients struct {
+	IndexView *views.View
+	NewView   *views.View
+	ShowView  *views.View
+	EditView  *views.View
+	ps        models.PatientService
+	es        models.EncounterService
+	prs       models.PrescriptionService
+	is        models.InvoiceService
+	logger    *logrus.Entry
+}
+
+func NewPatients(ps models.PatientService, es models.EncounterService, prs models.PrescriptionService,
+	is models.InvoiceService, logger *logrus.Entry) *Patients {
+	return &Patients{
+		IndexView: views.NewView("bootstrap", "patients/index"),
+		NewView:   views.NewView("bootstrap", "patients/new", "patients/form"),
+		ShowView:  views.NewView("bootstrap", "patients/show"),
+		EditView:  views.NewView("bootstrap", "patients/edit", "patients/form"),
+		ps:        ps,
+		es:        es,
+		prs:       prs,
+		is:        is,
+		logger:    logger,
+	}
+}
+
+type PatientForm struct {
+	MRN              string               `schema:"mrn"`
+	FirstName        string               `schema:"first_name"`
+	LastName         string               `schema:"last_name"`
+	DateOfBirth      string               `schema:"date_of_birth"`
+	Sex              models.Sex           `schema:"sex"`
+	BloodGroup       string               `schema:"blood_group"`
+	Occupation       string               `schema:"occupation"`
+	Contact          models.Contact       `schema:"contact"`
+	Address          models.Address       `schema:"address"`
+	BillingAddress   models.Address       `schema:"billing_address"`
+	Guardian         models.RelatedPerson `schema:"guardian"`
+	EmergencyContact models.RelatedPerson `schema:"emergency_contact"`
+	Identifiers      []models.Identifier  `schema:"identifiers"`
+	Notes            string               `schema:"notes"`
+	// Patient is nil when registering a new patient.
+	Patient *models.Patient `schema:"-"`
+}
+
+func newPatientForm(patient *models.Patient) PatientForm {
+	form := PatientForm{
+		MRN:              patient.MRN,
+		FirstName:        patient.FirstName,
+		LastName:         patient.LastName,
+		Sex:              patient.Sex,
+		BloodGroup:       patient.BloodGroup,
+		Occupation:       patient.Occupation,
+		Contact:          patient.Contact,
+		Guardian:         patient.Guardian,
+		EmergencyContact: patient.EmergencyContact,
+		Identifiers:      patient.Identifiers,
+		Notes:            patient.Notes,
+		Patient:          patient,
+	}
+	if !patient.DateOfBirth.IsZero() {
+		form.DateOfBirth = patient.DateOfBirth.Format(dateFormat)
+	}
+	if home := patient.Address(models.AddressTypeHome); home != nil {
+		form.Address = *home
+	}
+	if billing := patient.Address(models.AddressTypeBilling); billing != nil {
+		form.BillingAddress = *billing
+	}
+	return form
+}
+
+// Action is the path the form is submitted to.
+func (f *PatientForm) Action() string {
+	if f.Patient == nil {
+		return "/patients"
+	}
+	return patientPath(f.Patient) + "/update"
+}
+
+// SexOptions and IdentifierSystemOptions are the choices of the select fields of the form.
+func (f *PatientForm) SexOptions() []models.Sex {
+	return models.SexList()
+}
+
+func (f *PatientForm) IdentifierSystemOptions() []models.IdentifierSystem {
+	return models.IdentifierSystemsList()
+}
+
+// RelatedPersonFields is the data of the fields of a related person in the patient form.
+type RelatedPersonFields struct {
+	Prefix string
+	Person models.RelatedPerson
+}
+
+func (f *PatientForm) GuardianFields() RelatedPersonFields {
+	return RelatedPersonFields{Prefix: "guardian", Person: f.Guardian}
+}
+
+func (f *PatientForm) EmergencyContactFields() RelatedPersonFields {
+	return RelatedPersonFields{Prefix: "emergency_contact", Person: f.EmergencyContact}
+}
+
+// AddressFields is the data of the fields of an address in the patient form.
+type AddressFields struct {
+	Prefix  string
+	Address models.Address
+}
+
+func (f *PatientForm) HomeAddressFields() AddressFields {
+	return AddressFields{Prefix: "address", Address: f.Address}
+}
+
+func (f *PatientForm) BillingAddressFields() AddressFields {
+	return AddressFields{Prefix: "billing_address", Address: f.BillingAddress}
+}
+
+// IdentifierRows returns the identifiers of the form, padded with empty rows for new ones.
+func (f *PatientForm) IdentifierRows() []models.Identifier {
+	rows := append([]models.Identifier(nil), f.Identifiers...)
+	for len(rows) < identifierRows {
+		rows = append(rows, models.Identifier{})
+	}
+	return rows
+}
+
+// apply sets the fields of the form on the patient. The medical record number can only be set on registration.
+func (f *PatientForm) apply(patient *models.Patient) error {
+	patient.FirstName = f.FirstName
+	patient.LastName = f.LastName
+	patient.DateOfBirth = time.Time{}
+	if f.DateOfBirth != "" {
+		dob, err := time.Parse(dateFormat, f.DateOfBirth)
+		if err != nil {
+			return models.ErrDateOfBirthRequired
+		}
+		patient.DateOfBirth = dob
+	}
+	patient.Sex = f.Sex
+	patient.BloodGroup = strings.TrimSpace(f.BloodGroup)
+	patient.Occupation = strings.TrimSpace(f.Occupation)
+	patient.Contact = f.Contact
+	patient.Guardian = f.Guardian
+	patient.EmergencyContact = f.EmergencyContact
+	patient.Identifiers = f.Identifiers
+	patient.Notes = strings.TrimSpace(f.Notes)
+
+	f.Address.AddressType = models.AddressTypeHome
+	f.BillingAddress.AddressType = models.AddressTypeBilling
+	addresses := nonEmptyAddresses([]models.Address{f.Address, f.BillingAddress})
+	for _, a := range patient.Addresses {
+		if a.AddressType != models.AddressTypeHome && a.AddressType != models.AddressTypeBilling {
+			addresses = append(addresses, a)
+		}
+	}
+	patient.Addresses = addresses
+	return nil
+}
+
+type PatientSearchData struct {
+	Query    string
+	Patients []models.Patient
+	// CanRegister is true for users who can register and edit patients.
+	CanRegister bool
+}
+
+type PatientShowData struct {
+	Patient *models.Patient
+	CanEdit bool
+	// CanDelete is only true for admins.
+	CanDelete bool
+	// Encounters and prescriptions are only listed for clinical users, CanStartEncounter is true for physicians.
+	Encounters        []models.Encounter
+	Prescriptions     []models.Prescription
+	CanViewEncounters bool
+	CanStartEncounter bool
+	// CanRenew is true for physicians and admins.
+	CanRenew bool
+	// Invoices and the visits not billed yet are listed for reception and admins.
+	Invoices []models.Invoice
+	Unbilled []models.Encounter
+	CanBill  bool
+}
+
+// Index searches patients by name, medical record number, phone or identifier.
+// Without a query the most recently registered patients are listed.
+// GET /patients
+func (p *Patients) Index(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	var vd views.Data
+	data := PatientSearchData{
+		Query:       query,
+		CanRegister: canEditPatients(context.User(r.Context())),
+	}
+	vd.Yield = &data
+	patients, err := p.ps.Search(query, models.DefaultPatientSearchLimit)
+	if err != nil {
+		p.logger.Errorf("Error while searching patients for %q: %v", query, err)
+		vd.SetAlert(err)
+	}
+	data.Patients = patients
+	p.IndexView.Render(w, r, vd)
+}
+
+// New renders the registration form.
+// GET /patients/new
+func (p *Patients) New(w http.ResponseWriter, r *http.Request) {
+	form := PatientForm{}
+	p.NewView.Render(w, r, &form)
+}
+
+// Create registers a new patient.
+// POST /patients
+func (p *Patients) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form PatientForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		p.logger.Errorln(err)
+		vd.SetAlert(err)
+		p.NewView.Render(w, r, vd)
+		return
+	}
+	patient := models.Patient{
+		MRN: form.MRN,
+	}
+	if user := context.User(r.Context()); user != nil {
+		patient.RegisteredBy = user.Id
+	}
+	if err := form.apply(&patient); err != nil {
+		vd.SetAlert(err)
+		p.NewView.Render(w, r, vd)
+		return
+	}
+	if err := p.ps.Create(&patient); err != nil {
+		vd.SetAlert(err)
+		p.NewView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("%s has been registered with MRN %s.", patient.FullName(), patient.MRN),
+	}
+	views.RedirectAlert(w, r, patientPath(&patient), http.StatusFound, alert)
+}
+
+// Show renders the details of a patient.
+// GET /patients/:id
+func (p *Patients) Show(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, p.ps, p.logger)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	var vd views.Data
+	data := PatientShowData{
+		Patient:           patient,
+		CanEdit:           canEditPatients(user),
+		CanDelete:         user != nil && user.HasRole(models.UserRoleAdmin),
+		CanViewEncounters: canViewEncounters(user),
+		CanStartEncounter: user != nil && user.HasRole(models.UserRolePhysician),
+		CanRenew:          canAddend(user),
+		CanBill:           canBill(user),
+	}
+	vd.Yield = &data
+	var encounters []models.Encounter
+	if data.CanViewEncounters || data.CanBill {
+		if encounters, err = p.es.ByPatient(patient.Id.Hex()); err != nil {
+			p.logger.Errorf("Error while fetching encounters of patient %s: %v", patient.MRN, err)
+			vd.SetAlert(err)
+		}
+	}
+	if data.CanViewEncounters {
+		data.Encounters = encounters
+		if data.Prescriptions, err = p.prs.ByPatient(patient.Id.Hex()); err != nil {
+			p.logger.Errorf("Error while fetching prescriptions of patient %s: %v", patient.MRN, err)
+			vd.SetAlert(err)
+		}
+	}
+	if data.CanBill {
+		if data.Invoices, err = p.is.ByPatient(patient.Id.Hex()); err != nil {
+			p.logger.Errorf("Error while fetching invoices of patient %s: %v", patient.MRN, err)
+			vd.SetAlert(err)
+		}
+		data.Unbilled = unbilledEncounters(encounters, data.Invoices)
+	}
+	p.ShowView.Render(w, r, vd)
+}
+
+// Edit renders the form to change the details of a patient.
+// GET /patients/:id/edit
+func (p *Patients) Edit(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, p.ps, p.logger)
+	if err != nil {
+		return
+	}
+	form := newPatientForm(patient)
+	var vd views.Data
+	vd.Yield = &form
+	p.EditView.Render(w, r, vd)
+}
+
+// Update saves the changes to the details of a patient.
+// POST /patients/:id/update
+func (p *Patients) Update(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, p.ps, p.logger)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	form := PatientForm{Patient: patient}
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		p.logger.Errorln(err)
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	form.MRN = patient.MRN
+	if err := form.apply(patient); err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	if err := p.ps.Update(patient); err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("%s updated successfully.", patient.FullName()),
+	}
+	views.RedirectAlert(w, r, patientPath(patient), http.StatusFound, alert)
+}
+
+// Delete removes a patient registered by mistake, before any records like encounters were kept for the patient.
+// POST /patients/:id/delete
+func (p *Patients) Delete(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, p.ps, p.logger)
+	if err != nil {
+		return
+	}
+	if err := p.ps.Delete(patient.Id.Hex()); err != nil {
+		if err != models.ErrPatientHasRecords {
+			p.logger.Errorf("Error while deleting patient %s: %v", patient.MRN, err)
+		}
+		redirectError(w, r, patientPath(patient), err)
+		return
+	}
+	views.RedirectAlert(w, r, "/patients", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Patient %s (%s) has been deleted.", patient.FullName(), patient.MRN),
+	})
+}
+
+func patientPath(patient *models.Patient) string {
+	return "/patients/" + patient.Id.Hex()
+}
+
+// unbilledEncounters returns the encounters without an invoice which is not cancelled.
+func unbilledEncounters(encounters []models.Encounter, invoices []models.Invoice) []models.Encounter {
+	billed := make(map[bson.ObjectId]bool)
+	for _, invoice := range invoices {
+		if !invoice.Cancelled {
+			billed[invoice.EncounterId] = true
+		}
+	}
+	var unbilled []models.Encounter
+	for _, e := range encounters {
+		if !billed[e.Id] {
+			unbilled = append(unbilled, e)
+		}
+	}
+	return unbilled
+}
+
+// canEditPatients reports whether the user may register patients and change their details.
+func canEditPatients(user *models.User) bool {
+	return user != nil && user.HasRole(models.UserRoleAdmin, models.UserRoleReception)
+}
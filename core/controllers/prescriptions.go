@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"net/http"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// medicationRows is the minimum number of medication rows offered by the prescription form.
+const medicationRows = 5
+
+// Prescriptions are written by physicians during encounters and printed for the patient.
+type Prescriptions struct {
+	NewView   *views.View
+	ShowView  *views.View
+	PrintView *views.View
+	prs       models.PrescriptionService
+	cs        models.ChartService
+	es        models.EncounterService
+	ps        models.PatientService
+	us        models.UserService
+	settings  models.SettingsService
+	logger    *logrus.Entry
+}
+
+func NewPrescriptions(prs models.PrescriptionService, cs models.ChartService, es models.EncounterService,
+	ps models.PatientService, us models.UserService, settings models.SettingsService, logger *logrus.Entry) *Prescriptions {
+	return &Prescriptions{
+		NewView:   views.NewView("bootstrap", "prescriptions/new", "chart/summary"),
+		ShowView:  views.NewView("bootstrap", "prescriptions/show", "prescriptions/sheet", "chart/summary"),
+		PrintView: views.NewView("print", "prescriptions/print", "prescriptions/sheet"),
+		prs:       prs,
+		cs:        cs,
+		es:        es,
+		ps:        ps,
+		us:        us,
+		settings:  settings,
+		logger:    logger,
+	}
+}
+
+type PrescriptionForm struct {
+	Medications []models.Medication `schema:"medications"`
+	Notes       string              `schema:"notes"`
+	// Acknowledge is set when the physician has seen the allergy warnings and prescribes anyway.
+	Acknowledge bool                    `schema:"acknowledge"`
+	Warnings    []models.AllergyWarning `schema:"-"`
+	Encounter   *models.Encounter       `schema:"-"`
+	Patient     *models.Patient         `schema:"-"`
+	Chart       *models.Chart           `schema:"-"`
+}
+
+// MedicationRows returns the medications of the form, padded with empty rows for new ones.
+func (f *PrescriptionForm) MedicationRows() []models.Medication {
+	rows := append([]models.Medication(nil), f.Medications...)
+	for len(rows) < medicationRows {
+		rows = append(rows, models.Medication{})
+	}
+	return rows
+}
+
+// RouteOptions are the choices of the route select fields.
+func (f *PrescriptionForm) RouteOptions() []models.Route {
+	return models.RoutesList()
+}
+
+type PrescriptionData struct {
+	Prescription *models.Prescription
+	Patient      *models.Patient
+	Physician    *models.User
+	Clinic       *models.ClinicSettings
+	CanRenew     bool
+	// Warnings are the allergies of the patient the medications match, checked again on renewal.
+	Warnings []models.AllergyWarning
+}
+
+// MedicationLine is a numbered line of a printed prescription.
+type MedicationLine struct {
+	Number int
+	models.Medication
+}
+
+// Lines returns the medications of the prescription numbered from one.
+func (d *PrescriptionData) Lines() []MedicationLine {
+	lines := make([]MedicationLine, len(d.Prescription.Medications))
+	for i, m := range d.Prescription.Medications {
+		lines[i] = MedicationLine{Number: i + 1, Medication: m}
+	}
+	return lines
+}
+
+// HomeAddress returns the home address of the patient, or nil.
+func (d *PrescriptionData) HomeAddress() *models.Address {
+	return d.Patient.Address(models.AddressTypeHome)
+}
+
+// New renders the form to write a prescription during the encounter.
+// GET /encounters/:id/prescriptions/new
+func (p *Prescriptions) New(w http.ResponseWriter, r *http.Request) {
+	encounter, err := p.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	form := PrescriptionForm{Encounter: encounter}
+	p.renderNew(w, r, &form, nil)
+}
+
+// Create writes a prescription during the encounter.
+// POST /encounters/:id/prescriptions
+func (p *Prescriptions) Create(w http.ResponseWriter, r *http.Request) {
+	encounter, err := p.encounterByID(w, r)
+	if err != nil {
+		return
+	}
+	form := PrescriptionForm{Encounter: encounter}
+	if err := parseForm(r, &form); err != nil {
+		p.logger.Errorln(err)
+		p.renderNew(w, r, &form, err)
+		return
+	}
+	prescription := models.Prescription{
+		EncounterId: encounter.Id,
+		PhysicianId: prescriber(context.User(r.Context()), encounter),
+		Medications: form.Medications,
+		Notes:       form.Notes,
+	}
+	form.Warnings = p.allergyWarnings(encounter.PatientId, form.Medications)
+	if len(form.Warnings) > 0 && !form.Acknowledge {
+		p.renderNew(w, r, &form, nil)
+		return
+	}
+	if err := p.prs.Create(&prescription); err != nil {
+		p.renderNew(w, r, &form, err)
+		return
+	}
+	if len(form.Warnings) > 0 {
+		p.logger.Warnf("Prescription %s written despite %d allergy warnings", prescription.Id.Hex(), len(form.Warnings))
+	}
+	views.RedirectAlert(w, r, prescriptionPath(&prescription), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The prescription has been written.",
+	})
+}
+
+func (p *Prescriptions) renderNew(w http.ResponseWriter, r *http.Request, form *PrescriptionForm, alert error) {
+	var vd views.Data
+	vd.Yield = form
+	var err error
+	if form.Patient, err = p.ps.ById(form.Encounter.PatientId.Hex()); err != nil {
+		p.logger.Errorf("Error while fetching patient of encounter %s: %v", form.Encounter.Id.Hex(), err)
+		form.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if form.Chart, err = p.cs.Chart(form.Encounter.PatientId.Hex()); err != nil {
+		p.logger.Errorf("Error while fetching the chart of patient %s: %v", form.Encounter.PatientId.Hex(), err)
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	} else if len(form.Warnings) > 0 {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: allergyAlert(form.Warnings, "prescribing"),
+		}
+	}
+	p.NewView.Render(w, r, vd)
+}
+
+// Show renders a prescription with a preview of its printout.
+// GET /prescriptions/:id
+func (p *Prescriptions) Show(w http.ResponseWriter, r *http.Request) {
+	p.render(w, r, p.ShowView)
+}
+
+// Print renders the printable prescription with the header of the clinic.
+// GET /prescriptions/:id/print
+func (p *Prescriptions) Print(w http.ResponseWriter, r *http.Request) {
+	p.render(w, r, p.PrintView)
+}
+
+func (p *Prescriptions) render(w http.ResponseWriter, r *http.Request, view *views.View) {
+	prescription, err := p.prescriptionByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	data := PrescriptionData{
+		Prescription: prescription,
+		CanRenew:     canAddend(context.User(r.Context())),
+	}
+	vd.Yield = &data
+	if data.Patient, err = p.ps.ById(prescription.PatientId.Hex()); err != nil {
+		p.logger.Errorf("Error while fetching patient of prescription %s: %v", prescription.Id.Hex(), err)
+		data.Patient = &models.Patient{FirstName: "Unknown patient"}
+	}
+	if data.Physician, err = p.us.ById(prescription.PhysicianId.Hex()); err != nil {
+		p.logger.Errorf("Error while fetching physician of prescription %s: %v", prescription.Id.Hex(), err)
+		data.Physician = &models.User{Name: "Unknown physician"}
+	}
+	if data.Clinic, err = p.settings.Clinic(); err != nil {
+		p.logger.Errorf("Error while fetching clinic settings: %v", err)
+		data.Clinic = &models.ClinicSettings{}
+	}
+	if data.CanRenew {
+		data.Warnings = p.allergyWarnings(prescription.PatientId, prescription.Medications)
+	}
+	view.Render(w, r, vd)
+}
+
+// RenewForm confirms a renewal despite allergy warnings.
+type RenewForm struct {
+	Acknowledge bool `schema:"acknowledge"`
+}
+
+// Renew writes a new prescription with the same medications, prescribed by the signed in physician.
+// POST /prescriptions/:id/renew
+func (p *Prescriptions) Renew(w http.ResponseWriter, r *http.Request) {
+	prescription, err := p.prescriptionByID(w, r)
+	if err != nil {
+		return
+	}
+	physician := context.User(r.Context())
+	if !physician.HasRole(models.UserRolePhysician) {
+		// Admins renew on behalf of the physician of the original prescription.
+		if physician, err = p.us.ById(prescription.PhysicianId.Hex()); err != nil {
+			p.logger.Errorf("Error while fetching physician of prescription %s: %v", prescription.Id.Hex(), err)
+			redirectError(w, r, prescriptionPath(prescription), err)
+			return
+		}
+	}
+	var form RenewForm
+	if err := parseForm(r, &form); err != nil {
+		p.logger.Errorln(err)
+		redirectError(w, r, prescriptionPath(prescription), err)
+		return
+	}
+	warnings := p.allergyWarnings(prescription.PatientId, prescription.Medications)
+	if len(warnings) > 0 && !form.Acknowledge {
+		views.RedirectAlert(w, r, prescriptionPath(prescription), http.StatusFound, views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: allergyAlert(warnings, "renewing"),
+		})
+		return
+	}
+	renewal, err := p.prs.Renew(prescription, physician)
+	if err != nil {
+		redirectError(w, r, prescriptionPath(prescription), err)
+		return
+	}
+	views.RedirectAlert(w, r, prescriptionPath(renewal), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The prescription has been renewed.",
+	})
+}
+
+// allergyWarnings checks the medications against the allergies of the patient. If the check fails, a warning
+// saying so is returned, so that the physician has to acknowledge prescribing without it.
+func (p *Prescriptions) allergyWarnings(patientId bson.ObjectId, medications []models.Medication) []models.AllergyWarning {
+	names := make([]string, 0, len(medications))
+	for _, m := range medications {
+		if m.Name != "" {
+			names = append(names, m.Name)
+		}
+	}
+	warnings, err := p.cs.AllergyWarnings(patientId.Hex(), names)
+	if err != nil {
+		p.logger.Errorf("Error while checking allergies of patient %s: %v", patientId.Hex(), err)
+		return []models.AllergyWarning{{CheckFailed: true}}
+	}
+	return warnings
+}
+
+// allergyAlert asks the physician to check the allergy warnings before the action, like prescribing.
+func allergyAlert(warnings []models.AllergyWarning, action string) string {
+	if len(warnings) == 1 && warnings[0].CheckFailed {
+		return "The allergies of the patient could not be checked. Please check them before " + action + "."
+	}
+	return "The medications match allergies of the patient. Please check the warnings before " + action + "."
+}
+
+// encounterByID fetches the encounter with the id from the request path.
+// If an error is returned, the response has already been written.
+func (p *Prescriptions) encounterByID(w http.ResponseWriter, r *http.Request) (*models.Encounter, error) {
+	id := mux.Vars(r)["id"]
+	encounter, err := p.es.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Encounter not found", http.StatusNotFound)
+		default:
+			p.logger.Errorf("Error while fetching encounter %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return encounter, nil
+}
+
+// prescriptionByID fetches the prescription with the id from the request path.
+// If an error is returned, the response has already been written.
+func (p *Prescriptions) prescriptionByID(w http.ResponseWriter, r *http.Request) (*models.Prescription, error) {
+	id := mux.Vars(r)["id"]
+	prescription, err := p.prs.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Prescription not found", http.StatusNotFound)
+		default:
+			p.logger.Errorf("Error while fetching prescription %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return prescription, nil
+}
+
+func prescriptionPath(prescription *models.Prescription) string {
+	return "/prescriptions/" + prescription.Id.Hex()
+}
+
+// prescriber returns the physician a prescription written by the user is prescribed by:
+// the user if they are a physician, the physician of the encounter otherwise.
+func prescriber(user *models.User, encounter *models.Encounter) bson.ObjectId {
+	if user != nil && user.HasRole(models.UserRolePhysician) {
+		return user.Id
+	}
+	return encounter.PhysicianId
+}
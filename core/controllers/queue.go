@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// Queue is the walk-in queue: reception checks patients in, physicians call them, and a display in the waiting
+// room shows the called tokens.
+type Queue struct {
+	DeskView    *views.View
+	DisplayView *views.View
+	qs          models.QueueService
+	us          models.UserService
+	ps          models.PatientService
+	logger      *logrus.Entry
+}
+
+func NewQueue(qs models.QueueService, us models.UserService, ps models.PatientService, logger *logrus.Entry) *Queue {
+	return &Queue{
+		DeskView:    views.NewView("bootstrap", "queue/desk"),
+		DisplayView: views.NewView("display", "queue/display"),
+		qs:          qs,
+		us:          us,
+		ps:          ps,
+		logger:      logger,
+	}
+}
+
+type QueueData struct {
+	Physicians []models.User
+	Physician  *models.User
+	Entries    []models.QueueEntry
+	// Patients are the patients of the entries, by their id.
+	Patients map[bson.ObjectId]models.Patient
+	// CanCheckIn is true for reception, CanCall for the physician of the queue, CanAdvance for both.
+	CanCheckIn bool
+	CanCall    bool
+	CanAdvance bool
+	// CanTakeVitals is true for clinical staff, who take the vitals of patients waiting.
+	CanTakeVitals bool
+}
+
+// QueueAction is a change of the status of a queue entry offered as a button.
+type QueueAction struct {
+	Status models.QueueStatus
+	Label  string
+}
+
+// Actions returns the changes of the status of the entry the user can make.
+func (d *QueueData) Actions(entry models.QueueEntry) []QueueAction {
+	if !d.CanAdvance {
+		return nil
+	}
+	all := []QueueAction{
+		{models.QueueCalled, "Call"},
+		{models.QueueInConsultation, "Start consultation"},
+		{models.QueueWaiting, "Back to waiting"},
+		{models.QueueDone, "Done"},
+	}
+	var actions []QueueAction
+	for _, a := range all {
+		if entry.Status.CanChangeTo(a.Status) {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+// PhysicianLink returns the queue of the physician.
+func (d *QueueData) PhysicianLink(physician models.User) string {
+	return queuePath(physician.Id)
+}
+
+// PatientName returns the name and medical record number of the patient with the id.
+func (d *QueueData) PatientName(id bson.ObjectId) string {
+	return patientName(d.Patients, id)
+}
+
+// Waiting returns the number of patients waiting.
+func (d *QueueData) Waiting() int {
+	n := 0
+	for _, e := range d.Entries {
+		if e.Status == models.QueueWaiting {
+			n++
+		}
+	}
+	return n
+}
+
+// Desk shows today's queue of a physician: the physician signed in, or the first one.
+// GET /queue?physician=:id
+func (q *Queue) Desk(w http.ResponseWriter, r *http.Request) {
+	physicians, err := activePhysicians(q.us)
+	if err != nil {
+		q.logger.Errorf("Error while fetching physicians: %v", err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	user := context.User(r.Context())
+	var vd views.Data
+	data := QueueData{
+		Physicians:    physicians,
+		CanCheckIn:    canEditPatients(user),
+		CanTakeVitals: canViewEncounters(user),
+	}
+	vd.Yield = &data
+	if len(physicians) == 0 {
+		q.DeskView.Render(w, r, vd)
+		return
+	}
+	data.Physician = &physicians[0]
+	selected := r.URL.Query().Get("physician")
+	if selected == "" && user.HasRole(models.UserRolePhysician) {
+		selected = user.Id.Hex()
+	}
+	for i := range physicians {
+		if physicians[i].Id.Hex() == selected {
+			data.Physician = &physicians[i]
+		}
+	}
+	data.CanCall = canCallQueue(user, data.Physician.Id)
+	data.CanAdvance = data.CanCheckIn || data.CanCall
+	data.Entries, err = q.qs.Day(data.Physician.Id.Hex(), time.Now())
+	if err != nil {
+		q.logger.Errorf("Error while fetching the queue of %s: %v", data.Physician.Username, err)
+		vd.SetAlert(err)
+	}
+	data.Patients = make(map[bson.ObjectId]models.Patient)
+	for _, e := range data.Entries {
+		if patient, err := q.ps.ById(e.PatientId.Hex()); err == nil {
+			data.Patients[patient.Id] = *patient
+		}
+	}
+	q.DeskView.Render(w, r, vd)
+}
+
+type CheckInForm struct {
+	Physician string `schema:"physician"`
+	MRN       string `schema:"mrn"`
+}
+
+// CheckIn adds a walk-in patient to today's queue of a physician and shows the token.
+// POST /queue
+func (q *Queue) CheckIn(w http.ResponseWriter, r *http.Request) {
+	var form CheckInForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, "/queue", err)
+		return
+	}
+	path := "/queue"
+	if bson.IsObjectIdHex(form.Physician) {
+		path = queuePath(bson.ObjectIdHex(form.Physician))
+	}
+	patient, err := q.ps.ByMRN(form.MRN)
+	if err != nil {
+		if err.Error() == models.MongoErrNotFound.Error() {
+			err = models.ErrPatientRequired
+		}
+		redirectError(w, r, path, err)
+		return
+	}
+	entry, err := q.qs.CheckIn(form.Physician, patient.Id.Hex(), context.User(r.Context()))
+	if err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("%s has been checked in with token %d.", patient.FullName(), entry.Token),
+	})
+}
+
+// CallNext calls the next waiting patient of the queue of a physician.
+// POST /queue/call-next
+func (q *Queue) CallNext(w http.ResponseWriter, r *http.Request) {
+	physicianId := r.FormValue("physician")
+	if !bson.IsObjectIdHex(physicianId) {
+		http.Error(w, "Physician not found", http.StatusNotFound)
+		return
+	}
+	path := queuePath(bson.ObjectIdHex(physicianId))
+	if !canCallQueue(context.User(r.Context()), bson.ObjectIdHex(physicianId)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	entry, err := q.qs.CallNext(physicianId)
+	if err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Token %d has been called.", entry.Token),
+	})
+}
+
+// Advance changes the status of a queue entry.
+// POST /queue/:id/status
+func (q *Queue) Advance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	entry, err := q.qs.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Queue entry not found", http.StatusNotFound)
+		default:
+			q.logger.Errorf("Error while fetching queue entry %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return
+	}
+	user := context.User(r.Context())
+	if !canEditPatients(user) && !canCallQueue(user, entry.PhysicianId) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	path := queuePath(entry.PhysicianId)
+	if err := q.qs.Advance(entry, models.QueueStatus(r.FormValue("status"))); err != nil {
+		redirectError(w, r, path, err)
+		return
+	}
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// QueueBoard is what the display in the waiting room shows, for every physician with a queue today.
+type QueueBoard struct {
+	Queues  []QueueBoardQueue `json:"queues"`
+	Updated time.Time         `json:"updated"`
+}
+
+type QueueBoardQueue struct {
+	Physician string `json:"physician"`
+	// Called are the tokens called to the physician's room, InConsultation the tokens being seen.
+	Called         []int64 `json:"called"`
+	InConsultation []int64 `json:"in_consultation"`
+	Waiting        []int64 `json:"waiting"`
+}
+
+// Display renders the token display for a screen in the waiting room, it polls DisplayJSON for updates.
+// GET /queue/display
+func (q *Queue) Display(w http.ResponseWriter, r *http.Request) {
+	board, err := q.board()
+	if err != nil {
+		q.logger.Errorf("Error while fetching the queues: %v", err)
+		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		return
+	}
+	q.DisplayView.Render(w, r, board)
+}
+
+// DisplayJSON returns the token display as JSON.
+// GET /queue/display.json
+func (q *Queue) DisplayJSON(w http.ResponseWriter, r *http.Request) {
+	board, err := q.board()
+	if err != nil {
+		q.logger.Errorf("Error while fetching the queues: %v", err)
+		views.RenderJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, board)
+}
+
+// board collects today's tokens of the physicians, leaving out physicians without patients in their queue.
+// Patient names are not shown in the waiting room.
+func (q *Queue) board() (*QueueBoard, error) {
+	physicians, err := activePhysicians(q.us)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entries, err := q.qs.Today(now)
+	if err != nil {
+		return nil, err
+	}
+	board := QueueBoard{Queues: []QueueBoardQueue{}, Updated: now}
+	for _, physician := range physicians {
+		queue := QueueBoardQueue{Physician: physician.Name, Called: []int64{}, InConsultation: []int64{},
+			Waiting: []int64{}}
+		for _, e := range entries {
+			if e.PhysicianId != physician.Id {
+				continue
+			}
+			switch e.Status {
+			case models.QueueCalled:
+				queue.Called = append(queue.Called, e.Token)
+			case models.QueueInConsultation:
+				queue.InConsultation = append(queue.InConsultation, e.Token)
+			case models.QueueWaiting:
+				queue.Waiting = append(queue.Waiting, e.Token)
+			}
+		}
+		if len(queue.Called)+len(queue.InConsultation)+len(queue.Waiting) > 0 {
+			board.Queues = append(board.Queues, queue)
+		}
+	}
+	return &board, nil
+}
+
+func queuePath(physicianId bson.ObjectId) string {
+	return "/queue?physician=" + physicianId.Hex()
+}
+
+// canCallQueue reports whether the user may call patients of the queue of the physician: the physician or an admin.
+func canCallQueue(user *models.User, physicianId bson.ObjectId) bool {
+	return user != nil && (user.Id == physicianId || user.HasRole(models.UserRoleAdmin))
+}
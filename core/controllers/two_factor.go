@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TwoFactor lets signed in users manage their own second factor.
+type TwoFactor struct {
+	StatusView        *views.View
+	EnrollView        *views.View
+	RecoveryCodesView *views.View
+	tfs               models.TwoFactorService
+	logger            *logrus.Entry
+}
+
+func NewTwoFactor(tfs models.TwoFactorService, logger *logrus.Entry) *TwoFactor {
+	return &TwoFactor{
+		StatusView:        views.NewView("bootstrap", "users/two_factor"),
+		EnrollView:        views.NewView("bootstrap", "users/two_factor_enroll"),
+		RecoveryCodesView: views.NewView("bootstrap", "users/recovery_codes"),
+		tfs:               tfs,
+		logger:            logger,
+	}
+}
+
+type TwoFactorStatusData struct {
+	Enabled            bool
+	Required           bool
+	RecoveryCodesCount int
+}
+
+// Status shows whether two factor authentication is enabled for the signed in user.
+// GET /profile/2fa
+func (tf *TwoFactor) Status(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	required, err := tf.tfs.Required(user)
+	if err != nil {
+		tf.logger.Errorf("Error while checking two factor requirement of user %s: %v", user.Username, err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = TwoFactorStatusData{
+		Enabled:            user.TOTPEnabled,
+		Required:           required,
+		RecoveryCodesCount: len(user.RecoveryCodeHashes),
+	}
+	tf.StatusView.Render(w, r, vd)
+}
+
+// Enroll generates a new secret and shows it to the user.
+// POST /profile/2fa/enroll
+func (tf *TwoFactor) Enroll(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.TOTPEnabled {
+		http.Redirect(w, r, "/profile/2fa", http.StatusFound)
+		return
+	}
+	var vd views.Data
+	enrollment, err := tf.tfs.WithActor(requestActor(r)).Enroll(user)
+	if err != nil {
+		tf.logger.Errorf("Error while enrolling user %s: %v", user.Username, err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = TwoFactorEnrollData{Enrollment: enrollment, Action: "/profile/2fa/confirm"}
+	tf.EnrollView.Render(w, r, vd)
+}
+
+// Confirm activates the secret once the user entered a valid code from their app.
+// POST /profile/2fa/confirm
+func (tf *TwoFactor) Confirm(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		tf.EnrollView.Render(w, r, vd)
+		return
+	}
+	codes, err := tf.tfs.WithActor(requestActor(r)).Confirm(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		enrollment, _ := tf.tfs.Enrollment(user)
+		vd.Yield = TwoFactorEnrollData{Enrollment: enrollment, Action: "/profile/2fa/confirm"}
+		tf.EnrollView.Render(w, r, vd)
+		return
+	}
+	tf.RecoveryCodesView.Render(w, r, codes)
+}
+
+// RecoveryCodes replaces the recovery codes of the user.
+// POST /profile/2fa/recovery-codes
+func (tf *TwoFactor) RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		tf.redirectError(w, r, err)
+		return
+	}
+	codes, err := tf.tfs.WithActor(requestActor(r)).RegenerateRecoveryCodes(user, form.Code)
+	if err != nil {
+		tf.redirectError(w, r, err)
+		return
+	}
+	tf.RecoveryCodesView.Render(w, r, codes)
+}
+
+// Disable turns off two factor authentication, unless the role of the user requires it.
+// POST /profile/2fa/disable
+func (tf *TwoFactor) Disable(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		tf.redirectError(w, r, err)
+		return
+	}
+	if err := tf.tfs.WithActor(requestActor(r)).Disable(user, form.Code); err != nil {
+		tf.redirectError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/profile/2fa", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Two factor authentication has been turned off.",
+	})
+}
+
+func (tf *TwoFactor) redirectError(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, "/profile/2fa", http.StatusFound, *vd.Alert)
+}
@@ -5,27 +5,54 @@ import (
 	"gcchr-system/core/models"
 	"gcchr-system/core/views"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"fmt"
-	"gcchr-system/core/rand"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
 )
 
 type Users struct {
-	LoginView *views.View
-	NewView   *views.View
-	us        models.UserService
-	logger    *logrus.Entry
+	LoginView          *views.View
+	TwoFactorLoginView *views.View
+	EnrollView         *views.View
+	RecoveryCodesView  *views.View
+	NewView            *views.View
+	ShowView           *views.View
+	EditView           *views.View
+	SessionsView       *views.View
+	ChangePasswordView *views.View
+	ResetPasswordView  *views.View
+	ResetLinkView      *views.View
+	us                 models.UserService
+	ss                 models.SessionService
+	tfs                models.TwoFactorService
+	audit              models.AuditService
+	logger             *logrus.Entry
 }
 
-func NewUsers(us models.UserService, logger *logrus.Entry) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, tfs models.TwoFactorService, audit models.AuditService,
+	logger *logrus.Entry) *Users {
 	return &Users{
-		LoginView: views.NewView("bootstrap", "users/login"),
-		NewView:   views.NewView("bootstrap", "users/new"),
-		us:        us,
-		logger:    logger,
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		TwoFactorLoginView: views.NewView("bootstrap", "users/two_factor_login"),
+		EnrollView:         views.NewView("bootstrap", "users/two_factor_enroll"),
+		RecoveryCodesView:  views.NewView("bootstrap", "users/recovery_codes"),
+		NewView:            views.NewView("bootstrap", "users/new"),
+		ShowView:           views.NewView("bootstrap", "users/show"),
+		EditView:           views.NewView("bootstrap", "users/edit"),
+		SessionsView:       views.NewView("bootstrap", "users/sessions"),
+		ChangePasswordView: views.NewView("bootstrap", "users/change_password"),
+		ResetPasswordView:  views.NewView("bootstrap", "users/reset_password"),
+		ResetLinkView:      views.NewView("bootstrap", "users/reset_link"),
+		us:                 us,
+		ss:                 ss,
+		tfs:                tfs,
+		audit:              audit,
+		logger:             logger,
 	}
 }
 
@@ -66,7 +93,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Password:  form.Password,
 		UserRoles: form.UserRoles,
 	}
-	if err := u.us.Create(&user); err != nil {
+	if err := u.users(r).Create(&user); err != nil {
 		vd.SetAlert(err)
 		u.NewView.Render(w, r, vd)
 		return
@@ -95,45 +122,214 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		u.LoginView.Render(w, r, vd)
 		return
 	}
-	user, err := u.us.Authenticate(form.Username, form.Password)
+	user, err := u.us.Authenticate(form.Username, form.Password, clientIP(r))
 	if err != nil {
-		switch err.Error() {
-		case models.MongoErrNotFound.Error():
-			vd.AlertError("Invalid username")
-		default:
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+
+	required, err := u.tfs.Required(user)
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	if user.TOTPEnabled || required {
+		if err := u.startTwoFactor(w, r, user); err != nil {
 			vd.SetAlert(err)
+			u.LoginView.Render(w, r, vd)
+			return
 		}
-		u.LoginView.Render(w, r, vd)
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
 		return
 	}
 
-	err = u.signIn(w, user)
+	err = u.signIn(w, r, user)
 	if err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
 		return
 	}
-	// TODO: redirect to admin overview or by type
-	if userRoleExists(models.UserRoleAdmin, user.UserRoles) {
+	redirectAfterLogin(w, r, user)
+}
+
+// redirectAfterLogin sends the user to the start page for their role.
+func redirectAfterLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	// TODO: redirect to overview pages of the other roles
+	if user.MustChangePassword {
+		views.RedirectAlert(w, r, "/profile/password", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: "Please choose a new password before you continue.",
+		})
+	} else if user.HasRole(models.UserRoleAdmin) {
 		http.Redirect(w, r, "/admin/dashboard", http.StatusFound)
 	} else {
-		fmt.Fprintf(w, "Login sucessfull..!! with user: %+v", user)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// startTwoFactor starts a pending session, which is completed once the second factor is provided.
+func (u *Users) startTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session, err := u.ss.StartPending(user, clientIP(r), r.UserAgent())
+	if err != nil {
+		return err
 	}
+	cookie := http.Cookie{
+		Name:     "pending_token",
+		Path:     "/",
+		Value:    session.Token,
+		Expires:  session.Expires,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	return nil
 }
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RemeberToken()
-		if err != nil {
-			return err
+// pendingLogin returns the pending session and user of a login waiting for the second factor.
+// If an error is returned, the client has already been redirected back to the login page.
+func (u *Users) pendingLogin(w http.ResponseWriter, r *http.Request) (*models.Session, *models.User, error) {
+	cookie, err := r.Cookie("pending_token")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil, nil, err
+	}
+	session, user, err := u.ss.ResolvePending(cookie.Value)
+	if err != nil {
+		views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: "Your login has expired, please log in again.",
+		})
+		return nil, nil, err
+	}
+	return session, user, nil
+}
+
+type TwoFactorEnrollData struct {
+	Enrollment *models.TwoFactorEnrollment
+	Action     string
+}
+
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// LoginTwoFactor asks for the second factor after a correct password.
+// Users whose role requires two factor authentication, but who have not enrolled yet, enroll here.
+// GET /login/2fa
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, user, err := u.pendingLogin(w, r)
+	if err != nil {
+		return
+	}
+	if user.TOTPEnabled {
+		u.TwoFactorLoginView.Render(w, r, nil)
+		return
+	}
+	var vd views.Data
+	enrollment, err := u.loginEnrollment(r, user)
+	if err != nil {
+		u.logger.Errorf("Error while enrolling user %s: %v", user.Username, err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = TwoFactorEnrollData{Enrollment: enrollment, Action: "/login/2fa"}
+	u.EnrollView.Render(w, r, vd)
+}
+
+// loginEnrollment keeps the secret generated on the first visit, so reloading the page does not
+// invalidate a secret the user already scanned.
+func (u *Users) loginEnrollment(r *http.Request, user *models.User) (*models.TwoFactorEnrollment, error) {
+	if user.TOTPSecret != "" {
+		return u.tfs.Enrollment(user)
+	}
+	return u.tfs.WithActor(models.ActorOf(user, clientIP(r))).Enroll(user)
+}
+
+// LoginTwoFactorVerify checks the second factor and completes the login.
+// POST /login/2fa
+func (u *Users) LoginTwoFactorVerify(w http.ResponseWriter, r *http.Request) {
+	session, user, err := u.pendingLogin(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	// The user is not signed in yet, so the changes are recorded as made by the user logging in.
+	tfs := u.tfs.WithActor(models.ActorOf(user, clientIP(r)))
+	var recoveryCodes []string
+	if user.TOTPEnabled {
+		err = tfs.Verify(user, form.Code)
+	} else {
+		recoveryCodes, err = tfs.Confirm(user, form.Code)
+	}
+	if err != nil {
+		u.record(r, models.ActorOf(user, clientIP(r)), models.AuditLoginFailed, user, "second factor failed")
+		// Once the user is locked, the login has to start again with the password.
+		if err == models.ErrTooManyLoginAttempts {
+			u.endPendingLogin(w, session)
+			redirectError(w, r, "/login", err)
+			return
+		}
+		vd.SetAlert(err)
+		if user.TOTPEnabled {
+			u.TwoFactorLoginView.Render(w, r, vd)
+			return
 		}
-		user.Remember = token
-		user.LastLogin = time.Now()
-		err = u.us.Update(user)
+		enrollment, _ := u.tfs.Enrollment(user)
+		vd.Yield = TwoFactorEnrollData{Enrollment: enrollment, Action: "/login/2fa"}
+		u.EnrollView.Render(w, r, vd)
+		return
+	}
+
+	u.endPendingLogin(w, session)
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	if recoveryCodes != nil {
+		u.RecoveryCodesView.Render(w, r, recoveryCodes)
+		return
+	}
+	redirectAfterLogin(w, r, user)
+}
+
+// endPendingLogin ends the pending session and removes its cookie.
+func (u *Users) endPendingLogin(w http.ResponseWriter, session *models.Session) {
+	if err := u.ss.Delete(session.Id.Hex()); err != nil {
+		u.logger.Errorf("Error while ending pending session %s: %v", session.Id.Hex(), err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "pending_token",
+		Path:     "/",
+		Value:    "",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	})
+}
+
+// signIn starts a new session for the user on the device which sent the request.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session, err := u.ss.Start(user, clientIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+	u.record(r, models.ActorOf(user, clientIP(r)), models.AuditLogin, user, "")
+	user.LastLogin = time.Now()
+	if err := u.us.Update(user); err != nil {
+		u.logger.Errorf("Error while updating last login of user %s: %v", user.Username, err)
 	}
 	cookie := http.Cookie{
 		Name:     "remember_token",
-		Value:    user.Remember,
+		Path:     "/",
+		Value:    session.Token,
+		Expires:  session.Expires,
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
@@ -144,24 +340,497 @@ func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	cookie := http.Cookie{
 		Name:     "remember_token",
+		Path:     "/",
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
 
-	user := context.User(r.Context())
-	token, _ := rand.RemeberToken()
-	user.Remember = token
-	u.us.Update(user)
+	// Only this device is signed out, sessions on other devices stay valid.
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.ss.Delete(session.Id.Hex()); err != nil {
+			u.logger.Errorf("Error while ending session %s: %v", session.Id.Hex(), err)
+		}
+	}
+	if user := context.User(r.Context()); user != nil {
+		u.record(r, requestActor(r), models.AuditLogout, user, "")
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func userRoleExists(role models.UserRole, roles []models.UserRole) bool {
-	for _, r := range roles {
-		if r == role {
-			return true
+type SessionsData struct {
+	Current  *models.Session
+	Sessions []models.Session
+}
+
+// Sessions lists the devices the signed in user is currently signed in on.
+// GET /profile/sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	sessions, err := u.ss.ByUserId(user.Id.Hex())
+	if err != nil {
+		u.logger.Errorf("Error while fetching sessions of user %s: %v", user.Username, err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = SessionsData{
+		Current:  context.Session(r.Context()),
+		Sessions: sessions,
+	}
+	u.SessionsView.Render(w, r, vd)
+}
+
+// RevokeSession signs the user out on one of their devices.
+// POST /profile/sessions/:id/revoke
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id := mux.Vars(r)["id"]
+	if err := u.ss.Revoke(user.Id.Hex(), id); err != nil {
+		u.logger.Errorf("Error while revoking session %s: %v", id, err)
+		views.RedirectAlert(w, r, "/profile/sessions", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: "The session could not be revoked.",
+		})
+		return
+	}
+	current := context.Session(r.Context())
+	if current != nil && current.Id.Hex() == id {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, "/profile/sessions", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The session has been revoked.",
+	})
+}
+
+type EditUserForm struct {
+	Name               string            `schema:"name"`
+	UserRoles          []models.UserRole `schema:"user_roles"`
+	RegistrationNumber string            `schema:"registration_number"`
+	Contact            models.Contact    `schema:"contact"`
+	Addresses          []models.Address  `schema:"addresses"`
+	UserRolesOptions   []models.UserRole `schema:"-"`
+	User               *models.User      `schema:"-"`
+}
+
+// HasRole is used by the edit template to preselect the roles of the user.
+func (f *EditUserForm) HasRole(role models.UserRole) bool {
+	return models.UserRoleExists(role, f.UserRoles)
+}
+
+// BillingAddress and DeliveryAddress return the address of the given type, or an empty address of that type.
+func (f *EditUserForm) BillingAddress() models.Address {
+	return addressOfType(f.Addresses, models.AddressTypeBilling)
+}
+
+func (f *EditUserForm) DeliveryAddress() models.Address {
+	return addressOfType(f.Addresses, models.AddressTypeDelivery)
+}
+
+// Show renders the details of a user with actions to manage the account.
+// GET /admin/users/:id
+func (u *Users) Show(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = user
+	u.ShowView.Render(w, r, vd)
+}
+
+// Edit renders the form to edit a user.
+// GET /admin/users/:id/edit
+func (u *Users) Edit(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	form := EditUserForm{
+		Name:               user.Name,
+		UserRoles:          user.UserRoles,
+		RegistrationNumber: user.RegistrationNumber,
+		Contact:            user.Contact,
+		Addresses:          user.Addresses,
+		UserRolesOptions:   models.UserRolesList(),
+		User:               user,
+	}
+	var vd views.Data
+	vd.Yield = &form
+	u.EditView.Render(w, r, vd)
+}
+
+// Update processes the edit user form.
+// POST /admin/users/:id/update
+func (u *Users) Update(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	form := EditUserForm{User: user}
+	vd.Yield = &form
+	form.UserRolesOptions = models.UserRolesList()
+	if err := parseForm(r, &form); err != nil {
+		u.logger.Errorln(err)
+		vd.SetAlert(err)
+		u.EditView.Render(w, r, vd)
+		return
+	}
+
+	user.Name = form.Name
+	user.UserRoles = form.UserRoles
+	user.RegistrationNumber = strings.TrimSpace(form.RegistrationNumber)
+	user.Contact = form.Contact
+	user.Addresses = nonEmptyAddresses(form.Addresses)
+	if err := u.users(r).Update(user); err != nil {
+		vd.SetAlert(err)
+		u.EditView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("User %s updated successfully.", user.Name),
+	}
+	views.RedirectAlert(w, r, userPath(user), http.StatusFound, alert)
+}
+
+type ResetPasswordForm struct {
+	Password string `schema:"password"`
+}
+
+// ResetPassword sets a new password for a user and signs them out on all devices.
+// POST /admin/users/:id/password
+func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = user
+	var form ResetPasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	if form.Password == "" {
+		vd.SetAlert(models.ErrPasswordRequired)
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	user.Password = form.Password
+	// The admin knows this password, so the user has to replace it.
+	user.MustChangePassword = true
+	if err := u.users(r).Update(user); err != nil {
+		vd.SetAlert(err)
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	u.endSessions(user)
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Password for %s has been reset.", user.Name),
+	}
+	views.RedirectAlert(w, r, userPath(user), http.StatusFound, alert)
+}
+
+// Disable blocks a user from logging in.
+// POST /admin/users/:id/disable
+func (u *Users) Disable(w http.ResponseWriter, r *http.Request) {
+	u.setDisabled(w, r, true)
+}
+
+// Enable allows a disabled user to log in again.
+// POST /admin/users/:id/enable
+func (u *Users) Enable(w http.ResponseWriter, r *http.Request) {
+	u.setDisabled(w, r, false)
+}
+
+func (u *Users) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	user.Disabled = disabled
+	if err := u.users(r).Update(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		user.Disabled = !disabled
+		vd.Yield = user
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	if disabled {
+		u.endSessions(user)
+	}
+	status := "enabled"
+	if disabled {
+		status = "disabled"
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("User %s has been %s.", user.Name, status),
+	}
+	views.RedirectAlert(w, r, userPath(user), http.StatusFound, alert)
+}
+
+// Unlock lifts the lockout of a user after too many failed login attempts.
+// POST /admin/users/:id/unlock
+func (u *Users) Unlock(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := u.users(r).Unlock(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		vd.Yield = user
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("User %s has been unlocked.", user.Name),
+	}
+	views.RedirectAlert(w, r, userPath(user), http.StatusFound, alert)
+}
+
+type ResetLinkData struct {
+	User    *models.User
+	Link    string
+	Expires time.Time
+}
+
+// ResetLink creates a single use link the user can open to choose a new password.
+// POST /admin/users/:id/reset-token
+func (u *Users) ResetLink(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	token, err := u.users(r).CreateResetToken(user)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		vd.Yield = user
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	u.ResetLinkView.Render(w, r, ResetLinkData{
+		User:    user,
+		Link:    baseURL(r) + "/reset-password?" + url.Values{"token": {token}}.Encode(),
+		Expires: user.ResetTokenExpires,
+	})
+}
+
+// ResetTwoFactor removes the second factor of a user who lost their device.
+// POST /admin/users/:id/2fa/reset
+func (u *Users) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := u.tfs.WithActor(requestActor(r)).Reset(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		vd.Yield = user
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Two factor authentication of %s has been reset.", user.Name),
+	}
+	views.RedirectAlert(w, r, userPath(user), http.StatusFound, alert)
+}
+
+// Delete removes a user permanently.
+// POST /admin/users/:id/delete
+func (u *Users) Delete(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := u.users(r).Delete(user.Id.Hex()); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		vd.Yield = user
+		u.ShowView.Render(w, r, vd)
+		return
+	}
+	u.logger.Infoln("Deleted user with username: ", user.Username)
+	u.endSessions(user)
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("User %s has been deleted.", user.Name),
+	}
+	views.RedirectAlert(w, r, "/admin/dashboard", http.StatusFound, alert)
+}
+
+// userByID fetches the user with the id from the request path.
+// If an error is returned, the response has already been written.
+func (u *Users) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id := mux.Vars(r)["id"]
+	user, err := u.us.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			u.logger.Errorf("Error while fetching user %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+type ChangePasswordForm struct {
+	CurrentPassword string `schema:"current_password"`
+	Password        string `schema:"password"`
+	ConfirmPassword string `schema:"confirm_password"`
+}
+
+// ChangePassword renders the form to change the password of the signed in user.
+// GET /profile/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	u.ChangePasswordView.Render(w, r, nil)
+}
+
+// UpdatePassword processes the change password form.
+// Sessions on other devices are ended, the current session stays signed in.
+// POST /profile/password
+func (u *Users) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form ChangePasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ChangePasswordView.Render(w, r, vd)
+		return
+	}
+	if form.Password != form.ConfirmPassword {
+		vd.SetAlert(models.ErrPasswordMismatch)
+		u.ChangePasswordView.Render(w, r, vd)
+		return
+	}
+	if err := u.users(r).ChangePassword(user, form.CurrentPassword, form.Password); err != nil {
+		vd.SetAlert(err)
+		u.ChangePasswordView.Render(w, r, vd)
+		return
+	}
+	u.endOtherSessions(user, context.Session(r.Context()))
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your password has been changed.",
+	}
+	views.RedirectAlert(w, r, "/", http.StatusFound, alert)
+}
+
+type ResetPasswordTokenForm struct {
+	Token           string `schema:"token"`
+	Password        string `schema:"password"`
+	ConfirmPassword string `schema:"confirm_password"`
+}
+
+// ResetPasswordWithToken renders the form to choose a new password with a reset link.
+// GET /reset-password?token=...
+func (u *Users) ResetPasswordWithToken(w http.ResponseWriter, r *http.Request) {
+	var form ResetPasswordTokenForm
+	parseURLParams(r, &form)
+	u.ResetPasswordView.Render(w, r, &form)
+}
+
+// CompleteReset sets the new password and signs the user out everywhere.
+// POST /reset-password
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPasswordTokenForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ResetPasswordView.Render(w, r, vd)
+		return
+	}
+	if form.Password != form.ConfirmPassword {
+		vd.SetAlert(models.ErrPasswordMismatch)
+		u.ResetPasswordView.Render(w, r, vd)
+		return
+	}
+	user, err := u.users(r).ResetPassword(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPasswordView.Render(w, r, vd)
+		return
+	}
+	u.endSessions(user)
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your password has been changed, please log in.",
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+}
+
+// users returns the user service recording changes as made by the signed in user.
+func (u *Users) users(r *http.Request) models.UserService {
+	return u.us.WithActor(requestActor(r))
+}
+
+// record adds an entry to the audit log, failures are only logged.
+func (u *Users) record(r *http.Request, actor models.Actor, action models.AuditAction, target *models.User, detail string) {
+	if err := u.audit.Record(actor, action, target, nil, detail); err != nil {
+		u.logger.Errorf("Error while recording audit entry %s: %v", action, err)
+	}
+}
+
+// endOtherSessions signs the user out on all devices except the one of the current session.
+func (u *Users) endOtherSessions(user *models.User, current *models.Session) {
+	sessions, err := u.ss.ByUserId(user.Id.Hex())
+	if err != nil {
+		u.logger.Errorf("Error while fetching sessions of user %s: %v", user.Username, err)
+		return
+	}
+	for _, s := range sessions {
+		if current != nil && s.Id == current.Id {
+			continue
+		}
+		if err := u.ss.Delete(s.Id.Hex()); err != nil {
+			u.logger.Errorf("Error while ending session %s: %v", s.Id.Hex(), err)
+		}
+	}
+}
+
+// endSessions signs the user out on all devices.
+func (u *Users) endSessions(user *models.User) {
+	if err := u.ss.DeleteByUserId(user.Id.Hex()); err != nil {
+		u.logger.Errorf("Error while ending sessions of user %s: %v", user.Username, err)
+	}
+}
+
+func userPath(user *models.User) string {
+	return "/admin/users/" + user.Id.Hex()
+}
+
+func addressOfType(addresses []models.Address, addressType models.AddressType) models.Address {
+	for _, a := range addresses {
+		if a.AddressType == addressType {
+			return a
+		}
+	}
+	return models.Address{AddressType: addressType}
+}
+
+// nonEmptyAddresses drops addresses from a form which were left blank.
+func nonEmptyAddresses(addresses []models.Address) []models.Address {
+	var ret []models.Address
+	for _, a := range addresses {
+		if a.Street == "" && a.City == "" && a.State == "" && a.Country == "" && a.Pincode == 0 {
+			continue
 		}
+		ret = append(ret, a)
 	}
-	return false
+	return ret
 }
@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"gcchr-system/core/context"
+	"gcchr-system/core/models"
+	"gcchr-system/core/views"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// adultAge is the age from which the normal ranges of adults are shaded on the vitals charts.
+const adultAge = 18
+
+// Vitals records the vitals taken of patients at check-in and charts them over time.
+type Vitals struct {
+	IndexView *views.View
+	vs        models.VitalsService
+	ps        models.PatientService
+	logger    *logrus.Entry
+}
+
+func NewVitals(vs models.VitalsService, ps models.PatientService, logger *logrus.Entry) *Vitals {
+	return &Vitals{
+		IndexView: views.NewView("bootstrap", "vitals/index", "vitals/parts"),
+		vs:        vs,
+		ps:        ps,
+		logger:    logger,
+	}
+}
+
+type VitalsForm struct {
+	Taken  string        `schema:"taken"`
+	Vitals models.Vitals `schema:"vitals"`
+}
+
+// VitalsRow is a row of the table of vitals, with the growth percentiles for children.
+type VitalsRow struct {
+	Record      models.VitalsRecord
+	Percentiles models.GrowthPercentiles
+}
+
+// VitalsTrend is the chart of a measurement over time.
+type VitalsTrend struct {
+	Name   string
+	Unit   string
+	Latest string
+	// Note explains the grey lines of the chart, if it has any.
+	Note  string
+	Chart *TrendChart
+}
+
+// GrowthChart is the chart of a growth measurement of a child against the percentile curves of the reference.
+type GrowthChart struct {
+	Name   string
+	Unit   string
+	Latest string
+	// Percentile is the percentile of the latest measurement.
+	Percentile models.Percentile
+	// From and To are the ages in months the chart spans.
+	From, To int
+	Chart    *TrendChart
+}
+
+type VitalsData struct {
+	Patient *models.Patient
+	Form    VitalsForm
+	// Rows are the vitals of the patient, newest first.
+	Rows   []VitalsRow
+	Trends []VitalsTrend
+	Growth []GrowthChart
+	// Child is true if the growth reference covers the age of the patient at any of the vitals.
+	Child     bool
+	CanDelete bool
+}
+
+// Age returns the age of the patient now.
+func (d *VitalsData) Age() string {
+	return childAge(d.Patient, time.Now())
+}
+
+// vitalsMeasure is a measurement charted over time, with the normal range of adults.
+type vitalsMeasure struct {
+	name, unit string
+	value      func(v *models.Vitals) float64
+	low, high  *float64
+	// always shades the range for children as well.
+	always bool
+	// bloodPressure adds the diastolic pressure to the systolic one.
+	bloodPressure bool
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+var vitalsMeasures = []vitalsMeasure{
+	{name: "Weight", unit: "kg", value: func(v *models.Vitals) float64 { return v.WeightKg }},
+	{name: "Height", unit: "cm", value: func(v *models.Vitals) float64 { return v.HeightCm }},
+	{name: "BMI", unit: "kg/m²", value: func(v *models.Vitals) float64 { return v.BMI },
+		low: bound(18.5), high: bound(25)},
+	{name: "Blood pressure", unit: "mmHg", value: func(v *models.Vitals) float64 { return float64(v.SystolicBP) },
+		low: bound(90), high: bound(140), bloodPressure: true},
+	{name: "Pulse", unit: "/min", value: func(v *models.Vitals) float64 { return float64(v.Pulse) },
+		low: bound(60), high: bound(100)},
+	{name: "Respiratory rate", unit: "/min", value: func(v *models.Vitals) float64 { return float64(v.RespiratoryRate) },
+		low: bound(12), high: bound(20)},
+	{name: "Temperature", unit: "°C", value: func(v *models.Vitals) float64 { return v.TemperatureC },
+		low: bound(36), high: bound(37.5), always: true},
+	{name: "SpO2", unit: "%", value: func(v *models.Vitals) float64 { return float64(v.SpO2) },
+		low: bound(95), always: true},
+	{name: "Head circumference", unit: "cm", value: func(v *models.Vitals) float64 { return v.HeadCm }},
+}
+
+// growthMeasures are the names and units of the measures of growth charts.
+var growthMeasures = []struct {
+	measure    models.GrowthMeasure
+	name, unit string
+	value      func(v *models.Vitals) float64
+	percentile func(p *models.GrowthPercentiles) models.Percentile
+}{
+	{models.GrowthWeight, "Weight for age", "kg", func(v *models.Vitals) float64 { return v.WeightKg },
+		func(p *models.GrowthPercentiles) models.Percentile { return p.Weight }},
+	{models.GrowthHeight, "Length/height for age", "cm", func(v *models.Vitals) float64 { return v.HeightCm },
+		func(p *models.GrowthPercentiles) models.Percentile { return p.Height }},
+	{models.GrowthBMI, "BMI for age", "kg/m²", func(v *models.Vitals) float64 { return v.BMI },
+		func(p *models.GrowthPercentiles) models.Percentile { return p.BMI }},
+	{models.GrowthHead, "Head circumference for age", "cm", func(v *models.Vitals) float64 { return v.HeadCm },
+		func(p *models.GrowthPercentiles) models.Percentile { return p.Head }},
+}
+
+// Index renders the vitals of the patient with their trends, growth charts for children, and the form to record
+// new ones.
+// GET /patients/:id/vitals
+func (vc *Vitals) Index(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, vc.ps, vc.logger)
+	if err != nil {
+		return
+	}
+	data := VitalsData{Form: VitalsForm{Taken: time.Now().Format(dateTimeFormat)}}
+	vc.render(w, r, patient, &data, nil)
+}
+
+func (vc *Vitals) render(w http.ResponseWriter, r *http.Request, patient *models.Patient, data *VitalsData,
+	alert error) {
+	var vd views.Data
+	vd.Yield = data
+	data.Patient = patient
+	data.CanDelete = context.User(r.Context()).HasRole(models.UserRoleAdmin)
+	records, err := vc.vs.History(patient.Id.Hex())
+	if err != nil {
+		vc.logger.Errorf("Error while fetching the vitals of patient %s: %v", patient.MRN, err)
+		vd.SetAlert(err)
+	}
+	rows := make([]VitalsRow, len(records))
+	for i := range records {
+		rows[i] = VitalsRow{Record: records[i], Percentiles: vc.vs.Percentiles(patient, &records[i])}
+	}
+	data.Trends = vitalsTrends(patient, rows)
+	data.Growth = vc.growthCharts(patient, rows)
+	data.Child = len(data.Growth) > 0
+	for i := len(rows) - 1; i >= 0; i-- {
+		data.Rows = append(data.Rows, rows[i])
+	}
+	if alert != nil {
+		vd.SetAlert(alert)
+	}
+	vc.IndexView.Render(w, r, vd)
+}
+
+// vitalsTrends charts every measurement taken of the patient. The normal ranges of adults are only shaded for
+// adults, and the diastolic blood pressure is drawn as a grey line below the systolic one.
+func vitalsTrends(patient *models.Patient, rows []VitalsRow) []VitalsTrend {
+	adult := patient.CurrentAge() >= adultAge
+	var trends []VitalsTrend
+	for _, m := range vitalsMeasures {
+		var values []ChartValue
+		diastolic := ChartLine{Label: "Diastolic"}
+		trend := VitalsTrend{Name: m.name, Unit: m.unit}
+		for _, row := range rows {
+			v := m.value(&row.Record.Vitals)
+			if v == 0 {
+				continue
+			}
+			label := formatMeasure(v)
+			if m.bloodPressure {
+				label = row.Record.BloodPressure()
+				diastolic.Values = append(diastolic.Values, ChartValue{
+					Time:  row.Record.Taken,
+					Value: float64(row.Record.DiastolicBP),
+				})
+			}
+			trend.Latest = label
+			values = append(values, ChartValue{
+				Time:    row.Record.Taken,
+				Value:   v,
+				Label:   row.Record.Taken.Format("02 Jan 2006") + ": " + label + " " + m.unit,
+				Flagged: (adult || m.always) && outside(v, m.low, m.high),
+			})
+		}
+		if len(values) == 0 {
+			continue
+		}
+		low, high := m.low, m.high
+		if !adult && !m.always {
+			low, high = nil, nil
+		}
+		if m.bloodPressure {
+			trend.Note = "The grey line is the diastolic pressure."
+			trend.Chart = newTrendChartWithLines(values, []ChartLine{diastolic}, low, high)
+		} else {
+			trend.Chart = newTrendChart(values, low, high)
+		}
+		trends = append(trends, trend)
+	}
+	return trends
+}
+
+// growthCharts charts the growth measurements of the patient the reference has percentiles for, with the
+// percentile curves over the ages the measurements were taken at.
+func (vc *Vitals) growthCharts(patient *models.Patient, rows []VitalsRow) []GrowthChart {
+	growth := vc.vs.Growth()
+	var charts []GrowthChart
+	for _, g := range growthMeasures {
+		var values []ChartValue
+		var latest VitalsRow
+		for _, row := range rows {
+			p := g.percentile(&row.Percentiles)
+			if !p.Known {
+				continue
+			}
+			v := g.value(&row.Record.Vitals)
+			values = append(values, ChartValue{
+				Time:    row.Record.Taken,
+				Value:   v,
+				Label:   fmt.Sprintf("%s: %s %s, %s", row.Record.Taken.Format("02 Jan 2006"), formatMeasure(v), g.unit, p),
+				Flagged: p.Outside(),
+			})
+			latest = row
+		}
+		if len(values) == 0 {
+			continue
+		}
+		loc := values[0].Time.Location()
+		first := models.AgeInMonths(patient.DateOfBirth, values[0].Time)
+		last := models.AgeInMonths(patient.DateOfBirth, values[len(values)-1].Time)
+		from := math.Max(0, math.Floor(first)-1)
+		to := math.Min(growth.MaxMonth(g.measure, patient.Sex), math.Ceil(last)+1)
+		var lines []ChartLine
+		for _, p := range models.GrowthChartPercentiles {
+			line := ChartLine{Label: fmt.Sprintf("P%d", p.Percentile)}
+			for _, point := range growth.Curve(g.measure, patient.Sex, p.Z, from, to) {
+				line.Values = append(line.Values, ChartValue{
+					Time:  models.AtAgeInMonths(patient.DateOfBirth, point.Month, loc),
+					Value: point.Value,
+				})
+			}
+			lines = append(lines, line)
+		}
+		charts = append(charts, GrowthChart{
+			Name:       g.name,
+			Unit:       g.unit,
+			Latest:     formatMeasure(g.value(&latest.Record.Vitals)),
+			Percentile: g.percentile(&latest.Percentiles),
+			From:       int(from),
+			To:         int(to),
+			Chart:      newTrendChartWithLines(values, lines, nil, nil),
+		})
+	}
+	return charts
+}
+
+func outside(v float64, low, high *float64) bool {
+	return (low != nil && v < *low) || (high != nil && v > *high)
+}
+
+// formatMeasure formats a measurement without trailing zeros, like 72 or 36.8.
+func formatMeasure(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+// Create records vitals taken of the patient, usually at check-in.
+// POST /patients/:id/vitals
+func (vc *Vitals) Create(w http.ResponseWriter, r *http.Request) {
+	patient, err := patientByID(w, r, vc.ps, vc.logger)
+	if err != nil {
+		return
+	}
+	var data VitalsData
+	if err := parseForm(r, &data.Form); err != nil {
+		vc.logger.Errorln(err)
+		vc.render(w, r, patient, &data, models.ErrVitalsValueInvalid)
+		return
+	}
+	record := models.VitalsRecord{
+		PatientId:  patient.Id,
+		Vitals:     data.Form.Vitals,
+		RecordedBy: context.User(r.Context()).Id,
+	}
+	if data.Form.Taken != "" {
+		if record.Taken, err = time.ParseInLocation(dateTimeFormat, data.Form.Taken, time.Local); err != nil {
+			vc.render(w, r, patient, &data, models.ErrDateInvalid)
+			return
+		}
+	}
+	if err := vc.vs.Create(&record); err != nil {
+		vc.render(w, r, patient, &data, err)
+		return
+	}
+	views.RedirectAlert(w, r, vitalsPath(patient), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The vitals have been recorded.",
+	})
+}
+
+// Delete removes vitals recorded by mistake.
+// POST /vitals/:id/delete
+func (vc *Vitals) Delete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	record, err := vc.vs.ById(id)
+	if err != nil {
+		switch err.Error() {
+		case models.ErrIDInvalid.Error(), models.MongoErrNotFound.Error():
+			http.Error(w, "Vitals not found", http.StatusNotFound)
+		default:
+			vc.logger.Errorf("Error while fetching vitals %s: %v", id, err)
+			http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		}
+		return
+	}
+	patient := &models.Patient{Id: record.PatientId}
+	if err := vc.vs.Delete(id); err != nil {
+		vc.logger.Errorf("Error while deleting vitals %s: %v", id, err)
+		redirectError(w, r, vitalsPath(patient), err)
+		return
+	}
+	vc.logger.Infof("User %s removed the vitals taken of patient %s at %s", context.User(r.Context()).Username,
+		record.PatientId.Hex(), record.Taken.Format(time.RFC3339))
+	views.RedirectAlert(w, r, vitalsPath(patient), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "The vitals have been removed.",
+	})
+}
+
+func vitalsPath(patient *models.Patient) string {
+	return "/patients/" + patient.Id.Hex() + "/vitals"
+}
@@ -4,8 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"gcchr-system/core/controllers"
+	"gcchr-system/core/hl7"
 	"gcchr-system/core/middleware"
 	"gcchr-system/core/models"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -14,43 +16,301 @@ import (
 func main() {
 
 	prodEnv := flag.Bool("prod", false, "Set to true to run the server in production mode. core.config is required if set to true.")
+	inMemory := flag.Bool("memory", false, "Set to true to keep all data in memory instead of MongoDB. Data is lost on exit.")
 
 	flag.Parse()
 	config := models.LoadConfig(*prodEnv)
 
 	fmt.Println("This is gcchr system core.")
-	fmt.Printf("%+v\n", config)
+	fmt.Printf("%+v\n", config.Redacted())
+
+	storeConfig := models.WithMongoDB(config.MongoDB)
+	if *inMemory {
+		storeConfig = models.WithInMemoryStore()
+	}
 
 	services, err := models.NewServices(
 		models.WithLogger(config.LogConfig),
-		models.WithMongoDB(config.MongoDB),
-		models.WithUserService(config.Pepper, config.HMACKey),
+		storeConfig,
+		models.WithUserService(config.Pepper, config.HMACKey, config.LoginPolicy, config.PasswordPolicy),
+		models.WithAuditService(),
+		models.WithSessionService(config.HMACKey, config.SessionLifetime()),
+		models.WithAPITokenService(config.HMACKey),
+		models.WithSettingsService(),
+		models.WithTwoFactorService(config.EncryptionKey, config.HMACKey),
+		models.WithPatientService(),
+		models.WithScheduleService(),
+		models.WithAppointmentService(),
+		models.WithDiagnosisCodeService(config.DiagnosisCodesFile),
+		models.WithEncounterService(),
+		models.WithPrescriptionService(),
+		models.WithQueueService(),
+		models.WithCatalogueService(),
+		models.WithInvoiceService(),
+		models.WithLabService(config.LabTestsFile),
+		models.WithDocumentService(config.DocumentStorage),
+		models.WithChartService(config.DrugClassesFile),
+		models.WithImmunizationService(config.VaccineScheduleFile),
+		models.WithVitalsService(config.GrowthReferenceDir),
+		models.WithHL7MessageService(),
 	)
 	must(err)
 	defer services.Close()
 	ensureAdmin(services.User)
 
+	hl7Config := config.HL7.WithDefaults()
+	hl7Receiver := hl7.NewReceiver(services.Patient, services.Lab, services.HL7Message,
+		hl7.Application{Name: hl7Config.Application, Facility: hl7Config.Facility},
+		services.GetContextLogger("HL7Receiver"))
+	if hl7Config.Port > 0 {
+		hl7Server, err := hl7.NewServer(hl7Receiver, hl7Config.AllowedIPs, services.GetContextLogger("HL7Server"))
+		must(err)
+		l, err := net.Listen("tcp", hl7Config.Address())
+		must(err)
+		fmt.Printf("Accepting HL7 messages at %s...\n", hl7Config.Address())
+		go hl7Server.Serve(l)
+	}
+
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User, services.GetContextLogger("UserController"))
-	adminC := controllers.NewAdmin(services.User, services.GetContextLogger("AdminController"))
+	usersC := controllers.NewUsers(services.User, services.Session, services.TwoFactor, services.Audit,
+		services.GetContextLogger("UserController"))
+	twoFactorC := controllers.NewTwoFactor(services.TwoFactor, services.GetContextLogger("TwoFactorController"))
+	tokensC := controllers.NewAPITokens(services.APIToken, services.User, services.Audit, services.GetContextLogger("APITokenController"))
+	apiC := controllers.NewAPI(services.User, services.Session, services.TwoFactor, services.Patient,
+		services.Diagnosis, services.Audit, services.GetContextLogger("APIController"))
+	patientsC := controllers.NewPatients(services.Patient, services.Encounter, services.Prescription, services.Invoice,
+		services.GetContextLogger("PatientController"))
+	appointmentsC := controllers.NewAppointments(services.Appointment, services.Schedule, services.User, services.Patient,
+		services.GetContextLogger("AppointmentController"))
+	encountersC := controllers.NewEncounters(services.Encounter, services.Prescription, services.Lab, services.Document,
+		services.Chart, services.Appointment, services.Vitals, services.Patient, services.User,
+		services.GetContextLogger("EncounterController"))
+	prescriptionsC := controllers.NewPrescriptions(services.Prescription, services.Chart, services.Encounter,
+		services.Patient, services.User, services.Settings, services.GetContextLogger("PrescriptionController"))
+	queueC := controllers.NewQueue(services.Queue, services.User, services.Patient, services.GetContextLogger("QueueController"))
+	catalogueC := controllers.NewCatalogue(services.Catalogue, services.GetContextLogger("CatalogueController"))
+	invoicesC := controllers.NewInvoices(services.Invoice, services.Catalogue, services.Encounter, services.Patient,
+		services.User, services.Settings, services.GetContextLogger("InvoiceController"))
+	labC := controllers.NewLab(services.Lab, services.Chart, services.Encounter, services.Patient, services.User,
+		services.GetContextLogger("LabController"))
+	documentsC := controllers.NewDocuments(services.Document, services.Patient, services.Encounter,
+		services.GetContextLogger("DocumentController"))
+	chartC := controllers.NewChart(services.Chart, services.Patient, services.GetContextLogger("ChartController"))
+	immunizationsC := controllers.NewImmunizations(services.Immunization, services.Patient, services.User,
+		services.Settings, services.GetContextLogger("ImmunizationController"))
+	vitalsC := controllers.NewVitals(services.Vitals, services.Patient, services.GetContextLogger("VitalsController"))
+	fhirC := controllers.NewFHIR(services.Patient, services.User, services.Encounter,
+		services.GetContextLogger("FHIRController"))
+	diagnosesC := controllers.NewDiagnoses(services.Diagnosis, services.Encounter,
+		services.GetContextLogger("DiagnosesController"))
+	hl7C := controllers.NewHL7(hl7Receiver, services.HL7Message, services.GetContextLogger("HL7Controller"))
+	adminC := controllers.NewAdmin(services.User, services.Settings, services.Audit, services.HL7Message,
+		services.GetContextLogger("AdminController"))
 
 	//b, err := rand.Bytes(32)
 	must(err)
 	//csrfMw := csrf.Protect(b, csrf.Secure(config.IsProd()))
-	userMw := middleware.User{UserService: services.User}
+	userMw := middleware.User{SessionService: services.Session, APITokens: services.APIToken}
 	requireUserMw := middleware.RequireUser{User: userMw}
+	requireAdminMw := middleware.NewRequireRole(requireUserMw, models.UserRoleAdmin)
+	usersReadMw := middleware.RequireScope{Scope: models.ScopeUsersRead}
+	usersWriteMw := middleware.RequireScope{Scope: models.ScopeUsersWrite}
+	// Reception registers patients and changes their details, clinical staff can look them up.
+	requireReceptionMw := middleware.NewRequireRole(requireUserMw, models.UserRoleAdmin, models.UserRoleReception)
+	requireClinicMw := middleware.NewRequireRole(requireUserMw, models.UserRoleAdmin, models.UserRoleReception,
+		models.UserRolePhysician, models.UserRoleStaff)
+	// Clinical notes are read by clinical staff and written by physicians, reception can not see them.
+	requireClinicianMw := middleware.NewRequireRole(requireUserMw, models.UserRoleAdmin, models.UserRolePhysician,
+		models.UserRoleStaff)
+	requirePhysicianMw := middleware.NewRequireRole(requireUserMw, models.UserRoleAdmin, models.UserRolePhysician)
+	patientsReadMw := middleware.RequireScope{Scope: models.ScopePatientsRead}
+	patientsWriteMw := middleware.RequireScope{Scope: models.ScopePatientsWrite}
+	encountersReadMw := middleware.RequireScope{Scope: models.ScopeEncountersRead}
 
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
 	r.Handle("/login", usersC.LoginView).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/login/2fa", usersC.LoginTwoFactor).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.LoginTwoFactorVerify).Methods("POST")
+	r.HandleFunc("/reset-password", usersC.ResetPasswordWithToken).Methods("GET")
+	r.HandleFunc("/reset-password", usersC.CompleteReset).Methods("POST")
 	r.HandleFunc("/logout", requireUserMw.ApplyFunc(usersC.Logout)).Methods("POST")
 
+	// Profile
+	r.HandleFunc("/profile/password", requireUserMw.ApplyFunc(usersC.ChangePassword)).Methods("GET")
+	r.HandleFunc("/profile/password", requireUserMw.ApplyFunc(usersC.UpdatePassword)).Methods("POST")
+	r.HandleFunc("/profile/tokens", requireUserMw.ApplyFunc(tokensC.Index)).Methods("GET")
+	r.HandleFunc("/profile/tokens", requireUserMw.ApplyFunc(tokensC.Create)).Methods("POST")
+	r.HandleFunc("/profile/tokens/{tid}/revoke", requireUserMw.ApplyFunc(tokensC.Revoke)).Methods("POST")
+	r.HandleFunc("/profile/sessions", requireUserMw.ApplyFunc(usersC.Sessions)).Methods("GET")
+	r.HandleFunc("/profile/sessions/{id}/revoke", requireUserMw.ApplyFunc(usersC.RevokeSession)).Methods("POST")
+	r.HandleFunc("/profile/2fa", requireUserMw.ApplyFunc(twoFactorC.Status)).Methods("GET")
+	r.HandleFunc("/profile/2fa/enroll", requireUserMw.ApplyFunc(twoFactorC.Enroll)).Methods("POST")
+	r.HandleFunc("/profile/2fa/confirm", requireUserMw.ApplyFunc(twoFactorC.Confirm)).Methods("POST")
+	r.HandleFunc("/profile/2fa/recovery-codes", requireUserMw.ApplyFunc(twoFactorC.RecoveryCodes)).Methods("POST")
+	r.HandleFunc("/profile/2fa/disable", requireUserMw.ApplyFunc(twoFactorC.Disable)).Methods("POST")
+
 	// Admin
-	r.HandleFunc("/admin/dashboard", requireUserMw.ApplyFunc(adminC.Dashboard)).Methods("GET")
-	r.HandleFunc("/newuser", requireUserMw.ApplyFunc(usersC.New)).Methods("GET")
-	r.HandleFunc("/newuser", requireUserMw.ApplyFunc(usersC.Create)).Methods("POST")
+	r.HandleFunc("/admin/dashboard", requireAdminMw.ApplyFunc(adminC.Dashboard)).Methods("GET")
+	r.HandleFunc("/admin/security", requireAdminMw.ApplyFunc(adminC.Security)).Methods("GET")
+	r.HandleFunc("/admin/security", requireAdminMw.ApplyFunc(adminC.SaveSecurity)).Methods("POST")
+	r.HandleFunc("/admin/clinic", requireAdminMw.ApplyFunc(adminC.Clinic)).Methods("GET")
+	r.HandleFunc("/admin/clinic", requireAdminMw.ApplyFunc(adminC.SaveClinic)).Methods("POST")
+	r.HandleFunc("/admin/audit", requireAdminMw.ApplyFunc(adminC.Audit)).Methods("GET")
+	r.HandleFunc("/admin/catalogue", requireAdminMw.ApplyFunc(catalogueC.Index)).Methods("GET")
+	r.HandleFunc("/admin/catalogue", requireAdminMw.ApplyFunc(catalogueC.Create)).Methods("POST")
+	r.HandleFunc("/admin/catalogue/{id}/edit", requireAdminMw.ApplyFunc(catalogueC.Edit)).Methods("GET")
+	r.HandleFunc("/admin/catalogue/{id}/update", requireAdminMw.ApplyFunc(catalogueC.Update)).Methods("POST")
+	r.HandleFunc("/newuser", requireAdminMw.ApplyFunc(usersC.New)).Methods("GET")
+	r.HandleFunc("/newuser", requireAdminMw.ApplyFunc(usersC.Create)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}", requireAdminMw.ApplyFunc(usersC.Show)).Methods("GET")
+	r.HandleFunc("/admin/users/{id}/edit", requireAdminMw.ApplyFunc(usersC.Edit)).Methods("GET")
+	r.HandleFunc("/admin/users/{id}/update", requireAdminMw.ApplyFunc(usersC.Update)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/password", requireAdminMw.ApplyFunc(usersC.ResetPassword)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/tokens", requireAdminMw.ApplyFunc(tokensC.UserIndex)).Methods("GET")
+	r.HandleFunc("/admin/users/{id}/tokens", requireAdminMw.ApplyFunc(tokensC.UserCreate)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/tokens/{tid}/revoke", requireAdminMw.ApplyFunc(tokensC.UserRevoke)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/reset-token", requireAdminMw.ApplyFunc(usersC.ResetLink)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/disable", requireAdminMw.ApplyFunc(usersC.Disable)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/enable", requireAdminMw.ApplyFunc(usersC.Enable)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/unlock", requireAdminMw.ApplyFunc(usersC.Unlock)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/2fa/reset", requireAdminMw.ApplyFunc(usersC.ResetTwoFactor)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/delete", requireAdminMw.ApplyFunc(usersC.Delete)).Methods("POST")
+
+	// Patients
+	r.HandleFunc("/patients", requireClinicMw.ApplyFunc(patientsC.Index)).Methods("GET")
+	r.HandleFunc("/patients", requireReceptionMw.ApplyFunc(patientsC.Create)).Methods("POST")
+	r.HandleFunc("/patients/new", requireReceptionMw.ApplyFunc(patientsC.New)).Methods("GET")
+	r.HandleFunc("/patients/{id}", requireClinicMw.ApplyFunc(patientsC.Show)).Methods("GET")
+	r.HandleFunc("/patients/{id}/edit", requireReceptionMw.ApplyFunc(patientsC.Edit)).Methods("GET")
+	r.HandleFunc("/patients/{id}/update", requireReceptionMw.ApplyFunc(patientsC.Update)).Methods("POST")
+	r.HandleFunc("/patients/{id}/delete", requireAdminMw.ApplyFunc(patientsC.Delete)).Methods("POST")
+
+	// Appointments
+	r.HandleFunc("/appointments", requireClinicMw.ApplyFunc(appointmentsC.Calendar)).Methods("GET")
+	r.HandleFunc("/appointments", requireReceptionMw.ApplyFunc(appointmentsC.Create)).Methods("POST")
+	r.HandleFunc("/appointments/new", requireReceptionMw.ApplyFunc(appointmentsC.New)).Methods("GET")
+	r.HandleFunc("/appointments/{id}", requireClinicMw.ApplyFunc(appointmentsC.Show)).Methods("GET")
+	r.HandleFunc("/appointments/{id}/reschedule", requireReceptionMw.ApplyFunc(appointmentsC.Reschedule)).Methods("POST")
+	r.HandleFunc("/appointments/{id}/cancel", requireReceptionMw.ApplyFunc(appointmentsC.Cancel)).Methods("POST")
+	r.HandleFunc("/appointments/{id}/no-show", requireReceptionMw.ApplyFunc(appointmentsC.NoShow)).Methods("POST")
+	r.HandleFunc("/physicians/{id}/availability", requireClinicMw.ApplyFunc(appointmentsC.Availability)).Methods("GET")
+	r.HandleFunc("/physicians/{id}/availability", requireClinicMw.ApplyFunc(appointmentsC.SaveAvailability)).Methods("POST")
+	r.HandleFunc("/physicians/{id}/exceptions", requireClinicMw.ApplyFunc(appointmentsC.CreateException)).Methods("POST")
+	r.HandleFunc("/physicians/{id}/exceptions/{eid}/delete", requireClinicMw.ApplyFunc(appointmentsC.DeleteException)).Methods("POST")
+
+	// Walk-in queue
+	r.HandleFunc("/queue", requireClinicMw.ApplyFunc(queueC.Desk)).Methods("GET")
+	r.HandleFunc("/queue", requireReceptionMw.ApplyFunc(queueC.CheckIn)).Methods("POST")
+	r.HandleFunc("/queue/call-next", requirePhysicianMw.ApplyFunc(queueC.CallNext)).Methods("POST")
+	r.HandleFunc("/queue/display", requireClinicMw.ApplyFunc(queueC.Display)).Methods("GET")
+	r.HandleFunc("/queue/display.json", requireClinicMw.ApplyFunc(queueC.DisplayJSON)).Methods("GET")
+	r.HandleFunc("/queue/{id}/status", requireClinicMw.ApplyFunc(queueC.Advance)).Methods("POST")
+
+	// Allergies, problems and medications
+	r.HandleFunc("/patients/{id}/chart", requireClinicianMw.ApplyFunc(chartC.Show)).Methods("GET")
+	r.HandleFunc("/patients/{id}/allergies", requireClinicianMw.ApplyFunc(chartC.CreateAllergy)).Methods("POST")
+	r.HandleFunc("/patients/{id}/problems", requireClinicianMw.ApplyFunc(chartC.CreateProblem)).Methods("POST")
+	r.HandleFunc("/patients/{id}/medications", requireClinicianMw.ApplyFunc(chartC.CreateMedication)).Methods("POST")
+	r.HandleFunc("/allergies/{id}/delete", requireClinicianMw.ApplyFunc(chartC.DeleteAllergy)).Methods("POST")
+	r.HandleFunc("/problems/{id}/resolve", requireClinicianMw.ApplyFunc(chartC.ResolveProblem)).Methods("POST")
+	r.HandleFunc("/medications/{id}/stop", requireClinicianMw.ApplyFunc(chartC.StopMedication)).Methods("POST")
+
+	// Encounters
+	r.HandleFunc("/patients/{id}/encounters", requirePhysicianMw.ApplyFunc(encountersC.Create)).Methods("POST")
+	r.HandleFunc("/encounters/{id}", requireClinicianMw.ApplyFunc(encountersC.Show)).Methods("GET")
+	r.HandleFunc("/encounters/{id}/update", requirePhysicianMw.ApplyFunc(encountersC.Update)).Methods("POST")
+	r.HandleFunc("/encounters/{id}/sign", requirePhysicianMw.ApplyFunc(encountersC.Sign)).Methods("POST")
+	r.HandleFunc("/encounters/{id}/addenda", requirePhysicianMw.ApplyFunc(encountersC.Addend)).Methods("POST")
+
+	// Prescriptions
+	r.HandleFunc("/encounters/{id}/prescriptions/new", requirePhysicianMw.ApplyFunc(prescriptionsC.New)).Methods("GET")
+	r.HandleFunc("/encounters/{id}/prescriptions", requirePhysicianMw.ApplyFunc(prescriptionsC.Create)).Methods("POST")
+	r.HandleFunc("/prescriptions/{id}", requireClinicianMw.ApplyFunc(prescriptionsC.Show)).Methods("GET")
+	r.HandleFunc("/prescriptions/{id}/print", requireClinicianMw.ApplyFunc(prescriptionsC.Print)).Methods("GET")
+	r.HandleFunc("/prescriptions/{id}/renew", requirePhysicianMw.ApplyFunc(prescriptionsC.Renew)).Methods("POST")
+
+	// Lab
+	r.HandleFunc("/encounters/{id}/lab-orders/new", requirePhysicianMw.ApplyFunc(labC.New)).Methods("GET")
+	r.HandleFunc("/encounters/{id}/lab-orders", requirePhysicianMw.ApplyFunc(labC.Create)).Methods("POST")
+	r.HandleFunc("/lab-orders", requireClinicianMw.ApplyFunc(labC.Index)).Methods("GET")
+	r.HandleFunc("/lab-orders/{id}", requireClinicianMw.ApplyFunc(labC.Show)).Methods("GET")
+	r.HandleFunc("/lab-orders/{id}/results", requireClinicianMw.ApplyFunc(labC.Results)).Methods("POST")
+	r.HandleFunc("/patients/{id}/lab", requireClinicianMw.ApplyFunc(labC.Patient)).Methods("GET")
+	r.HandleFunc("/lab/import", requireClinicianMw.ApplyFunc(labC.ImportForm)).Methods("GET")
+	r.HandleFunc("/lab/import", requireClinicianMw.ApplyFunc(labC.Import)).Methods("POST")
+
+	// Documents, reception only sees the documents it scans in. Images are served under /images to be shown in pages.
+	r.HandleFunc("/patients/{id}/documents", requireClinicMw.ApplyFunc(documentsC.Index)).Methods("GET")
+	r.HandleFunc("/patients/{id}/documents", requireClinicMw.ApplyFunc(documentsC.Upload)).Methods("POST")
+	r.HandleFunc("/documents/{id}/download", requireClinicMw.ApplyFunc(documentsC.Download)).Methods("GET")
+	r.HandleFunc("/documents/{id}/delete", requireAdminMw.ApplyFunc(documentsC.Delete)).Methods("POST")
+	r.HandleFunc("/images/{id}", requireClinicMw.ApplyFunc(documentsC.Image)).Methods("GET")
+
+	// Immunizations, recorded by clinical staff. Reception calls in the patients due and prints their cards.
+	r.HandleFunc("/immunizations/due", requireClinicMw.ApplyFunc(immunizationsC.Due)).Methods("GET")
+	r.HandleFunc("/patients/{id}/immunizations", requireClinicMw.ApplyFunc(immunizationsC.Index)).Methods("GET")
+	r.HandleFunc("/patients/{id}/immunizations", requireClinicianMw.ApplyFunc(immunizationsC.Create)).Methods("POST")
+	r.HandleFunc("/patients/{id}/immunizations/card", requireClinicMw.ApplyFunc(immunizationsC.Card)).Methods("GET")
+	r.HandleFunc("/immunizations/{id}/delete", requireAdminMw.ApplyFunc(immunizationsC.Delete)).Methods("POST")
+
+	// Vitals, taken by clinical staff at check-in and copied into the encounter started the same day.
+	r.HandleFunc("/patients/{id}/vitals", requireClinicianMw.ApplyFunc(vitalsC.Index)).Methods("GET")
+	r.HandleFunc("/patients/{id}/vitals", requireClinicianMw.ApplyFunc(vitalsC.Create)).Methods("POST")
+	r.HandleFunc("/vitals/{id}/delete", requireAdminMw.ApplyFunc(vitalsC.Delete)).Methods("POST")
+
+	// Diagnosis codes, searched while coding encounters and replaced by admins without a restart.
+	r.HandleFunc("/admin/diagnosis-codes", requireAdminMw.ApplyFunc(diagnosesC.Codes)).Methods("GET")
+	r.HandleFunc("/admin/diagnosis-codes", requireAdminMw.ApplyFunc(diagnosesC.Upload)).Methods("POST")
+	r.HandleFunc("/admin/diagnosis-codes/reload", requireAdminMw.ApplyFunc(diagnosesC.Reload)).Methods("POST")
+	r.HandleFunc("/reports/diagnoses", requireClinicianMw.ApplyFunc(diagnosesC.Report)).Methods("GET")
+
+	// HL7 messages which failed, reviewed by admins and processed again once the cause is fixed.
+	r.HandleFunc("/admin/hl7", requireAdminMw.ApplyFunc(hl7C.Index)).Methods("GET")
+	r.HandleFunc("/admin/hl7/{id}", requireAdminMw.ApplyFunc(hl7C.Show)).Methods("GET")
+	r.HandleFunc("/admin/hl7/{id}/retry", requireAdminMw.ApplyFunc(hl7C.Retry)).Methods("POST")
+	r.HandleFunc("/admin/hl7/{id}/dismiss", requireAdminMw.ApplyFunc(hl7C.Dismiss)).Methods("POST")
+
+	// Billing
+	r.HandleFunc("/invoices", requireReceptionMw.ApplyFunc(invoicesC.Index)).Methods("GET")
+	r.HandleFunc("/invoices/report", requireReceptionMw.ApplyFunc(invoicesC.Report)).Methods("GET")
+	r.HandleFunc("/encounters/{id}/invoices/new", requireReceptionMw.ApplyFunc(invoicesC.New)).Methods("GET")
+	r.HandleFunc("/encounters/{id}/invoices", requireReceptionMw.ApplyFunc(invoicesC.Create)).Methods("POST")
+	r.HandleFunc("/invoices/{id}", requireReceptionMw.ApplyFunc(invoicesC.Show)).Methods("GET")
+	r.HandleFunc("/invoices/{id}/print", requireReceptionMw.ApplyFunc(invoicesC.Print)).Methods("GET")
+	r.HandleFunc("/invoices/{id}/payments", requireReceptionMw.ApplyFunc(invoicesC.Pay)).Methods("POST")
+	r.HandleFunc("/invoices/{id}/cancel", requireAdminMw.ApplyFunc(invoicesC.Cancel)).Methods("POST")
+	r.HandleFunc("/payments/{id}/receipt", requireReceptionMw.ApplyFunc(invoicesC.Receipt)).Methods("GET")
+
+	// JSON API, authenticated with "Authorization: Bearer" tokens or the session cookie.
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(apiC.NotFound)
+	api.HandleFunc("/login", apiC.Login).Methods("POST")
+	api.HandleFunc("/me", requireUserMw.ApplyFunc(apiC.Me)).Methods("GET")
+	api.HandleFunc("/users", requireAdminMw.ApplyFunc(usersReadMw.ApplyFunc(apiC.Users))).Methods("GET")
+	api.HandleFunc("/users", requireAdminMw.ApplyFunc(usersWriteMw.ApplyFunc(apiC.CreateUser))).Methods("POST")
+	api.HandleFunc("/users/{id}", requireAdminMw.ApplyFunc(usersReadMw.ApplyFunc(apiC.User))).Methods("GET")
+	api.HandleFunc("/users/{id}", requireAdminMw.ApplyFunc(usersWriteMw.ApplyFunc(apiC.UpdateUser))).Methods("PATCH", "PUT")
+	api.HandleFunc("/users/{id}", requireAdminMw.ApplyFunc(usersWriteMw.ApplyFunc(apiC.DeleteUser))).Methods("DELETE")
+	api.HandleFunc("/patients", requireClinicMw.ApplyFunc(patientsReadMw.ApplyFunc(apiC.Patients))).Methods("GET")
+	api.HandleFunc("/patients", requireReceptionMw.ApplyFunc(patientsWriteMw.ApplyFunc(apiC.CreatePatient))).Methods("POST")
+	api.HandleFunc("/patients/{id}", requireClinicMw.ApplyFunc(patientsReadMw.ApplyFunc(apiC.Patient))).Methods("GET")
+	api.HandleFunc("/patients/{id}", requireReceptionMw.ApplyFunc(patientsWriteMw.ApplyFunc(apiC.UpdatePatient))).Methods("PATCH", "PUT")
+	api.HandleFunc("/diagnosis-codes", requireClinicianMw.ApplyFunc(apiC.DiagnosisCodes)).Methods("GET")
+	api.HandleFunc("/diagnosis-codes/{code}", requireClinicianMw.ApplyFunc(apiC.DiagnosisCode)).Methods("GET")
+
+	// FHIR R4 facade, read only and authenticated like the JSON API.
+	fhirR := r.PathPrefix("/fhir").Subrouter()
+	fhirR.HandleFunc("/metadata", fhirC.Metadata).Methods("GET")
+	fhirR.HandleFunc("/Patient", requireClinicMw.ApplyFunc(patientsReadMw.ApplyFunc(fhirC.SearchPatients))).Methods("GET")
+	fhirR.HandleFunc("/Patient/{id}", requireClinicMw.ApplyFunc(patientsReadMw.ApplyFunc(fhirC.Patient))).Methods("GET")
+	fhirR.HandleFunc("/Practitioner", requireClinicMw.ApplyFunc(patientsReadMw.ApplyFunc(fhirC.SearchPractitioners))).Methods("GET")
+	fhirR.HandleFunc("/Practitioner/{id}", requireClinicMw.ApplyFunc(patientsReadMw.ApplyFunc(fhirC.Practitioner))).Methods("GET")
+	fhirR.HandleFunc("/Encounter", requireClinicianMw.ApplyFunc(encountersReadMw.ApplyFunc(fhirC.SearchEncounters))).Methods("GET")
+	fhirR.HandleFunc("/Encounter/{id}", requireClinicianMw.ApplyFunc(encountersReadMw.ApplyFunc(fhirC.Encounter))).Methods("GET")
+	fhirR.PathPrefix("/").HandlerFunc(fhirC.NotSupported)
 
 	// Assets
 	assetHandler := http.FileServer(http.Dir("./core/assets"))
@@ -0,0 +1,147 @@
+package fhir
+
+import "time"
+
+// CapabilityStatement describes what the server supports, served at /fhir/metadata.
+type CapabilityStatement struct {
+	ResourceType   string           `json:"resourceType"`
+	Status         string           `json:"status"`
+	Date           string           `json:"date"`
+	Kind           string           `json:"kind"`
+	Software       Software         `json:"software"`
+	Implementation Implementation   `json:"implementation"`
+	FhirVersion    string           `json:"fhirVersion"`
+	Format         []string         `json:"format"`
+	Rest           []CapabilityRest `json:"rest"`
+}
+
+type Software struct {
+	Name string `json:"name"`
+}
+
+type Implementation struct {
+	Description string `json:"description"`
+	URL         string `json:"url"`
+}
+
+type CapabilityRest struct {
+	Mode        string               `json:"mode"`
+	Security    CapabilitySecurity   `json:"security"`
+	Resource    []CapabilityResource `json:"resource"`
+	SearchParam []SearchParam        `json:"searchParam"`
+}
+
+type CapabilitySecurity struct {
+	Description string `json:"description"`
+}
+
+type CapabilityResource struct {
+	Type        string        `json:"type"`
+	Interaction []Interaction `json:"interaction"`
+	SearchParam []SearchParam `json:"searchParam"`
+}
+
+type Interaction struct {
+	Code string `json:"code"`
+}
+
+type SearchParam struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Documentation string `json:"documentation,omitempty"`
+}
+
+// CommonSearchParams are supported for every resource type.
+var CommonSearchParams = []SearchParam{
+	{Name: ParamCount, Type: "number", Documentation: "Number of results on a page, at most 100."},
+	{Name: ParamPage, Type: "number", Documentation: "Page of the results, starting at 1. Follow the links of the bundle."},
+}
+
+// Resources are the resource types served, with their search parameters.
+var Resources = []CapabilityResource{
+	{
+		Type:        "Patient",
+		Interaction: []Interaction{{Code: "read"}, {Code: "search-type"}},
+		SearchParam: []SearchParam{
+			{Name: "_id", Type: "token"},
+			{Name: "identifier", Type: "token", Documentation: "The medical record number, with the system " +
+				SystemPrefix + "mrn, or another identifier of the patient like " + SystemPrefix + "aadhaar|1234."},
+			{Name: "name", Type: "string", Documentation: "Start of the first or last name, or of a word of them."},
+			{Name: "birthdate", Type: "date"},
+		},
+	},
+	{
+		Type:        "Practitioner",
+		Interaction: []Interaction{{Code: "read"}, {Code: "search-type"}},
+		SearchParam: []SearchParam{
+			{Name: "_id", Type: "token"},
+			{Name: "identifier", Type: "token", Documentation: "The username, with the system " + SystemUsername +
+				", or the medical council registration number, with the system " + SystemRegistration + "."},
+			{Name: "name", Type: "string", Documentation: "Start of the name, or of a word of it."},
+		},
+	},
+	{
+		Type:        "Encounter",
+		Interaction: []Interaction{{Code: "read"}, {Code: "search-type"}},
+		SearchParam: []SearchParam{
+			{Name: "_id", Type: "token"},
+			{Name: "patient", Type: "reference", Documentation: "Also chained as patient.identifier."},
+			{Name: "subject", Type: "reference"},
+			{Name: "practitioner", Type: "reference"},
+			{Name: "participant", Type: "reference"},
+			{Name: "date", Type: "date", Documentation: "Start of the encounter."},
+		},
+	},
+}
+
+// NewCapabilityStatement describes the server at the base URL, published at the time.
+func NewCapabilityStatement(base string, published time.Time) CapabilityStatement {
+	return CapabilityStatement{
+		ResourceType: "CapabilityStatement",
+		Status:       "active",
+		Date:         formatInstant(published),
+		Kind:         "instance",
+		Software:     Software{Name: "gcchr system core"},
+		Implementation: Implementation{
+			Description: "Read only FHIR facade of the clinic records",
+			URL:         base,
+		},
+		FhirVersion: Version,
+		Format:      []string{"json"},
+		Rest: []CapabilityRest{{
+			Mode: "server",
+			Security: CapabilitySecurity{
+				Description: "Send an API token as \"Authorization: Bearer <token>\". Patients and practitioners " +
+					"need the scope patients:read, encounters encounters:read.",
+			},
+			Resource:    Resources,
+			SearchParam: CommonSearchParams,
+		}},
+	}
+}
+
+// SupportsParam reports whether the search parameter is supported for the resource type.
+func SupportsParam(resourceType, name string) bool {
+	if name == ParamFormat {
+		return true
+	}
+	for _, p := range CommonSearchParams {
+		if p.Name == name {
+			return true
+		}
+	}
+	if resourceType == "Encounter" && name == "patient.identifier" {
+		return true
+	}
+	for _, r := range Resources {
+		if r.Type != resourceType {
+			continue
+		}
+		for _, p := range r.SearchParam {
+			if p.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
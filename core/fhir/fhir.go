@@ -0,0 +1,185 @@
+// Package fhir maps the records of the clinic to FHIR R4 resources, so that they can be shared with other systems.
+// Only the elements the clinic records are mapped, see https://hl7.org/fhir/R4 for the resources.
+package fhir
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// Version is the FHIR version of the resources.
+	Version = "4.0.1"
+	// ContentType is the media type of FHIR resources in JSON.
+	ContentType = "application/fhir+json"
+
+	// dateFormat and instantFormat are the formats of the date and instant types.
+	dateFormat    = "2006-01-02"
+	instantFormat = time.RFC3339
+)
+
+// Code systems and identifier systems used by the resources. The records of the clinic are identified with URNs
+// starting with SystemPrefix, like urn:gcchr:mrn for medical record numbers.
+const (
+	SystemPrefix         = "urn:gcchr:"
+	SystemUsername       = SystemPrefix + "username"
+	SystemRegistration   = SystemPrefix + "registration-number"
+	SystemICD10          = "http://hl7.org/fhir/sid/icd-10"
+	SystemActCode        = "http://terminology.hl7.org/CodeSystem/v3-ActCode"
+	SystemIdentifierType = "http://terminology.hl7.org/CodeSystem/v2-0203"
+	SystemContactRole    = "http://terminology.hl7.org/CodeSystem/v2-0131"
+)
+
+// Issue types of OperationOutcome issues.
+const (
+	IssueInvalid      = "invalid"
+	IssueLogin        = "login"
+	IssueForbidden    = "forbidden"
+	IssueNotFound     = "not-found"
+	IssueNotSupported = "not-supported"
+	IssueException    = "exception"
+)
+
+type Meta struct {
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Identifier struct {
+	Use    string           `json:"use,omitempty"`
+	Type   *CodeableConcept `json:"type,omitempty"`
+	System string           `json:"system,omitempty"`
+	Value  string           `json:"value"`
+}
+
+type HumanName struct {
+	Use    string   `json:"use,omitempty"`
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+type ContactPoint struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+	Use    string `json:"use,omitempty"`
+}
+
+type Address struct {
+	Use        string   `json:"use,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Line       []string `json:"line,omitempty"`
+	City       string   `json:"city,omitempty"`
+	State      string   `json:"state,omitempty"`
+	PostalCode string   `json:"postalCode,omitempty"`
+	Country    string   `json:"country,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference"`
+	Display   string `json:"display,omitempty"`
+}
+
+type Period struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// Bundle holds the results of a search.
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"`
+	Total        int           `json:"total"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+type BundleEntry struct {
+	FullURL  string       `json:"fullUrl"`
+	Resource interface{}  `json:"resource"`
+	Search   *BundleMatch `json:"search,omitempty"`
+}
+
+type BundleMatch struct {
+	Mode string `json:"mode"`
+}
+
+// NewSearchSet returns the bundle of a page of search results, with the number of all results.
+func NewSearchSet(total int) Bundle {
+	return Bundle{ResourceType: "Bundle", Type: "searchset", Total: total}
+}
+
+// Add adds a resource found by the search, which can be read at the url.
+func (b *Bundle) Add(url string, resource interface{}) {
+	b.Entry = append(b.Entry, BundleEntry{FullURL: url, Resource: resource, Search: &BundleMatch{Mode: "match"}})
+}
+
+// OperationOutcome describes why a request failed.
+type OperationOutcome struct {
+	ResourceType string  `json:"resourceType"`
+	Issue        []Issue `json:"issue"`
+}
+
+type Issue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+// NewOperationOutcome returns an outcome with a single error of the issue type.
+func NewOperationOutcome(code, diagnostics string) OperationOutcome {
+	return OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []Issue{{Severity: "error", Code: code, Diagnostics: diagnostics}},
+	}
+}
+
+// IssueForStatus returns the issue type of errors answered with the HTTP status code.
+func IssueForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return IssueInvalid
+	case http.StatusUnauthorized:
+		return IssueLogin
+	case http.StatusForbidden:
+		return IssueForbidden
+	case http.StatusNotFound:
+		return IssueNotFound
+	case http.StatusMethodNotAllowed, http.StatusNotAcceptable:
+		return IssueNotSupported
+	default:
+		return IssueException
+	}
+}
+
+func formatInstant(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(instantFormat)
+}
+
+func lastUpdated(created, updated time.Time) *Meta {
+	if updated.IsZero() {
+		updated = created
+	}
+	if updated.IsZero() {
+		return nil
+	}
+	return &Meta{LastUpdated: formatInstant(updated)}
+}
@@ -0,0 +1,254 @@
+package fhir
+
+import (
+	"strconv"
+	"strings"
+
+	"gcchr-system/core/models"
+)
+
+type Patient struct {
+	ResourceType string           `json:"resourceType"`
+	Id           string           `json:"id"`
+	Meta         *Meta            `json:"meta,omitempty"`
+	Identifier   []Identifier     `json:"identifier,omitempty"`
+	Active       bool             `json:"active"`
+	Name         []HumanName      `json:"name,omitempty"`
+	Telecom      []ContactPoint   `json:"telecom,omitempty"`
+	Gender       string           `json:"gender,omitempty"`
+	BirthDate    string           `json:"birthDate,omitempty"`
+	Address      []Address        `json:"address,omitempty"`
+	Contact      []PatientContact `json:"contact,omitempty"`
+}
+
+// PatientContact is the guardian or the emergency contact of a patient.
+type PatientContact struct {
+	Relationship []CodeableConcept `json:"relationship,omitempty"`
+	Name         *HumanName        `json:"name,omitempty"`
+	Telecom      []ContactPoint    `json:"telecom,omitempty"`
+}
+
+// NewPatient maps a patient. The medical record number is the usual identifier, the other identifiers use the
+// systems returned by IdentifierSystem.
+func NewPatient(p *models.Patient) Patient {
+	patient := Patient{
+		ResourceType: "Patient",
+		Id:           p.Id.Hex(),
+		Meta:         lastUpdated(p.Created, p.Updated),
+		Active:       true,
+		Name: []HumanName{{
+			Use:    "official",
+			Text:   p.FullName(),
+			Family: p.LastName,
+			Given:  []string{p.FirstName},
+		}},
+		Telecom: contactPoints(p.Contact),
+		Gender:  string(p.Sex),
+		Address: addresses(p.Addresses),
+	}
+	if p.MRN != "" {
+		patient.Identifier = append(patient.Identifier, Identifier{
+			Use: "usual",
+			Type: &CodeableConcept{
+				Coding: []Coding{{System: SystemIdentifierType, Code: "MR", Display: "Medical record number"}},
+			},
+			System: IdentifierSystem(models.IdentifierMRN),
+			Value:  p.MRN,
+		})
+	}
+	for _, id := range p.Identifiers {
+		patient.Identifier = append(patient.Identifier, Identifier{System: IdentifierSystem(id.System), Value: id.Value})
+	}
+	if !p.DateOfBirth.IsZero() {
+		patient.BirthDate = p.DateOfBirth.Format(dateFormat)
+	}
+	if !p.Guardian.Empty() {
+		patient.Contact = append(patient.Contact, patientContact(p.Guardian, Coding{}))
+	}
+	if !p.EmergencyContact.Empty() {
+		emergency := Coding{System: SystemContactRole, Code: "C", Display: "Emergency Contact"}
+		patient.Contact = append(patient.Contact, patientContact(p.EmergencyContact, emergency))
+	}
+	return patient
+}
+
+// IdentifierSystem returns the system of identifiers issued by the system, like urn:gcchr:aadhaar.
+func IdentifierSystem(system models.IdentifierSystem) string {
+	return SystemPrefix + string(system)
+}
+
+// ParseIdentifierSystem returns the identifier system of the system URI, the reverse of IdentifierSystem.
+func ParseIdentifierSystem(uri string) (models.IdentifierSystem, bool) {
+	if !strings.HasPrefix(uri, SystemPrefix) {
+		return "", false
+	}
+	system := models.IdentifierSystem(strings.TrimPrefix(uri, SystemPrefix))
+	if system == models.IdentifierMRN {
+		return system, true
+	}
+	for _, s := range models.IdentifierSystemsList() {
+		if s == system {
+			return system, true
+		}
+	}
+	return "", false
+}
+
+func patientContact(person models.RelatedPerson, role Coding) PatientContact {
+	var contact PatientContact
+	if person.Relationship != "" || role.Code != "" {
+		relationship := CodeableConcept{Text: person.Relationship}
+		if role.Code != "" {
+			relationship.Coding = []Coding{role}
+		}
+		contact.Relationship = []CodeableConcept{relationship}
+	}
+	if person.Name != "" {
+		contact.Name = &HumanName{Text: person.Name}
+	}
+	contact.Telecom = contactPoints(person.Contact)
+	return contact
+}
+
+type Practitioner struct {
+	ResourceType string         `json:"resourceType"`
+	Id           string         `json:"id"`
+	Meta         *Meta          `json:"meta,omitempty"`
+	Identifier   []Identifier   `json:"identifier,omitempty"`
+	Active       bool           `json:"active"`
+	Name         []HumanName    `json:"name,omitempty"`
+	Telecom      []ContactPoint `json:"telecom,omitempty"`
+	Address      []Address      `json:"address,omitempty"`
+}
+
+// NewPractitioner maps a physician, identified by the username and the medical council registration number.
+// Names of users are not split into given and family names, so only their text is given.
+func NewPractitioner(u *models.User) Practitioner {
+	practitioner := Practitioner{
+		ResourceType: "Practitioner",
+		Id:           u.Id.Hex(),
+		Meta:         lastUpdated(u.Created, u.Updated),
+		Identifier:   []Identifier{{System: SystemUsername, Value: u.Username}},
+		Active:       !u.Disabled,
+		Name:         []HumanName{{Use: "official", Text: u.Name}},
+		Telecom:      contactPoints(u.Contact),
+		Address:      addresses(u.Addresses),
+	}
+	if u.RegistrationNumber != "" {
+		practitioner.Identifier = append(practitioner.Identifier, Identifier{
+			System: SystemRegistration,
+			Value:  u.RegistrationNumber,
+		})
+	}
+	return practitioner
+}
+
+type Encounter struct {
+	ResourceType string                 `json:"resourceType"`
+	Id           string                 `json:"id"`
+	Meta         *Meta                  `json:"meta,omitempty"`
+	Contained    []Condition            `json:"contained,omitempty"`
+	Status       string                 `json:"status"`
+	Class        Coding                 `json:"class"`
+	Subject      Reference              `json:"subject"`
+	Participant  []EncounterParticipant `json:"participant,omitempty"`
+	Period       *Period                `json:"period,omitempty"`
+	Diagnosis    []EncounterDiagnosis   `json:"diagnosis,omitempty"`
+}
+
+type EncounterParticipant struct {
+	Individual Reference `json:"individual"`
+}
+
+type EncounterDiagnosis struct {
+	Condition Reference `json:"condition"`
+	Rank      int       `json:"rank,omitempty"`
+}
+
+// Condition is a diagnosis of an encounter. They are contained in the encounter, as the clinic does not keep
+// diagnoses apart from encounters.
+type Condition struct {
+	ResourceType string          `json:"resourceType"`
+	Id           string          `json:"id"`
+	Code         CodeableConcept `json:"code"`
+	Subject      Reference       `json:"subject"`
+}
+
+// NewEncounter maps an encounter. Signed encounters are finished, drafts in progress. The diagnoses are ranked
+// with the primary diagnosis first. The notes of the encounter are not shared.
+func NewEncounter(e *models.Encounter) Encounter {
+	status := "in-progress"
+	if e.Signed() {
+		status = "finished"
+	}
+	patient := Reference{Reference: "Patient/" + e.PatientId.Hex()}
+	encounter := Encounter{
+		ResourceType: "Encounter",
+		Id:           e.Id.Hex(),
+		Meta:         lastUpdated(e.Created, e.Updated),
+		Status:       status,
+		Class:        Coding{System: SystemActCode, Code: "AMB", Display: "ambulatory"},
+		Subject:      patient,
+		Participant:  []EncounterParticipant{{Individual: Reference{Reference: "Practitioner/" + e.PhysicianId.Hex()}}},
+		Period:       &Period{Start: formatInstant(e.Date)},
+	}
+	rank := 2
+	for i, d := range e.Diagnoses {
+		condition := Condition{
+			ResourceType: "Condition",
+			Id:           "diagnosis" + strconv.Itoa(i+1),
+			Code:         CodeableConcept{Text: d.Description},
+			Subject:      patient,
+		}
+		if d.Code != "" {
+			condition.Code.Coding = []Coding{{System: SystemICD10, Code: d.Code, Display: d.Description}}
+		}
+		diagnosis := EncounterDiagnosis{Condition: Reference{Reference: "#" + condition.Id}}
+		if d.Primary {
+			diagnosis.Rank = 1
+		} else {
+			diagnosis.Rank = rank
+			rank++
+		}
+		encounter.Contained = append(encounter.Contained, condition)
+		encounter.Diagnosis = append(encounter.Diagnosis, diagnosis)
+	}
+	return encounter
+}
+
+func contactPoints(c models.Contact) []ContactPoint {
+	var points []ContactPoint
+	add := func(system, value, use string) {
+		if value != "" {
+			points = append(points, ContactPoint{System: system, Value: value, Use: use})
+		}
+	}
+	add("phone", c.MobilePhone, "mobile")
+	add("phone", c.HomePhone, "home")
+	add("phone", c.OfficePhone, "work")
+	add("email", c.Email, "")
+	return points
+}
+
+func addresses(list []models.Address) []Address {
+	var mapped []Address
+	for _, a := range list {
+		address := Address{City: a.City, State: a.State, Country: a.Country}
+		switch a.AddressType {
+		case models.AddressTypeHome:
+			address.Use = "home"
+		case models.AddressTypeBilling:
+			address.Use = "billing"
+		case models.AddressTypeDelivery:
+			address.Type = "postal"
+		}
+		if a.Street != "" {
+			address.Line = []string{a.Street}
+		}
+		if a.Pincode > 0 {
+			address.PostalCode = strconv.Itoa(a.Pincode)
+		}
+		mapped = append(mapped, address)
+	}
+	return mapped
+}
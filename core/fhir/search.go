@@ -0,0 +1,103 @@
+package fhir
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// DefaultCount is the number of results on a page if the search does not give a count.
+const DefaultCount = 20
+
+// Search parameters common to all resource types.
+const (
+	ParamCount  = "_count"
+	ParamPage   = "_page"
+	ParamFormat = "_format"
+)
+
+var errDateInvalid = errors.New("fhir: date search parameters are written like ge2024-03-01")
+
+// DateRange is the span of time a date search parameter matches, To excluded. Zero times leave the range open.
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// dateLayouts are the precisions a date can be searched with, with the duration they stand for.
+var dateLayouts = []struct {
+	layout string
+	next   func(time.Time) time.Time
+}{
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Second) }},
+}
+
+// ParseDate parses a date search parameter like 2024-03, ge2024-03-01 or lt2024-03-01T10:00:00+05:30. The date
+// matches the whole year, month, day or second it names; dates without a time zone are in the location.
+// The prefixes eq, ge, gt, le and lt are supported.
+func ParseDate(value string, loc *time.Location) (DateRange, error) {
+	prefix := "eq"
+	if len(value) > 2 && value[0] >= 'a' && value[0] <= 'z' {
+		prefix, value = value[:2], value[2:]
+	}
+	for _, l := range dateLayouts {
+		t, err := time.ParseInLocation(l.layout, value, loc)
+		if err != nil {
+			continue
+		}
+		start, end := t, l.next(t)
+		switch prefix {
+		case "eq":
+			return DateRange{From: start, To: end}, nil
+		case "ge":
+			return DateRange{From: start}, nil
+		case "gt":
+			return DateRange{From: end}, nil
+		case "le":
+			return DateRange{To: end}, nil
+		case "lt":
+			return DateRange{To: start}, nil
+		}
+		return DateRange{}, errDateInvalid
+	}
+	return DateRange{}, errDateInvalid
+}
+
+// Intersect returns the range matching both ranges, for search parameters given more than once.
+func (d DateRange) Intersect(other DateRange) DateRange {
+	if other.From.After(d.From) {
+		d.From = other.From
+	}
+	if !other.To.IsZero() && (d.To.IsZero() || other.To.Before(d.To)) {
+		d.To = other.To
+	}
+	return d
+}
+
+// ParseToken splits a token search parameter like urn:gcchr:mrn|GC000001 into its system and code. The system
+// is empty if the token does not have one.
+func ParseToken(value string) (system, code string) {
+	if i := strings.Index(value, "|"); i >= 0 {
+		return value[:i], value[i+1:]
+	}
+	return "", value
+}
+
+// ParseReference returns the id of a reference search parameter to a resource of the type, given as the id,
+// like Patient/123 or as an absolute URL.
+func ParseReference(value, resourceType string) (string, bool) {
+	if i := strings.LastIndex(value, resourceType+"/"); i >= 0 {
+		if i > 0 && value[i-1] != '/' {
+			return "", false
+		}
+		value = value[i+len(resourceType)+1:]
+	}
+	if value == "" || strings.Contains(value, "/") {
+		return "", false
+	}
+	return value, true
+}
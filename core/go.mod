@@ -1,5 +1,7 @@
 module gcchr-system/core
 
+go 1.27.1
+
 require (
 	github.com/Sirupsen/logrus v1.0.6
 	github.com/globalsign/mgo v0.0.0-20180828104044-6f9f54af1356
@@ -7,5 +9,11 @@ require (
 	github.com/gorilla/mux v1.6.2
 	github.com/gorilla/schema v1.0.2
 	golang.org/x/crypto v0.0.0-20180820150726-614d502a4dac
+)
+
+require (
+	github.com/gorilla/context v1.1.1 // indirect
+	github.com/gorilla/securecookie v1.1.1 // indirect
+	github.com/pkg/errors v0.8.0 // indirect
 	golang.org/x/sys v0.0.0-20180828065106-d99a578cf41b // indirect
 )
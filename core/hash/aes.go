@@ -0,0 +1,56 @@
+package hash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"gcchr-system/core/rand"
+)
+
+// AES encrypts and decrypts small secrets with AES-256-GCM.
+// The key is derived from the configured key string with SHA-256.
+type AES struct {
+	aead cipher.AEAD
+}
+
+func NewAES(key string) AES {
+	k := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		// Only happens for invalid key sizes, which is not possible with a SHA-256 sum.
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return AES{
+		aead: aead,
+	}
+}
+
+// Encrypt returns the base64 encoded nonce and ciphertext of plaintext.
+func (a AES) Encrypt(plaintext []byte) (string, error) {
+	nonce, err := rand.Bytes(a.aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := a.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt.
+func (a AES) Decrypt(encrypted string) ([]byte, error) {
+	sealed, err := base64.URLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < a.aead.NonceSize() {
+		return nil, errors.New("hash: encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:a.aead.NonceSize()], sealed[a.aead.NonceSize():]
+	return a.aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -4,24 +4,23 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
-// HMAC is a wrapper around the crypto/hmac package
+// HMAC is a wrapper around the crypto/hmac package. It is safe for concurrent use, every Hash call uses a hash of
+// its own.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
@@ -0,0 +1,31 @@
+package hash
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestHMACConcurrent hashes from many goroutines at once, as requests do with session and API tokens, and checks
+// that every digest matches the digest computed alone. Run it with -race.
+func TestHMACConcurrent(t *testing.T) {
+	h := NewHMAC("secret-hmac-key")
+	want := make([]string, 64)
+	for i := range want {
+		want[i] = h.Hash(fmt.Sprintf("token-%d", i))
+	}
+	var wg sync.WaitGroup
+	for i := range want {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				if got := h.Hash(fmt.Sprintf("token-%d", i)); got != want[i] {
+					t.Errorf("token-%d hashed to %s, want %s", i, got, want[i])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
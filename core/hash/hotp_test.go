@@ -0,0 +1,39 @@
+package hash
+
+import "testing"
+
+// The secret of the test vectors of RFC 4226 and RFC 6238, the ASCII digits 1234567890 twice.
+var rfcSecret = []byte("12345678901234567890")
+
+// TestHOTP checks the test values of RFC 4226 Appendix D.
+func TestHOTP(t *testing.T) {
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, code := range want {
+		if got := HOTP(rfcSecret, uint64(counter), 6); got != code {
+			t.Errorf("HOTP(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+// TestTOTP checks the SHA-1 test values of RFC 6238 Appendix B, with 8 digits and time steps of 30 seconds.
+func TestTOTP(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		if got := HOTP(rfcSecret, uint64(test.unix/30), 8); got != test.code {
+			t.Errorf("TOTP(time %d) = %s, want %s", test.unix, got, test.code)
+		}
+	}
+}
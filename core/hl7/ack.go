@@ -0,0 +1,103 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Acknowledgement codes of the MSA segment, in original acknowledgement mode.
+const (
+	// AckAccept tells the sender the message was processed.
+	AckAccept = "AA"
+	// AckError tells the sender the message could not be processed because of its content, sending it again
+	// unchanged fails again.
+	AckError = "AE"
+	// AckReject tells the sender the message could not be read or processed at this time.
+	AckReject = "AR"
+)
+
+// Error conditions of the ERR segment, from HL7 table 0357.
+const (
+	ConditionSegmentSequence  = "100"
+	ConditionRequiredMissing  = "101"
+	ConditionDataType         = "102"
+	ConditionTableValue       = "103"
+	ConditionUnsupportedType  = "200"
+	ConditionUnsupportedEvent = "201"
+	ConditionUnknownKey       = "204"
+	ConditionInternal         = "207"
+)
+
+// standard are the delimiters acknowledgements are written with.
+var standard = &delimiters{field: '|', component: '^', repetition: '~', escape: '\\', subcomponent: '&'}
+
+// ackSequence numbers the acknowledgements sent since the start, to give each a unique control id.
+var ackSequence uint64
+
+// Application names the receiving side of the interface in acknowledgements.
+type Application struct {
+	Name     string
+	Facility string
+}
+
+// Error is why a message could not be processed, as told to its sender.
+type Error struct {
+	// Code is AckError or AckReject.
+	Code      string
+	Condition string
+	Text      string
+}
+
+func (e *Error) Error() string {
+	return e.Text
+}
+
+func rejected(condition, text string) *Error {
+	return &Error{Code: AckReject, Condition: condition, Text: text}
+}
+
+func failed(condition, text string) *Error {
+	return &Error{Code: AckError, Condition: condition, Text: text}
+}
+
+// NewACK returns the acknowledgement of the message, received by the application at the time. The error is nil
+// for messages which were processed. The message is nil if it could not be parsed, then the acknowledgement does
+// not refer to it.
+func NewACK(msg *Message, app Application, err *Error, now time.Time) []byte {
+	code, event, version, processing, controlId := AckAccept, "", "2.5.1", "P", ""
+	receiver := []string{"", ""}
+	if msg != nil {
+		msh := msg.Header()
+		event = msh.Component(9, 2)
+		if v := msh.Value(12); v != "" {
+			version = v
+		}
+		if p := msh.Value(11); p != "" {
+			processing = p
+		}
+		controlId = msg.ControlId()
+		receiver = []string{msh.Value(3), msh.Value(4)}
+	}
+	if err != nil {
+		code = err.Code
+	}
+	id := fmt.Sprintf("%s%d", now.Format("20060102150405"), atomic.AddUint64(&ackSequence, 1))
+	msh := []string{"MSH", `^~\&`, esc(app.Name), esc(app.Facility), esc(receiver[0]), esc(receiver[1]),
+		now.Format("20060102150405-0700"), "", "ACK^" + esc(event) + "^ACK", id, esc(processing), esc(version)}
+	msa := []string{"MSA", code, esc(controlId)}
+	segments := []string{strings.Join(msh, "|"), strings.Join(msa, "|")}
+	if err != nil {
+		msa = append(msa, esc(err.Text))
+		segments[1] = strings.Join(msa, "|")
+		// ERR-3 is the condition, ERR-4 the severity and ERR-8 the message for users.
+		errSegment := []string{"ERR", "", "", err.Condition + "^^HL70357", "E", "", "", "", esc(err.Text)}
+		segments = append(segments, strings.Join(errSegment, "|"))
+	}
+	return []byte(strings.Join(segments, "\r") + "\r")
+}
+
+func esc(value string) string {
+	return escape(value, standard)
+}
@@ -0,0 +1,335 @@
+package hl7
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gcchr-system/core/models"
+)
+
+// demographicEvents are the ADT trigger events which register a patient or change the details of one. Other events,
+// like transfers and discharges, are acknowledged without changing any records, as the clinic does not keep track
+// of admissions.
+var demographicEvents = map[string]bool{
+	"A01": true, // admit
+	"A04": true, // register
+	"A05": true, // pre-admit
+	"A08": true, // update patient information
+	"A28": true, // add person information
+	"A31": true, // update person information
+}
+
+// identifierTypes map identifier type codes of PID-3, from HL7 table 0203, to the identifier systems of patients.
+// Identifiers of other types are kept as other identifiers, medical record numbers (MR) as the MRN.
+var identifierTypes = map[string]models.IdentifierSystem{
+	"NI":  models.IdentifierAadhaar,
+	"PPN": models.IdentifierPassport,
+	"MB":  models.IdentifierInsurance,
+	"SN":  models.IdentifierInsurance,
+}
+
+// sexCodes map the administrative sex of PID-8, from HL7 table 0001.
+var sexCodes = map[string]models.Sex{
+	"M": models.SexMale,
+	"F": models.SexFemale,
+	"O": models.SexOther,
+	"A": models.SexOther,
+	"U": models.SexUnknown,
+	"N": models.SexUnknown,
+}
+
+// relationships name the relationship codes of NK1-3, from HL7 table 0063, which are sent without a text.
+var relationships = map[string]string{
+	"MTH": "Mother",
+	"FTH": "Father",
+	"PAR": "Parent",
+	"GRD": "Guardian",
+	"SPO": "Spouse",
+	"CHD": "Child",
+	"SIB": "Sibling",
+	"BRO": "Brother",
+	"SIS": "Sister",
+	"GRP": "Grandparent",
+	"FND": "Friend",
+	"EMC": "Emergency contact",
+}
+
+// admit registers the patient of an ADT message, or updates the patient with the medical record number in PID-3.
+// Only the fields sent are changed, addresses and phone numbers sent as "" are cleared.
+func (rc *Receiver) admit(msg *Message) *Error {
+	event := msg.Header().Component(9, 2)
+	if event == "" {
+		if evn := msg.Segment("EVN"); evn != nil {
+			event = evn.Value(1)
+		}
+	}
+	if !demographicEvents[event] {
+		rc.logger.Infof("ADT event %s of message %s acknowledged without changes", event, msg.ControlId())
+		return nil
+	}
+	pid := msg.Segment("PID")
+	if pid == nil {
+		return failed(ConditionSegmentSequence, "The message has no PID segment")
+	}
+	mrn, identifiers := patientIdentifiers(pid)
+	if mrn == "" {
+		return failed(ConditionRequiredMissing, "The medical record number in PID-3 is missing")
+	}
+	patient, err := rc.patients.ByMRN(mrn)
+	create := false
+	if err != nil {
+		if err.Error() != models.MongoErrNotFound.Error() {
+			return rc.recordError(err)
+		}
+		patient = &models.Patient{MRN: mrn}
+		create = true
+	} else if !samePatient(patient, pid) {
+		return failed(ConditionUnknownKey, "The name or date of birth in PID does not match patient "+mrn+
+			" of the clinic, the medical record number may belong to someone else")
+	}
+	for _, id := range identifiers {
+		setIdentifier(patient, id)
+	}
+	if perr := applyPID(patient, pid); perr != nil {
+		return perr
+	}
+	applyNextOfKin(patient, msg.All("NK1"))
+	if create {
+		if patient.Sex == "" {
+			patient.Sex = models.SexUnknown
+		}
+		err = rc.patients.Create(patient)
+	} else {
+		err = rc.patients.Update(patient)
+	}
+	if err != nil {
+		return rc.recordError(err)
+	}
+	if create {
+		rc.logger.Infof("Patient %s registered by ADT^%s message %s", patient.MRN, event, msg.ControlId())
+	} else {
+		rc.logger.Infof("Patient %s updated by ADT^%s message %s", patient.MRN, event, msg.ControlId())
+	}
+	return nil
+}
+
+// samePatient reports whether the PID segment describes the patient found by the medical record number, so that a
+// number of the hospital which happens to be the number of another patient of the clinic does not overwrite that
+// patient. The family or the given name has to match, so that either can be corrected, and so does the date of birth
+// if the message has one.
+func samePatient(patient *models.Patient, pid *Segment) bool {
+	if dob := pid.Value(7); dob != "" {
+		t, err := ParseTime(dob, time.UTC)
+		if err != nil || t.Year() != patient.DateOfBirth.Year() || t.YearDay() != patient.DateOfBirth.YearDay() {
+			return false
+		}
+	}
+	name := pid.Field(5)
+	family, given := name.Component(1), name.Component(2)
+	if family != "" && strings.EqualFold(family, patient.LastName) {
+		return true
+	}
+	first := strings.Fields(patient.FirstName)
+	return given != "" && len(first) > 0 && strings.EqualFold(given, first[0])
+}
+
+// patientIdentifiers returns the medical record number of PID-3, the first identifier of type MR or the first
+// identifier if none has this type, and the other identifiers.
+func patientIdentifiers(pid *Segment) (string, []models.Identifier) {
+	var reps []Field
+	for _, rep := range pid.Field(3).Repetitions() {
+		if rep.Component(1) != "" {
+			reps = append(reps, rep)
+		}
+	}
+	if len(reps) == 0 {
+		return "", nil
+	}
+	mrn := 0
+	for i, rep := range reps {
+		if strings.ToUpper(rep.Component(5)) == "MR" {
+			mrn = i
+			break
+		}
+	}
+	var identifiers []models.Identifier
+	for i, rep := range reps {
+		if i == mrn {
+			continue
+		}
+		system, ok := identifierTypes[strings.ToUpper(rep.Component(5))]
+		if !ok {
+			system = models.IdentifierOther
+		}
+		identifiers = append(identifiers, models.Identifier{System: system, Value: rep.Component(1)})
+	}
+	return reps[mrn].Component(1), identifiers
+}
+
+// setIdentifier replaces the identifier of the patient issued by the same system.
+func setIdentifier(patient *models.Patient, id models.Identifier) {
+	for i := range patient.Identifiers {
+		if patient.Identifiers[i].System == id.System {
+			patient.Identifiers[i].Value = id.Value
+			return
+		}
+	}
+	patient.Identifiers = append(patient.Identifiers, id)
+}
+
+// applyPID copies the name, date of birth, sex, address and phone numbers of the PID segment to the patient.
+func applyPID(patient *models.Patient, pid *Segment) *Error {
+	if name := pid.Field(5); name.Value() != "" || name.Component(2) != "" {
+		patient.LastName = name.Component(1)
+		patient.FirstName = strings.TrimSpace(name.Component(2) + " " + name.Component(3))
+	}
+	if dob := pid.Value(7); dob != "" {
+		t, err := ParseTime(dob, time.UTC)
+		if err != nil {
+			return failed(ConditionDataType, "The date of birth in PID-7 must be a date like 20240301")
+		}
+		patient.DateOfBirth = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	if code := pid.Value(8); code != "" {
+		sex, ok := sexCodes[strings.ToUpper(code)]
+		if !ok {
+			return failed(ConditionTableValue, "The sex in PID-8 must be one of M, F, O, A, U or N")
+		}
+		patient.Sex = sex
+	}
+	applyAddresses(patient, pid.Field(11))
+	applyPhones(&patient.Contact, pid.Field(13), false)
+	applyPhones(&patient.Contact, pid.Field(14), true)
+	return nil
+}
+
+// applyAddresses replaces the addresses of the patient with the types sent in PID-11: home (H), mailing (M) and
+// billing (B) addresses. Addresses without a type are home addresses.
+func applyAddresses(patient *models.Patient, field Field) {
+	if field.Null() {
+		patient.Addresses = nil
+		return
+	}
+	for _, rep := range field.Repetitions() {
+		var addressType models.AddressType
+		switch strings.ToUpper(rep.Component(7)) {
+		case "", "H":
+			addressType = models.AddressTypeHome
+		case "M":
+			addressType = models.AddressTypeDelivery
+		case "B":
+			addressType = models.AddressTypeBilling
+		default:
+			continue
+		}
+		address := models.Address{
+			AddressType: addressType,
+			Street:      strings.TrimSpace(rep.Component(1) + " " + rep.Component(2)),
+			City:        rep.Component(3),
+			State:       rep.Component(4),
+			Country:     rep.Component(6),
+		}
+		address.Pincode, _ = strconv.Atoi(strings.Replace(rep.Component(5), " ", "", -1))
+		replaced := false
+		for i := range patient.Addresses {
+			if patient.Addresses[i].AddressType == addressType {
+				patient.Addresses[i] = address
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			patient.Addresses = append(patient.Addresses, address)
+		}
+	}
+}
+
+// applyPhones copies the phone numbers and the email address of a PID-13 or NK1-5 field, or of PID-14 if work is
+// set, to the contact.
+func applyPhones(contact *models.Contact, field Field, work bool) {
+	if field.Null() {
+		if work {
+			contact.OfficePhone = ""
+		} else {
+			contact.HomePhone, contact.MobilePhone, contact.Email = "", "", ""
+		}
+		return
+	}
+	for _, rep := range field.Repetitions() {
+		use, equipment := strings.ToUpper(rep.Component(2)), strings.ToUpper(rep.Component(3))
+		if use == "NET" || equipment == "INTERNET" || equipment == "X.400" {
+			if email := rep.Component(4); email != "" {
+				contact.Email = email
+			} else if strings.Contains(rep.Component(1), "@") {
+				contact.Email = rep.Component(1)
+			}
+			continue
+		}
+		number := rep.Component(12)
+		if number == "" {
+			number = rep.Component(1)
+		}
+		if number == "" {
+			number = strings.TrimSpace(rep.Component(6) + " " + rep.Component(7))
+		}
+		if number == "" {
+			continue
+		}
+		switch {
+		case equipment == "CP" || equipment == "BP":
+			contact.MobilePhone = number
+		case work || use == "WPN":
+			contact.OfficePhone = number
+		default:
+			contact.HomePhone = number
+		}
+	}
+}
+
+// applyNextOfKin copies the NK1 segments to the patient. Emergency contacts (contact role C in NK1-7) become the
+// emergency contact, other next of kin the guardian of minors and the emergency contact of adults.
+func applyNextOfKin(patient *models.Patient, segments []*Segment) {
+	emergencySent := false
+	for _, nk1 := range segments {
+		if isEmergencyContact(nk1) {
+			patient.EmergencyContact = relatedPerson(nk1)
+			emergencySent = true
+		}
+	}
+	for _, nk1 := range segments {
+		if isEmergencyContact(nk1) {
+			continue
+		}
+		if patient.Minor(time.Now()) {
+			patient.Guardian = relatedPerson(nk1)
+			return
+		}
+		if !emergencySent {
+			patient.EmergencyContact = relatedPerson(nk1)
+			return
+		}
+	}
+}
+
+func isEmergencyContact(nk1 *Segment) bool {
+	return strings.ToUpper(nk1.Value(7)) == "C"
+}
+
+func relatedPerson(nk1 *Segment) models.RelatedPerson {
+	name := nk1.Field(2)
+	person := models.RelatedPerson{
+		Name:         strings.TrimSpace(name.Component(2) + " " + name.Component(1)),
+		Relationship: nk1.Component(3, 2),
+	}
+	if person.Relationship == "" {
+		code := strings.ToUpper(nk1.Value(3))
+		person.Relationship = relationships[code]
+		if person.Relationship == "" {
+			person.Relationship = code
+		}
+	}
+	applyPhones(&person.Contact, nk1.Field(5), false)
+	applyPhones(&person.Contact, nk1.Field(6), true)
+	return person
+}
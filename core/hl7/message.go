@@ -0,0 +1,331 @@
+// Package hl7 receives HL7 v2 messages over MLLP from lab analyzers and hospital systems. ADT messages register
+// and update patients, ORU messages carry lab results. Every message is answered with an acknowledgement, and
+// messages which fail are kept in a queue for admins to review. See https://www.hl7.org/implement/standards for
+// the structure of the messages.
+package hl7
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// null is the value of a field which deletes the value the receiver has.
+const null = `""`
+
+var (
+	errHeaderMissing   = errors.New("hl7: the message does not start with an MSH segment")
+	errHeaderTooShort  = errors.New("hl7: the MSH segment is too short to hold the delimiters")
+	errSegmentInvalid  = errors.New("hl7: segment names are three letters or digits")
+	errTimestampFormat = errors.New("hl7: timestamps are written like 20240301093000")
+)
+
+// delimiters separate the parts of the fields of a message, they are set by the MSH segment.
+type delimiters struct {
+	field        byte
+	component    byte
+	repetition   byte
+	escape       byte
+	subcomponent byte
+}
+
+// Message is a parsed message. The values of fields are read with the accessors of its segments, which unescape
+// them.
+type Message struct {
+	Segments []Segment
+	d        *delimiters
+}
+
+// Segment is a line of a message, like PID. Fields are numbered from 1 like in the standard. In the MSH segment,
+// field 1 is the field separator and field 2 the encoding characters.
+type Segment struct {
+	Name   string
+	fields []string
+	d      *delimiters
+}
+
+// Field is a field of a segment with all its repetitions.
+type Field struct {
+	raw string
+	d   *delimiters
+}
+
+// Parse parses a message. Segments may end with a carriage return, as in the standard, or with a line feed as in
+// files with recorded messages.
+func Parse(data []byte) (*Message, error) {
+	text := strings.Replace(string(data), "\r\n", "\r", -1)
+	text = strings.Replace(text, "\n", "\r", -1)
+	text = strings.Trim(text, "\r \t\x00")
+	if !strings.HasPrefix(text, "MSH") {
+		return nil, errHeaderMissing
+	}
+	if len(text) < 8 {
+		return nil, errHeaderTooShort
+	}
+	d := &delimiters{
+		field:        text[3],
+		component:    text[4],
+		repetition:   text[5],
+		escape:       text[6],
+		subcomponent: text[7],
+	}
+	msg := &Message{d: d}
+	for _, line := range strings.Split(text, "\r") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, string(d.field))
+		if !segmentName(fields[0]) {
+			return nil, errSegmentInvalid
+		}
+		if fields[0] == "MSH" {
+			// The field separator itself is MSH-1.
+			fields = append([]string{"MSH", string(d.field)}, fields[1:]...)
+		}
+		msg.Segments = append(msg.Segments, Segment{Name: fields[0], fields: fields, d: d})
+	}
+	return msg, nil
+}
+
+func segmentName(name string) bool {
+	if len(name) != 3 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Segment returns the first segment with the name, or nil if the message has none.
+func (m *Message) Segment(name string) *Segment {
+	for i := range m.Segments {
+		if m.Segments[i].Name == name {
+			return &m.Segments[i]
+		}
+	}
+	return nil
+}
+
+// All returns the segments with the name, in the order of the message.
+func (m *Message) All(name string) []*Segment {
+	var segments []*Segment
+	for i := range m.Segments {
+		if m.Segments[i].Name == name {
+			segments = append(segments, &m.Segments[i])
+		}
+	}
+	return segments
+}
+
+// Header returns the MSH segment.
+func (m *Message) Header() *Segment {
+	return &m.Segments[0]
+}
+
+// Type returns the message type and the trigger event, like ADT^A04.
+func (m *Message) Type() string {
+	msh := m.Header()
+	code, event := msh.Component(9, 1), msh.Component(9, 2)
+	if event == "" {
+		return code
+	}
+	return code + "^" + event
+}
+
+// ControlId returns the id the sender gave the message, acknowledgements refer to it.
+func (m *Message) ControlId() string {
+	return m.Header().Value(10)
+}
+
+// Sender returns the sending application and facility, like LAB^CITYHOSPITAL.
+func (m *Message) Sender() string {
+	msh := m.Header()
+	app, facility := msh.Value(3), msh.Value(4)
+	if facility == "" {
+		return app
+	}
+	return app + "^" + facility
+}
+
+// Field returns the field with the number, an empty field if the segment is shorter.
+func (s *Segment) Field(n int) Field {
+	if n < 1 || n >= len(s.fields) {
+		return Field{d: s.d}
+	}
+	if s.Name == "MSH" && n <= 2 {
+		// The delimiters are not escaped.
+		return Field{raw: escape(s.fields[n], s.d), d: s.d}
+	}
+	return Field{raw: s.fields[n], d: s.d}
+}
+
+// Value returns the first component of the first repetition of the field.
+func (s *Segment) Value(n int) string {
+	return s.Field(n).Value()
+}
+
+// Component returns a component of the first repetition of the field, numbered from 1.
+func (s *Segment) Component(n, component int) string {
+	return s.Field(n).Component(component)
+}
+
+// Repetitions returns the repetitions of the field, none if it is empty.
+func (f Field) Repetitions() []Field {
+	if f.raw == "" {
+		return nil
+	}
+	var reps []Field
+	for _, r := range strings.Split(f.raw, string(f.d.repetition)) {
+		reps = append(reps, Field{raw: r, d: f.d})
+	}
+	return reps
+}
+
+// Empty reports whether the field has no value, which leaves the value the receiver has unchanged.
+func (f Field) Empty() bool {
+	return f.raw == ""
+}
+
+// Null reports whether the field is "", which deletes the value the receiver has.
+func (f Field) Null() bool {
+	return f.raw == null
+}
+
+// Value returns the first component of the first repetition.
+func (f Field) Value() string {
+	return f.Component(1)
+}
+
+// Component returns a component of the first repetition, numbered from 1. Its subcomponents are joined with
+// spaces.
+func (f Field) Component(n int) string {
+	if f.Null() {
+		return ""
+	}
+	rep := f.raw
+	if i := strings.IndexByte(rep, f.d.repetition); i >= 0 {
+		rep = rep[:i]
+	}
+	components := strings.Split(rep, string(f.d.component))
+	if n < 1 || n > len(components) {
+		return ""
+	}
+	var parts []string
+	for _, sub := range strings.Split(components[n-1], string(f.d.subcomponent)) {
+		if sub = strings.TrimSpace(unescape(sub, f.d)); sub != "" {
+			parts = append(parts, sub)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// unescape replaces the escape sequences of the value with the characters they stand for. Formatting sequences
+// other than line breaks are dropped.
+func unescape(value string, d *delimiters) string {
+	if strings.IndexByte(value, d.escape) < 0 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != d.escape {
+			b.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(value[i+1:], d.escape)
+		if end < 0 {
+			b.WriteString(value[i:])
+			break
+		}
+		seq := value[i+1 : i+1+end]
+		i += end + 1
+		switch {
+		case seq == "F":
+			b.WriteByte(d.field)
+		case seq == "S":
+			b.WriteByte(d.component)
+		case seq == "R":
+			b.WriteByte(d.repetition)
+		case seq == "E":
+			b.WriteByte(d.escape)
+		case seq == "T":
+			b.WriteByte(d.subcomponent)
+		case seq == ".br":
+			b.WriteByte('\n')
+		case strings.HasPrefix(seq, "X") && len(seq)%2 == 1:
+			for j := 1; j+1 < len(seq); j += 2 {
+				if n, err := strconv.ParseUint(seq[j:j+2], 16, 8); err == nil {
+					b.WriteByte(byte(n))
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// escape replaces the delimiters in the value with escape sequences, so that it can be written into a field.
+func escape(value string, d *delimiters) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case d.field:
+			b.WriteString(string(d.escape) + "F" + string(d.escape))
+		case d.component:
+			b.WriteString(string(d.escape) + "S" + string(d.escape))
+		case d.repetition:
+			b.WriteString(string(d.escape) + "R" + string(d.escape))
+		case d.escape:
+			b.WriteString(string(d.escape) + "E" + string(d.escape))
+		case d.subcomponent:
+			b.WriteString(string(d.escape) + "T" + string(d.escape))
+		case '\r', '\n':
+			b.WriteString(string(d.escape) + ".br" + string(d.escape))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// timestampLayouts are the precisions of timestamps, by the length of their digits.
+var timestampLayouts = map[int]string{
+	4:  "2006",
+	6:  "200601",
+	8:  "20060102",
+	10: "2006010215",
+	12: "200601021504",
+	14: "20060102150405",
+}
+
+// ParseTime parses a timestamp like 20240301093000 or 20240301093000.5+0530. Timestamps without a time zone are
+// in the location.
+func ParseTime(value string, loc *time.Location) (time.Time, error) {
+	zone := ""
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value, zone = value[:i], value[i:]
+	}
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		value = value[:i]
+	}
+	layout, ok := timestampLayouts[len(value)]
+	if !ok {
+		return time.Time{}, errTimestampFormat
+	}
+	if zone != "" {
+		t, err := time.Parse(layout+"-0700", value+zone)
+		if err != nil {
+			return time.Time{}, errTimestampFormat
+		}
+		return t, nil
+	}
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, errTimestampFormat
+	}
+	return t, nil
+}
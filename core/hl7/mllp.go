@@ -0,0 +1,62 @@
+package hl7
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// MLLP frames each message with a start block and an end block followed by a carriage return.
+const (
+	startBlock     = 0x0b
+	endBlock       = 0x1c
+	carriageReturn = 0x0d
+
+	// MaxMessageSize is the size of the largest message read, in bytes.
+	MaxMessageSize = 1 << 20
+)
+
+var errMessageTooLarge = errors.New("hl7: the message is larger than the size limit")
+
+// ReadMessage reads the next framed message. Bytes between frames are skipped. It returns io.EOF if the
+// connection is closed between messages, and io.ErrUnexpectedEOF if it is closed within one.
+func ReadMessage(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+	var msg []byte
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == endBlock {
+			// The carriage return after the end block is skipped with the bytes before the next frame, not
+			// waited for.
+			return msg, nil
+		}
+		if len(msg) >= MaxMessageSize {
+			return nil, errMessageTooLarge
+		}
+		msg = append(msg, b)
+	}
+}
+
+// WriteMessage writes the message in a frame.
+func WriteMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 0, len(msg)+3)
+	frame = append(frame, startBlock)
+	frame = append(frame, msg...)
+	frame = append(frame, endBlock, carriageReturn)
+	_, err := w.Write(frame)
+	return err
+}
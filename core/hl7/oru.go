@@ -0,0 +1,135 @@
+package hl7
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gcchr-system/core/models"
+)
+
+// resultGroup holds the results of an OBR segment, with the patient of the PID segment before it.
+type resultGroup struct {
+	mrn   string
+	order string
+	// collected is the time of the observation in OBR-7, the default of the results.
+	collected time.Time
+	results   []models.LabResult
+}
+
+// results saves the lab results of an ORU message. Each OBR segment and the OBX segments after it are saved
+// together, for the patient with the medical record number in PID-3 and the lab order with the placer order number
+// in OBR-2 if it has one. Each PID segment has to describe the patient with its number, like the PID of ADT
+// updates. Numeric results are saved, other observations like comments are skipped.
+func (rc *Receiver) results(msg *Message) *Error {
+	var groups []*resultGroup
+	var group *resultGroup
+	mrn := ""
+	for i := range msg.Segments {
+		s := &msg.Segments[i]
+		switch s.Name {
+		case "PID":
+			mrn, _ = patientIdentifiers(s)
+			group = nil
+			if mrn == "" {
+				continue
+			}
+			patient, err := rc.patients.ByMRN(mrn)
+			if err != nil {
+				if err.Error() != models.MongoErrNotFound.Error() {
+					return rc.recordError(err)
+				}
+				// Results of unknown patients fail when they are saved, like the results of imports.
+				continue
+			}
+			if !samePatient(patient, s) {
+				return failed(ConditionUnknownKey, "The name or date of birth in PID does not match patient "+mrn+
+					" of the clinic, the medical record number may belong to someone else")
+			}
+		case "OBR":
+			if mrn == "" {
+				return failed(ConditionRequiredMissing, "The medical record number in PID-3 is missing")
+			}
+			group = &resultGroup{mrn: mrn, order: s.Value(2)}
+			if value := s.Value(7); value != "" {
+				t, err := ParseTime(value, time.Local)
+				if err != nil {
+					return failed(ConditionDataType, "The observation time in OBR-7 must be a time like 20240301093000")
+				}
+				group.collected = t
+			}
+			groups = append(groups, group)
+		case "OBX":
+			if group == nil {
+				return failed(ConditionSegmentSequence, "OBX segments must follow an OBR segment")
+			}
+			result, ok, err := labResult(s, group.collected)
+			if err != nil {
+				return err
+			}
+			if ok {
+				group.results = append(group.results, result)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return failed(ConditionSegmentSequence, "The message has no OBR segment")
+	}
+	imported, duplicates, received := 0, 0, false
+	for _, g := range groups {
+		if len(g.results) == 0 {
+			continue
+		}
+		received = true
+		report, err := rc.lab.Receive(g.mrn, g.order, g.results)
+		if err != nil {
+			return rc.recordError(err)
+		}
+		imported += report.Imported
+		duplicates += report.Duplicates
+	}
+	if !received {
+		return failed(ConditionRequiredMissing, "The message has no numeric results")
+	}
+	rc.logger.Infof("%d lab results of message %s saved, %d received before", imported, msg.ControlId(), duplicates)
+	return nil
+}
+
+// labResult returns the result of an OBX segment, with the analyte code in OBX-3, the value in OBX-5 and the unit in
+// OBX-6. Observations which are not numeric, or could not be made (result status X), are skipped.
+func labResult(obx *Segment, collected time.Time) (models.LabResult, bool, *Error) {
+	result := models.LabResult{
+		AnalyteCode: strings.ToUpper(obx.Value(3)),
+		Unit:        obx.Value(6),
+		Collected:   collected,
+	}
+	valueType := strings.ToUpper(obx.Value(2))
+	if valueType != "" && valueType != "NM" && valueType != "SN" || strings.ToUpper(obx.Value(11)) == "X" {
+		return result, false, nil
+	}
+	if result.AnalyteCode == "" {
+		return result, false, failed(ConditionRequiredMissing, "The analyte code in OBX-3 is missing")
+	}
+	value := obx.Value(5)
+	if valueType == "SN" {
+		// Structured numbers are read if they are a plain number, like ^5.2, not a comparison or a range.
+		f := obx.Field(5)
+		if comparator := f.Component(1); comparator != "" && comparator != "=" || f.Component(3) != "" {
+			return result, false, failed(ConditionDataType, "The result of "+result.AnalyteCode+" in OBX-5 is not a number")
+		}
+		value = f.Component(2)
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return result, false, failed(ConditionDataType, "The result of "+result.AnalyteCode+" in OBX-5 is not a number")
+	}
+	result.Value = v
+	if observed := obx.Value(14); observed != "" {
+		t, err := ParseTime(observed, time.Local)
+		if err != nil {
+			return result, false, failed(ConditionDataType, "The observation time in OBX-14 must be a time like 20240301093000")
+		}
+		result.Collected = t
+	}
+	return result, true, nil
+}
@@ -0,0 +1,112 @@
+package hl7
+
+import (
+	"strings"
+	"time"
+
+	"gcchr-system/core/models"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Receiver maps messages onto the records of the clinic and queues the messages which fail.
+type Receiver struct {
+	patients models.PatientService
+	lab      models.LabService
+	messages models.HL7MessageService
+	app      Application
+	logger   *logrus.Entry
+}
+
+func NewReceiver(ps models.PatientService, ls models.LabService, ms models.HL7MessageService, app Application,
+	logger *logrus.Entry) *Receiver {
+	return &Receiver{
+		patients: ps,
+		lab:      ls,
+		messages: ms,
+		app:      app,
+		logger:   logger,
+	}
+}
+
+// Handle processes a message received from the remote address and returns its acknowledgement. Messages which
+// fail are queued, unless the queue itself fails, then the message is rejected so that the sender tries again.
+func (rc *Receiver) Handle(data []byte, remote string) []byte {
+	msg, err := rc.process(data)
+	if err != nil {
+		queued := models.HL7Message{Remote: remote, Raw: string(data)}
+		if msg != nil {
+			queued.Sender, queued.Type, queued.ControlId = msg.Sender(), msg.Type(), msg.ControlId()
+		}
+		rc.logger.Warnf("Message %s %s from %s failed: %v", queued.Type, queued.ControlId, remote, err)
+		if qerr := rc.messages.Fail(&queued, err); qerr != nil {
+			rc.logger.Errorf("Error while queueing the failed message from %s: %v", remote, qerr)
+			err = rejected(ConditionInternal, "The message could not be processed, please send it again")
+		}
+	} else {
+		rc.resolveWaiting(msg)
+	}
+	return NewACK(msg, rc.app, err, time.Now())
+}
+
+// resolveWaiting marks the message as processed if it failed before, and the sender sent it again.
+func (rc *Receiver) resolveWaiting(msg *Message) {
+	if msg.ControlId() == "" {
+		return
+	}
+	waiting, err := rc.messages.Waiting(msg.Sender(), msg.ControlId())
+	if err == nil {
+		err = rc.messages.Resolve(waiting, models.HL7MessageProcessed, nil)
+	}
+	if err != nil && err.Error() != models.MongoErrNotFound.Error() {
+		rc.logger.Errorf("Error while resolving message %s sent again: %v", msg.ControlId(), err)
+	}
+}
+
+// Retry processes a failed message again, for the user who fixed what made it fail. The message is resolved if it
+// is processed, and queued with the new error if it fails again.
+func (rc *Receiver) Retry(message *models.HL7Message, by *models.User) error {
+	if message.Status != models.HL7MessageFailed {
+		return models.ErrHL7MessageResolved
+	}
+	if _, err := rc.process([]byte(message.Raw)); err != nil {
+		if qerr := rc.messages.Fail(message, err); qerr != nil {
+			return qerr
+		}
+		return err
+	}
+	return rc.messages.Resolve(message, models.HL7MessageProcessed, by)
+}
+
+// process parses the message and hands it on by its type. The message is nil if it could not be parsed.
+func (rc *Receiver) process(data []byte) (*Message, *Error) {
+	msg, err := Parse(data)
+	if err != nil {
+		text := strings.TrimPrefix(err.Error(), "hl7: ")
+		return nil, rejected(ConditionSegmentSequence, strings.ToUpper(text[:1])+text[1:])
+	}
+	switch code := msg.Header().Component(9, 1); code {
+	case "ADT":
+		return msg, rc.admit(msg)
+	case "ORU":
+		return msg, rc.results(msg)
+	case "":
+		return msg, rejected(ConditionRequiredMissing, "The message type in MSH-9 is missing")
+	default:
+		return msg, rejected(ConditionUnsupportedType, "Messages of type "+code+" are not accepted")
+	}
+}
+
+// recordError returns the error of saving a record. Errors of the models are told to the sender, other errors are
+// hidden behind an internal error.
+func (rc *Receiver) recordError(err error) *Error {
+	if pe, ok := err.(interface{ Public() string }); ok {
+		condition := ConditionInternal
+		if err == models.ErrLabPatientUnknown {
+			condition = ConditionUnknownKey
+		}
+		return failed(condition, pe.Public())
+	}
+	rc.logger.Errorf("Error while saving the records of a message: %v", err)
+	return rejected(ConditionInternal, "The records could not be saved, please send the message again")
+}
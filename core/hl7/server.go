@@ -0,0 +1,99 @@
+package hl7
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// writeTimeout limits how long an acknowledgement may take to be sent.
+const writeTimeout = 30 * time.Second
+
+// Handler processes a message received from the remote address and returns its acknowledgement.
+type Handler interface {
+	Handle(data []byte, remote string) []byte
+}
+
+// Server accepts MLLP connections and answers every message on them with its acknowledgement. Senders keep their
+// connection open for further messages, or open one per message.
+type Server struct {
+	handler Handler
+	// allowed are the addresses connections are accepted from, this machine only if it is empty.
+	allowed map[string]bool
+	logger  *logrus.Entry
+}
+
+// NewServer returns a server accepting connections from the allowed IP addresses, or from this machine only if there
+// are none. Entries which are not IP addresses, like networks or host names, are an error rather than being skipped,
+// so that a mistyped list does not leave the listener open.
+func NewServer(handler Handler, allowedIPs []string, logger *logrus.Entry) (*Server, error) {
+	allowed := make(map[string]bool)
+	for _, ip := range allowedIPs {
+		parsed := net.ParseIP(strings.TrimSpace(ip))
+		if parsed == nil {
+			return nil, fmt.Errorf("hl7: the allowed address %q is not an IP address", ip)
+		}
+		allowed[parsed.String()] = true
+	}
+	return &Server{handler: handler, allowed: allowed, logger: logger}, nil
+}
+
+// Serve accepts connections on the listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.logger.Warnf("Error while accepting a connection: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	if !s.accepts(conn.RemoteAddr()) {
+		s.logger.Warnf("Connection from %s refused, the address is not allowed", remote)
+		return
+	}
+	s.logger.Infof("Connection from %s accepted", remote)
+	r := bufio.NewReader(conn)
+	for {
+		data, err := ReadMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Warnf("Connection from %s closed: %v", remote, err)
+			} else {
+				s.logger.Infof("Connection from %s closed", remote)
+			}
+			return
+		}
+		ack := s.handler.Handle(data, remote)
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := WriteMessage(conn, ack); err != nil {
+			s.logger.Warnf("Error while acknowledging a message from %s: %v", remote, err)
+			return
+		}
+	}
+}
+
+func (s *Server) accepts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if len(s.allowed) == 0 {
+		return tcp.IP.IsLoopback()
+	}
+	return s.allowed[tcp.IP.String()]
+}
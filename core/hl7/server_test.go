@@ -0,0 +1,220 @@
+package hl7
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gcchr-system/core/models"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TestServerSamples sends the recorded sample messages to a listener over TCP, in the order of their files, and
+// checks the acknowledgements and the records they leave behind.
+func TestServerSamples(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	entry := logrus.NewEntry(logger)
+
+	tests, err := models.LoadLabTests(filepath.Join("..", "data", "lab_tests.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters := models.NewCounterMemory()
+	patients := models.NewInMemoryPatientService(counters, entry)
+	lab := models.NewInMemoryLabService(nil, nil, patients, tests, counters, entry)
+	messages := models.NewInMemoryHL7MessageService(entry)
+	rc := NewReceiver(patients, lab, messages, Application{Name: "GCCHR", Facility: "CLINIC"}, entry)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server, err := NewServer(rc, nil, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	want := map[string]string{
+		"01_adt_a04_register.hl7":               AckAccept,
+		"02_adt_a08_update.hl7":                 AckAccept,
+		"03_oru_r01_results.hl7":                AckAccept,
+		"04_oru_r01_unknown_patient.hl7":        AckError,
+		"05_adt_a04_minor.hl7":                  AckAccept,
+		"06_adt_a04_minor_without_guardian.hl7": AckError,
+		"07_siu_s12_unsupported.hl7":            AckReject,
+		"08_adt_a08_other_patient.hl7":          AckError,
+		"09_oru_r01_other_patient.hl7":          AckError,
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "*.hl7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d sample files, want %d", len(files), len(want))
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range splitMessages(string(data)) {
+			if err := WriteMessage(conn, []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			raw, err := ReadMessage(r)
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			ack, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			msa := ack.Segment("MSA")
+			if msa == nil {
+				t.Fatalf("%s: the acknowledgement has no MSA segment", file)
+			}
+			if code := msa.Value(1); code != want[filepath.Base(file)] {
+				t.Errorf("%s: got %s %q, want %s", file, code, msa.Value(3), want[filepath.Base(file)])
+			}
+		}
+	}
+
+	anita, err := patients.ByMRN("H0042871")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anita.FirstName != "Anita R" || anita.LastName != "Sharma" {
+		t.Errorf("got patient %s %s, want Anita R Sharma", anita.FirstName, anita.LastName)
+	}
+	if anita.Contact.MobilePhone != "9900112233" {
+		t.Errorf("got mobile phone %q, want the update 9900112233", anita.Contact.MobilePhone)
+	}
+	if got := anita.DateOfBirth.Format("2006-01-02"); got != "1985-06-14" {
+		t.Errorf("got date of birth %s, want 1985-06-14", got)
+	}
+	if anita.EmergencyContact.Name == "" {
+		t.Error("the emergency contact from NK1 is missing")
+	}
+	results, err := lab.Results(anita.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Errorf("got %d lab results, want the 4 numeric ones", len(results))
+	}
+	for _, result := range results {
+		if result.AnalyteCode == "HGB" && (result.Value != 11.2 || result.Flag == "") {
+			t.Errorf("got haemoglobin %v flagged %q, want 11.2 flagged low", result.Value, result.Flag)
+		}
+	}
+
+	meera, err := patients.ByMRN("H0042890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meera.Guardian.Name == "" {
+		t.Error("the guardian of the minor from NK1 is missing")
+	}
+	if results, err := lab.Results(meera.Id.Hex()); err != nil || len(results) != 0 {
+		t.Errorf("got %d lab results (%v), want none for results sent before the patient was registered",
+			len(results), err)
+	}
+	if _, err := patients.ByMRN("H0042891"); err == nil {
+		t.Error("the minor without a guardian was registered")
+	}
+
+	failed, total, err := messages.Find(models.HL7MessageFilter{Status: models.HL7MessageFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 {
+		t.Errorf("got %d failed messages, want 5", total)
+	}
+	for _, msg := range failed {
+		if msg.Remote == "" || msg.ControlId == "" {
+			t.Errorf("failed message %+v lacks the remote address or the control id", msg)
+		}
+	}
+}
+
+// TestServerAllowedIPs checks that entries which are not IP addresses stop the server, and that connections from
+// addresses which are not allowed are closed without processing their messages.
+func TestServerAllowedIPs(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	entry := logrus.NewEntry(logger)
+
+	for _, allowed := range [][]string{{"10.0.0.0/24"}, {"lab.example.com"}, {"10.0.0.12", ""}} {
+		if _, err := NewServer(nil, allowed, entry); err == nil {
+			t.Errorf("NewServer accepted the allowed addresses %q", allowed)
+		}
+	}
+
+	handled := &countingHandler{}
+	server, err := NewServer(handled, []string{"10.0.0.12"}, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	WriteMessage(conn, []byte("MSH|^~\\&|HIS|CITYHOSPITAL|GCCHR|CLINIC|||ADT^A08|HIS000301|P|2.5.1\r"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadMessage(bufio.NewReader(conn)); err == nil {
+		t.Error("got an acknowledgement from an address which is not allowed")
+	}
+	if handled.count != 0 {
+		t.Errorf("%d messages handled from an address which is not allowed", handled.count)
+	}
+}
+
+type countingHandler struct {
+	count int
+}
+
+func (h *countingHandler) Handle(data []byte, remote string) []byte {
+	h.count++
+	return nil
+}
+
+// splitMessages returns the messages of a sample file, with their segments ending in carriage returns.
+func splitMessages(data string) []string {
+	var messages []string
+	var segments []string
+	for _, line := range strings.FieldsFunc(data, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if strings.HasPrefix(line, "MSH") && len(segments) > 0 {
+			messages = append(messages, strings.Join(segments, "\r")+"\r")
+			segments = nil
+		}
+		segments = append(segments, line)
+	}
+	if len(segments) > 0 {
+		messages = append(messages, strings.Join(segments, "\r")+"\r")
+	}
+	return messages
+}
@@ -3,12 +3,15 @@ package middleware
 import (
 	"gcchr-system/core/context"
 	"gcchr-system/core/models"
+	"gcchr-system/core/views"
 	"net/http"
 	"strings"
 )
 
 type User struct {
-	models.UserService
+	models.SessionService
+	// APITokens resolves "Authorization: Bearer" API tokens. They are only accepted for the JSON and FHIR APIs.
+	APITokens models.APITokenService
 }
 
 func (u *User) Apply(next http.Handler) http.HandlerFunc {
@@ -18,32 +21,69 @@ func (u *User) Apply(next http.Handler) http.HandlerFunc {
 func (u *User) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		// User lookup not required for static pages and public assets
+		// User lookup not required for static pages and public assets. Images under /images are documents of
+		// patients, which are only served to signed in users.
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets") ||
-			strings.HasPrefix(path, "/images") {
+		if strings.HasPrefix(path, "/assets") {
 			next(w, r)
 			return
 		}
 
-		cookie, err := r.Cookie("remember_token")
-		if err != nil {
-			next(w, r)
+		token := bearerToken(r)
+		if strings.HasPrefix(token, models.APITokenPrefix) {
+			next(w, u.withAPIToken(r, token))
 			return
 		}
-		user, err := u.UserService.ByRemember(cookie.Value)
+		if token == "" {
+			cookie, err := r.Cookie("remember_token")
+			if err != nil {
+				next(w, r)
+				return
+			}
+			token = cookie.Value
+		}
+		session, user, err := u.SessionService.Resolve(token)
 		if err != nil {
 			next(w, r)
 			return
 		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 
 	})
 }
 
+// withAPIToken adds the user and scopes of the API token to the request context, if the token is valid.
+func (u *User) withAPIToken(r *http.Request, token string) *http.Request {
+	if u.APITokens == nil || !views.IsAPIRequest(r) {
+		return r
+	}
+	t, user, err := u.APITokens.Resolve(token)
+	if err != nil {
+		return r
+	}
+	ctx := r.Context()
+	ctx = context.WithUser(ctx, user)
+	ctx = context.WithScopes(ctx, t.Scopes)
+	return r.WithContext(ctx)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or an empty string.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// changePasswordPath is the only page users who must change their password can open.
+const changePasswordPath = "/profile/password"
+
 type RequireUser struct {
 	User
 }
@@ -58,10 +98,81 @@ func (mw *RequireUser) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := context.User(r.Context())
 		if user == nil {
+			if views.IsAPIRequest(r) {
+				views.RenderAPIError(w, r, http.StatusUnauthorized, "Authentication required")
+				return
+			}
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
+		if user.MustChangePassword && r.URL.Path != changePasswordPath && r.URL.Path != "/logout" {
+			if views.IsAPIRequest(r) {
+				views.RenderAPIError(w, r, http.StatusForbidden, "Password change required")
+				return
+			}
+			http.Redirect(w, r, changePasswordPath, http.StatusFound)
+			return
+		}
+		next(w, r)
+	})
+
+}
+
+// RequireRole only lets users through which have at least one of the Roles.
+type RequireRole struct {
+	RequireUser
+	Roles         []models.UserRole
+	forbiddenView *views.View
+}
+
+func NewRequireRole(requireUser RequireUser, roles ...models.UserRole) *RequireRole {
+	return &RequireRole{
+		RequireUser:   requireUser,
+		Roles:         roles,
+		forbiddenView: views.NewView("bootstrap", "errors/forbidden"),
+	}
+}
+
+// Apply assumes that User middleware has already been run.
+func (mw *RequireRole) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+// ApplyFunc assumes that User middleware has already been run.
+func (mw *RequireRole) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.HasRole(mw.Roles...) {
+			if views.IsAPIRequest(r) {
+				views.RenderAPIError(w, r, http.StatusForbidden, "You do not have permission to access this resource")
+				return
+			}
+			var vd views.Data
+			vd.AlertError("You do not have permission to access this page.")
+			mw.forbiddenView.RenderStatus(w, r, http.StatusForbidden, vd)
+			return
+		}
 		next(w, r)
 	})
+}
 
+// RequireScope only lets requests authenticated with an API token through if the token has the Scope.
+// Requests authenticated with a session are limited by the roles of the user only.
+type RequireScope struct {
+	Scope models.Scope
+}
+
+func (mw *RequireScope) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *RequireScope) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes := context.Scopes(r.Context())
+		if scopes != nil && !models.ScopeExists(mw.Scope, scopes) {
+			views.RenderAPIError(w, r, http.StatusForbidden, "The API token does not have the scope "+string(mw.Scope))
+			return
+		}
+		next(w, r)
+	})
 }
@@ -5,6 +5,7 @@ type AddressType string
 const (
 	AddressTypeBilling  AddressType = "billing_address"
 	AddressTypeDelivery AddressType = "delivery_address"
+	AddressTypeHome     AddressType = "home_address"
 )
 
 type Address struct {
@@ -0,0 +1,390 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gcchr-system/core/hash"
+	"gcchr-system/core/rand"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	APITokenCollection = "api_token"
+
+	// APITokenPrefix starts every API token, so they can be told apart from session tokens.
+	APITokenPrefix = "gcchr_"
+
+	// MaxAPITokenLifetime is the longest time an API token can be valid for.
+	MaxAPITokenLifetime = 366 * 24 * time.Hour
+
+	// apiTokenTouchInterval limits how often LastUsed is written back for a token.
+	apiTokenTouchInterval = time.Minute
+)
+
+// Scope limits what an API token can be used for, in addition to the roles of its user.
+type Scope string
+
+const (
+	ScopeUsersRead      Scope = "users:read"
+	ScopeUsersWrite     Scope = "users:write"
+	ScopePatientsRead   Scope = "patients:read"
+	ScopePatientsWrite  Scope = "patients:write"
+	ScopeEncountersRead Scope = "encounters:read"
+)
+
+func ScopesList() []Scope {
+	return []Scope{ScopeUsersRead, ScopeUsersWrite, ScopePatientsRead, ScopePatientsWrite, ScopeEncountersRead}
+}
+
+// ScopeExists reports whether scope is one of scopes.
+func ScopeExists(scope Scope, scopes []Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIToken is a named, long lived token for scripts and other machine clients.
+// Only the HMAC of the token is stored, the token itself is only shown once when it is created.
+type APIToken struct {
+	Id        bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	UserId    bson.ObjectId `json:"user_id" bson:"user_id"`
+	Name      string        `json:"name" bson:"name"`
+	Token     string        `json:"-" bson:"-"`
+	TokenHash string        `json:"-" bson:"token_hash"`
+	Scopes    []Scope       `json:"scopes" bson:"scopes"`
+	Created   time.Time     `json:"created" bson:"created"`
+	Expires   time.Time     `json:"expires" bson:"expires"`
+	LastUsed  time.Time     `json:"last_used,omitempty" bson:"last_used,omitempty"`
+	// CreatedBy is the user who created the token, an admin for tokens of service accounts.
+	CreatedBy bson.ObjectId `json:"created_by,omitempty" bson:"created_by,omitempty"`
+}
+
+// Expired reports whether the token can no longer be used.
+func (t *APIToken) Expired() bool {
+	return !time.Now().Before(t.Expires)
+}
+
+// HasScope is used by templates to show the scopes of a token.
+func (t *APIToken) HasScope(scope Scope) bool {
+	return ScopeExists(scope, t.Scopes)
+}
+
+type APITokenDB interface {
+	// Single token fetch methods
+	ById(id string) (*APIToken, error)
+	ByToken(token string) (*APIToken, error)
+
+	// List of tokens fetch methods
+	ByUserId(userId string) ([]APIToken, error)
+
+	// Data modifying methods
+	Create(token *APIToken) error
+	Update(token *APIToken) error
+	Delete(id string) error
+	DeleteByUserId(userId string) error
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+var _ APITokenDB = &apiTokenValidator{}
+
+func newAPITokenValidator(tdb APITokenDB, hmac hash.HMAC) *apiTokenValidator {
+	return &apiTokenValidator{
+		APITokenDB: tdb,
+		hmac:       hmac,
+	}
+}
+
+func (tv *apiTokenValidator) Create(token *APIToken) error {
+	if err := runAPITokenValFuncs(token, tv.requireUserId, tv.requireName, tv.scopesValid, tv.setTokenIfUnset,
+		tv.hmacToken, tv.tokenHashRequired, tv.setCreated, tv.expiresValid); err != nil {
+		return err
+	}
+	return tv.APITokenDB.Create(token)
+}
+
+func (tv *apiTokenValidator) Update(token *APIToken) error {
+	if err := runAPITokenValFuncs(token, tv.requireUserId, tv.requireName, tv.scopesValid,
+		tv.tokenHashRequired); err != nil {
+		return err
+	}
+	return tv.APITokenDB.Update(token)
+}
+
+func (tv *apiTokenValidator) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return tv.APITokenDB.Delete(id)
+}
+
+func (tv *apiTokenValidator) DeleteByUserId(userId string) error {
+	if !bson.IsObjectIdHex(userId) {
+		return ErrIDInvalid
+	}
+	return tv.APITokenDB.DeleteByUserId(userId)
+}
+
+func (tv *apiTokenValidator) ById(id string) (*APIToken, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return tv.APITokenDB.ById(id)
+}
+
+// ByToken hashes the token and looks up the matching API token.
+func (tv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	t := APIToken{
+		Token: token,
+	}
+	if err := runAPITokenValFuncs(&t, tv.hmacToken, tv.tokenHashRequired); err != nil {
+		return nil, err
+	}
+	return tv.APITokenDB.ByToken(t.TokenHash)
+}
+
+func (tv *apiTokenValidator) ByUserId(userId string) ([]APIToken, error) {
+	if !bson.IsObjectIdHex(userId) {
+		return nil, ErrIDInvalid
+	}
+	return tv.APITokenDB.ByUserId(userId)
+}
+
+func (tv *apiTokenValidator) requireUserId(token *APIToken) error {
+	if token.UserId == "" {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) requireName(token *APIToken) error {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return ErrTokenNameRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) scopesValid(token *APIToken) error {
+	if len(token.Scopes) == 0 {
+		return ErrScopeRequired
+	}
+	for _, scope := range token.Scopes {
+		if !ScopeExists(scope, ScopesList()) {
+			return ErrScopeInvalid
+		}
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) setTokenIfUnset(token *APIToken) error {
+	if token.Token != "" {
+		return nil
+	}
+	t, err := rand.RemeberToken()
+	if err != nil {
+		return err
+	}
+	token.Token = APITokenPrefix + t
+	return nil
+}
+
+func (tv *apiTokenValidator) hmacToken(token *APIToken) error {
+	if token.Token == "" {
+		return nil
+	}
+	token.TokenHash = tv.hmac.Hash(token.Token)
+	return nil
+}
+
+func (tv *apiTokenValidator) tokenHashRequired(token *APIToken) error {
+	if token.TokenHash == "" {
+		return ErrSessionTokenRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) setCreated(token *APIToken) error {
+	if token.Created.IsZero() {
+		token.Created = time.Now()
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) expiresValid(token *APIToken) error {
+	if !token.Expires.After(token.Created) || token.Expires.Sub(token.Created) > MaxAPITokenLifetime {
+		return ErrTokenExpiryInvalid
+	}
+	return nil
+}
+
+type APITokenService interface {
+	// Issue creates a token for the user. The returned token has its Token set, it can not be retrieved later.
+	Issue(user *User, name string, scopes []Scope, expires time.Time, createdBy *User) (*APIToken, error)
+	// Resolve looks up the API token and its user for a token provided by a client.
+	Resolve(token string) (*APIToken, *User, error)
+	// Revoke deletes a token of the user with the provided user Id.
+	Revoke(userId, tokenId string) error
+	APITokenDB
+}
+
+type apiTokenService struct {
+	APITokenDB
+	users  UserDB
+	logger *logrus.Entry
+}
+
+func NewAPITokenService(mgo *mgo.Session, users UserDB, logger *logrus.Entry, dbname, hmacKey string) APITokenService {
+	tm := &apiTokenMongo{mgo, dbname, logger}
+	return newAPITokenService(tm, users, logger, hmacKey)
+}
+
+// NewInMemoryAPITokenService returns an APITokenService backed by an in-memory APITokenDB.
+func NewInMemoryAPITokenService(users UserDB, logger *logrus.Entry, hmacKey string) APITokenService {
+	return newAPITokenService(newAPITokenMemory(), users, logger, hmacKey)
+}
+
+func newAPITokenService(tdb APITokenDB, users UserDB, logger *logrus.Entry, hmacKey string) APITokenService {
+	return &apiTokenService{
+		APITokenDB: newAPITokenValidator(tdb, hash.NewHMAC(hmacKey)),
+		users:      users,
+		logger:     logger,
+	}
+}
+
+func (ts *apiTokenService) Issue(user *User, name string, scopes []Scope, expires time.Time, createdBy *User) (*APIToken, error) {
+	token := APIToken{
+		UserId:  user.Id,
+		Name:    name,
+		Scopes:  scopes,
+		Expires: expires,
+	}
+	if createdBy != nil {
+		token.CreatedBy = createdBy.Id
+	}
+	if err := ts.Create(&token); err != nil {
+		return nil, err
+	}
+	ts.logger.Infof("Issued API token %q for user %s", token.Name, user.Username)
+	return &token, nil
+}
+
+func (ts *apiTokenService) Resolve(token string) (*APIToken, *User, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, nil, MongoErrNotFound
+	}
+	t, err := ts.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Expired() {
+		return nil, nil, ErrTokenExpired
+	}
+	user, err := ts.users.ById(t.UserId.Hex())
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+	if time.Since(t.LastUsed) > apiTokenTouchInterval {
+		t.LastUsed = time.Now()
+		if err := ts.Update(t); err != nil {
+			ts.logger.Errorf("Error while updating last use of API token %s: %v", t.Id.Hex(), err)
+		}
+	}
+	return t, user, nil
+}
+
+func (ts *apiTokenService) Revoke(userId, tokenId string) error {
+	t, err := ts.ById(tokenId)
+	if err != nil {
+		return err
+	}
+	if t.UserId.Hex() != userId {
+		return MongoErrNotFound
+	}
+	return ts.Delete(tokenId)
+}
+
+type apiTokenMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ APITokenDB = &apiTokenMongo{}
+
+func (tm *apiTokenMongo) Create(token *APIToken) error {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	if token.Id == "" {
+		token.Id = bson.NewObjectId()
+	}
+	return ses.DB(tm.dbname).C(APITokenCollection).Insert(token)
+}
+
+func (tm *apiTokenMongo) Update(token *APIToken) error {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(tm.dbname).C(APITokenCollection).UpdateId(token.Id, token)
+}
+
+func (tm *apiTokenMongo) Delete(id string) error {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(tm.dbname).C(APITokenCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+func (tm *apiTokenMongo) DeleteByUserId(userId string) error {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	_, err := ses.DB(tm.dbname).C(APITokenCollection).RemoveAll(bson.M{"user_id": bson.ObjectIdHex(userId)})
+	return err
+}
+
+func (tm *apiTokenMongo) ById(id string) (*APIToken, error) {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	t := APIToken{}
+	err := ses.DB(tm.dbname).C(APITokenCollection).FindId(bson.ObjectIdHex(id)).One(&t)
+	return &t, err
+}
+
+func (tm *apiTokenMongo) ByToken(tokenHash string) (*APIToken, error) {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	t := APIToken{}
+	err := ses.DB(tm.dbname).C(APITokenCollection).Find(bson.M{"token_hash": tokenHash}).One(&t)
+	return &t, err
+}
+
+func (tm *apiTokenMongo) ByUserId(userId string) ([]APIToken, error) {
+	ses := tm.mgo.Copy()
+	defer ses.Close()
+	var tokens []APIToken
+	err := ses.DB(tm.dbname).C(APITokenCollection).Find(bson.M{"user_id": bson.ObjectIdHex(userId)}).
+		Sort("-created").All(&tokens)
+	return tokens, err
+}
+
+type apiTokenValFunc func(token *APIToken) error
+
+func runAPITokenValFuncs(token *APIToken, fns ...apiTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// apiTokenMemory is a thread safe in-memory implementation of APITokenDB.
+type apiTokenMemory struct {
+	mu     sync.RWMutex
+	tokens map[bson.ObjectId]APIToken
+}
+
+var _ APITokenDB = &apiTokenMemory{}
+
+func newAPITokenMemory() *apiTokenMemory {
+	return &apiTokenMemory{
+		tokens: make(map[bson.ObjectId]APIToken),
+	}
+}
+
+func (tm *apiTokenMemory) Create(token *APIToken) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if token.Id == "" {
+		token.Id = bson.NewObjectId()
+	}
+	tm.tokens[token.Id] = copyAPIToken(token)
+	return nil
+}
+
+func (tm *apiTokenMemory) Update(token *APIToken) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if _, ok := tm.tokens[token.Id]; !ok {
+		return MongoErrNotFound
+	}
+	tm.tokens[token.Id] = copyAPIToken(token)
+	return nil
+}
+
+func (tm *apiTokenMemory) Delete(id string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	if _, ok := tm.tokens[oid]; !ok {
+		return MongoErrNotFound
+	}
+	delete(tm.tokens, oid)
+	return nil
+}
+
+func (tm *apiTokenMemory) DeleteByUserId(userId string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	uid := bson.ObjectIdHex(userId)
+	for id, t := range tm.tokens {
+		if t.UserId == uid {
+			delete(tm.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (tm *apiTokenMemory) ById(id string) (*APIToken, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	t, ok := tm.tokens[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyAPIToken(&t)
+	return &found, nil
+}
+
+func (tm *apiTokenMemory) ByToken(tokenHash string) (*APIToken, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	for _, t := range tm.tokens {
+		if t.TokenHash == tokenHash {
+			found := copyAPIToken(&t)
+			return &found, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+func (tm *apiTokenMemory) ByUserId(userId string) ([]APIToken, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	uid := bson.ObjectIdHex(userId)
+	var tokens []APIToken
+	for _, t := range tm.tokens {
+		if t.UserId == uid {
+			tokens = append(tokens, copyAPIToken(&t))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+	return tokens, nil
+}
+
+// copyAPIToken returns a copy of the token without the raw token, which does not share the scopes with the original.
+func copyAPIToken(token *APIToken) APIToken {
+	t := *token
+	t.Token = ""
+	t.Scopes = append([]Scope(nil), token.Scopes...)
+	return t
+}
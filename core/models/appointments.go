@@ -0,0 +1,455 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const AppointmentCollection = "appointment"
+
+type AppointmentStatus string
+
+const (
+	AppointmentBooked    AppointmentStatus = "booked"
+	AppointmentCancelled AppointmentStatus = "cancelled"
+	AppointmentNoShow    AppointmentStatus = "no_show"
+	AppointmentCompleted AppointmentStatus = "completed"
+)
+
+type Appointment struct {
+	Id          bson.ObjectId     `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId   bson.ObjectId     `json:"patient_id" bson:"patient_id"`
+	PhysicianId bson.ObjectId     `json:"physician_id" bson:"physician_id"`
+	Start       time.Time         `json:"start" bson:"start"`
+	End         time.Time         `json:"end" bson:"end"`
+	Status      AppointmentStatus `json:"status" bson:"status"`
+	Reason      string            `json:"reason,omitempty" bson:"reason,omitempty"`
+	// CancelReason is why a cancelled appointment was cancelled.
+	CancelReason string `json:"cancel_reason,omitempty" bson:"cancel_reason,omitempty"`
+	// RescheduledFrom is the previous start of a rescheduled appointment.
+	RescheduledFrom time.Time     `json:"rescheduled_from,omitempty" bson:"rescheduled_from,omitempty"`
+	BookedBy        bson.ObjectId `json:"booked_by,omitempty" bson:"booked_by,omitempty"`
+	Created         time.Time     `json:"created" bson:"created"`
+	Updated         time.Time     `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+// Occupies reports whether the appointment blocks its time slot for other bookings.
+func (a *Appointment) Occupies() bool {
+	return a.Status == AppointmentBooked || a.Status == AppointmentCompleted
+}
+
+// Overlaps reports whether the appointment overlaps the period from start to end.
+func (a *Appointment) Overlaps(start, end time.Time) bool {
+	return a.Start.Before(end) && start.Before(a.End)
+}
+
+// Slot is a period of a session of a physician which can be booked.
+type Slot struct {
+	Start time.Time
+	End   time.Time
+	// Appointments are the appointments occupying the slot.
+	Appointments []Appointment
+}
+
+// Free reports whether the slot has no appointment.
+func (s *Slot) Free() bool {
+	return len(s.Appointments) == 0
+}
+
+// DaySchedule is the schedule of a physician on one day.
+type DaySchedule struct {
+	Date time.Time
+	// Closed is the leave or holiday on the day, Slots is empty then.
+	Closed *ScheduleException
+	Slots  []Slot
+	// Appointments are all appointments on the day, also cancelled ones and ones outside the slots.
+	Appointments []Appointment
+}
+
+type AppointmentDB interface {
+	ById(id string) (*Appointment, error)
+	// ByPhysician returns the appointments of the physician starting from from until before to, ordered by their start.
+	ByPhysician(physicianId string, from, to time.Time) ([]Appointment, error)
+	// ByPatient returns the appointments of the patient, newest first.
+	ByPatient(patientId string) ([]Appointment, error)
+
+	Create(appointment *Appointment) error
+	Update(appointment *Appointment) error
+}
+
+type appointmentValidator struct {
+	AppointmentDB
+	users    UserDB
+	patients PatientDB
+	schedule ScheduleService
+	clock    Clock
+	// mu makes checking for conflicts and saving one step, so that concurrent requests can not book the same slot.
+	// It only guards against requests to this process.
+	mu sync.Mutex
+}
+
+var _ AppointmentDB = &appointmentValidator{}
+
+func (av *appointmentValidator) ById(id string) (*Appointment, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return av.AppointmentDB.ById(id)
+}
+
+func (av *appointmentValidator) ByPhysician(physicianId string, from, to time.Time) ([]Appointment, error) {
+	if !bson.IsObjectIdHex(physicianId) {
+		return nil, ErrIDInvalid
+	}
+	return av.AppointmentDB.ByPhysician(physicianId, from, to)
+}
+
+func (av *appointmentValidator) ByPatient(patientId string) ([]Appointment, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return av.AppointmentDB.ByPatient(patientId)
+}
+
+func (av *appointmentValidator) Create(appointment *Appointment) error {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	appointment.Status = AppointmentBooked
+	if err := runAppointmentValFuncs(appointment, av.requirePatient, av.requirePhysician, av.requireTimes,
+		av.notInPast, av.withinAvailability, av.noConflict, av.ensureCreatedAt); err != nil {
+		return err
+	}
+	return av.AppointmentDB.Create(appointment)
+}
+
+// Update only checks the time of booked appointments, other appointments can not be moved.
+func (av *appointmentValidator) Update(appointment *Appointment) error {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	fns := []appointmentValFunc{av.requireTimes}
+	if appointment.Status == AppointmentBooked {
+		fns = append(fns, av.timeUnchangedOrValid)
+	}
+	fns = append(fns, av.ensureUpdatedAt)
+	if err := runAppointmentValFuncs(appointment, fns...); err != nil {
+		return err
+	}
+	return av.AppointmentDB.Update(appointment)
+}
+
+func (av *appointmentValidator) requirePatient(appointment *Appointment) error {
+	if appointment.PatientId == "" {
+		return ErrPatientRequired
+	}
+	_, err := av.patients.ById(appointment.PatientId.Hex())
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return ErrPatientRequired
+	}
+	return err
+}
+
+func (av *appointmentValidator) requirePhysician(appointment *Appointment) error {
+	if appointment.PhysicianId == "" {
+		return ErrPhysicianInvalid
+	}
+	physician, err := av.users.ById(appointment.PhysicianId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPhysicianInvalid
+		}
+		return err
+	}
+	if !physician.HasRole(UserRolePhysician) || physician.Disabled {
+		return ErrPhysicianInvalid
+	}
+	return nil
+}
+
+func (av *appointmentValidator) requireTimes(appointment *Appointment) error {
+	if appointment.Start.IsZero() || !appointment.End.After(appointment.Start) {
+		return ErrAppointmentTimesInvalid
+	}
+	return nil
+}
+
+func (av *appointmentValidator) notInPast(appointment *Appointment) error {
+	if appointment.Start.Before(av.clock.Now()) {
+		return ErrAppointmentInPast
+	}
+	return nil
+}
+
+func (av *appointmentValidator) withinAvailability(appointment *Appointment) error {
+	physicianId := appointment.PhysicianId.Hex()
+	closed, err := av.schedule.Closed(physicianId, appointment.Start)
+	if err != nil {
+		return err
+	}
+	if closed != nil {
+		return errPhysicianUnavailable(closed)
+	}
+	availability, err := av.schedule.Availability(physicianId)
+	if err != nil {
+		return err
+	}
+	if !availability.Covers(appointment.Start, appointment.End) {
+		return ErrOutsideAvailability
+	}
+	return nil
+}
+
+// noConflict makes sure that neither the physician nor the patient have another appointment at the same time.
+func (av *appointmentValidator) noConflict(appointment *Appointment) error {
+	day := StartOfDay(appointment.Start)
+	others, err := av.AppointmentDB.ByPhysician(appointment.PhysicianId.Hex(), day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Id != appointment.Id && other.Occupies() && other.Overlaps(appointment.Start, appointment.End) {
+			return ErrAppointmentConflict
+		}
+	}
+	others, err = av.AppointmentDB.ByPatient(appointment.PatientId.Hex())
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Id != appointment.Id && other.Occupies() && other.Overlaps(appointment.Start, appointment.End) {
+			return ErrPatientDoubleBooked
+		}
+	}
+	return nil
+}
+
+// timeUnchangedOrValid checks a booked appointment like a new one if it was moved to another time or physician.
+func (av *appointmentValidator) timeUnchangedOrValid(appointment *Appointment) error {
+	existing, err := av.AppointmentDB.ById(appointment.Id.Hex())
+	if err != nil {
+		return err
+	}
+	if existing.Status == AppointmentBooked && existing.Start.Equal(appointment.Start) &&
+		existing.End.Equal(appointment.End) && existing.PhysicianId == appointment.PhysicianId {
+		return nil
+	}
+	return runAppointmentValFuncs(appointment, av.requirePhysician, av.notInPast, av.withinAvailability, av.noConflict)
+}
+
+func (av *appointmentValidator) ensureCreatedAt(appointment *Appointment) error {
+	if appointment.Created.IsZero() {
+		appointment.Created = av.clock.Now()
+	}
+	return nil
+}
+
+func (av *appointmentValidator) ensureUpdatedAt(appointment *Appointment) error {
+	appointment.Updated = av.clock.Now()
+	return nil
+}
+
+func errPhysicianUnavailable(closed *ScheduleException) error {
+	if closed.Reason == "" {
+		return modelError(fmt.Sprintf("models: the physician is not available on this day (%s)", closed.Kind))
+	}
+	return modelError(fmt.Sprintf("models: the physician is not available on this day (%s: %s)", closed.Kind, closed.Reason))
+}
+
+// AppointmentService books appointments within the availability of physicians.
+type AppointmentService interface {
+	// Day returns the slots of the physician on the day of date together with the appointments on that day.
+	Day(physicianId string, date time.Time) (*DaySchedule, error)
+	// Reschedule moves a booked appointment to start, keeping its length.
+	Reschedule(appointment *Appointment, start time.Time) error
+	Cancel(appointment *Appointment, reason string) error
+	// MarkNoShow records that the patient did not come to an appointment which has already started.
+	MarkNoShow(appointment *Appointment) error
+	// Complete records that the patient was seen.
+	Complete(appointment *Appointment) error
+	AppointmentDB
+}
+
+type appointmentService struct {
+	AppointmentDB
+	schedule ScheduleService
+	clock    Clock
+	logger   *logrus.Entry
+}
+
+func NewAppointmentService(mgo *mgo.Session, users UserDB, patients PatientDB, schedule ScheduleService,
+	logger *logrus.Entry, dbname string) AppointmentService {
+	am := &appointmentMongo{mgo, dbname, logger}
+	return newAppointmentService(am, users, patients, schedule, logger)
+}
+
+// NewInMemoryAppointmentService returns an AppointmentService backed by an in-memory AppointmentDB.
+func NewInMemoryAppointmentService(users UserDB, patients PatientDB, schedule ScheduleService,
+	logger *logrus.Entry) AppointmentService {
+	return newAppointmentService(newAppointmentMemory(), users, patients, schedule, logger)
+}
+
+func newAppointmentService(adb AppointmentDB, users UserDB, patients PatientDB, schedule ScheduleService,
+	logger *logrus.Entry) AppointmentService {
+	return &appointmentService{
+		AppointmentDB: &appointmentValidator{
+			AppointmentDB: adb,
+			users:         users,
+			patients:      patients,
+			schedule:      schedule,
+			clock:         SystemClock(),
+		},
+		schedule: schedule,
+		clock:    SystemClock(),
+		logger:   logger,
+	}
+}
+
+func (as *appointmentService) Day(physicianId string, date time.Time) (*DaySchedule, error) {
+	day := StartOfDay(date)
+	appointments, err := as.ByPhysician(physicianId, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	schedule := DaySchedule{Date: day, Appointments: appointments}
+	closed, err := as.schedule.Closed(physicianId, day)
+	if err != nil {
+		return nil, err
+	}
+	if closed != nil {
+		schedule.Closed = closed
+		return &schedule, nil
+	}
+	availability, err := as.schedule.Availability(physicianId)
+	if err != nil {
+		return nil, err
+	}
+	length := availability.SlotLength()
+	for _, session := range availability.SessionsOn(day) {
+		end := session.End.On(day)
+		for start := session.Start.On(day); !start.Add(length).After(end); start = start.Add(length) {
+			slot := Slot{Start: start, End: start.Add(length)}
+			for _, a := range appointments {
+				if a.Occupies() && a.Overlaps(slot.Start, slot.End) {
+					slot.Appointments = append(slot.Appointments, a)
+				}
+			}
+			schedule.Slots = append(schedule.Slots, slot)
+		}
+	}
+	return &schedule, nil
+}
+
+func (as *appointmentService) Reschedule(appointment *Appointment, start time.Time) error {
+	if appointment.Status != AppointmentBooked {
+		return ErrAppointmentNotBooked
+	}
+	previous := appointment.Start
+	length := appointment.End.Sub(appointment.Start)
+	appointment.Start = start
+	appointment.End = start.Add(length)
+	appointment.RescheduledFrom = previous
+	return as.Update(appointment)
+}
+
+func (as *appointmentService) Cancel(appointment *Appointment, reason string) error {
+	if appointment.Status != AppointmentBooked {
+		return ErrAppointmentNotBooked
+	}
+	appointment.Status = AppointmentCancelled
+	appointment.CancelReason = reason
+	return as.Update(appointment)
+}
+
+func (as *appointmentService) MarkNoShow(appointment *Appointment) error {
+	if appointment.Status != AppointmentBooked {
+		return ErrAppointmentNotBooked
+	}
+	if as.clock.Now().Before(appointment.Start) {
+		return ErrNoShowTooEarly
+	}
+	appointment.Status = AppointmentNoShow
+	return as.Update(appointment)
+}
+
+func (as *appointmentService) Complete(appointment *Appointment) error {
+	if appointment.Status != AppointmentBooked {
+		return ErrAppointmentNotBooked
+	}
+	appointment.Status = AppointmentCompleted
+	return as.Update(appointment)
+}
+
+type appointmentMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ AppointmentDB = &appointmentMongo{}
+
+func (am *appointmentMongo) ById(id string) (*Appointment, error) {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	a := Appointment{}
+	err := ses.DB(am.dbname).C(AppointmentCollection).FindId(bson.ObjectIdHex(id)).One(&a)
+	return &a, err
+}
+
+func (am *appointmentMongo) ByPhysician(physicianId string, from, to time.Time) ([]Appointment, error) {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	query := bson.M{
+		"physician_id": bson.ObjectIdHex(physicianId),
+		"start":        bson.M{"$gte": from, "$lt": to},
+	}
+	var appointments []Appointment
+	err := ses.DB(am.dbname).C(AppointmentCollection).Find(query).Sort("start").All(&appointments)
+	return appointments, err
+}
+
+func (am *appointmentMongo) ByPatient(patientId string) ([]Appointment, error) {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	var appointments []Appointment
+	err := ses.DB(am.dbname).C(AppointmentCollection).Find(bson.M{"patient_id": bson.ObjectIdHex(patientId)}).
+		Sort("-start").All(&appointments)
+	return appointments, err
+}
+
+func (am *appointmentMongo) Create(appointment *Appointment) error {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	if appointment.Id == "" {
+		appointment.Id = bson.NewObjectId()
+	}
+	return ses.DB(am.dbname).C(AppointmentCollection).Insert(appointment)
+}
+
+func (am *appointmentMongo) Update(appointment *Appointment) error {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(am.dbname).C(AppointmentCollection).UpdateId(appointment.Id, appointment)
+}
+
+// sortAppointments orders appointments by their start.
+func sortAppointments(appointments []Appointment) {
+	sort.Slice(appointments, func(i, j int) bool {
+		return appointments[i].Start.Before(appointments[j].Start)
+	})
+}
+
+type appointmentValFunc func(appointment *Appointment) error
+
+func runAppointmentValFuncs(appointment *Appointment, fns ...appointmentValFunc) error {
+	for _, fn := range fns {
+		if err := fn(appointment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// appointmentMemory is a thread safe in-memory implementation of AppointmentDB.
+type appointmentMemory struct {
+	mu           sync.RWMutex
+	appointments map[bson.ObjectId]Appointment
+}
+
+var _ AppointmentDB = &appointmentMemory{}
+
+func newAppointmentMemory() *appointmentMemory {
+	return &appointmentMemory{
+		appointments: make(map[bson.ObjectId]Appointment),
+	}
+}
+
+func (am *appointmentMemory) ById(id string) (*Appointment, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	a, ok := am.appointments[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &a, nil
+}
+
+func (am *appointmentMemory) ByPhysician(physicianId string, from, to time.Time) ([]Appointment, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	var appointments []Appointment
+	for _, a := range am.appointments {
+		if a.PhysicianId.Hex() == physicianId && !a.Start.Before(from) && a.Start.Before(to) {
+			appointments = append(appointments, a)
+		}
+	}
+	sortAppointments(appointments)
+	return appointments, nil
+}
+
+func (am *appointmentMemory) ByPatient(patientId string) ([]Appointment, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	var appointments []Appointment
+	for _, a := range am.appointments {
+		if a.PatientId.Hex() == patientId {
+			appointments = append(appointments, a)
+		}
+	}
+	sortAppointments(appointments)
+	for i, j := 0, len(appointments)-1; i < j; i, j = i+1, j-1 {
+		appointments[i], appointments[j] = appointments[j], appointments[i]
+	}
+	return appointments, nil
+}
+
+func (am *appointmentMemory) Create(appointment *Appointment) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if appointment.Id == "" {
+		appointment.Id = bson.NewObjectId()
+	}
+	if _, ok := am.appointments[appointment.Id]; ok {
+		return ErrIDInvalid
+	}
+	am.appointments[appointment.Id] = *appointment
+	return nil
+}
+
+func (am *appointmentMemory) Update(appointment *Appointment) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if _, ok := am.appointments[appointment.Id]; !ok {
+		return MongoErrNotFound
+	}
+	am.appointments[appointment.Id] = *appointment
+	return nil
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	AuditCollection = "audit"
+
+	// DefaultAuditPageSize is the number of entries per page if the filter does not set one.
+	DefaultAuditPageSize = 50
+)
+
+type AuditAction string
+
+const (
+	AuditLogin       AuditAction = "login"
+	AuditLoginFailed AuditAction = "login_failed"
+	AuditLogout      AuditAction = "logout"
+	AuditUserCreate  AuditAction = "user_create"
+	AuditUserUpdate  AuditAction = "user_update"
+	AuditUserDelete  AuditAction = "user_delete"
+	AuditTokenCreate AuditAction = "token_create"
+	AuditTokenRevoke AuditAction = "token_revoke"
+)
+
+func AuditActionsList() []AuditAction {
+	return []AuditAction{AuditLogin, AuditLoginFailed, AuditLogout, AuditUserCreate, AuditUserUpdate, AuditUserDelete,
+		AuditTokenCreate, AuditTokenRevoke}
+}
+
+// Actor is who performed an audited action, and from where.
+// Actions without a signed in user, like a failed login, only have a Username and IP.
+type Actor struct {
+	UserId   bson.ObjectId `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	Username string        `json:"username,omitempty" bson:"username,omitempty"`
+	IP       string        `json:"ip,omitempty" bson:"ip,omitempty"`
+}
+
+// ActorOf returns the actor for the user signed in from the ip.
+func ActorOf(user *User, ip string) Actor {
+	if user == nil {
+		return Actor{IP: ip}
+	}
+	return Actor{UserId: user.Id, Username: user.Username, IP: ip}
+}
+
+// FieldChange is the value of a field before and after a change.
+type FieldChange struct {
+	Field  string `json:"field" bson:"field"`
+	Before string `json:"before,omitempty" bson:"before,omitempty"`
+	After  string `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+type AuditEntry struct {
+	Id         bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	Time       time.Time     `json:"time" bson:"time"`
+	Action     AuditAction   `json:"action" bson:"action"`
+	Actor      Actor         `json:"actor" bson:"actor"`
+	TargetId   bson.ObjectId `json:"target_id,omitempty" bson:"target_id,omitempty"`
+	TargetName string        `json:"target_name,omitempty" bson:"target_name,omitempty"`
+	Changes    []FieldChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	Detail     string        `json:"detail,omitempty" bson:"detail,omitempty"`
+}
+
+// AuditFilter selects audit entries. Empty fields match all entries.
+type AuditFilter struct {
+	Action AuditAction
+	// Actor and Target match the username of the actor and the name of the target.
+	Actor  string
+	Target string
+	From   time.Time
+	To     time.Time
+	// Page starts at 1.
+	Page    int
+	PerPage int
+}
+
+func (f AuditFilter) withDefaults() AuditFilter {
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage < 1 {
+		f.PerPage = DefaultAuditPageSize
+	}
+	return f
+}
+
+// AuditDB is append-only: entries can be added and queried, but never changed or removed.
+type AuditDB interface {
+	Create(entry *AuditEntry) error
+	// Query returns the page of entries matching the filter, newest first, and the number of all matching entries.
+	Query(filter AuditFilter) ([]AuditEntry, int, error)
+}
+
+type AuditService interface {
+	// Record adds an entry for the action of the actor. The target may be nil.
+	Record(actor Actor, action AuditAction, target *User, changes []FieldChange, detail string) error
+	AuditDB
+}
+
+type auditService struct {
+	AuditDB
+	clock Clock
+}
+
+func NewAuditService(mgo *mgo.Session, logger *logrus.Entry, dbname string) AuditService {
+	return &auditService{
+		AuditDB: &auditMongo{mgo, dbname, logger},
+		clock:   SystemClock(),
+	}
+}
+
+// NewInMemoryAuditService returns an AuditService backed by an in-memory AuditDB.
+func NewInMemoryAuditService() AuditService {
+	return &auditService{
+		AuditDB: newAuditMemory(),
+		clock:   SystemClock(),
+	}
+}
+
+func (as *auditService) Record(actor Actor, action AuditAction, target *User, changes []FieldChange, detail string) error {
+	entry := AuditEntry{
+		Action:  action,
+		Actor:   actor,
+		Changes: changes,
+		Detail:  detail,
+	}
+	if target != nil {
+		entry.TargetId = target.Id
+		entry.TargetName = target.Username
+	}
+	return as.Create(&entry)
+}
+
+func (as *auditService) Create(entry *AuditEntry) error {
+	entry.Id = bson.NewObjectId()
+	if entry.Time.IsZero() {
+		entry.Time = as.clock.Now()
+	}
+	return as.AuditDB.Create(entry)
+}
+
+func (as *auditService) Query(filter AuditFilter) ([]AuditEntry, int, error) {
+	return as.AuditDB.Query(filter.withDefaults())
+}
+
+type auditMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ AuditDB = &auditMongo{}
+
+func (am *auditMongo) Create(entry *AuditEntry) error {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(am.dbname).C(AuditCollection).Insert(entry)
+}
+
+func (am *auditMongo) Query(filter AuditFilter) ([]AuditEntry, int, error) {
+	ses := am.mgo.Copy()
+	defer ses.Close()
+	query := bson.M{}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.Actor != "" {
+		query["actor.username"] = filter.Actor
+	}
+	if filter.Target != "" {
+		query["target_name"] = filter.Target
+	}
+	if !filter.From.IsZero() || !filter.To.IsZero() {
+		span := bson.M{}
+		if !filter.From.IsZero() {
+			span["$gte"] = filter.From
+		}
+		if !filter.To.IsZero() {
+			span["$lt"] = filter.To
+		}
+		query["time"] = span
+	}
+	q := ses.DB(am.dbname).C(AuditCollection).Find(query)
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []AuditEntry
+	err = q.Sort("-time").Skip((filter.Page - 1) * filter.PerPage).Limit(filter.PerPage).All(&entries)
+	return entries, total, err
+}
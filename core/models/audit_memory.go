@@ -0,0 +1,60 @@
+package models
+
+import "sync"
+
+// auditMemory is a thread safe in-memory implementation of AuditDB.
+type auditMemory struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+var _ AuditDB = &auditMemory{}
+
+func newAuditMemory() *auditMemory {
+	return &auditMemory{}
+}
+
+func (am *auditMemory) Create(entry *AuditEntry) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	e := *entry
+	e.Changes = append([]FieldChange(nil), entry.Changes...)
+	am.entries = append(am.entries, e)
+	return nil
+}
+
+func (am *auditMemory) Query(filter AuditFilter) ([]AuditEntry, int, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	var matching []AuditEntry
+	// Entries are appended in time order, so walking backwards returns the newest first.
+	for i := len(am.entries) - 1; i >= 0; i-- {
+		e := am.entries[i]
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		if filter.Actor != "" && e.Actor.Username != filter.Actor {
+			continue
+		}
+		if filter.Target != "" && e.TargetName != filter.Target {
+			continue
+		}
+		if !filter.From.IsZero() && e.Time.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !e.Time.Before(filter.To) {
+			continue
+		}
+		matching = append(matching, e)
+	}
+	total := len(matching)
+	start := (filter.Page - 1) * filter.PerPage
+	if start >= total {
+		return nil, total, nil
+	}
+	end := start + filter.PerPage
+	if end > total {
+		end = total
+	}
+	return matching[start:end], total, nil
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/globalsign/mgo"
+)
+
+const (
+	// BlobStorageFilesystem keeps blobs as files in a directory.
+	BlobStorageFilesystem = "filesystem"
+	// BlobStorageGridFS keeps blobs in GridFS in the MongoDB database.
+	BlobStorageGridFS = "gridfs"
+
+	// documentsGridFSPrefix is the prefix of the GridFS collections documents are kept in.
+	documentsGridFSPrefix = "documents"
+)
+
+// BlobStore keeps the content of files, like uploaded documents, by key. Blobs are written once and not changed.
+// Content is streamed in and out, so that large files are never held in memory.
+type BlobStore interface {
+	// Put stores the content read from r under the key. Nothing is kept under the key if an error is returned.
+	Put(key string, r io.Reader) error
+	// Open returns the content stored under the key, which the caller has to close.
+	// MongoErrNotFound is returned if there is none.
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// fileBlobStore keeps every blob in a file named after its key, in sub directories of dir named after
+// the first characters of the key.
+type fileBlobStore struct {
+	dir string
+}
+
+var _ BlobStore = &fileBlobStore{}
+
+func NewFileBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+func (fs *fileBlobStore) path(key string) string {
+	return filepath.Join(fs.dir, key[:2], key)
+}
+
+// Put writes to a temporary file first, so that a blob is never seen half written.
+func (fs *fileBlobStore) Put(key string, r io.Reader) error {
+	path := fs.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (fs *fileBlobStore) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil, MongoErrNotFound
+	}
+	return f, err
+}
+
+func (fs *fileBlobStore) Delete(key string) error {
+	err := os.Remove(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// gridFSBlobStore keeps blobs in GridFS, using the key as the file name.
+type gridFSBlobStore struct {
+	mgo    *mgo.Session
+	dbname string
+	prefix string
+}
+
+var _ BlobStore = &gridFSBlobStore{}
+
+func NewGridFSBlobStore(mgo *mgo.Session, dbname, prefix string) BlobStore {
+	return &gridFSBlobStore{mgo, dbname, prefix}
+}
+
+func (gs *gridFSBlobStore) Put(key string, r io.Reader) error {
+	ses := gs.mgo.Copy()
+	defer ses.Close()
+	gfs := ses.DB(gs.dbname).GridFS(gs.prefix)
+	f, err := gfs.Create(key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Abort()
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// gridFSReader closes the session of a GridFS file together with the file.
+type gridFSReader struct {
+	*mgo.GridFile
+	ses *mgo.Session
+}
+
+func (r *gridFSReader) Close() error {
+	defer r.ses.Close()
+	return r.GridFile.Close()
+}
+
+func (gs *gridFSBlobStore) Open(key string) (io.ReadCloser, error) {
+	ses := gs.mgo.Copy()
+	f, err := ses.DB(gs.dbname).GridFS(gs.prefix).Open(key)
+	if err != nil {
+		ses.Close()
+		return nil, err
+	}
+	return &gridFSReader{f, ses}, nil
+}
+
+func (gs *gridFSBlobStore) Delete(key string) error {
+	ses := gs.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(gs.dbname).GridFS(gs.prefix).Remove(key)
+}
+
+// memoryBlobStore is a thread safe in-memory implementation of BlobStore, for running without storage.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+var _ BlobStore = &memoryBlobStore{}
+
+func NewMemoryBlobStore() BlobStore {
+	return &memoryBlobStore{
+		blobs: make(map[string][]byte),
+	}
+}
+
+func (ms *memoryBlobStore) Put(key string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.blobs[key] = content
+	return nil
+}
+
+func (ms *memoryBlobStore) Open(key string) (io.ReadCloser, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	content, ok := ms.blobs[key]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (ms *memoryBlobStore) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.blobs, key)
+	return nil
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const CatalogueCollection = "catalogue_item"
+
+// CatalogueItem is a service the clinic bills for, like a consultation or a dressing.
+// Invoices copy the price and tax rate, so changing them does not change issued invoices.
+type CatalogueItem struct {
+	Id bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	// Code is a short unique name of the service, like CONS or ECG.
+	Code  string `json:"code" bson:"code"`
+	Name  string `json:"name" bson:"name"`
+	Price Money  `json:"price" bson:"price"`
+	// TaxRate is the tax on the service in percent, like 18 for 18% GST.
+	TaxRate float64 `json:"tax_rate" bson:"tax_rate"`
+	// Active services can be added to new invoices.
+	Active  bool      `json:"active" bson:"active"`
+	Created time.Time `json:"created" bson:"created"`
+	Updated time.Time `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+type CatalogueDB interface {
+	ById(id string) (*CatalogueItem, error)
+	ByCode(code string) (*CatalogueItem, error)
+	// All returns the services ordered by name, the inactive ones too.
+	All() ([]CatalogueItem, error)
+
+	Create(item *CatalogueItem) error
+	Update(item *CatalogueItem) error
+}
+
+type catalogueValidator struct {
+	CatalogueDB
+	clock Clock
+}
+
+var _ CatalogueDB = &catalogueValidator{}
+
+func (cv *catalogueValidator) ById(id string) (*CatalogueItem, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return cv.CatalogueDB.ById(id)
+}
+
+func (cv *catalogueValidator) ByCode(code string) (*CatalogueItem, error) {
+	return cv.CatalogueDB.ByCode(strings.ToUpper(strings.TrimSpace(code)))
+}
+
+func (cv *catalogueValidator) Create(item *CatalogueItem) error {
+	if err := runCatalogueValFuncs(item, cv.normalize, cv.requireCode, cv.requireName, cv.priceNotNegative,
+		cv.taxRateInRange, cv.codeIsAvailable, cv.ensureCreatedAt); err != nil {
+		return err
+	}
+	return cv.CatalogueDB.Create(item)
+}
+
+func (cv *catalogueValidator) Update(item *CatalogueItem) error {
+	if err := runCatalogueValFuncs(item, cv.normalize, cv.requireCode, cv.requireName, cv.priceNotNegative,
+		cv.taxRateInRange, cv.codeIsAvailable, cv.ensureUpdatedAt); err != nil {
+		return err
+	}
+	return cv.CatalogueDB.Update(item)
+}
+
+func (cv *catalogueValidator) normalize(item *CatalogueItem) error {
+	item.Code = strings.ToUpper(strings.TrimSpace(item.Code))
+	item.Name = strings.TrimSpace(item.Name)
+	return nil
+}
+
+func (cv *catalogueValidator) requireCode(item *CatalogueItem) error {
+	if item.Code == "" {
+		return ErrCatalogueCodeRequired
+	}
+	return nil
+}
+
+func (cv *catalogueValidator) requireName(item *CatalogueItem) error {
+	if item.Name == "" {
+		return ErrCatalogueNameRequired
+	}
+	return nil
+}
+
+func (cv *catalogueValidator) priceNotNegative(item *CatalogueItem) error {
+	if item.Price < 0 {
+		return ErrPriceInvalid
+	}
+	return nil
+}
+
+func (cv *catalogueValidator) taxRateInRange(item *CatalogueItem) error {
+	if item.TaxRate < 0 || item.TaxRate > 100 {
+		return ErrTaxRateInvalid
+	}
+	return nil
+}
+
+func (cv *catalogueValidator) codeIsAvailable(item *CatalogueItem) error {
+	existing, err := cv.CatalogueDB.ByCode(item.Code)
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return nil
+		}
+		return err
+	}
+	if existing.Id != item.Id {
+		return ErrCatalogueCodeTaken
+	}
+	return nil
+}
+
+func (cv *catalogueValidator) ensureCreatedAt(item *CatalogueItem) error {
+	item.Created = cv.clock.Now()
+	return nil
+}
+
+func (cv *catalogueValidator) ensureUpdatedAt(item *CatalogueItem) error {
+	item.Updated = cv.clock.Now()
+	return nil
+}
+
+// CatalogueService keeps the services of the clinic and their prices. Only admins change it.
+type CatalogueService interface {
+	CatalogueDB
+}
+
+type catalogueService struct {
+	CatalogueDB
+}
+
+func NewCatalogueService(mgo *mgo.Session, logger *logrus.Entry, dbname string) CatalogueService {
+	cm := &catalogueMongo{mgo, dbname, logger}
+	return newCatalogueService(cm)
+}
+
+// NewInMemoryCatalogueService returns a CatalogueService backed by an in-memory CatalogueDB.
+func NewInMemoryCatalogueService() CatalogueService {
+	return newCatalogueService(newCatalogueMemory())
+}
+
+func newCatalogueService(cdb CatalogueDB) CatalogueService {
+	return &catalogueService{
+		CatalogueDB: &catalogueValidator{
+			CatalogueDB: cdb,
+			clock:       SystemClock(),
+		},
+	}
+}
+
+type catalogueMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ CatalogueDB = &catalogueMongo{}
+
+func (cm *catalogueMongo) ById(id string) (*CatalogueItem, error) {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	item := CatalogueItem{}
+	err := ses.DB(cm.dbname).C(CatalogueCollection).FindId(bson.ObjectIdHex(id)).One(&item)
+	return &item, err
+}
+
+func (cm *catalogueMongo) ByCode(code string) (*CatalogueItem, error) {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	item := CatalogueItem{}
+	err := ses.DB(cm.dbname).C(CatalogueCollection).Find(bson.M{"code": code}).One(&item)
+	return &item, err
+}
+
+func (cm *catalogueMongo) All() ([]CatalogueItem, error) {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	var items []CatalogueItem
+	err := ses.DB(cm.dbname).C(CatalogueCollection).Find(nil).Sort("name").All(&items)
+	return items, err
+}
+
+func (cm *catalogueMongo) Create(item *CatalogueItem) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	item.Id = bson.NewObjectId()
+	return ses.DB(cm.dbname).C(CatalogueCollection).Insert(item)
+}
+
+func (cm *catalogueMongo) Update(item *CatalogueItem) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(cm.dbname).C(CatalogueCollection).UpdateId(item.Id, item)
+}
+
+type catalogueValFunc func(item *CatalogueItem) error
+
+func runCatalogueValFuncs(item *CatalogueItem, fns ...catalogueValFunc) error {
+	for _, fn := range fns {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
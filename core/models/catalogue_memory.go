@@ -0,0 +1,74 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// catalogueMemory is a thread safe in-memory implementation of CatalogueDB.
+type catalogueMemory struct {
+	mu    sync.RWMutex
+	items map[bson.ObjectId]CatalogueItem
+}
+
+var _ CatalogueDB = &catalogueMemory{}
+
+func newCatalogueMemory() *catalogueMemory {
+	return &catalogueMemory{
+		items: make(map[bson.ObjectId]CatalogueItem),
+	}
+}
+
+func (cm *catalogueMemory) ById(id string) (*CatalogueItem, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	item, ok := cm.items[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &item, nil
+}
+
+func (cm *catalogueMemory) ByCode(code string) (*CatalogueItem, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	for _, item := range cm.items {
+		if item.Code == code {
+			return &item, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+func (cm *catalogueMemory) All() ([]CatalogueItem, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	items := make([]CatalogueItem, 0, len(cm.items))
+	for _, item := range cm.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+func (cm *catalogueMemory) Create(item *CatalogueItem) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	item.Id = bson.NewObjectId()
+	cm.items[item.Id] = *item
+	return nil
+}
+
+func (cm *catalogueMemory) Update(item *CatalogueItem) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.items[item.Id]; !ok {
+		return MongoErrNotFound
+	}
+	cm.items[item.Id] = *item
+	return nil
+}
@@ -0,0 +1,491 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	AllergyCollection           = "allergy"
+	ProblemCollection           = "problem"
+	CurrentMedicationCollection = "current_medication"
+)
+
+type AllergySeverity string
+
+const (
+	AllergyMild     AllergySeverity = "mild"
+	AllergyModerate AllergySeverity = "moderate"
+	AllergySevere   AllergySeverity = "severe"
+)
+
+func AllergySeveritiesList() []AllergySeverity {
+	return []AllergySeverity{AllergyMild, AllergyModerate, AllergySevere}
+}
+
+// Allergy is a substance, usually a drug, the patient reacts to.
+type Allergy struct {
+	Id        bson.ObjectId   `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId bson.ObjectId   `json:"patient_id" bson:"patient_id"`
+	Substance string          `json:"substance" bson:"substance"`
+	Reaction  string          `json:"reaction,omitempty" bson:"reaction,omitempty"`
+	Severity  AllergySeverity `json:"severity" bson:"severity"`
+	// Recorded is when the allergy was entered, RecordedBy who entered it.
+	Recorded   time.Time     `json:"recorded" bson:"recorded"`
+	RecordedBy bson.ObjectId `json:"recorded_by" bson:"recorded_by"`
+}
+
+type ProblemStatus string
+
+const (
+	ProblemActive   ProblemStatus = "active"
+	ProblemResolved ProblemStatus = "resolved"
+)
+
+// Problem is a condition on the problem list of the patient, like hypertension.
+type Problem struct {
+	Id          bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId   bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	Description string        `json:"description" bson:"description"`
+	Status      ProblemStatus `json:"status" bson:"status"`
+	// Onset is zero if the onset is not known.
+	Onset      time.Time     `json:"onset,omitempty" bson:"onset,omitempty"`
+	Resolved   time.Time     `json:"resolved,omitempty" bson:"resolved,omitempty"`
+	Recorded   time.Time     `json:"recorded" bson:"recorded"`
+	RecordedBy bson.ObjectId `json:"recorded_by" bson:"recorded_by"`
+}
+
+func (p *Problem) Active() bool {
+	return p.Status == ProblemActive
+}
+
+// CurrentMedication is a medication the patient takes, whether prescribed here or elsewhere.
+type CurrentMedication struct {
+	Id        bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	Name      string        `json:"name" bson:"name"`
+	Dose      string        `json:"dose,omitempty" bson:"dose,omitempty"`
+	Frequency string        `json:"frequency,omitempty" bson:"frequency,omitempty"`
+	// Started is zero if the start is not known, Stopped is zero while the medication is taken.
+	Started    time.Time     `json:"started,omitempty" bson:"started,omitempty"`
+	Stopped    time.Time     `json:"stopped,omitempty" bson:"stopped,omitempty"`
+	Recorded   time.Time     `json:"recorded" bson:"recorded"`
+	RecordedBy bson.ObjectId `json:"recorded_by" bson:"recorded_by"`
+}
+
+func (m *CurrentMedication) Current() bool {
+	return m.Stopped.IsZero()
+}
+
+// Chart is the allergies, problems and medications of a patient, which physicians check at every encounter.
+type Chart struct {
+	PatientId bson.ObjectId
+	Allergies []Allergy
+	// Problems are the active problems, Resolved the resolved ones, most recently recorded first.
+	Problems []Problem
+	Resolved []Problem
+	// Medications are the medications taken, Stopped the medications stopped, most recently recorded first.
+	Medications []CurrentMedication
+	Stopped     []CurrentMedication
+}
+
+// ChartDB keeps the allergies, problems and medications of patients. The lists of a patient are returned oldest
+// first.
+type ChartDB interface {
+	AllergyById(id string) (*Allergy, error)
+	Allergies(patientId string) ([]Allergy, error)
+	CreateAllergy(allergy *Allergy) error
+	DeleteAllergy(id string) error
+
+	ProblemById(id string) (*Problem, error)
+	Problems(patientId string) ([]Problem, error)
+	CreateProblem(problem *Problem) error
+	UpdateProblem(problem *Problem) error
+
+	MedicationById(id string) (*CurrentMedication, error)
+	Medications(patientId string) ([]CurrentMedication, error)
+	CreateMedication(medication *CurrentMedication) error
+	UpdateMedication(medication *CurrentMedication) error
+}
+
+type chartValidator struct {
+	ChartDB
+	patients PatientDB
+	clock    Clock
+}
+
+var _ ChartDB = &chartValidator{}
+
+func (cv *chartValidator) AllergyById(id string) (*Allergy, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return cv.ChartDB.AllergyById(id)
+}
+
+func (cv *chartValidator) Allergies(patientId string) ([]Allergy, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return cv.ChartDB.Allergies(patientId)
+}
+
+func (cv *chartValidator) CreateAllergy(allergy *Allergy) error {
+	if err := cv.requirePatient(allergy.PatientId); err != nil {
+		return err
+	}
+	allergy.Substance = strings.TrimSpace(allergy.Substance)
+	allergy.Reaction = strings.TrimSpace(allergy.Reaction)
+	if allergy.Substance == "" {
+		return ErrAllergySubstanceRequired
+	}
+	if !allergySeverityExists(allergy.Severity) {
+		return ErrAllergySeverityInvalid
+	}
+	allergies, err := cv.ChartDB.Allergies(allergy.PatientId.Hex())
+	if err != nil {
+		return err
+	}
+	for _, a := range allergies {
+		if strings.EqualFold(a.Substance, allergy.Substance) {
+			return ErrAllergyRecorded
+		}
+	}
+	allergy.Recorded = cv.clock.Now()
+	return cv.ChartDB.CreateAllergy(allergy)
+}
+
+func (cv *chartValidator) DeleteAllergy(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return cv.ChartDB.DeleteAllergy(id)
+}
+
+func (cv *chartValidator) ProblemById(id string) (*Problem, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return cv.ChartDB.ProblemById(id)
+}
+
+func (cv *chartValidator) Problems(patientId string) ([]Problem, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return cv.ChartDB.Problems(patientId)
+}
+
+func (cv *chartValidator) CreateProblem(problem *Problem) error {
+	if err := cv.requirePatient(problem.PatientId); err != nil {
+		return err
+	}
+	problem.Status = ProblemActive
+	problem.Resolved = time.Time{}
+	problem.Recorded = cv.clock.Now()
+	if err := cv.validateProblem(problem); err != nil {
+		return err
+	}
+	return cv.ChartDB.CreateProblem(problem)
+}
+
+func (cv *chartValidator) UpdateProblem(problem *Problem) error {
+	if err := cv.validateProblem(problem); err != nil {
+		return err
+	}
+	return cv.ChartDB.UpdateProblem(problem)
+}
+
+func (cv *chartValidator) validateProblem(problem *Problem) error {
+	problem.Description = strings.TrimSpace(problem.Description)
+	if problem.Description == "" {
+		return ErrProblemDescriptionRequired
+	}
+	if problem.Onset.After(cv.clock.Now()) {
+		return ErrProblemOnsetInvalid
+	}
+	if problem.Status == ProblemResolved && !problem.Onset.IsZero() && problem.Resolved.Before(problem.Onset) {
+		return ErrProblemResolvedInvalid
+	}
+	return nil
+}
+
+func (cv *chartValidator) MedicationById(id string) (*CurrentMedication, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return cv.ChartDB.MedicationById(id)
+}
+
+func (cv *chartValidator) Medications(patientId string) ([]CurrentMedication, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return cv.ChartDB.Medications(patientId)
+}
+
+func (cv *chartValidator) CreateMedication(medication *CurrentMedication) error {
+	if err := cv.requirePatient(medication.PatientId); err != nil {
+		return err
+	}
+	medication.Stopped = time.Time{}
+	medication.Recorded = cv.clock.Now()
+	if err := cv.validateMedication(medication); err != nil {
+		return err
+	}
+	return cv.ChartDB.CreateMedication(medication)
+}
+
+func (cv *chartValidator) UpdateMedication(medication *CurrentMedication) error {
+	if err := cv.validateMedication(medication); err != nil {
+		return err
+	}
+	return cv.ChartDB.UpdateMedication(medication)
+}
+
+func (cv *chartValidator) validateMedication(medication *CurrentMedication) error {
+	medication.Name = strings.TrimSpace(medication.Name)
+	medication.Dose = strings.TrimSpace(medication.Dose)
+	medication.Frequency = strings.TrimSpace(medication.Frequency)
+	if medication.Name == "" {
+		return ErrMedicationNameRequired
+	}
+	if medication.Started.After(cv.clock.Now()) {
+		return ErrMedicationStartInvalid
+	}
+	if !medication.Current() && medication.Stopped.Before(medication.Started) {
+		return ErrMedicationStopInvalid
+	}
+	return nil
+}
+
+func (cv *chartValidator) requirePatient(patientId bson.ObjectId) error {
+	if patientId == "" {
+		return ErrPatientRequired
+	}
+	if _, err := cv.patients.ById(patientId.Hex()); err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPatientRequired
+		}
+		return err
+	}
+	return nil
+}
+
+func allergySeverityExists(severity AllergySeverity) bool {
+	for _, s := range AllergySeveritiesList() {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// ChartService keeps the allergy, problem and medication lists of patients and checks prescriptions against the
+// allergies.
+type ChartService interface {
+	// Chart returns the lists of the patient.
+	Chart(patientId string) (*Chart, error)
+	// ResolveProblem marks the problem resolved on the day.
+	ResolveProblem(problem *Problem, day time.Time) error
+	// StopMedication marks the medication stopped on the day.
+	StopMedication(medication *CurrentMedication, day time.Time) error
+	// AllergyWarnings checks the names of medications against the allergies of the patient and the drug classes.
+	AllergyWarnings(patientId string, medications []string) ([]AllergyWarning, error)
+	DrugClasses() *DrugClasses
+	ChartDB
+}
+
+type chartService struct {
+	ChartDB
+	classes *DrugClasses
+	logger  *logrus.Entry
+}
+
+func NewChartService(mgo *mgo.Session, patients PatientDB, classes *DrugClasses, logger *logrus.Entry,
+	dbname string) ChartService {
+	cm := &chartMongo{mgo, dbname, logger}
+	return newChartService(cm, patients, classes, logger)
+}
+
+// NewInMemoryChartService returns a ChartService backed by an in-memory ChartDB.
+func NewInMemoryChartService(patients PatientDB, classes *DrugClasses, logger *logrus.Entry) ChartService {
+	return newChartService(newChartMemory(), patients, classes, logger)
+}
+
+func newChartService(cdb ChartDB, patients PatientDB, classes *DrugClasses, logger *logrus.Entry) ChartService {
+	return &chartService{
+		ChartDB: &chartValidator{
+			ChartDB:  cdb,
+			patients: patients,
+			clock:    SystemClock(),
+		},
+		classes: classes,
+		logger:  logger,
+	}
+}
+
+func (cs *chartService) DrugClasses() *DrugClasses {
+	return cs.classes
+}
+
+func (cs *chartService) Chart(patientId string) (*Chart, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	chart := Chart{PatientId: bson.ObjectIdHex(patientId)}
+	var err error
+	if chart.Allergies, err = cs.Allergies(patientId); err != nil {
+		return nil, err
+	}
+	problems, err := cs.Problems(patientId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(problems) - 1; i >= 0; i-- {
+		if problems[i].Active() {
+			chart.Problems = append(chart.Problems, problems[i])
+		} else {
+			chart.Resolved = append(chart.Resolved, problems[i])
+		}
+	}
+	medications, err := cs.Medications(patientId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(medications) - 1; i >= 0; i-- {
+		if medications[i].Current() {
+			chart.Medications = append(chart.Medications, medications[i])
+		} else {
+			chart.Stopped = append(chart.Stopped, medications[i])
+		}
+	}
+	return &chart, nil
+}
+
+func (cs *chartService) ResolveProblem(problem *Problem, day time.Time) error {
+	if !problem.Active() {
+		return ErrProblemNotActive
+	}
+	problem.Status = ProblemResolved
+	problem.Resolved = day
+	return cs.UpdateProblem(problem)
+}
+
+func (cs *chartService) StopMedication(medication *CurrentMedication, day time.Time) error {
+	if !medication.Current() {
+		return ErrMedicationStopped
+	}
+	medication.Stopped = day
+	return cs.UpdateMedication(medication)
+}
+
+func (cs *chartService) AllergyWarnings(patientId string, medications []string) ([]AllergyWarning, error) {
+	allergies, err := cs.Allergies(patientId)
+	if err != nil {
+		return nil, err
+	}
+	return cs.classes.Warnings(medications, allergies), nil
+}
+
+type chartMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ ChartDB = &chartMongo{}
+
+func (cm *chartMongo) byId(collection, id string, result interface{}) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(cm.dbname).C(collection).FindId(bson.ObjectIdHex(id)).One(result)
+}
+
+func (cm *chartMongo) byPatient(collection, patientId string, result interface{}) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	query := bson.M{"patient_id": bson.ObjectIdHex(patientId)}
+	return ses.DB(cm.dbname).C(collection).Find(query).Sort("recorded").All(result)
+}
+
+func (cm *chartMongo) insert(collection string, doc interface{}) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(cm.dbname).C(collection).Insert(doc)
+}
+
+func (cm *chartMongo) update(collection string, id bson.ObjectId, doc interface{}) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(cm.dbname).C(collection).UpdateId(id, doc)
+}
+
+func (cm *chartMongo) AllergyById(id string) (*Allergy, error) {
+	a := Allergy{}
+	err := cm.byId(AllergyCollection, id, &a)
+	return &a, err
+}
+
+func (cm *chartMongo) Allergies(patientId string) ([]Allergy, error) {
+	var allergies []Allergy
+	err := cm.byPatient(AllergyCollection, patientId, &allergies)
+	return allergies, err
+}
+
+func (cm *chartMongo) CreateAllergy(allergy *Allergy) error {
+	allergy.Id = bson.NewObjectId()
+	return cm.insert(AllergyCollection, allergy)
+}
+
+func (cm *chartMongo) DeleteAllergy(id string) error {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(cm.dbname).C(AllergyCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+func (cm *chartMongo) ProblemById(id string) (*Problem, error) {
+	p := Problem{}
+	err := cm.byId(ProblemCollection, id, &p)
+	return &p, err
+}
+
+func (cm *chartMongo) Problems(patientId string) ([]Problem, error) {
+	var problems []Problem
+	err := cm.byPatient(ProblemCollection, patientId, &problems)
+	return problems, err
+}
+
+func (cm *chartMongo) CreateProblem(problem *Problem) error {
+	problem.Id = bson.NewObjectId()
+	return cm.insert(ProblemCollection, problem)
+}
+
+func (cm *chartMongo) UpdateProblem(problem *Problem) error {
+	return cm.update(ProblemCollection, problem.Id, problem)
+}
+
+func (cm *chartMongo) MedicationById(id string) (*CurrentMedication, error) {
+	m := CurrentMedication{}
+	err := cm.byId(CurrentMedicationCollection, id, &m)
+	return &m, err
+}
+
+func (cm *chartMongo) Medications(patientId string) ([]CurrentMedication, error) {
+	var medications []CurrentMedication
+	err := cm.byPatient(CurrentMedicationCollection, patientId, &medications)
+	return medications, err
+}
+
+func (cm *chartMongo) CreateMedication(medication *CurrentMedication) error {
+	medication.Id = bson.NewObjectId()
+	return cm.insert(CurrentMedicationCollection, medication)
+}
+
+func (cm *chartMongo) UpdateMedication(medication *CurrentMedication) error {
+	return cm.update(CurrentMedicationCollection, medication.Id, medication)
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// chartMemory is a thread safe in-memory implementation of ChartDB.
+type chartMemory struct {
+	mu          sync.RWMutex
+	allergies   map[bson.ObjectId]Allergy
+	problems    map[bson.ObjectId]Problem
+	medications map[bson.ObjectId]CurrentMedication
+}
+
+var _ ChartDB = &chartMemory{}
+
+func newChartMemory() *chartMemory {
+	return &chartMemory{
+		allergies:   make(map[bson.ObjectId]Allergy),
+		problems:    make(map[bson.ObjectId]Problem),
+		medications: make(map[bson.ObjectId]CurrentMedication),
+	}
+}
+
+func (cm *chartMemory) AllergyById(id string) (*Allergy, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	a, ok := cm.allergies[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &a, nil
+}
+
+func (cm *chartMemory) Allergies(patientId string) ([]Allergy, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	var allergies []Allergy
+	for _, a := range cm.allergies {
+		if a.PatientId.Hex() == patientId {
+			allergies = append(allergies, a)
+		}
+	}
+	sort.Slice(allergies, func(i, j int) bool {
+		return allergies[i].Recorded.Before(allergies[j].Recorded)
+	})
+	return allergies, nil
+}
+
+func (cm *chartMemory) CreateAllergy(allergy *Allergy) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	allergy.Id = bson.NewObjectId()
+	cm.allergies[allergy.Id] = *allergy
+	return nil
+}
+
+func (cm *chartMemory) DeleteAllergy(id string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.allergies[bson.ObjectIdHex(id)]; !ok {
+		return MongoErrNotFound
+	}
+	delete(cm.allergies, bson.ObjectIdHex(id))
+	return nil
+}
+
+func (cm *chartMemory) ProblemById(id string) (*Problem, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	p, ok := cm.problems[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &p, nil
+}
+
+func (cm *chartMemory) Problems(patientId string) ([]Problem, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	var problems []Problem
+	for _, p := range cm.problems {
+		if p.PatientId.Hex() == patientId {
+			problems = append(problems, p)
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Recorded.Before(problems[j].Recorded)
+	})
+	return problems, nil
+}
+
+func (cm *chartMemory) CreateProblem(problem *Problem) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	problem.Id = bson.NewObjectId()
+	cm.problems[problem.Id] = *problem
+	return nil
+}
+
+func (cm *chartMemory) UpdateProblem(problem *Problem) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.problems[problem.Id]; !ok {
+		return MongoErrNotFound
+	}
+	cm.problems[problem.Id] = *problem
+	return nil
+}
+
+func (cm *chartMemory) MedicationById(id string) (*CurrentMedication, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	m, ok := cm.medications[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &m, nil
+}
+
+func (cm *chartMemory) Medications(patientId string) ([]CurrentMedication, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	var medications []CurrentMedication
+	for _, m := range cm.medications {
+		if m.PatientId.Hex() == patientId {
+			medications = append(medications, m)
+		}
+	}
+	sort.Slice(medications, func(i, j int) bool {
+		return medications[i].Recorded.Before(medications[j].Recorded)
+	})
+	return medications, nil
+}
+
+func (cm *chartMemory) CreateMedication(medication *CurrentMedication) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	medication.Id = bson.NewObjectId()
+	cm.medications[medication.Id] = *medication
+	return nil
+}
+
+func (cm *chartMemory) UpdateMedication(medication *CurrentMedication) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.medications[medication.Id]; !ok {
+		return MongoErrNotFound
+	}
+	cm.medications[medication.Id] = *medication
+	return nil
+}
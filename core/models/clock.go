@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Clock provides the current time, so that time dependent logic can be tested with a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock returns a Clock which reads the system time.
+func SystemClock() Clock {
+	return systemClock{}
+}
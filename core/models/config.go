@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
 type LogLevel string
@@ -54,27 +55,214 @@ func DefaultMongoConfig() DatabaseConfig {
 	}
 }
 
+// LoginPolicy configures when logins are throttled and accounts are locked.
+type LoginPolicy struct {
+	MaxFailedAttempts int `json:"max_failed_attempts"`
+	LockoutMinutes    int `json:"lockout_minutes"`
+	MaxFailedPerIP    int `json:"max_failed_per_ip"`
+	IPWindowMinutes   int `json:"ip_window_minutes"`
+}
+
+func DefaultLoginPolicy() LoginPolicy {
+	return LoginPolicy{
+		MaxFailedAttempts: 5,
+		LockoutMinutes:    15,
+		MaxFailedPerIP:    20,
+		IPWindowMinutes:   15,
+	}
+}
+
+// withDefaults fills in the values missing from a loaded config.
+func (p LoginPolicy) withDefaults() LoginPolicy {
+	d := DefaultLoginPolicy()
+	if p.MaxFailedAttempts <= 0 {
+		p.MaxFailedAttempts = d.MaxFailedAttempts
+	}
+	if p.LockoutMinutes <= 0 {
+		p.LockoutMinutes = d.LockoutMinutes
+	}
+	if p.MaxFailedPerIP <= 0 {
+		p.MaxFailedPerIP = d.MaxFailedPerIP
+	}
+	if p.IPWindowMinutes <= 0 {
+		p.IPWindowMinutes = d.IPWindowMinutes
+	}
+	return p
+}
+
+func (p LoginPolicy) lockout() time.Duration {
+	return time.Duration(p.LockoutMinutes) * time.Minute
+}
+
+func (p LoginPolicy) ipWindow() time.Duration {
+	return time.Duration(p.IPWindowMinutes) * time.Minute
+}
+
+const (
+	// DefaultDocumentsDir is where documents are kept with filesystem storage, relative to the directory the
+	// server runs in.
+	DefaultDocumentsDir = "documents"
+	// DefaultMaxDocumentSizeMB is the size limit of uploaded documents if none is configured.
+	DefaultMaxDocumentSizeMB = 20
+)
+
+// DocumentStorage configures where the content of documents is kept.
+type DocumentStorage struct {
+	// Backend is "filesystem" or "gridfs".
+	Backend string `json:"backend"`
+	// Directory is used by the filesystem backend.
+	Directory string `json:"directory"`
+	MaxSizeMB int    `json:"max_size_mb"`
+}
+
+func DefaultDocumentStorage() DocumentStorage {
+	return DocumentStorage{
+		Backend:   BlobStorageFilesystem,
+		Directory: DefaultDocumentsDir,
+		MaxSizeMB: DefaultMaxDocumentSizeMB,
+	}
+}
+
+// withDefaults fills in the values missing from a loaded config.
+func (s DocumentStorage) withDefaults() DocumentStorage {
+	d := DefaultDocumentStorage()
+	if s.Backend == "" {
+		s.Backend = d.Backend
+	}
+	if s.Directory == "" {
+		s.Directory = d.Directory
+	}
+	if s.MaxSizeMB <= 0 {
+		s.MaxSizeMB = d.MaxSizeMB
+	}
+	return s
+}
+
+// MaxSize returns the size limit of documents in bytes.
+func (s DocumentStorage) MaxSize() int64 {
+	return int64(s.withDefaults().MaxSizeMB) << 20
+}
+
+const (
+	// DefaultHL7Port is the port registered for HL7 over MLLP.
+	DefaultHL7Port = 2575
+	// DefaultHL7Application and DefaultHL7Facility name the clinic in acknowledgements if none are configured.
+	DefaultHL7Application = "GCCHR"
+	DefaultHL7Facility    = "CLINIC"
+)
+
+// HL7Config configures the listener for HL7 v2 messages sent over MLLP by lab analyzers and hospital systems.
+type HL7Config struct {
+	// Port is the TCP port the listener accepts connections on, 0 turns the listener off.
+	Port int `json:"port"`
+	// Application and Facility name the clinic as the sender of acknowledgements.
+	Application string `json:"application"`
+	Facility    string `json:"facility"`
+	// AllowedIPs are the IP addresses connections are accepted from, the server does not start if one is not an IP
+	// address. Messages are not authenticated, so without allowed addresses the listener only accepts connections
+	// from this machine.
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+func DefaultHL7Config() HL7Config {
+	return HL7Config{
+		Port:        DefaultHL7Port,
+		Application: DefaultHL7Application,
+		Facility:    DefaultHL7Facility,
+	}
+}
+
+// Address returns the address the listener binds to, all interfaces only if connections are limited to the allowed
+// addresses.
+func (c HL7Config) Address() string {
+	if len(c.AllowedIPs) == 0 {
+		return fmt.Sprintf("127.0.0.1:%d", c.Port)
+	}
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// WithDefaults fills in the names missing from a loaded config. A missing port leaves the listener off.
+func (c HL7Config) WithDefaults() HL7Config {
+	d := DefaultHL7Config()
+	if c.Application == "" {
+		c.Application = d.Application
+	}
+	if c.Facility == "" {
+		c.Facility = d.Facility
+	}
+	return c
+}
+
 type Config struct {
-	Port      int            `json:"port"`
-	Env       ENV            `json:"env"`
-	Pepper    string         `json:"pepper"`
-	HMACKey   string         `json:"hmac_key"`
-	MongoDB   DatabaseConfig `json:"mongo_db"`
-	LogConfig LogConfig      `json:"log_config"`
+	Port                 int            `json:"port"`
+	Env                  ENV            `json:"env"`
+	Pepper               string         `json:"pepper"`
+	HMACKey              string         `json:"hmac_key"`
+	EncryptionKey        string         `json:"encryption_key"`
+	SessionLifetimeHours int            `json:"session_lifetime_hours"`
+	LoginPolicy          LoginPolicy    `json:"login_policy"`
+	PasswordPolicy       PasswordPolicy `json:"password_policy"`
+	MongoDB              DatabaseConfig `json:"mongo_db"`
+	LogConfig            LogConfig      `json:"log_config"`
+	// LabTestsFile lists the lab tests which can be ordered, with their analytes and reference ranges.
+	LabTestsFile string `json:"lab_tests_file"`
+	// DocumentStorage configures where uploaded documents are kept and how large they can be.
+	DocumentStorage DocumentStorage `json:"document_storage"`
+	// DrugClassesFile lists the drug classes prescriptions are checked against allergies with.
+	DrugClassesFile string `json:"drug_classes_file"`
+	// VaccineScheduleFile holds the immunization schedule the doses due for patients are worked out by.
+	VaccineScheduleFile string `json:"vaccine_schedule_file"`
+	// GrowthReferenceDir holds the percentile tables the growth of children is compared against.
+	GrowthReferenceDir string `json:"growth_reference_dir"`
+	// DiagnosisCodesFile holds the ICD-10 code table diagnoses are coded with.
+	DiagnosisCodesFile string `json:"diagnosis_codes_file"`
+	// HL7 configures the listener for HL7 v2 messages from the lab analyzer and the hospital.
+	HL7 HL7Config `json:"hl7"`
 }
 
 func (c *Config) IsProd() bool {
 	return c.Env == PROD
 }
 
+// SessionLifetime returns how long a sign in on a device stays valid.
+func (c *Config) SessionLifetime() time.Duration {
+	return time.Duration(c.SessionLifetimeHours) * time.Hour
+}
+
+// Redacted returns a copy of the config with the keys and passwords replaced, for printing at startup. Secrets
+// which are not set stay empty, so that a missing one shows.
+func (c Config) Redacted() Config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = "[redacted]"
+		}
+	}
+	redact(&c.Pepper)
+	redact(&c.HMACKey)
+	redact(&c.EncryptionKey)
+	redact(&c.MongoDB.Password)
+	return c
+}
+
 func DefaultConfig() Config {
 	return Config{
-		Port:      1986,
-		Env:       DEV,
-		Pepper:    "some-secret-random-string",
-		HMACKey:   "secret-random-hmac-key",
-		MongoDB:   DefaultMongoConfig(),
-		LogConfig: DefaultLogConfig(),
+		Port:                 1986,
+		Env:                  DEV,
+		Pepper:               "some-secret-random-string",
+		HMACKey:              "secret-random-hmac-key",
+		EncryptionKey:        "secret-random-encryption-key",
+		SessionLifetimeHours: 12,
+		LoginPolicy:          DefaultLoginPolicy(),
+		PasswordPolicy:       DefaultPasswordPolicy(),
+		MongoDB:              DefaultMongoConfig(),
+		LogConfig:            DefaultLogConfig(),
+		LabTestsFile:         DefaultLabTestsFile,
+		DocumentStorage:      DefaultDocumentStorage(),
+		DrugClassesFile:      DefaultDrugClassesFile,
+		VaccineScheduleFile:  DefaultImmunizationScheduleFile,
+		GrowthReferenceDir:   DefaultGrowthReferenceDir,
+		DiagnosisCodesFile:   DefaultDiagnosisCodesFile,
+		HL7:                  DefaultHL7Config(),
 	}
 }
 
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const CounterCollection = "counter"
+
+// CounterDB hands out sequential numbers, like medical record numbers.
+// Next is safe for concurrent use, also across several server processes sharing a database.
+type CounterDB interface {
+	// Next increments the counter with the name and returns its new value. The first value is 1.
+	Next(name string) (int64, error)
+}
+
+type counter struct {
+	Id    string `bson:"_id"`
+	Value int64  `bson:"value"`
+}
+
+type counterMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ CounterDB = &counterMongo{}
+
+func NewCounterMongo(mgo *mgo.Session, logger *logrus.Entry, dbname string) CounterDB {
+	return &counterMongo{mgo, dbname, logger}
+}
+
+func (cm *counterMongo) Next(name string) (int64, error) {
+	ses := cm.mgo.Copy()
+	defer ses.Close()
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"value": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var c counter
+	_, err := ses.DB(cm.dbname).C(CounterCollection).FindId(name).Apply(change, &c)
+	return c.Value, err
+}
+
+// counterMemory is a thread safe in-memory implementation of CounterDB.
+type counterMemory struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+var _ CounterDB = &counterMemory{}
+
+func NewCounterMemory() CounterDB {
+	return &counterMemory{
+		values: make(map[string]int64),
+	}
+}
+
+func (cm *counterMemory) Next(name string) (int64, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.values[name]++
+	return cm.values[name], nil
+}
@@ -0,0 +1,374 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultDiagnosisCodesFile holds the ICD-10 codes shipped with the system, relative to the directory the server
+// runs in.
+const DefaultDiagnosisCodesFile = "core/data/icd10.tsv"
+
+// maxDiagnosisCodeResults is the most codes a search returns.
+const maxDiagnosisCodeResults = 50
+
+// codeSetVersionPrefix starts the comment naming the version of a code file.
+const codeSetVersionPrefix = "# version:"
+
+// DiagnosisCode is a code of the ICD-10 classification with its title.
+type DiagnosisCode struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// Category returns the three character category of the code, like J45 for J45.9.
+func (c DiagnosisCode) Category() string {
+	return DiagnosisCategory(c.Code)
+}
+
+// NormalizeDiagnosisCode writes a code the way code sets list them, in upper case with a dot after the category.
+// Codes from files like the ICD-10-CM code list, which leave out the dot, are written the same way.
+func NormalizeDiagnosisCode(code string) string {
+	code = strings.ToUpper(strings.Replace(strings.TrimSpace(code), ".", "", -1))
+	if len(code) > 3 {
+		code = code[:3] + "." + code[3:]
+	}
+	return code
+}
+
+// DiagnosisCategory returns the three character category of a code.
+func DiagnosisCategory(code string) string {
+	code = NormalizeDiagnosisCode(code)
+	if len(code) > 3 {
+		return code[:3]
+	}
+	return code
+}
+
+// CodeSet is a version of the ICD-10 code table, indexed for looking up codes and searching them by code prefix or
+// by the words of their titles. A code set does not change once loaded, new versions replace it as a whole.
+type CodeSet struct {
+	Version string
+	Loaded  time.Time
+	// codes are sorted by code, so that codes starting with a prefix are next to each other.
+	codes  []DiagnosisCode
+	byCode map[string]int
+	// words are the words of the titles, sorted, with the positions of the codes using them in postings.
+	words    []string
+	postings map[string][]int
+}
+
+// LoadCodeSet reads the code table in the file. See ReadCodeSet for its format.
+func LoadCodeSet(file string) (*CodeSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cs, err := ReadCodeSet(f, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+	if err != nil {
+		return nil, fmt.Errorf("models: reading diagnosis codes from %s: %v", file, err)
+	}
+	return cs, nil
+}
+
+// ReadCodeSet reads a code table with a code and its title per line, separated by a tab or, like the ICD-10-CM
+// code files, by spaces. Empty lines and lines starting with # are skipped, except for a "# version:" comment
+// naming the version; the name is used if there is none.
+func ReadCodeSet(r io.Reader, name string) (*CodeSet, error) {
+	cs := CodeSet{Version: name, byCode: make(map[string]int)}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(text, codeSetVersionPrefix) {
+			cs.Version = strings.TrimSpace(strings.TrimPrefix(text, codeSetVersionPrefix))
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, "\t", 2)
+		if len(fields) < 2 {
+			fields = strings.SplitN(text, " ", 2)
+		}
+		if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("line %d needs a code and a description", line)
+		}
+		code := DiagnosisCode{Code: NormalizeDiagnosisCode(fields[0]), Description: strings.TrimSpace(fields[1])}
+		if !validDiagnosisCode(code.Code) {
+			return nil, fmt.Errorf("line %d: %q is not an ICD-10 code", line, fields[0])
+		}
+		if _, ok := cs.byCode[code.Code]; ok {
+			return nil, fmt.Errorf("line %d: code %s is listed twice", line, code.Code)
+		}
+		cs.byCode[code.Code] = len(cs.codes)
+		cs.codes = append(cs.codes, code)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cs.codes) == 0 {
+		return nil, fmt.Errorf("there are no codes")
+	}
+	cs.index()
+	return &cs, nil
+}
+
+// validDiagnosisCode reports whether the code looks like an ICD-10 code: a letter, two digits, and up to five more
+// characters after the dot.
+func validDiagnosisCode(code string) bool {
+	if len(code) < 3 || len(code) > 9 || !unicode.IsLetter(rune(code[0])) {
+		return false
+	}
+	if !unicode.IsDigit(rune(code[1])) || !unicode.IsDigit(rune(code[2])) {
+		return false
+	}
+	for _, c := range code[3:] {
+		if c != '.' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// index sorts the codes and builds the word index of their titles.
+func (cs *CodeSet) index() {
+	sort.Slice(cs.codes, func(i, j int) bool {
+		return cs.codes[i].Code < cs.codes[j].Code
+	})
+	cs.postings = make(map[string][]int)
+	for i, c := range cs.codes {
+		cs.byCode[c.Code] = i
+		seen := make(map[string]bool)
+		for _, w := range searchWords(c.Description) {
+			if !seen[w] {
+				seen[w] = true
+				cs.postings[w] = append(cs.postings[w], i)
+			}
+		}
+	}
+	cs.words = make([]string, 0, len(cs.postings))
+	for w := range cs.postings {
+		cs.words = append(cs.words, w)
+	}
+	sort.Strings(cs.words)
+}
+
+// searchWords splits the text into lower case words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Len returns the number of codes.
+func (cs *CodeSet) Len() int {
+	return len(cs.codes)
+}
+
+// Lookup returns the code, written with or without the dot.
+func (cs *CodeSet) Lookup(code string) (DiagnosisCode, bool) {
+	i, ok := cs.byCode[NormalizeDiagnosisCode(code)]
+	if !ok {
+		return DiagnosisCode{}, false
+	}
+	return cs.codes[i], true
+}
+
+// Search returns at most limit codes, in the order of the codes. A query starting like a code, such as J45 or j450,
+// finds the codes starting with it. Otherwise every word of the query has to start a word of the title, so that
+// "type 2 diab" finds type 2 diabetes mellitus while it is typed.
+func (cs *CodeSet) Search(query string, limit int) []DiagnosisCode {
+	if limit <= 0 || limit > maxDiagnosisCodeResults {
+		limit = maxDiagnosisCodeResults
+	}
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil
+	}
+	if looksLikeDiagnosisCode(query) {
+		return cs.searchCode(query, limit)
+	}
+	var matches []int
+	for i, w := range searchWords(query) {
+		positions := cs.wordPrefix(w)
+		if i == 0 {
+			matches = positions
+		} else {
+			matches = intersect(matches, positions)
+		}
+		if len(matches) == 0 {
+			return nil
+		}
+	}
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	codes := make([]DiagnosisCode, len(matches))
+	for i, m := range matches {
+		codes[i] = cs.codes[m]
+	}
+	return codes
+}
+
+func looksLikeDiagnosisCode(query string) bool {
+	return len(query) >= 2 && unicode.IsLetter(rune(query[0])) && unicode.IsDigit(rune(query[1]))
+}
+
+// searchCode returns the codes starting with the prefix.
+func (cs *CodeSet) searchCode(prefix string, limit int) []DiagnosisCode {
+	prefix = NormalizeDiagnosisCode(prefix)
+	i := sort.Search(len(cs.codes), func(i int) bool {
+		return cs.codes[i].Code >= prefix
+	})
+	var codes []DiagnosisCode
+	for ; i < len(cs.codes) && len(codes) < limit && strings.HasPrefix(cs.codes[i].Code, prefix); i++ {
+		codes = append(codes, cs.codes[i])
+	}
+	return codes
+}
+
+// wordPrefix returns the sorted positions of the codes with a word of the title starting with the prefix.
+func (cs *CodeSet) wordPrefix(prefix string) []int {
+	i := sort.SearchStrings(cs.words, prefix)
+	var lists [][]int
+	for ; i < len(cs.words) && strings.HasPrefix(cs.words[i], prefix); i++ {
+		lists = append(lists, cs.postings[cs.words[i]])
+	}
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	seen := make(map[int]bool)
+	var positions []int
+	for _, l := range lists {
+		for _, p := range l {
+			if !seen[p] {
+				seen[p] = true
+				positions = append(positions, p)
+			}
+		}
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+// intersect returns the positions in both sorted lists.
+func intersect(a, b []int) []int {
+	var both []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+// DiagnosisCodeService holds the code set in use. New versions of the code table can be loaded while the server
+// runs: requests keep using the code set they started with, and later ones use the new one.
+type DiagnosisCodeService interface {
+	// CodeSet returns the code set in use.
+	CodeSet() *CodeSet
+	// Search searches the code set in use, see CodeSet.Search.
+	Search(query string, limit int) []DiagnosisCode
+	// Lookup looks up the code in the code set in use.
+	Lookup(code string) (DiagnosisCode, bool)
+	// Reload reads the code file again, keeping the code set in use if it can not be read.
+	Reload() (*CodeSet, error)
+	// Replace checks the uploaded code table, saves it as the code file and uses it. The name is the version used
+	// if the table does not name one.
+	Replace(r io.Reader, name string) (*CodeSet, error)
+}
+
+type diagnosisCodeService struct {
+	mu     sync.RWMutex
+	codes  *CodeSet
+	file   string
+	clock  Clock
+	logger *logrus.Entry
+}
+
+// NewDiagnosisCodeService loads the code set from the file.
+func NewDiagnosisCodeService(file string, logger *logrus.Entry) (DiagnosisCodeService, error) {
+	ds := &diagnosisCodeService{file: file, clock: SystemClock(), logger: logger}
+	if _, err := ds.Reload(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (ds *diagnosisCodeService) CodeSet() *CodeSet {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.codes
+}
+
+func (ds *diagnosisCodeService) Search(query string, limit int) []DiagnosisCode {
+	return ds.CodeSet().Search(query, limit)
+}
+
+func (ds *diagnosisCodeService) Lookup(code string) (DiagnosisCode, bool) {
+	return ds.CodeSet().Lookup(code)
+}
+
+func (ds *diagnosisCodeService) Reload() (*CodeSet, error) {
+	cs, err := LoadCodeSet(ds.file)
+	if err != nil {
+		return nil, err
+	}
+	ds.use(cs)
+	return cs, nil
+}
+
+func (ds *diagnosisCodeService) Replace(r io.Reader, name string) (*CodeSet, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := ReadCodeSet(bytes.NewReader(data), name)
+	if err != nil {
+		return nil, modelError(fmt.Sprintf("models: the code table can not be used, %v", err))
+	}
+	if !bytes.Contains(data, []byte(codeSetVersionPrefix)) {
+		// Keep the version over restarts.
+		data = append([]byte(codeSetVersionPrefix+" "+cs.Version+"\n"), data...)
+	}
+	// Write a copy first and rename it, so that the file is never half written.
+	tmp := ds.file + ".new"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, ds.file); err != nil {
+		return nil, err
+	}
+	ds.use(cs)
+	return cs, nil
+}
+
+func (ds *diagnosisCodeService) use(cs *CodeSet) {
+	cs.Loaded = ds.clock.Now()
+	ds.mu.Lock()
+	ds.codes = cs
+	ds.mu.Unlock()
+	ds.logger.Infof("Using diagnosis codes %s with %d codes", cs.Version, cs.Len())
+}
@@ -0,0 +1,415 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const DocumentCollection = "document"
+
+type DocumentCategory string
+
+const (
+	DocumentReferral  DocumentCategory = "referral"
+	DocumentConsent   DocumentCategory = "consent"
+	DocumentIDCard    DocumentCategory = "id_card"
+	DocumentImage     DocumentCategory = "image"
+	DocumentLabReport DocumentCategory = "lab_report"
+	DocumentOther     DocumentCategory = "other"
+)
+
+func DocumentCategoriesList() []DocumentCategory {
+	return []DocumentCategory{DocumentReferral, DocumentConsent, DocumentIDCard, DocumentImage, DocumentLabReport,
+		DocumentOther}
+}
+
+// Label returns the name of the category shown to users.
+func (c DocumentCategory) Label() string {
+	switch c {
+	case DocumentIDCard:
+		return "ID card"
+	case DocumentConsent:
+		return "Consent form"
+	case DocumentLabReport:
+		return "Lab report"
+	}
+	return strings.Title(string(c))
+}
+
+// Clinical reports whether documents of the category are part of the clinical record, which reception can not see.
+// Referrals, consent forms and ID cards are scanned in at the front desk.
+func (c DocumentCategory) Clinical() bool {
+	return c == DocumentImage || c == DocumentLabReport
+}
+
+// Clinical reports whether the document is part of the clinical record, like everything attached to an encounter.
+func (d *Document) Clinical() bool {
+	return d.Category.Clinical() || d.EncounterId != ""
+}
+
+// documentContentTypes are the content types which can be uploaded. The type is detected from the content,
+// the name of the file and the type sent by the browser are not trusted.
+var documentContentTypes = []string{"application/pdf", "image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// Document is a file attached to a patient, like a scanned referral or an image, and optionally to an encounter.
+// The content is kept in a BlobStore under the storage key.
+type Document struct {
+	Id          bson.ObjectId    `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId   bson.ObjectId    `json:"patient_id" bson:"patient_id"`
+	EncounterId bson.ObjectId    `json:"encounter_id,omitempty" bson:"encounter_id,omitempty"`
+	Category    DocumentCategory `json:"category" bson:"category"`
+	Title       string           `json:"title" bson:"title"`
+	FileName    string           `json:"file_name" bson:"file_name"`
+	ContentType string           `json:"content_type" bson:"content_type"`
+	Size        int64            `json:"size" bson:"size"`
+	// Checksum is the hex encoded SHA-256 of the content.
+	Checksum   string        `json:"checksum" bson:"checksum"`
+	StorageKey string        `json:"-" bson:"storage_key"`
+	Uploaded   time.Time     `json:"uploaded" bson:"uploaded"`
+	UploadedBy bson.ObjectId `json:"uploaded_by" bson:"uploaded_by"`
+}
+
+// IsImage reports whether the document can be shown in a page.
+func (d *Document) IsImage() bool {
+	return strings.HasPrefix(d.ContentType, "image/")
+}
+
+// SizeString returns the size of the content like 340 KB or 1.2 MB.
+func (d *Document) SizeString() string {
+	switch {
+	case d.Size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(d.Size)/(1<<20))
+	case d.Size >= 1<<10:
+		return fmt.Sprintf("%d KB", d.Size>>10)
+	}
+	return fmt.Sprintf("%d bytes", d.Size)
+}
+
+type DocumentDB interface {
+	ById(id string) (*Document, error)
+	// ByPatient and ByEncounter return documents newest first.
+	ByPatient(patientId string) ([]Document, error)
+	ByEncounter(encounterId string) ([]Document, error)
+
+	Create(document *Document) error
+	Delete(id string) error
+}
+
+type documentValidator struct {
+	DocumentDB
+	patients   PatientDB
+	encounters EncounterDB
+	clock      Clock
+}
+
+var _ DocumentDB = &documentValidator{}
+
+func (dv *documentValidator) ById(id string) (*Document, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return dv.DocumentDB.ById(id)
+}
+
+func (dv *documentValidator) ByPatient(patientId string) ([]Document, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return dv.DocumentDB.ByPatient(patientId)
+}
+
+func (dv *documentValidator) ByEncounter(encounterId string) ([]Document, error) {
+	if !bson.IsObjectIdHex(encounterId) {
+		return nil, ErrIDInvalid
+	}
+	return dv.DocumentDB.ByEncounter(encounterId)
+}
+
+func (dv *documentValidator) Create(document *Document) error {
+	if err := dv.validate(document); err != nil {
+		return err
+	}
+	return dv.DocumentDB.Create(document)
+}
+
+func (dv *documentValidator) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return dv.DocumentDB.Delete(id)
+}
+
+// validate checks the details of a document before its content is stored.
+func (dv *documentValidator) validate(document *Document) error {
+	return runDocumentValFuncs(document, dv.requirePatient, dv.encounterOfPatient, dv.categoryExists,
+		dv.normalizeNames, dv.ensureUploadedAt)
+}
+
+func (dv *documentValidator) requirePatient(document *Document) error {
+	if document.PatientId == "" {
+		return ErrPatientRequired
+	}
+	if _, err := dv.patients.ById(document.PatientId.Hex()); err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPatientRequired
+		}
+		return err
+	}
+	return nil
+}
+
+func (dv *documentValidator) encounterOfPatient(document *Document) error {
+	if document.EncounterId == "" {
+		return nil
+	}
+	encounter, err := dv.encounters.ById(document.EncounterId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrDocumentEncounterInvalid
+		}
+		return err
+	}
+	if encounter.PatientId != document.PatientId {
+		return ErrDocumentEncounterInvalid
+	}
+	return nil
+}
+
+func (dv *documentValidator) categoryExists(document *Document) error {
+	for _, c := range DocumentCategoriesList() {
+		if c == document.Category {
+			return nil
+		}
+	}
+	return ErrDocumentCategoryInvalid
+}
+
+// normalizeNames keeps only the base name of the uploaded file, and uses it as the title if there is none.
+func (dv *documentValidator) normalizeNames(document *Document) error {
+	name := strings.TrimSpace(filepath.Base(strings.Replace(document.FileName, "\\", "/", -1)))
+	if name == "." || name == "/" {
+		name = ""
+	}
+	document.FileName = name
+	document.Title = strings.TrimSpace(document.Title)
+	if document.Title == "" {
+		document.Title = name
+	}
+	if document.Title == "" {
+		return ErrDocumentTitleRequired
+	}
+	return nil
+}
+
+func (dv *documentValidator) ensureUploadedAt(document *Document) error {
+	document.Uploaded = dv.clock.Now()
+	return nil
+}
+
+// DocumentService keeps documents attached to patients, their details in a DocumentDB and their content in a
+// BlobStore.
+type DocumentService interface {
+	// Upload checks the details of the document and the type and size of its content, then stores the content
+	// and records its size and checksum. The content is streamed into the store.
+	Upload(document *Document, content io.Reader) error
+	// Open returns the content of the document, which the caller has to close.
+	Open(document *Document) (io.ReadCloser, error)
+	// Remove deletes the document and its content.
+	Remove(document *Document) error
+	// MaxSize returns the size limit of documents in bytes.
+	MaxSize() int64
+	DocumentDB
+}
+
+type documentService struct {
+	DocumentDB
+	validator *documentValidator
+	blobs     BlobStore
+	maxSize   int64
+	logger    *logrus.Entry
+}
+
+func NewDocumentService(mgo *mgo.Session, patients PatientDB, encounters EncounterDB, blobs BlobStore,
+	maxSize int64, logger *logrus.Entry, dbname string) DocumentService {
+	dm := &documentMongo{mgo, dbname, logger}
+	return newDocumentService(dm, patients, encounters, blobs, maxSize, logger)
+}
+
+// NewInMemoryDocumentService returns a DocumentService backed by an in-memory DocumentDB.
+func NewInMemoryDocumentService(patients PatientDB, encounters EncounterDB, blobs BlobStore, maxSize int64,
+	logger *logrus.Entry) DocumentService {
+	return newDocumentService(newDocumentMemory(), patients, encounters, blobs, maxSize, logger)
+}
+
+func newDocumentService(ddb DocumentDB, patients PatientDB, encounters EncounterDB, blobs BlobStore,
+	maxSize int64, logger *logrus.Entry) DocumentService {
+	dv := &documentValidator{
+		DocumentDB: ddb,
+		patients:   patients,
+		encounters: encounters,
+		clock:      SystemClock(),
+	}
+	return &documentService{
+		DocumentDB: dv,
+		validator:  dv,
+		blobs:      blobs,
+		maxSize:    maxSize,
+		logger:     logger,
+	}
+}
+
+func (ds *documentService) MaxSize() int64 {
+	return ds.maxSize
+}
+
+func (ds *documentService) Upload(document *Document, content io.Reader) error {
+	if err := ds.validator.validate(document); err != nil {
+		return err
+	}
+	// The content type is detected from the first bytes, which are read again when the content is stored.
+	buffered := bufio.NewReaderSize(content, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if len(head) == 0 {
+		return ErrDocumentEmpty
+	}
+	document.ContentType = detectContentType(head)
+	if document.ContentType == "" {
+		return ErrDocumentTypeInvalid
+	}
+	counter := &countingReader{r: buffered, limit: ds.maxSize, hash: sha256.New()}
+	document.StorageKey = bson.NewObjectId().Hex()
+	if err := ds.blobs.Put(document.StorageKey, counter); err != nil {
+		ds.blobs.Delete(document.StorageKey)
+		if counter.exceeded {
+			return ErrDocumentTooLarge
+		}
+		return err
+	}
+	document.Size = counter.n
+	document.Checksum = hex.EncodeToString(counter.hash.Sum(nil))
+	if err := ds.validator.DocumentDB.Create(document); err != nil {
+		ds.blobs.Delete(document.StorageKey)
+		return err
+	}
+	ds.logger.Infof("Document %s (%s, %d bytes) uploaded for patient %s", document.Id.Hex(), document.ContentType,
+		document.Size, document.PatientId.Hex())
+	return nil
+}
+
+func (ds *documentService) Open(document *Document) (io.ReadCloser, error) {
+	return ds.blobs.Open(document.StorageKey)
+}
+
+// Remove deletes the details first, so that a document is never listed without its content.
+func (ds *documentService) Remove(document *Document) error {
+	if err := ds.Delete(document.Id.Hex()); err != nil {
+		return err
+	}
+	if err := ds.blobs.Delete(document.StorageKey); err != nil {
+		ds.logger.Errorf("Error while deleting the content of document %s: %v", document.Id.Hex(), err)
+	}
+	return nil
+}
+
+// detectContentType returns the content type of the content starting with head, or an empty string if it is
+// not a type which can be uploaded.
+func detectContentType(head []byte) string {
+	detected := http.DetectContentType(head)
+	for _, t := range documentContentTypes {
+		if detected == t {
+			return t
+		}
+	}
+	return ""
+}
+
+// countingReader counts and hashes what is read through it, and fails once more than limit bytes are read.
+type countingReader struct {
+	r        io.Reader
+	limit    int64
+	n        int64
+	hash     hash.Hash
+	exceeded bool
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	cr.hash.Write(p[:n])
+	if cr.n > cr.limit {
+		cr.exceeded = true
+		return n, ErrDocumentTooLarge
+	}
+	return n, err
+}
+
+type documentMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ DocumentDB = &documentMongo{}
+
+func (dm *documentMongo) ById(id string) (*Document, error) {
+	ses := dm.mgo.Copy()
+	defer ses.Close()
+	d := Document{}
+	err := ses.DB(dm.dbname).C(DocumentCollection).FindId(bson.ObjectIdHex(id)).One(&d)
+	return &d, err
+}
+
+func (dm *documentMongo) ByPatient(patientId string) ([]Document, error) {
+	return dm.find(bson.M{"patient_id": bson.ObjectIdHex(patientId)})
+}
+
+func (dm *documentMongo) ByEncounter(encounterId string) ([]Document, error) {
+	return dm.find(bson.M{"encounter_id": bson.ObjectIdHex(encounterId)})
+}
+
+func (dm *documentMongo) find(query bson.M) ([]Document, error) {
+	ses := dm.mgo.Copy()
+	defer ses.Close()
+	var documents []Document
+	err := ses.DB(dm.dbname).C(DocumentCollection).Find(query).Sort("-uploaded").All(&documents)
+	return documents, err
+}
+
+func (dm *documentMongo) Create(document *Document) error {
+	ses := dm.mgo.Copy()
+	defer ses.Close()
+	document.Id = bson.NewObjectId()
+	return ses.DB(dm.dbname).C(DocumentCollection).Insert(document)
+}
+
+func (dm *documentMongo) Delete(id string) error {
+	ses := dm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(dm.dbname).C(DocumentCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+type documentValFunc func(document *Document) error
+
+func runDocumentValFuncs(document *Document, fns ...documentValFunc) error {
+	for _, fn := range fns {
+		if err := fn(document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
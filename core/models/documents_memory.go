@@ -0,0 +1,78 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// documentMemory is a thread safe in-memory implementation of DocumentDB.
+type documentMemory struct {
+	mu        sync.RWMutex
+	documents map[bson.ObjectId]Document
+}
+
+var _ DocumentDB = &documentMemory{}
+
+func newDocumentMemory() *documentMemory {
+	return &documentMemory{
+		documents: make(map[bson.ObjectId]Document),
+	}
+}
+
+func (dm *documentMemory) ById(id string) (*Document, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.documents[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &d, nil
+}
+
+func (dm *documentMemory) ByPatient(patientId string) ([]Document, error) {
+	return dm.filter(func(d *Document) bool {
+		return d.PatientId.Hex() == patientId
+	}), nil
+}
+
+func (dm *documentMemory) ByEncounter(encounterId string) ([]Document, error) {
+	return dm.filter(func(d *Document) bool {
+		return d.EncounterId.Hex() == encounterId
+	}), nil
+}
+
+// filter returns the documents matching the function, newest first.
+func (dm *documentMemory) filter(match func(d *Document) bool) []Document {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	var documents []Document
+	for _, d := range dm.documents {
+		if match(&d) {
+			documents = append(documents, d)
+		}
+	}
+	sort.Slice(documents, func(i, j int) bool {
+		return documents[i].Uploaded.After(documents[j].Uploaded)
+	})
+	return documents
+}
+
+func (dm *documentMemory) Create(document *Document) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	document.Id = bson.NewObjectId()
+	dm.documents[document.Id] = *document
+	return nil
+}
+
+func (dm *documentMemory) Delete(id string) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, ok := dm.documents[bson.ObjectIdHex(id)]; !ok {
+		return MongoErrNotFound
+	}
+	delete(dm.documents, bson.ObjectIdHex(id))
+	return nil
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// DefaultDrugClassesFile lists the drug classes shipped with the system, relative to the directory the server runs in.
+const DefaultDrugClassesFile = "core/data/drug_classes.json"
+
+// DrugClass is a group of drugs patients allergic to one of them may react to all of, like the penicillins.
+type DrugClass struct {
+	Name  string   `json:"name"`
+	Drugs []string `json:"drugs"`
+}
+
+// includes reports whether the text, like the name of a medication or an allergy, names the class or one of its drugs.
+func (dc *DrugClass) includes(text string) bool {
+	if containsTerm(text, dc.Name) {
+		return true
+	}
+	for _, d := range dc.Drugs {
+		if containsTerm(text, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// DrugClasses are the drug classes allergies are checked against when prescribing.
+type DrugClasses struct {
+	classes []DrugClass
+}
+
+type drugClassesFile struct {
+	Classes []DrugClass `json:"classes"`
+}
+
+// LoadDrugClasses reads the drug classes from a JSON file like core/data/drug_classes.json.
+func LoadDrugClasses(file string) (*DrugClasses, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var content drugClassesFile
+	if err := json.NewDecoder(f).Decode(&content); err != nil {
+		return nil, fmt.Errorf("models: reading drug classes from %s: %v", file, err)
+	}
+	for i, c := range content.Classes {
+		if strings.TrimSpace(c.Name) == "" || len(c.Drugs) == 0 {
+			return nil, fmt.Errorf("models: drug class %d in %s needs a name and drugs", i+1, file)
+		}
+	}
+	return &DrugClasses{classes: content.Classes}, nil
+}
+
+// All returns the classes in the order of the file.
+func (dc *DrugClasses) All() []DrugClass {
+	return dc.classes
+}
+
+// Of returns the classes the text names or names a drug of.
+func (dc *DrugClasses) Of(text string) []DrugClass {
+	var classes []DrugClass
+	for _, c := range dc.classes {
+		if c.includes(text) {
+			classes = append(classes, c)
+		}
+	}
+	return classes
+}
+
+// AllergyWarning is raised when a medication is prescribed to a patient with a matching allergy.
+type AllergyWarning struct {
+	Medication string
+	Allergy    Allergy
+	// Class is the drug class the medication shares with the allergy, empty if the medication names the allergy.
+	Class string
+	// CheckFailed is set on the only warning when the allergies could not be checked at all. Prescribing without
+	// the check has to be acknowledged like a match.
+	CheckFailed bool
+}
+
+func (w *AllergyWarning) Message() string {
+	if w.CheckFailed {
+		return "The allergies of the patient could not be checked, please check them in the chart"
+	}
+	allergy := w.Allergy.Substance
+	if w.Allergy.Reaction != "" {
+		allergy += " (" + string(w.Allergy.Severity) + ", " + w.Allergy.Reaction + ")"
+	} else {
+		allergy += " (" + string(w.Allergy.Severity) + ")"
+	}
+	if w.Class == "" {
+		return fmt.Sprintf("%s: the patient is allergic to %s", w.Medication, allergy)
+	}
+	return fmt.Sprintf("%s belongs to the %s, the patient is allergic to %s", w.Medication, w.Class, allergy)
+}
+
+// Warnings checks the medications against the allergies, first by name and then by drug class.
+func (dc *DrugClasses) Warnings(medications []string, allergies []Allergy) []AllergyWarning {
+	var warnings []AllergyWarning
+	for _, m := range medications {
+		for _, a := range allergies {
+			if containsTerm(m, a.Substance) {
+				warnings = append(warnings, AllergyWarning{Medication: m, Allergy: a})
+				continue
+			}
+			for _, c := range dc.Of(a.Substance) {
+				if c.includes(m) {
+					warnings = append(warnings, AllergyWarning{Medication: m, Allergy: a, Class: c.Name})
+					break
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// containsTerm reports whether the words of the term appear in the text next to each other, ignoring case and
+// punctuation. "Amoxicillin 500 mg" contains "amoxicillin", but "Ampicillin" does not contain "penicillin".
+func containsTerm(text, term string) bool {
+	words, termWords := termWords(text), termWords(term)
+	if len(termWords) == 0 {
+		return false
+	}
+	for i := 0; i+len(termWords) <= len(words); i++ {
+		match := true
+		for j, w := range termWords {
+			if words[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func termWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,580 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	EncounterCollection = "encounter"
+
+	// DefaultEncounterPageSize is the number of encounters on a page of filtered encounters if no page size is given.
+	DefaultEncounterPageSize = 20
+)
+
+type EncounterStatus string
+
+const (
+	EncounterDraft  EncounterStatus = "draft"
+	EncounterSigned EncounterStatus = "signed"
+)
+
+// Vitals are the measurements taken during an encounter, or at check-in. Zero values were not measured.
+type Vitals struct {
+	HeightCm float64 `json:"height_cm,omitempty" bson:"height_cm,omitempty"`
+	WeightKg float64 `json:"weight_kg,omitempty" bson:"weight_kg,omitempty"`
+	// BMI is worked out from the height and weight when the vitals are saved.
+	BMI             float64 `json:"bmi,omitempty" bson:"bmi,omitempty"`
+	SystolicBP      int     `json:"systolic_bp,omitempty" bson:"systolic_bp,omitempty"`
+	DiastolicBP     int     `json:"diastolic_bp,omitempty" bson:"diastolic_bp,omitempty"`
+	Pulse           int     `json:"pulse,omitempty" bson:"pulse,omitempty"`
+	RespiratoryRate int     `json:"respiratory_rate,omitempty" bson:"respiratory_rate,omitempty"`
+	TemperatureC    float64 `json:"temperature_c,omitempty" bson:"temperature_c,omitempty"`
+	SpO2            int     `json:"spo2,omitempty" bson:"spo2,omitempty"`
+	// HeadCm is the head circumference, measured for infants and young children.
+	HeadCm float64 `json:"head_cm,omitempty" bson:"head_cm,omitempty"`
+}
+
+// Empty reports whether no vitals were measured.
+func (v Vitals) Empty() bool {
+	return v == Vitals{}
+}
+
+// Diagnosis is a diagnosis of an encounter, coded with ICD-10. Encounters with diagnoses have one primary
+// diagnosis, the main reason for the visit.
+type Diagnosis struct {
+	Code        string `json:"code,omitempty" bson:"code,omitempty"`
+	Description string `json:"description" bson:"description"`
+	Primary     bool   `json:"primary,omitempty" bson:"primary,omitempty"`
+}
+
+// Addendum is a note added to an encounter after it was signed.
+type Addendum struct {
+	Text       string        `json:"text" bson:"text"`
+	AuthorId   bson.ObjectId `json:"author_id" bson:"author_id"`
+	AuthorName string        `json:"author_name" bson:"author_name"`
+	Created    time.Time     `json:"created" bson:"created"`
+}
+
+// Encounter is the note of a visit of a patient, in the SOAP structure.
+// Once signed it can not be changed anymore, only addenda can be added.
+type Encounter struct {
+	Id            bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId     bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	PhysicianId   bson.ObjectId `json:"physician_id" bson:"physician_id"`
+	AppointmentId bson.ObjectId `json:"appointment_id,omitempty" bson:"appointment_id,omitempty"`
+	Date          time.Time     `json:"date" bson:"date"`
+
+	Subjective string      `json:"subjective,omitempty" bson:"subjective,omitempty"`
+	Objective  string      `json:"objective,omitempty" bson:"objective,omitempty"`
+	Assessment string      `json:"assessment,omitempty" bson:"assessment,omitempty"`
+	Plan       string      `json:"plan,omitempty" bson:"plan,omitempty"`
+	Vitals     Vitals      `json:"vitals,omitempty" bson:"vitals,omitempty"`
+	Diagnoses  []Diagnosis `json:"diagnoses,omitempty" bson:"diagnoses,omitempty"`
+
+	Status   EncounterStatus `json:"status" bson:"status"`
+	SignedBy bson.ObjectId   `json:"signed_by,omitempty" bson:"signed_by,omitempty"`
+	SignedAt time.Time       `json:"signed_at,omitempty" bson:"signed_at,omitempty"`
+	Addenda  []Addendum      `json:"addenda,omitempty" bson:"addenda,omitempty"`
+
+	CreatedBy bson.ObjectId `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	Created   time.Time     `json:"created" bson:"created"`
+	Updated   time.Time     `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+func (e *Encounter) Signed() bool {
+	return e.Status == EncounterSigned
+}
+
+// CanSign reports whether the user may sign the encounter: its physician or an admin.
+func (e *Encounter) CanSign(user *User) bool {
+	return user != nil && (user.Id == e.PhysicianId || user.HasRole(UserRoleAdmin))
+}
+
+// EncounterFilter selects encounters. Empty fields match all encounters.
+type EncounterFilter struct {
+	Id bson.ObjectId
+	// PatientIds matches the encounters of any of the patients.
+	PatientIds  []bson.ObjectId
+	PhysicianId bson.ObjectId
+	// From and To limit the date of the encounters, To excluded.
+	From time.Time
+	To   time.Time
+	// Page starts at 1.
+	Page    int
+	PerPage int
+}
+
+func (f EncounterFilter) withDefaults() EncounterFilter {
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage < 1 {
+		f.PerPage = DefaultEncounterPageSize
+	}
+	return f
+}
+
+type EncounterDB interface {
+	ById(id string) (*Encounter, error)
+	// ByPatient returns the encounters of the patient, newest first.
+	ByPatient(patientId string) ([]Encounter, error)
+
+	Create(encounter *Encounter) error
+	// Update saves a draft encounter. Signed encounters can not be updated.
+	Update(encounter *Encounter) error
+	// AddAddendum appends an addendum to a signed encounter, leaving the rest of it untouched.
+	AddAddendum(id string, addendum *Addendum) error
+	// SignedBetween returns the encounters signed with a date from one time up to another, oldest first.
+	SignedBetween(from, to time.Time) ([]Encounter, error)
+	// Find returns the page of encounters matching the filter, newest first, and the number of all matching
+	// encounters.
+	Find(filter EncounterFilter) ([]Encounter, int, error)
+}
+
+type encounterValidator struct {
+	EncounterDB
+	users    UserDB
+	patients PatientDB
+	codes    DiagnosisCodeService
+	clock    Clock
+}
+
+var _ EncounterDB = &encounterValidator{}
+
+func (ev *encounterValidator) ById(id string) (*Encounter, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return ev.EncounterDB.ById(id)
+}
+
+func (ev *encounterValidator) ByPatient(patientId string) ([]Encounter, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return ev.EncounterDB.ByPatient(patientId)
+}
+
+func (ev *encounterValidator) Create(encounter *Encounter) error {
+	encounter.Status = EncounterDraft
+	encounter.SignedBy = ""
+	encounter.SignedAt = time.Time{}
+	encounter.Addenda = nil
+	if err := runEncounterValFuncs(encounter, ev.requirePatient, ev.requirePhysician, ev.normalizeDiagnoses,
+		ev.checkVitals, ev.ensureDate, ev.ensureCreatedAt); err != nil {
+		return err
+	}
+	return ev.EncounterDB.Create(encounter)
+}
+
+func (ev *encounterValidator) Update(encounter *Encounter) error {
+	if err := runEncounterValFuncs(encounter, ev.notSigned, ev.requirePhysician, ev.normalizeDiagnoses,
+		ev.checkVitals, ev.ensureDate, ev.ensureUpdatedAt); err != nil {
+		return err
+	}
+	return ev.EncounterDB.Update(encounter)
+}
+
+func (ev *encounterValidator) AddAddendum(id string, addendum *Addendum) error {
+	encounter, err := ev.ById(id)
+	if err != nil {
+		return err
+	}
+	if !encounter.Signed() {
+		return ErrEncounterNotSigned
+	}
+	addendum.Text = strings.TrimSpace(addendum.Text)
+	if addendum.Text == "" {
+		return ErrAddendumRequired
+	}
+	if addendum.AuthorId == "" {
+		return ErrUserIDRequired
+	}
+	addendum.Created = ev.clock.Now()
+	return ev.EncounterDB.AddAddendum(id, addendum)
+}
+
+func (ev *encounterValidator) requirePatient(encounter *Encounter) error {
+	if encounter.PatientId == "" {
+		return ErrPatientRequired
+	}
+	_, err := ev.patients.ById(encounter.PatientId.Hex())
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return ErrPatientRequired
+	}
+	return err
+}
+
+func (ev *encounterValidator) requirePhysician(encounter *Encounter) error {
+	if encounter.PhysicianId == "" {
+		return ErrPhysicianInvalid
+	}
+	physician, err := ev.users.ById(encounter.PhysicianId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPhysicianInvalid
+		}
+		return err
+	}
+	if !physician.HasRole(UserRolePhysician) {
+		return ErrPhysicianInvalid
+	}
+	return nil
+}
+
+// notSigned rejects changes to encounters which were signed, also if the update itself would unsign it.
+func (ev *encounterValidator) notSigned(encounter *Encounter) error {
+	existing, err := ev.EncounterDB.ById(encounter.Id.Hex())
+	if err != nil {
+		return err
+	}
+	if existing.Signed() {
+		return ErrEncounterSigned
+	}
+	if len(encounter.Addenda) > 0 {
+		return ErrEncounterNotSigned
+	}
+	return nil
+}
+
+// normalizeDiagnoses drops empty diagnoses, so that forms can offer empty rows. Codes must be in the code table,
+// which also gives the description if there is none. Without a primary diagnosis, the first one is primary.
+func (ev *encounterValidator) normalizeDiagnoses(encounter *Encounter) error {
+	diagnoses := make([]Diagnosis, 0, len(encounter.Diagnoses))
+	primary := -1
+	for _, d := range encounter.Diagnoses {
+		d.Code = strings.TrimSpace(d.Code)
+		d.Description = strings.TrimSpace(d.Description)
+		if d.Description == "" && d.Code == "" {
+			continue
+		}
+		if d.Code != "" {
+			code, ok := ev.codes.Lookup(d.Code)
+			if !ok {
+				return ErrDiagnosisCodeUnknown
+			}
+			d.Code = code.Code
+			if d.Description == "" {
+				d.Description = code.Description
+			}
+		}
+		if d.Description == "" {
+			return ErrDiagnosisDescriptionRequired
+		}
+		if d.Primary {
+			if primary >= 0 {
+				return ErrDiagnosisPrimaryMultiple
+			}
+			primary = len(diagnoses)
+		}
+		diagnoses = append(diagnoses, d)
+	}
+	if primary < 0 && len(diagnoses) > 0 {
+		diagnoses[0].Primary = true
+	}
+	encounter.Diagnoses = diagnoses
+	return nil
+}
+
+func (ev *encounterValidator) SignedBetween(from, to time.Time) ([]Encounter, error) {
+	if to.Before(from) {
+		return nil, ErrReportPeriodInvalid
+	}
+	return ev.EncounterDB.SignedBetween(from, to)
+}
+
+func (ev *encounterValidator) Find(filter EncounterFilter) ([]Encounter, int, error) {
+	return ev.EncounterDB.Find(filter.withDefaults())
+}
+
+func (ev *encounterValidator) checkVitals(encounter *Encounter) error {
+	if err := encounter.Vitals.check(); err != nil {
+		return err
+	}
+	encounter.Vitals.computeBMI()
+	return nil
+}
+
+func (ev *encounterValidator) ensureDate(encounter *Encounter) error {
+	if encounter.Date.IsZero() {
+		encounter.Date = ev.clock.Now()
+	}
+	return nil
+}
+
+func (ev *encounterValidator) ensureCreatedAt(encounter *Encounter) error {
+	if encounter.Created.IsZero() {
+		encounter.Created = ev.clock.Now()
+	}
+	return nil
+}
+
+func (ev *encounterValidator) ensureUpdatedAt(encounter *Encounter) error {
+	encounter.Updated = ev.clock.Now()
+	return nil
+}
+
+type EncounterService interface {
+	// Sign locks the encounter. Only its physician or an admin may sign it.
+	Sign(encounter *Encounter, user *User) error
+	// Addend adds an addendum written by the user to a signed encounter.
+	Addend(encounter *Encounter, user *User, text string) error
+	// DiagnosisReport counts the diagnoses of the encounters signed on the days from one day to another, by code or
+	// by the three character category of the codes.
+	DiagnosisReport(from, to time.Time, byCategory bool) (*DiagnosisReport, error)
+	EncounterDB
+}
+
+type encounterService struct {
+	EncounterDB
+	codes  DiagnosisCodeService
+	clock  Clock
+	logger *logrus.Entry
+}
+
+func NewEncounterService(mgo *mgo.Session, users UserDB, patients PatientDB, codes DiagnosisCodeService,
+	logger *logrus.Entry, dbname string) EncounterService {
+	em := &encounterMongo{mgo, dbname, logger}
+	return newEncounterService(em, users, patients, codes, logger)
+}
+
+// NewInMemoryEncounterService returns an EncounterService backed by an in-memory EncounterDB.
+func NewInMemoryEncounterService(users UserDB, patients PatientDB, codes DiagnosisCodeService,
+	logger *logrus.Entry) EncounterService {
+	return newEncounterService(newEncounterMemory(), users, patients, codes, logger)
+}
+
+func newEncounterService(edb EncounterDB, users UserDB, patients PatientDB, codes DiagnosisCodeService,
+	logger *logrus.Entry) EncounterService {
+	return &encounterService{
+		EncounterDB: &encounterValidator{
+			EncounterDB: edb,
+			users:       users,
+			patients:    patients,
+			codes:       codes,
+			clock:       SystemClock(),
+		},
+		codes:  codes,
+		clock:  SystemClock(),
+		logger: logger,
+	}
+}
+
+// Sign requires every diagnosis to be coded, so that reports can count them.
+func (es *encounterService) Sign(encounter *Encounter, user *User) error {
+	if encounter.Signed() {
+		return ErrEncounterSigned
+	}
+	if !encounter.CanSign(user) {
+		return ErrSignNotAllowed
+	}
+	for _, d := range encounter.Diagnoses {
+		if d.Code == "" {
+			return ErrDiagnosisCodeRequired
+		}
+	}
+	encounter.Status = EncounterSigned
+	encounter.SignedBy = user.Id
+	encounter.SignedAt = es.clock.Now()
+	if err := es.Update(encounter); err != nil {
+		encounter.Status = EncounterDraft
+		encounter.SignedBy = ""
+		encounter.SignedAt = time.Time{}
+		return err
+	}
+	es.logger.Infof("Encounter %s signed by %s", encounter.Id.Hex(), user.Username)
+	return nil
+}
+
+func (es *encounterService) Addend(encounter *Encounter, user *User, text string) error {
+	addendum := Addendum{
+		Text:       text,
+		AuthorId:   user.Id,
+		AuthorName: user.Name,
+	}
+	if err := es.AddAddendum(encounter.Id.Hex(), &addendum); err != nil {
+		return err
+	}
+	encounter.Addenda = append(encounter.Addenda, addendum)
+	return nil
+}
+
+// DiagnosisReport counts the encounters of a period by diagnosis.
+type DiagnosisReport struct {
+	From       time.Time
+	To         time.Time
+	ByCategory bool
+	// Encounters is the number of encounters signed in the period, Coded the number of them with diagnoses.
+	Encounters int
+	Coded      int
+	// Lines are ordered by the number of encounters, the most frequent diagnosis first.
+	Lines []DiagnosisReportLine
+}
+
+// DiagnosisReportLine is a code or category with the number of encounters it was diagnosed in, and in how many of
+// them it was the primary diagnosis.
+type DiagnosisReportLine struct {
+	Code        string
+	Description string
+	Encounters  int
+	Primary     int
+}
+
+func (es *encounterService) DiagnosisReport(from, to time.Time, byCategory bool) (*DiagnosisReport, error) {
+	from, to = StartOfDay(from), StartOfDay(to)
+	encounters, err := es.SignedBetween(from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	report := DiagnosisReport{From: from, To: to, ByCategory: byCategory, Encounters: len(encounters)}
+	lines := make(map[string]*DiagnosisReportLine)
+	for _, e := range encounters {
+		if len(e.Diagnoses) > 0 {
+			report.Coded++
+		}
+		counted := make(map[string]bool)
+		for _, d := range e.Diagnoses {
+			key, description := d.Code, d.Description
+			if byCategory {
+				key = DiagnosisCategory(d.Code)
+				if category, ok := es.codes.Lookup(key); ok {
+					description = category.Description
+				}
+			}
+			line, ok := lines[key]
+			if !ok {
+				line = &DiagnosisReportLine{Code: key, Description: description}
+				lines[key] = line
+			}
+			// An encounter with two codes of a category counts once for it, as primary if either code is.
+			if !counted[key] {
+				counted[key] = true
+				line.Encounters++
+			}
+			if d.Primary {
+				line.Primary++
+			}
+		}
+	}
+	for _, line := range lines {
+		report.Lines = append(report.Lines, *line)
+	}
+	sort.Slice(report.Lines, func(i, j int) bool {
+		a, b := report.Lines[i], report.Lines[j]
+		if a.Encounters != b.Encounters {
+			return a.Encounters > b.Encounters
+		}
+		return a.Code < b.Code
+	})
+	return &report, nil
+}
+
+type encounterMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ EncounterDB = &encounterMongo{}
+
+func (em *encounterMongo) ById(id string) (*Encounter, error) {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	e := Encounter{}
+	err := ses.DB(em.dbname).C(EncounterCollection).FindId(bson.ObjectIdHex(id)).One(&e)
+	return &e, err
+}
+
+func (em *encounterMongo) ByPatient(patientId string) ([]Encounter, error) {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	var encounters []Encounter
+	err := ses.DB(em.dbname).C(EncounterCollection).Find(bson.M{"patient_id": bson.ObjectIdHex(patientId)}).
+		Sort("-date").All(&encounters)
+	return encounters, err
+}
+
+func (em *encounterMongo) Create(encounter *Encounter) error {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	if encounter.Id == "" {
+		encounter.Id = bson.NewObjectId()
+	}
+	return ses.DB(em.dbname).C(EncounterCollection).Insert(encounter)
+}
+
+// Update only replaces encounters which are still drafts in the database, so that a concurrent signature wins.
+func (em *encounterMongo) Update(encounter *Encounter) error {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	err := ses.DB(em.dbname).C(EncounterCollection).Update(bson.M{"_id": encounter.Id, "status": EncounterDraft}, encounter)
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return ErrEncounterSigned
+	}
+	return err
+}
+
+func (em *encounterMongo) AddAddendum(id string, addendum *Addendum) error {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(em.dbname).C(EncounterCollection).UpdateId(bson.ObjectIdHex(id), bson.M{"$push": bson.M{"addenda": addendum}})
+}
+
+func (em *encounterMongo) SignedBetween(from, to time.Time) ([]Encounter, error) {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	var encounters []Encounter
+	query := bson.M{"status": EncounterSigned, "date": bson.M{"$gte": from, "$lt": to}}
+	err := ses.DB(em.dbname).C(EncounterCollection).Find(query).Sort("date").All(&encounters)
+	return encounters, err
+}
+
+func (em *encounterMongo) Find(filter EncounterFilter) ([]Encounter, int, error) {
+	ses := em.mgo.Copy()
+	defer ses.Close()
+	query := bson.M{}
+	if filter.Id != "" {
+		query["_id"] = filter.Id
+	}
+	if len(filter.PatientIds) > 0 {
+		query["patient_id"] = bson.M{"$in": filter.PatientIds}
+	}
+	if filter.PhysicianId != "" {
+		query["physician_id"] = filter.PhysicianId
+	}
+	if !filter.From.IsZero() || !filter.To.IsZero() {
+		span := bson.M{}
+		if !filter.From.IsZero() {
+			span["$gte"] = filter.From
+		}
+		if !filter.To.IsZero() {
+			span["$lt"] = filter.To
+		}
+		query["date"] = span
+	}
+	q := ses.DB(em.dbname).C(EncounterCollection).Find(query)
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	var encounters []Encounter
+	err = q.Sort("-date", "-_id").Skip((filter.Page - 1) * filter.PerPage).Limit(filter.PerPage).All(&encounters)
+	return encounters, total, err
+}
+
+type encounterValFunc func(encounter *Encounter) error
+
+func runEncounterValFuncs(encounter *Encounter, fns ...encounterValFunc) error {
+	for _, fn := range fns {
+		if err := fn(encounter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// encounterMemory is a thread safe in-memory implementation of EncounterDB.
+type encounterMemory struct {
+	mu         sync.RWMutex
+	encounters map[bson.ObjectId]Encounter
+}
+
+var _ EncounterDB = &encounterMemory{}
+
+func newEncounterMemory() *encounterMemory {
+	return &encounterMemory{
+		encounters: make(map[bson.ObjectId]Encounter),
+	}
+}
+
+func (em *encounterMemory) ById(id string) (*Encounter, error) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	e, ok := em.encounters[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyEncounter(&e)
+	return &found, nil
+}
+
+func (em *encounterMemory) ByPatient(patientId string) ([]Encounter, error) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	var encounters []Encounter
+	for _, e := range em.encounters {
+		if e.PatientId.Hex() == patientId {
+			encounters = append(encounters, copyEncounter(&e))
+		}
+	}
+	sort.Slice(encounters, func(i, j int) bool {
+		return encounters[i].Date.After(encounters[j].Date)
+	})
+	return encounters, nil
+}
+
+func (em *encounterMemory) Create(encounter *Encounter) error {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if encounter.Id == "" {
+		encounter.Id = bson.NewObjectId()
+	}
+	if _, ok := em.encounters[encounter.Id]; ok {
+		return ErrIDInvalid
+	}
+	em.encounters[encounter.Id] = copyEncounter(encounter)
+	return nil
+}
+
+func (em *encounterMemory) Update(encounter *Encounter) error {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	existing, ok := em.encounters[encounter.Id]
+	if !ok {
+		return MongoErrNotFound
+	}
+	if existing.Signed() {
+		return ErrEncounterSigned
+	}
+	em.encounters[encounter.Id] = copyEncounter(encounter)
+	return nil
+}
+
+func (em *encounterMemory) AddAddendum(id string, addendum *Addendum) error {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	e, ok := em.encounters[oid]
+	if !ok {
+		return MongoErrNotFound
+	}
+	e = copyEncounter(&e)
+	e.Addenda = append(e.Addenda, *addendum)
+	em.encounters[oid] = e
+	return nil
+}
+
+func (em *encounterMemory) SignedBetween(from, to time.Time) ([]Encounter, error) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	var encounters []Encounter
+	for _, e := range em.encounters {
+		if e.Signed() && !e.Date.Before(from) && e.Date.Before(to) {
+			encounters = append(encounters, copyEncounter(&e))
+		}
+	}
+	sort.Slice(encounters, func(i, j int) bool {
+		return encounters[i].Date.Before(encounters[j].Date)
+	})
+	return encounters, nil
+}
+
+func (em *encounterMemory) Find(filter EncounterFilter) ([]Encounter, int, error) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	var matching []Encounter
+	for _, e := range em.encounters {
+		if encounterMatchesFilter(&e, filter) {
+			matching = append(matching, e)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Date.Equal(matching[j].Date) {
+			return matching[i].Id > matching[j].Id
+		}
+		return matching[i].Date.After(matching[j].Date)
+	})
+	total := len(matching)
+	start := (filter.Page - 1) * filter.PerPage
+	if start >= total {
+		return nil, total, nil
+	}
+	end := start + filter.PerPage
+	if end > total {
+		end = total
+	}
+	encounters := make([]Encounter, 0, end-start)
+	for i := start; i < end; i++ {
+		encounters = append(encounters, copyEncounter(&matching[i]))
+	}
+	return encounters, total, nil
+}
+
+func encounterMatchesFilter(e *Encounter, filter EncounterFilter) bool {
+	if filter.Id != "" && e.Id != filter.Id {
+		return false
+	}
+	if len(filter.PatientIds) > 0 {
+		found := false
+		for _, id := range filter.PatientIds {
+			if e.PatientId == id {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.PhysicianId != "" && e.PhysicianId != filter.PhysicianId {
+		return false
+	}
+	if !filter.From.IsZero() && e.Date.Before(filter.From) {
+		return false
+	}
+	return filter.To.IsZero() || e.Date.Before(filter.To)
+}
+
+// copyEncounter returns a copy of the encounter which does not share any slices with the original.
+func copyEncounter(encounter *Encounter) Encounter {
+	e := *encounter
+	e.Diagnoses = append([]Diagnosis(nil), encounter.Diagnoses...)
+	e.Addenda = append([]Addendum(nil), encounter.Addenda...)
+	return e
+}
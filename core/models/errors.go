@@ -4,22 +4,181 @@ import "strings"
 
 const (
 	// ErrNotFound Error returned when resource not found.
-	ErrNotFound          modelError = "models: resource not found"
-	ErrPasswordIncorrect modelError = "models: incorrect password provided"
-	ErrEmailRequired     modelError = "models: email address is required"
-	ErrUsernameRequired  modelError = "models: username is required"
-	ErrUserRoleRequired  modelError = "models: user role is required"
-	ErrEmailInvalid      modelError = "models: email address is not valid"
-	ErrEmailTaken        modelError = "models: email address is already taken"
-	ErrUsernameTaken     modelError = "models: username is already taken"
-	ErrPasswordTooShort  modelError = "models: password must be at least 8 characters log"
-	ErrPasswordRequired  modelError = "models: password is required"
-	ErrTitleRequired     modelError = "models: title is required"
-
-	ErrIDInvalid             privateError = "models: ID provided was invalid"
-	ErrRememberTokenTooShort privateError = "models: remember token should be at least 32 bytes"
-	ErrRememberTokenRequired privateError = "models: remember token is required"
-	ErrUserIDRequired        privateError = "models: user ID is required"
+	ErrNotFound             modelError = "models: resource not found"
+	ErrPasswordIncorrect    modelError = "models: incorrect password provided"
+	ErrInvalidCredentials   modelError = "models: invalid username or password"
+	ErrTooManyLoginAttempts modelError = "models: too many failed login attempts, please try again later"
+	ErrEmailRequired        modelError = "models: email address is required"
+	ErrUsernameRequired     modelError = "models: username is required"
+	ErrUserRoleRequired     modelError = "models: user role is required"
+	ErrEmailInvalid         modelError = "models: email address is not valid"
+	ErrEmailTaken           modelError = "models: email address is already taken"
+	ErrUsernameTaken        modelError = "models: username is already taken"
+	ErrPasswordRequired     modelError = "models: password is required"
+	ErrTitleRequired        modelError = "models: title is required"
+	ErrUserDisabled         modelError = "models: user account is disabled"
+	ErrLastAdmin            modelError = "models: the last active admin can not be removed or disabled"
+	ErrUserRoleInvalid      modelError = "models: user role is not valid"
+	ErrPasswordMismatch     modelError = "models: the new passwords do not match"
+	ErrResetTokenInvalid    modelError = "models: the password reset link is invalid or has expired"
+	ErrPasswordNoLower      modelError = "models: password must contain a lowercase letter"
+	ErrPasswordNoUpper      modelError = "models: password must contain an uppercase letter"
+	ErrPasswordNoDigit      modelError = "models: password must contain a digit"
+	ErrPasswordNoSymbol     modelError = "models: password must contain a symbol"
+	ErrPasswordPersonalInfo modelError = "models: password must not contain your username or name"
+	ErrPasswordBanned       modelError = "models: password is too common, please choose another one"
+	ErrPasswordReused       modelError = "models: password was used recently, please choose another one"
+
+	ErrTwoFactorCodeInvalid modelError = "models: the verification code is not valid"
+	ErrTwoFactorRequired    modelError = "models: two factor authentication is required for your role"
+
+	ErrTokenNameRequired  modelError = "models: token name is required"
+	ErrScopeRequired      modelError = "models: at least one scope is required"
+	ErrScopeInvalid       modelError = "models: scope is not valid"
+	ErrTokenExpiryInvalid modelError = "models: token expiry must be in the future and at most one year away"
+
+	ErrPatientNameRequired     modelError = "models: first name of the patient is required"
+	ErrDateOfBirthRequired     modelError = "models: date of birth is required"
+	ErrDateOfBirthInvalid      modelError = "models: date of birth can not be in the future"
+	ErrSexRequired             modelError = "models: sex is required"
+	ErrSexInvalid              modelError = "models: sex is not valid"
+	ErrGuardianRequired        modelError = "models: a guardian is required for patients under 18"
+	ErrIdentifierSystemInvalid modelError = "models: identifier type is not valid"
+	ErrMRNRequired             modelError = "models: medical record number is required"
+	ErrMRNTaken                modelError = "models: medical record number is already taken"
+	ErrPatientHasRecords       modelError = "models: patients with records like encounters can not be deleted"
+
+	ErrTimeOfDayInvalid         modelError = "models: time must be given like 09:30"
+	ErrSlotLengthInvalid        modelError = "models: slot length must be between 5 and 240 minutes"
+	ErrSessionTimesInvalid      modelError = "models: a session must end after it starts"
+	ErrSessionsOverlap          modelError = "models: sessions on the same day must not overlap"
+	ErrScheduleExceptionInvalid modelError = "models: exception must be a leave or a holiday"
+	ErrScheduleExceptionDates   modelError = "models: exception must have a first day and a last day on or after it"
+	ErrPatientRequired          modelError = "models: patient is required"
+	ErrPhysicianInvalid         modelError = "models: please select an active physician"
+	ErrAppointmentTimesInvalid  modelError = "models: appointment must have a start and end after it"
+	ErrAppointmentInPast        modelError = "models: appointment can not be booked in the past"
+	ErrOutsideAvailability      modelError = "models: the physician is not available at this time"
+	ErrAppointmentConflict      modelError = "models: the physician already has an appointment at this time"
+	ErrPatientDoubleBooked      modelError = "models: the patient already has an appointment at this time"
+	ErrAppointmentNotBooked     modelError = "models: only booked appointments can be changed"
+	ErrNoShowTooEarly           modelError = "models: an appointment can only be marked as a no-show after it started"
+
+	ErrEncounterSigned              modelError = "models: the encounter is signed and can not be changed, please add an addendum"
+	ErrEncounterNotSigned           modelError = "models: addenda can only be added to signed encounters"
+	ErrSignNotAllowed               modelError = "models: only the physician of the encounter or an admin can sign it"
+	ErrAddendumRequired             modelError = "models: addendum text is required"
+	ErrDiagnosisDescriptionRequired modelError = "models: every diagnosis needs a description"
+	ErrEncounterAppointmentInvalid  modelError = "models: the appointment is not an appointment of the patient"
+
+	ErrClinicNameRequired     modelError = "models: the name of the clinic is required"
+	ErrEncounterRequired      modelError = "models: a prescription has to belong to an encounter"
+	ErrPrescriptionEmpty      modelError = "models: a prescription needs at least one medication"
+	ErrMedicationIncomplete   modelError = "models: every medication needs a dose and a frequency"
+	ErrMedicationRouteInvalid modelError = "models: the route of a medication is invalid"
+	ErrMedicationQuantity     modelError = "models: the quantity of a medication can not be negative"
+	ErrPrescriberNotPhysician modelError = "models: only physicians can prescribe"
+
+	ErrAlreadyInQueue     modelError = "models: the patient is already in the queue of the physician"
+	ErrQueueEmpty         modelError = "models: no patient is waiting"
+	ErrQueueStatusInvalid modelError = "models: the queue entry can not change to this state"
+	ErrQueueStatusChanged modelError = "models: the queue entry was changed by someone else, please reload"
+
+	ErrAmountInvalid            modelError = "models: amounts must be given like 250 or 250.50"
+	ErrCatalogueNameRequired    modelError = "models: the name of the service is required"
+	ErrCatalogueCodeRequired    modelError = "models: the code of the service is required"
+	ErrCatalogueCodeTaken       modelError = "models: the code of the service is already taken"
+	ErrPriceInvalid             modelError = "models: the price can not be negative"
+	ErrTaxRateInvalid           modelError = "models: the tax rate must be between 0 and 100 percent"
+	ErrInvoiceEncounterRequired modelError = "models: an invoice has to belong to an encounter"
+	ErrInvoiceEmpty             modelError = "models: an invoice needs at least one service"
+	ErrInvoiceItemInvalid       modelError = "models: the service is not offered anymore"
+	ErrInvoiceQuantity          modelError = "models: the quantity of a service can not be negative"
+	ErrInvoiceDiscountInvalid   modelError = "models: a discount can not be negative or more than the amount of its line"
+	ErrEncounterInvoiced        modelError = "models: the encounter already has an invoice"
+	ErrInvoiceCancelled         modelError = "models: the invoice is cancelled"
+	ErrInvoiceNotCancellable    modelError = "models: only invoices without payments can be cancelled"
+	ErrCancelReasonRequired     modelError = "models: a reason for the cancellation is required"
+	ErrPaymentAmountInvalid     modelError = "models: the amount paid must be more than zero"
+	ErrPaymentExceedsBalance    modelError = "models: the amount paid is more than the balance of the invoice"
+	ErrPaymentMethodInvalid     modelError = "models: the payment method must be cash, card or UPI"
+
+	ErrLabOrderEncounterRequired modelError = "models: a lab order has to belong to an encounter"
+	ErrLabOrderEmpty             modelError = "models: a lab order needs at least one test"
+	ErrLabTestInvalid            modelError = "models: the lab test is not offered"
+	ErrOrderingNotPhysician      modelError = "models: only physicians can order lab tests"
+	ErrLabAnalyteInvalid         modelError = "models: the analyte is not known"
+	ErrLabAnalyteNotOrdered      modelError = "models: the analyte is not part of the tests ordered"
+	ErrLabAnalyteResulted        modelError = "models: the analyte already has a result in this order"
+	ErrLabUnitMismatch           modelError = "models: the unit of the result does not match the unit of the analyte"
+	ErrLabValueInvalid           modelError = "models: lab results must be numbers like 5 or 12.4"
+	ErrLabResultsEmpty           modelError = "models: please enter at least one result"
+	ErrLabCollectedInvalid       modelError = "models: the sample can not be collected in the future"
+	ErrLabOrderPatient           modelError = "models: the lab order is not an order of the patient"
+	ErrLabPatientUnknown         modelError = "models: no patient has this medical record number"
+	ErrLabCollectedFormat        modelError = "models: the time of collection must be given like 2024-03-01 09:30"
+	ErrLabImportColumns          modelError = "models: the CSV file needs the columns mrn, analyte, value and collected"
+
+	ErrDocumentRequired         modelError = "models: please choose a file to upload"
+	ErrDocumentEmpty            modelError = "models: the file is empty"
+	ErrDocumentTypeInvalid      modelError = "models: only PDF files and JPEG, PNG, GIF or WebP images can be uploaded"
+	ErrDocumentTooLarge         modelError = "models: the file is larger than the size limit"
+	ErrDocumentCategoryInvalid  modelError = "models: the category of the document is not valid"
+	ErrDocumentTitleRequired    modelError = "models: the title of the document is required"
+	ErrDocumentEncounterInvalid modelError = "models: the encounter is not an encounter of the patient"
+
+	ErrDateInvalid                modelError = "models: dates must be given like 2024-03-01"
+	ErrAllergySubstanceRequired   modelError = "models: the substance the patient is allergic to is required"
+	ErrAllergySeverityInvalid     modelError = "models: the severity of an allergy must be mild, moderate or severe"
+	ErrAllergyRecorded            modelError = "models: the allergy is already recorded"
+	ErrProblemDescriptionRequired modelError = "models: the description of the problem is required"
+	ErrProblemOnsetInvalid        modelError = "models: the onset of a problem can not be in the future"
+	ErrProblemResolvedInvalid     modelError = "models: a problem can not be resolved before its onset"
+	ErrProblemNotActive           modelError = "models: the problem is already resolved"
+	ErrMedicationNameRequired     modelError = "models: the name of the medication is required"
+	ErrMedicationStartInvalid     modelError = "models: the start of a medication can not be in the future"
+	ErrMedicationStopInvalid      modelError = "models: a medication can not be stopped before it was started"
+	ErrMedicationStopped          modelError = "models: the medication is already stopped"
+
+	ErrVaccineDoseInvalid       modelError = "models: the vaccine dose is not in the immunization schedule"
+	ErrVaccineDoseRecorded      modelError = "models: the vaccine dose is already recorded"
+	ErrImmunizationDateRequired modelError = "models: the day the vaccine was given is required"
+	ErrImmunizationDateInvalid  modelError = "models: a vaccine can not be given before birth or in the future"
+	ErrVaccinatorRequired       modelError = "models: please select who gave the vaccine, or where it was given"
+	ErrLotNumberRequired        modelError = "models: the lot number of the vaccine is required"
+	ErrInjectionSiteInvalid     modelError = "models: please select the site the vaccine was given at"
+
+	ErrVitalsEmpty                  modelError = "models: please enter at least one measurement"
+	ErrVitalsTakenInvalid           modelError = "models: vitals can not be taken in the future"
+	ErrVitalsHeightInvalid          modelError = "models: the height must be given in centimetres, between 20 and 250"
+	ErrVitalsWeightInvalid          modelError = "models: the weight must be given in kilograms, between 0.3 and 350"
+	ErrVitalsBloodPressureInvalid   modelError = "models: the blood pressure needs a systolic value above the diastolic one, like 120/80"
+	ErrVitalsPulseInvalid           modelError = "models: the pulse must be between 20 and 250 beats per minute"
+	ErrVitalsRespiratoryRateInvalid modelError = "models: the respiratory rate must be between 4 and 80 breaths per minute"
+	ErrVitalsTemperatureInvalid     modelError = "models: the temperature must be given in degrees Celsius, between 30 and 45"
+	ErrVitalsSpO2Invalid            modelError = "models: the oxygen saturation must be between 50 and 100 percent"
+	ErrVitalsHeadInvalid            modelError = "models: the head circumference must be given in centimetres, between 20 and 70"
+	ErrVitalsValueInvalid           modelError = "models: measurements must be numbers like 72 or 36.8"
+
+	ErrDiagnosisCodeUnknown     modelError = "models: the diagnosis code is not in the ICD-10 code table, please pick one from the list"
+	ErrDiagnosisCodeRequired    modelError = "models: please code every diagnosis before signing the encounter"
+	ErrDiagnosisPrimaryMultiple modelError = "models: only one diagnosis can be the primary diagnosis"
+	ErrDiagnosisCodesUnreadable modelError = "models: the code file could not be read, the codes in use are kept"
+	ErrReportPeriodInvalid      modelError = "models: the last day of the report can not be before the first one"
+
+	ErrHL7MessageStatusInvalid modelError = "models: the status of a message must be failed, processed or dismissed"
+	ErrHL7MessageResolved      modelError = "models: the message was already processed or dismissed"
+
+	ErrIDInvalid            privateError = "models: ID provided was invalid"
+	ErrSessionTokenTooShort privateError = "models: session token should be at least 32 bytes"
+	ErrSessionTokenRequired privateError = "models: session token is required"
+	ErrUserIDRequired       privateError = "models: user ID is required"
+	ErrSessionExpired       privateError = "models: session has expired"
+	ErrSessionPending       privateError = "models: session is waiting for the second factor"
+	ErrTwoFactorNotEnrolled privateError = "models: two factor authentication is not enrolled"
+	ErrTokenExpired         privateError = "models: API token has expired"
+	// ErrEncryptionKeyRequired stops the server from encrypting two factor secrets with a key anyone can derive.
+	ErrEncryptionKeyRequired privateError = "models: encryption_key must be set in core.config"
 
 	MongoErrNotFound mongoError = "not found"
 )
@@ -0,0 +1,217 @@
+package models
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultGrowthReferenceDir holds the growth reference tables shipped with the system, relative to the directory
+// the server runs in.
+const DefaultGrowthReferenceDir = "core/data/growth"
+
+// daysPerMonth is the average length of a month the reference tables count ages in.
+const daysPerMonth = 30.4375
+
+type GrowthMeasure string
+
+const (
+	GrowthWeight GrowthMeasure = "weight"
+	GrowthHeight GrowthMeasure = "height"
+	GrowthHead   GrowthMeasure = "head"
+	GrowthBMI    GrowthMeasure = "bmi"
+)
+
+func GrowthMeasuresList() []GrowthMeasure {
+	return []GrowthMeasure{GrowthWeight, GrowthHeight, GrowthHead, GrowthBMI}
+}
+
+// GrowthPercentile is a percentile drawn on growth charts with its z-score.
+type GrowthPercentile struct {
+	Percentile int
+	Z          float64
+}
+
+// GrowthChartPercentiles are the percentiles growth charts show.
+var GrowthChartPercentiles = []GrowthPercentile{{3, -1.8808}, {15, -1.0364}, {50, 0}, {85, 1.0364}, {97, 1.8808}}
+
+// lms is the Box-Cox power, median and coefficient of variation of a measure at an age in months.
+type lms struct {
+	Month, L, M, S float64
+}
+
+// value returns the measurement with the z-score.
+func (p lms) value(z float64) float64 {
+	if p.L == 0 {
+		return p.M * math.Exp(p.S*z)
+	}
+	return p.M * math.Pow(1+p.L*p.S*z, 1/p.L)
+}
+
+// z returns the z-score of the measurement.
+func (p lms) z(value float64) float64 {
+	if p.L == 0 {
+		return math.Log(value/p.M) / p.S
+	}
+	return (math.Pow(value/p.M, p.L) - 1) / (p.L * p.S)
+}
+
+// GrowthReference holds the LMS tables children's growth is compared against, like the WHO Child Growth
+// Standards. There is a table per measure and sex, read from files named like weight_male.csv.
+type GrowthReference struct {
+	tables map[string][]lms
+}
+
+func growthTableKey(measure GrowthMeasure, sex Sex) string {
+	return string(measure) + "_" + string(sex)
+}
+
+// LoadGrowthReference reads the tables in the directory. Each file is a CSV file, or tab separated like the files
+// the WHO publishes, with a header naming the columns Month (or Day), L, M and S. Other columns are ignored, and
+// missing files leave the measure without percentiles for the sex.
+func LoadGrowthReference(dir string) (*GrowthReference, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	g := GrowthReference{tables: make(map[string][]lms)}
+	for _, measure := range GrowthMeasuresList() {
+		for _, sex := range []Sex{SexMale, SexFemale} {
+			key := growthTableKey(measure, sex)
+			file := filepath.Join(dir, key+".csv")
+			table, err := readLMSTable(file)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("models: reading growth reference %s: %v", file, err)
+			}
+			g.tables[key] = table
+		}
+	}
+	return &g, nil
+}
+
+func readLMSTable(file string) ([]lms, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header, err := br.Peek(256)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	r := csv.NewReader(br)
+	if line := strings.SplitN(string(header), "\n", 2)[0]; strings.Contains(line, "\t") {
+		r.Comma = '\t'
+	}
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("the table is empty")
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	age, perMonth := "month", 1.0
+	if _, ok := columns[age]; !ok {
+		age, perMonth = "day", daysPerMonth
+	}
+	for _, c := range []string{age, "l", "m", "s"} {
+		if _, ok := columns[c]; !ok {
+			return nil, fmt.Errorf("the columns Month, L, M and S are required")
+		}
+	}
+	table := make([]lms, 0, len(records)-1)
+	for i, record := range records[1:] {
+		var values [4]float64
+		for j, c := range []string{age, "l", "m", "s"} {
+			if columns[c] >= len(record) {
+				return nil, fmt.Errorf("line %d is incomplete", i+2)
+			}
+			if values[j], err = strconv.ParseFloat(strings.TrimSpace(record[columns[c]]), 64); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+2, err)
+			}
+		}
+		if values[2] <= 0 || values[3] <= 0 {
+			return nil, fmt.Errorf("line %d: M and S must be positive", i+2)
+		}
+		table = append(table, lms{Month: values[0] / perMonth, L: values[1], M: values[2], S: values[3]})
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Month < table[j].Month
+	})
+	return table, nil
+}
+
+// lmsAt interpolates the table of the measure and sex at the age in months. It returns false if there is no table
+// or the age is outside of it.
+func (g *GrowthReference) lmsAt(measure GrowthMeasure, sex Sex, month float64) (lms, bool) {
+	table := g.tables[growthTableKey(measure, sex)]
+	if len(table) == 0 || month < table[0].Month || month > table[len(table)-1].Month {
+		return lms{}, false
+	}
+	i := sort.Search(len(table), func(i int) bool {
+		return table[i].Month >= month
+	})
+	if table[i].Month == month || i == 0 {
+		return table[i], true
+	}
+	a, b := table[i-1], table[i]
+	f := (month - a.Month) / (b.Month - a.Month)
+	return lms{
+		Month: month,
+		L:     a.L + (b.L-a.L)*f,
+		M:     a.M + (b.M-a.M)*f,
+		S:     a.S + (b.S-a.S)*f,
+	}, true
+}
+
+// MaxMonth returns the oldest age in months the table of the measure and sex covers, zero if there is none.
+func (g *GrowthReference) MaxMonth(measure GrowthMeasure, sex Sex) float64 {
+	table := g.tables[growthTableKey(measure, sex)]
+	if len(table) == 0 {
+		return 0
+	}
+	return table[len(table)-1].Month
+}
+
+// Percentile returns the percentile of the measurement of a child of the sex at the age in months. It returns false
+// if the reference does not cover the measure, sex or age.
+func (g *GrowthReference) Percentile(measure GrowthMeasure, sex Sex, month, value float64) (float64, bool) {
+	p, ok := g.lmsAt(measure, sex, month)
+	if !ok || value <= 0 {
+		return 0, false
+	}
+	return 50 * (1 + math.Erf(p.z(value)/math.Sqrt2)), true
+}
+
+// GrowthPoint is a measurement at an age in months.
+type GrowthPoint struct {
+	Month float64
+	Value float64
+}
+
+// Curve returns the measurements at the z-score for every month from one age to another, as far as the table of
+// the measure and sex covers them.
+func (g *GrowthReference) Curve(measure GrowthMeasure, sex Sex, z, from, to float64) []GrowthPoint {
+	var curve []GrowthPoint
+	for month := math.Ceil(from); month <= to; month++ {
+		if p, ok := g.lmsAt(measure, sex, month); ok {
+			curve = append(curve, GrowthPoint{Month: month, Value: p.value(z)})
+		}
+	}
+	return curve
+}
@@ -0,0 +1,269 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	HL7MessageCollection = "hl7_message"
+
+	// DefaultHL7MessagePageSize is the number of messages per page if the filter does not set one.
+	DefaultHL7MessagePageSize = 50
+)
+
+// HL7MessageStatus is where a failed message is in its review.
+type HL7MessageStatus string
+
+const (
+	// HL7MessageFailed messages wait for an admin to process them again or dismiss them.
+	HL7MessageFailed    HL7MessageStatus = "failed"
+	HL7MessageProcessed HL7MessageStatus = "processed"
+	HL7MessageDismissed HL7MessageStatus = "dismissed"
+)
+
+func HL7MessageStatusList() []HL7MessageStatus {
+	return []HL7MessageStatus{HL7MessageFailed, HL7MessageProcessed, HL7MessageDismissed}
+}
+
+// HL7Message is a message received over the HL7 interface which could not be processed. It is kept with the error
+// until an admin has it processed again, once the cause is fixed, or dismisses it.
+type HL7Message struct {
+	Id       bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	Received time.Time     `json:"received" bson:"received"`
+	// Remote is the address of the system which sent the message.
+	Remote string `json:"remote" bson:"remote"`
+	// Sender is the sending application and facility of the message, like LAB^CITYHOSPITAL.
+	Sender string `json:"sender,omitempty" bson:"sender,omitempty"`
+	// Type is the message type and trigger event, like ADT^A04.
+	Type      string `json:"type,omitempty" bson:"type,omitempty"`
+	ControlId string `json:"control_id,omitempty" bson:"control_id,omitempty"`
+	Raw       string `json:"raw" bson:"raw"`
+	// Error is why the message failed the last time it was processed.
+	Error string `json:"error" bson:"error"`
+	// Attempts counts how often the message was processed, including when it was sent again.
+	Attempts int              `json:"attempts" bson:"attempts"`
+	Status   HL7MessageStatus `json:"status" bson:"status"`
+	Resolved time.Time        `json:"resolved,omitempty" bson:"resolved,omitempty"`
+	// ResolvedBy is the username of the admin who processed or dismissed the message, empty if the sender sent it
+	// again.
+	ResolvedBy string `json:"resolved_by,omitempty" bson:"resolved_by,omitempty"`
+}
+
+// Segments returns the segments of the raw message, to show them one per line.
+func (m *HL7Message) Segments() []string {
+	raw := strings.Replace(strings.Replace(m.Raw, "\r\n", "\r", -1), "\n", "\r", -1)
+	return strings.FieldsFunc(raw, func(r rune) bool { return r == '\r' })
+}
+
+// HL7MessageFilter selects messages. An empty status matches all messages.
+type HL7MessageFilter struct {
+	Status HL7MessageStatus
+	// Page starts at 1.
+	Page    int
+	PerPage int
+}
+
+func (f HL7MessageFilter) withDefaults() HL7MessageFilter {
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage < 1 {
+		f.PerPage = DefaultHL7MessagePageSize
+	}
+	return f
+}
+
+type HL7MessageDB interface {
+	ById(id string) (*HL7Message, error)
+	// Waiting returns the failed message from the sender with the control id.
+	Waiting(sender, controlId string) (*HL7Message, error)
+	// Find returns the page of messages matching the filter, newest received first, and the number of all matching
+	// messages.
+	Find(filter HL7MessageFilter) ([]HL7Message, int, error)
+
+	Create(message *HL7Message) error
+	Update(message *HL7Message) error
+}
+
+// HL7MessageService keeps the queue of messages which failed, for admins to review.
+type HL7MessageService interface {
+	// Fail queues the message with the error, or updates the error of a queued message. A message the sender tries
+	// again is queued once, counting the attempts, as long as the first one is not resolved.
+	Fail(message *HL7Message, err error) error
+	// Resolve marks a failed message as processed or dismissed by the user. The user is nil for messages the sender
+	// sent again, which were processed.
+	Resolve(message *HL7Message, status HL7MessageStatus, by *User) error
+	HL7MessageDB
+}
+
+type hl7MessageValidator struct {
+	HL7MessageDB
+}
+
+var _ HL7MessageDB = &hl7MessageValidator{}
+
+func (mv *hl7MessageValidator) ById(id string) (*HL7Message, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return mv.HL7MessageDB.ById(id)
+}
+
+func (mv *hl7MessageValidator) Find(filter HL7MessageFilter) ([]HL7Message, int, error) {
+	return mv.HL7MessageDB.Find(filter.withDefaults())
+}
+
+func (mv *hl7MessageValidator) Create(message *HL7Message) error {
+	if err := runHL7MessageValFuncs(message, mv.statusValid); err != nil {
+		return err
+	}
+	return mv.HL7MessageDB.Create(message)
+}
+
+func (mv *hl7MessageValidator) Update(message *HL7Message) error {
+	if err := runHL7MessageValFuncs(message, mv.statusValid); err != nil {
+		return err
+	}
+	return mv.HL7MessageDB.Update(message)
+}
+
+func (mv *hl7MessageValidator) statusValid(message *HL7Message) error {
+	if message.Status == "" {
+		message.Status = HL7MessageFailed
+	}
+	for _, s := range HL7MessageStatusList() {
+		if s == message.Status {
+			return nil
+		}
+	}
+	return ErrHL7MessageStatusInvalid
+}
+
+type hl7MessageService struct {
+	HL7MessageDB
+	clock  Clock
+	logger *logrus.Entry
+}
+
+func NewHL7MessageService(mgo *mgo.Session, logger *logrus.Entry, dbname string) HL7MessageService {
+	mm := &hl7MessageMongo{mgo, dbname, logger}
+	return newHL7MessageService(mm, logger)
+}
+
+// NewInMemoryHL7MessageService returns an HL7MessageService backed by an in-memory HL7MessageDB.
+func NewInMemoryHL7MessageService(logger *logrus.Entry) HL7MessageService {
+	return newHL7MessageService(newHL7MessageMemory(), logger)
+}
+
+func newHL7MessageService(mdb HL7MessageDB, logger *logrus.Entry) HL7MessageService {
+	return &hl7MessageService{
+		HL7MessageDB: &hl7MessageValidator{HL7MessageDB: mdb},
+		clock:        SystemClock(),
+		logger:       logger,
+	}
+}
+
+func (ms *hl7MessageService) Fail(message *HL7Message, err error) error {
+	if message.Id == "" && message.ControlId != "" {
+		waiting, werr := ms.Waiting(message.Sender, message.ControlId)
+		switch {
+		case werr == nil:
+			waiting.Remote = message.Remote
+			waiting.Raw = message.Raw
+			*message = *waiting
+		case werr.Error() != MongoErrNotFound.Error():
+			return werr
+		}
+	}
+	message.Error = err.Error()
+	message.Attempts++
+	if message.Id != "" {
+		return ms.Update(message)
+	}
+	message.Received = ms.clock.Now()
+	message.Status = HL7MessageFailed
+	return ms.Create(message)
+}
+
+func (ms *hl7MessageService) Resolve(message *HL7Message, status HL7MessageStatus, by *User) error {
+	if message.Status != HL7MessageFailed {
+		return ErrHL7MessageResolved
+	}
+	message.Status = status
+	message.Resolved = ms.clock.Now()
+	if by != nil {
+		message.ResolvedBy = by.Username
+	}
+	return ms.Update(message)
+}
+
+type hl7MessageMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ HL7MessageDB = &hl7MessageMongo{}
+
+func (mm *hl7MessageMongo) ById(id string) (*HL7Message, error) {
+	ses := mm.mgo.Copy()
+	defer ses.Close()
+	m := HL7Message{}
+	err := ses.DB(mm.dbname).C(HL7MessageCollection).FindId(bson.ObjectIdHex(id)).One(&m)
+	return &m, err
+}
+
+func (mm *hl7MessageMongo) Waiting(sender, controlId string) (*HL7Message, error) {
+	ses := mm.mgo.Copy()
+	defer ses.Close()
+	m := HL7Message{}
+	query := bson.M{"sender": sender, "control_id": controlId, "status": HL7MessageFailed}
+	err := ses.DB(mm.dbname).C(HL7MessageCollection).Find(query).One(&m)
+	return &m, err
+}
+
+func (mm *hl7MessageMongo) Find(filter HL7MessageFilter) ([]HL7Message, int, error) {
+	ses := mm.mgo.Copy()
+	defer ses.Close()
+	query := bson.M{}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	q := ses.DB(mm.dbname).C(HL7MessageCollection).Find(query)
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	var messages []HL7Message
+	err = q.Sort("-received").Skip((filter.Page - 1) * filter.PerPage).Limit(filter.PerPage).All(&messages)
+	return messages, total, err
+}
+
+func (mm *hl7MessageMongo) Create(message *HL7Message) error {
+	ses := mm.mgo.Copy()
+	defer ses.Close()
+	message.Id = bson.NewObjectId()
+	return ses.DB(mm.dbname).C(HL7MessageCollection).Insert(message)
+}
+
+func (mm *hl7MessageMongo) Update(message *HL7Message) error {
+	ses := mm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(mm.dbname).C(HL7MessageCollection).UpdateId(message.Id, message)
+}
+
+type hl7MessageValFunc func(message *HL7Message) error
+
+func runHL7MessageValFuncs(message *HL7Message, fns ...hl7MessageValFunc) error {
+	for _, fn := range fns {
+		if err := fn(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// hl7MessageMemory is a thread safe in-memory implementation of HL7MessageDB.
+type hl7MessageMemory struct {
+	mu       sync.RWMutex
+	messages map[bson.ObjectId]HL7Message
+}
+
+var _ HL7MessageDB = &hl7MessageMemory{}
+
+func newHL7MessageMemory() *hl7MessageMemory {
+	return &hl7MessageMemory{messages: make(map[bson.ObjectId]HL7Message)}
+}
+
+func (mm *hl7MessageMemory) ById(id string) (*HL7Message, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	m, ok := mm.messages[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &m, nil
+}
+
+func (mm *hl7MessageMemory) Waiting(sender, controlId string) (*HL7Message, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	for _, m := range mm.messages {
+		if m.Sender == sender && m.ControlId == controlId && m.Status == HL7MessageFailed {
+			return &m, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+func (mm *hl7MessageMemory) Find(filter HL7MessageFilter) ([]HL7Message, int, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	var matching []HL7Message
+	for _, m := range mm.messages {
+		if filter.Status != "" && m.Status != filter.Status {
+			continue
+		}
+		matching = append(matching, m)
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Received.After(matching[j].Received)
+	})
+	total := len(matching)
+	start := (filter.Page - 1) * filter.PerPage
+	if start >= total {
+		return nil, total, nil
+	}
+	end := start + filter.PerPage
+	if end > total {
+		end = total
+	}
+	return matching[start:end], total, nil
+}
+
+func (mm *hl7MessageMemory) Create(message *HL7Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	message.Id = bson.NewObjectId()
+	mm.messages[message.Id] = *message
+	return nil
+}
+
+func (mm *hl7MessageMemory) Update(message *HL7Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if _, ok := mm.messages[message.Id]; !ok {
+		return MongoErrNotFound
+	}
+	mm.messages[message.Id] = *message
+	return nil
+}
@@ -0,0 +1,291 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultImmunizationScheduleFile holds the schedule shipped with the system, relative to the directory the server
+// runs in.
+const DefaultImmunizationScheduleFile = "core/data/immunization_schedule.json"
+
+var ageRegex = regexp.MustCompile(`^(\d+[ymwd])+$`)
+var agePartRegex = regexp.MustCompile(`(\d+)([ymwd])`)
+
+// Age is a period of life, written in the schedule like "6w", "9m" or "1y6m" for years, months, weeks and days.
+type Age struct {
+	Years, Months, Weeks, Days int
+}
+
+// ParseAge parses an age like "14w" or "1y6m".
+func ParseAge(s string) (Age, error) {
+	var a Age
+	if !ageRegex.MatchString(s) {
+		return a, fmt.Errorf("models: age %q must be given like 6w, 9m or 1y6m", s)
+	}
+	for _, part := range agePartRegex.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.Atoi(part[1])
+		if err != nil {
+			return a, err
+		}
+		switch part[2] {
+		case "y":
+			a.Years += n
+		case "m":
+			a.Months += n
+		case "w":
+			a.Weeks += n
+		case "d":
+			a.Days += n
+		}
+	}
+	return a, nil
+}
+
+func (a *Age) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	age, err := ParseAge(s)
+	if err != nil {
+		return err
+	}
+	*a = age
+	return nil
+}
+
+// From returns the day the age is reached by someone born on the day.
+func (a Age) From(day time.Time) time.Time {
+	return day.AddDate(a.Years, a.Months, a.Weeks*7+a.Days)
+}
+
+// BornBefore returns the day someone who has the age on the day was born.
+func (a Age) BornBefore(day time.Time) time.Time {
+	return day.AddDate(-a.Years, -a.Months, -a.Weeks*7-a.Days)
+}
+
+// String returns the age in words, like "1 year 6 months", or "birth" for a zero age.
+func (a Age) String() string {
+	var parts []string
+	for _, p := range []struct {
+		n    int
+		unit string
+	}{{a.Years, "year"}, {a.Months, "month"}, {a.Weeks, "week"}, {a.Days, "day"}} {
+		switch {
+		case p.n == 1:
+			parts = append(parts, "1 "+p.unit)
+		case p.n > 1:
+			parts = append(parts, strconv.Itoa(p.n)+" "+p.unit+"s")
+		}
+	}
+	if len(parts) == 0 {
+		return "birth"
+	}
+	return strings.Join(parts, " ")
+}
+
+// VaccineDose is a dose of a vaccine in the schedule. It is due at the age, or the minimum interval after the
+// previous dose of the vaccine if that is later, overdue once the grace period has passed and no longer given
+// from the maximum age on. An unset grace period or maximum age falls back to the one of the schedule.
+type VaccineDose struct {
+	Label       string `json:"label"`
+	Age         Age    `json:"age"`
+	Grace       *Age   `json:"grace"`
+	MinInterval Age    `json:"min_interval"`
+	MaxAge      *Age   `json:"max_age"`
+}
+
+// Vaccine is a vaccine of the schedule with its doses in the order they are given.
+type Vaccine struct {
+	Code  string        `json:"code"`
+	Name  string        `json:"name"`
+	Doses []VaccineDose `json:"doses"`
+}
+
+// Dose returns the dose with the number counted from one, or nil if the vaccine has no such dose.
+func (v *Vaccine) Dose(number int) *VaccineDose {
+	if number < 1 || number > len(v.Doses) {
+		return nil
+	}
+	return &v.Doses[number-1]
+}
+
+// ImmunizationSchedule holds the rules the doses due for patients are worked out by. The rules are read from a
+// JSON file like core/data/immunization_schedule.json, so that they can be updated without a new release.
+type ImmunizationSchedule struct {
+	Name     string    `json:"name"`
+	Grace    *Age      `json:"grace"`
+	MaxAge   *Age      `json:"max_age"`
+	Vaccines []Vaccine `json:"vaccines"`
+}
+
+// LoadImmunizationSchedule reads and checks the schedule in the file.
+func LoadImmunizationSchedule(file string) (*ImmunizationSchedule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var s ImmunizationSchedule
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return nil, fmt.Errorf("models: reading immunization schedule from %s: %v", file, err)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("models: immunization schedule %s: %v", file, err)
+	}
+	return &s, nil
+}
+
+func (s *ImmunizationSchedule) check() error {
+	if s.Grace == nil || s.MaxAge == nil {
+		return fmt.Errorf("the grace period and the maximum age are required")
+	}
+	codes := make(map[string]bool)
+	for i, v := range s.Vaccines {
+		if strings.TrimSpace(v.Code) == "" || strings.TrimSpace(v.Name) == "" {
+			return fmt.Errorf("vaccine %d needs a code and a name", i+1)
+		}
+		if codes[v.Code] {
+			return fmt.Errorf("vaccine code %s is used twice", v.Code)
+		}
+		codes[v.Code] = true
+		if len(v.Doses) == 0 {
+			return fmt.Errorf("vaccine %s needs at least one dose", v.Code)
+		}
+		birth := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		for j := 1; j < len(v.Doses); j++ {
+			if v.Doses[j].Age.From(birth).Before(v.Doses[j-1].Age.From(birth)) {
+				return fmt.Errorf("the doses of vaccine %s must be listed by age", v.Code)
+			}
+		}
+	}
+	return nil
+}
+
+// Vaccine returns the vaccine with the code, or nil if the schedule has none.
+func (s *ImmunizationSchedule) Vaccine(code string) *Vaccine {
+	for i := range s.Vaccines {
+		if s.Vaccines[i].Code == code {
+			return &s.Vaccines[i]
+		}
+	}
+	return nil
+}
+
+// OldestBorn returns the earliest day of birth of patients who may still have doses to be given on the day.
+func (s *ImmunizationSchedule) OldestBorn(day time.Time) time.Time {
+	oldest := s.MaxAge.BornBefore(day)
+	for _, v := range s.Vaccines {
+		for _, d := range v.Doses {
+			if d.MaxAge != nil && d.MaxAge.BornBefore(day).Before(oldest) {
+				oldest = d.MaxAge.BornBefore(day)
+			}
+		}
+	}
+	return oldest
+}
+
+type DoseStatus string
+
+const (
+	DoseGiven    DoseStatus = "given"
+	DoseUpcoming DoseStatus = "upcoming"
+	DoseDue      DoseStatus = "due"
+	DoseOverdue  DoseStatus = "overdue"
+	// DoseMissed is a dose not given by its maximum age.
+	DoseMissed DoseStatus = "missed"
+)
+
+// Pending reports whether the dose is still to be given.
+func (s DoseStatus) Pending() bool {
+	return s == DoseUpcoming || s == DoseDue || s == DoseOverdue
+}
+
+// DoseForecast is a dose of the schedule for a patient, with the days it is due, overdue and given until.
+type DoseForecast struct {
+	Vaccine *Vaccine
+	Number  int
+	Dose    *VaccineDose
+	Due     time.Time
+	Overdue time.Time
+	Until   time.Time
+	Status  DoseStatus
+	// Given is the record of the dose, nil if it was not given.
+	Given *Immunization
+}
+
+// Forecast works out the status of every dose of the schedule on the day for a patient born on the day of birth
+// who was given the immunizations.
+func (s *ImmunizationSchedule) Forecast(dateOfBirth time.Time, given []Immunization, day time.Time) []DoseForecast {
+	day = StartOfDay(day)
+	birth := time.Date(dateOfBirth.Year(), dateOfBirth.Month(), dateOfBirth.Day(), 0, 0, 0, 0, day.Location())
+	records := make(map[string]*Immunization)
+	for i := range given {
+		records[doseKey(given[i].VaccineCode, given[i].Dose)] = &given[i]
+	}
+	var forecast []DoseForecast
+	for i := range s.Vaccines {
+		v := &s.Vaccines[i]
+		var previous time.Time
+		for j := range v.Doses {
+			d := &v.Doses[j]
+			f := DoseForecast{Vaccine: v, Number: j + 1, Dose: d, Due: d.Age.From(birth)}
+			if j > 0 {
+				if earliest := d.MinInterval.From(previous); earliest.After(f.Due) {
+					f.Due = earliest
+				}
+			}
+			grace, maxAge := s.Grace, s.MaxAge
+			if d.Grace != nil {
+				grace = d.Grace
+			}
+			if d.MaxAge != nil {
+				maxAge = d.MaxAge
+			}
+			f.Overdue = grace.From(f.Due)
+			f.Until = maxAge.From(birth)
+			f.Given = records[doseKey(v.Code, f.Number)]
+			switch {
+			case f.Given != nil:
+				f.Status = DoseGiven
+			case !day.Before(f.Until):
+				f.Status = DoseMissed
+			case day.Before(f.Due):
+				f.Status = DoseUpcoming
+			case day.Before(f.Overdue):
+				f.Status = DoseDue
+			default:
+				f.Status = DoseOverdue
+			}
+			previous = f.Due
+			if f.Given != nil {
+				previous = StartOfDay(f.Given.Given.In(day.Location()))
+			}
+			forecast = append(forecast, f)
+		}
+	}
+	return forecast
+}
+
+func doseKey(code string, dose int) string {
+	return code + "#" + strconv.Itoa(dose)
+}
+
+// LastDay returns the last day the dose can be given on.
+func (f *DoseForecast) LastDay() time.Time {
+	return f.Until.AddDate(0, 0, -1)
+}
+
+// Name names the vaccine and the dose, like "Rotavirus, Dose 2".
+func (f *DoseForecast) Name() string {
+	if f.Dose.Label == "" {
+		return fmt.Sprintf("%s, dose %d", f.Vaccine.Name, f.Number)
+	}
+	return f.Vaccine.Name + ", " + f.Dose.Label
+}
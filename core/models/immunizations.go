@@ -0,0 +1,413 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const ImmunizationCollection = "immunization"
+
+// InjectionSite is where on the body a vaccine was given.
+type InjectionSite string
+
+const (
+	SiteLeftArm    InjectionSite = "left_arm"
+	SiteRightArm   InjectionSite = "right_arm"
+	SiteLeftThigh  InjectionSite = "left_thigh"
+	SiteRightThigh InjectionSite = "right_thigh"
+	SiteOral       InjectionSite = "oral"
+)
+
+func InjectionSitesList() []InjectionSite {
+	return []InjectionSite{SiteLeftArm, SiteRightArm, SiteLeftThigh, SiteRightThigh, SiteOral}
+}
+
+// Label returns the name of the site shown to users.
+func (s InjectionSite) Label() string {
+	switch s {
+	case SiteLeftArm:
+		return "Left upper arm"
+	case SiteRightArm:
+		return "Right upper arm"
+	case SiteLeftThigh:
+		return "Left thigh"
+	case SiteRightThigh:
+		return "Right thigh"
+	case SiteOral:
+		return "Oral"
+	}
+	return string(s)
+}
+
+// Immunization is a dose of a vaccine of the schedule given to a patient, either at the clinic by a member of the
+// staff or elsewhere, like at a government health centre.
+type Immunization struct {
+	Id          bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId   bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	VaccineCode string        `json:"vaccine_code" bson:"vaccine_code"`
+	// Dose is the number of the dose of the vaccine in the schedule, counted from one.
+	Dose      int           `json:"dose" bson:"dose"`
+	Given     time.Time     `json:"given" bson:"given"`
+	LotNumber string        `json:"lot_number,omitempty" bson:"lot_number,omitempty"`
+	Site      InjectionSite `json:"site,omitempty" bson:"site,omitempty"`
+	// GivenBy is the member of the staff who gave the vaccine at the clinic, Elsewhere the place it was given
+	// otherwise.
+	GivenBy    bson.ObjectId `json:"given_by,omitempty" bson:"given_by,omitempty"`
+	Elsewhere  string        `json:"elsewhere,omitempty" bson:"elsewhere,omitempty"`
+	Notes      string        `json:"notes,omitempty" bson:"notes,omitempty"`
+	Recorded   time.Time     `json:"recorded" bson:"recorded"`
+	RecordedBy bson.ObjectId `json:"recorded_by" bson:"recorded_by"`
+}
+
+type ImmunizationDB interface {
+	ById(id string) (*Immunization, error)
+	// ByPatient returns the immunizations of the patient in the order they were given.
+	ByPatient(patientId string) ([]Immunization, error)
+	// ByPatients returns the immunizations of all the patients, in no particular order.
+	ByPatients(patientIds []bson.ObjectId) ([]Immunization, error)
+
+	Create(immunization *Immunization) error
+	Delete(id string) error
+}
+
+type immunizationValidator struct {
+	ImmunizationDB
+	patients PatientDB
+	users    UserDB
+	schedule *ImmunizationSchedule
+	clock    Clock
+}
+
+var _ ImmunizationDB = &immunizationValidator{}
+
+func (iv *immunizationValidator) ById(id string) (*Immunization, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return iv.ImmunizationDB.ById(id)
+}
+
+func (iv *immunizationValidator) ByPatient(patientId string) ([]Immunization, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return iv.ImmunizationDB.ByPatient(patientId)
+}
+
+func (iv *immunizationValidator) Create(immunization *Immunization) error {
+	if immunization.PatientId == "" {
+		return ErrPatientRequired
+	}
+	patient, err := iv.patients.ById(immunization.PatientId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPatientRequired
+		}
+		return err
+	}
+	if err := runImmunizationValFuncs(immunization, iv.doseExists, iv.doseNotRecorded(patient),
+		iv.givenAfterBirth(patient), iv.requireGiver, iv.ensureRecordedAt); err != nil {
+		return err
+	}
+	return iv.ImmunizationDB.Create(immunization)
+}
+
+func (iv *immunizationValidator) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return iv.ImmunizationDB.Delete(id)
+}
+
+type immunizationValFunc func(immunization *Immunization) error
+
+func runImmunizationValFuncs(immunization *Immunization, fns ...immunizationValFunc) error {
+	for _, fn := range fns {
+		if err := fn(immunization); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iv *immunizationValidator) doseExists(immunization *Immunization) error {
+	vaccine := iv.schedule.Vaccine(immunization.VaccineCode)
+	if vaccine == nil || vaccine.Dose(immunization.Dose) == nil {
+		return ErrVaccineDoseInvalid
+	}
+	return nil
+}
+
+func (iv *immunizationValidator) doseNotRecorded(patient *Patient) immunizationValFunc {
+	return func(immunization *Immunization) error {
+		given, err := iv.ImmunizationDB.ByPatient(patient.Id.Hex())
+		if err != nil {
+			return err
+		}
+		for _, g := range given {
+			if g.VaccineCode == immunization.VaccineCode && g.Dose == immunization.Dose {
+				return ErrVaccineDoseRecorded
+			}
+		}
+		return nil
+	}
+}
+
+func (iv *immunizationValidator) givenAfterBirth(patient *Patient) immunizationValFunc {
+	return func(immunization *Immunization) error {
+		if immunization.Given.IsZero() {
+			return ErrImmunizationDateRequired
+		}
+		birth := time.Date(patient.DateOfBirth.Year(), patient.DateOfBirth.Month(), patient.DateOfBirth.Day(), 0, 0,
+			0, 0, immunization.Given.Location())
+		if immunization.Given.Before(birth) || immunization.Given.After(iv.clock.Now()) {
+			return ErrImmunizationDateInvalid
+		}
+		return nil
+	}
+}
+
+// requireGiver requires the member of the staff, lot number and site of vaccines given at the clinic, and the
+// place of vaccines given elsewhere, where the lot number and site are often not known.
+func (iv *immunizationValidator) requireGiver(immunization *Immunization) error {
+	immunization.LotNumber = strings.TrimSpace(immunization.LotNumber)
+	immunization.Elsewhere = strings.TrimSpace(immunization.Elsewhere)
+	if immunization.Site != "" && !injectionSiteExists(immunization.Site) {
+		return ErrInjectionSiteInvalid
+	}
+	if immunization.Elsewhere != "" {
+		immunization.GivenBy = ""
+		return nil
+	}
+	if immunization.GivenBy == "" {
+		return ErrVaccinatorRequired
+	}
+	user, err := iv.users.ById(immunization.GivenBy.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrVaccinatorRequired
+		}
+		return err
+	}
+	if user.Disabled || !user.HasRole(UserRoleAdmin, UserRolePhysician, UserRoleStaff) {
+		return ErrVaccinatorRequired
+	}
+	if immunization.LotNumber == "" {
+		return ErrLotNumberRequired
+	}
+	if immunization.Site == "" {
+		return ErrInjectionSiteInvalid
+	}
+	return nil
+}
+
+func (iv *immunizationValidator) ensureRecordedAt(immunization *Immunization) error {
+	immunization.Recorded = iv.clock.Now()
+	return nil
+}
+
+func injectionSiteExists(site InjectionSite) bool {
+	for _, s := range InjectionSitesList() {
+		if s == site {
+			return true
+		}
+	}
+	return false
+}
+
+// ImmunizationRecord is the immunization status of a patient on a day.
+type ImmunizationRecord struct {
+	Patient *Patient
+	Day     time.Time
+	// Doses are the doses of the schedule, Unscheduled the immunizations of vaccines or doses the schedule does
+	// not have anymore.
+	Doses       []DoseForecast
+	Unscheduled []Immunization
+}
+
+// Pending returns the doses still to be given which are due or overdue.
+func (r *ImmunizationRecord) Pending() []DoseForecast {
+	var pending []DoseForecast
+	for _, d := range r.Doses {
+		if d.Status == DoseDue || d.Status == DoseOverdue {
+			pending = append(pending, d)
+		}
+	}
+	return pending
+}
+
+// Given returns the doses given, in the order of the schedule.
+func (r *ImmunizationRecord) Given() []DoseForecast {
+	var given []DoseForecast
+	for _, d := range r.Doses {
+		if d.Status == DoseGiven {
+			given = append(given, d)
+		}
+	}
+	return given
+}
+
+// DueDose is a dose due for a patient.
+type DueDose struct {
+	Patient Patient
+	DoseForecast
+}
+
+type ImmunizationService interface {
+	Schedule() *ImmunizationSchedule
+	// Record returns the immunization status of the patient on the day.
+	Record(patient *Patient, day time.Time) (*ImmunizationRecord, error)
+	// DueBy returns the doses of all patients which are due or overdue on the day or become due by the day until,
+	// the earliest due first.
+	DueBy(day, until time.Time) ([]DueDose, error)
+	ImmunizationDB
+}
+
+type immunizationService struct {
+	ImmunizationDB
+	patients PatientDB
+	schedule *ImmunizationSchedule
+	logger   *logrus.Entry
+}
+
+func NewImmunizationService(mgo *mgo.Session, patients PatientDB, users UserDB, schedule *ImmunizationSchedule,
+	logger *logrus.Entry, dbname string) ImmunizationService {
+	im := &immunizationMongo{mgo, dbname, logger}
+	return newImmunizationService(im, patients, users, schedule, logger)
+}
+
+// NewInMemoryImmunizationService returns an ImmunizationService backed by an in-memory ImmunizationDB.
+func NewInMemoryImmunizationService(patients PatientDB, users UserDB, schedule *ImmunizationSchedule,
+	logger *logrus.Entry) ImmunizationService {
+	return newImmunizationService(newImmunizationMemory(), patients, users, schedule, logger)
+}
+
+func newImmunizationService(idb ImmunizationDB, patients PatientDB, users UserDB, schedule *ImmunizationSchedule,
+	logger *logrus.Entry) ImmunizationService {
+	return &immunizationService{
+		ImmunizationDB: &immunizationValidator{
+			ImmunizationDB: idb,
+			patients:       patients,
+			users:          users,
+			schedule:       schedule,
+			clock:          SystemClock(),
+		},
+		patients: patients,
+		schedule: schedule,
+		logger:   logger,
+	}
+}
+
+func (is *immunizationService) Schedule() *ImmunizationSchedule {
+	return is.schedule
+}
+
+func (is *immunizationService) Record(patient *Patient, day time.Time) (*ImmunizationRecord, error) {
+	given, err := is.ByPatient(patient.Id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return is.record(patient, given, day), nil
+}
+
+func (is *immunizationService) record(patient *Patient, given []Immunization, day time.Time) *ImmunizationRecord {
+	record := ImmunizationRecord{
+		Patient: patient,
+		Day:     StartOfDay(day),
+		Doses:   is.schedule.Forecast(patient.DateOfBirth, given, day),
+	}
+	for _, g := range given {
+		if v := is.schedule.Vaccine(g.VaccineCode); v == nil || v.Dose(g.Dose) == nil {
+			record.Unscheduled = append(record.Unscheduled, g)
+		}
+	}
+	return &record
+}
+
+func (is *immunizationService) DueBy(day, until time.Time) ([]DueDose, error) {
+	day, until = StartOfDay(day), StartOfDay(until)
+	patients, err := is.patients.BornSince(is.schedule.OldestBorn(day))
+	if err != nil {
+		return nil, err
+	}
+	if len(patients) == 0 {
+		return nil, nil
+	}
+	ids := make([]bson.ObjectId, len(patients))
+	for i := range patients {
+		ids[i] = patients[i].Id
+	}
+	immunizations, err := is.ByPatients(ids)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[bson.ObjectId][]Immunization)
+	for _, im := range immunizations {
+		given[im.PatientId] = append(given[im.PatientId], im)
+	}
+	var due []DueDose
+	for i := range patients {
+		record := is.record(&patients[i], given[patients[i].Id], day)
+		for _, d := range record.Doses {
+			if d.Status == DoseDue || d.Status == DoseOverdue || (d.Status == DoseUpcoming && !d.Due.After(until)) {
+				due = append(due, DueDose{Patient: patients[i], DoseForecast: d})
+			}
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].Due.Before(due[j].Due)
+	})
+	return due, nil
+}
+
+type immunizationMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ ImmunizationDB = &immunizationMongo{}
+
+func (im *immunizationMongo) ById(id string) (*Immunization, error) {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	i := Immunization{}
+	err := ses.DB(im.dbname).C(ImmunizationCollection).FindId(bson.ObjectIdHex(id)).One(&i)
+	return &i, err
+}
+
+func (im *immunizationMongo) ByPatient(patientId string) ([]Immunization, error) {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	var immunizations []Immunization
+	query := bson.M{"patient_id": bson.ObjectIdHex(patientId)}
+	err := ses.DB(im.dbname).C(ImmunizationCollection).Find(query).Sort("given", "recorded").All(&immunizations)
+	return immunizations, err
+}
+
+func (im *immunizationMongo) ByPatients(patientIds []bson.ObjectId) ([]Immunization, error) {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	var immunizations []Immunization
+	query := bson.M{"patient_id": bson.M{"$in": patientIds}}
+	err := ses.DB(im.dbname).C(ImmunizationCollection).Find(query).All(&immunizations)
+	return immunizations, err
+}
+
+func (im *immunizationMongo) Create(immunization *Immunization) error {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	immunization.Id = bson.NewObjectId()
+	return ses.DB(im.dbname).C(ImmunizationCollection).Insert(immunization)
+}
+
+func (im *immunizationMongo) Delete(id string) error {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(im.dbname).C(ImmunizationCollection).RemoveId(bson.ObjectIdHex(id))
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// immunizationMemory is a thread safe in-memory implementation of ImmunizationDB.
+type immunizationMemory struct {
+	mu            sync.RWMutex
+	immunizations map[bson.ObjectId]Immunization
+}
+
+var _ ImmunizationDB = &immunizationMemory{}
+
+func newImmunizationMemory() *immunizationMemory {
+	return &immunizationMemory{immunizations: make(map[bson.ObjectId]Immunization)}
+}
+
+func (im *immunizationMemory) ById(id string) (*Immunization, error) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	i, ok := im.immunizations[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &i, nil
+}
+
+func (im *immunizationMemory) ByPatient(patientId string) ([]Immunization, error) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	var immunizations []Immunization
+	for _, i := range im.immunizations {
+		if i.PatientId.Hex() == patientId {
+			immunizations = append(immunizations, i)
+		}
+	}
+	sort.Slice(immunizations, func(i, j int) bool {
+		if immunizations[i].Given.Equal(immunizations[j].Given) {
+			return immunizations[i].Recorded.Before(immunizations[j].Recorded)
+		}
+		return immunizations[i].Given.Before(immunizations[j].Given)
+	})
+	return immunizations, nil
+}
+
+func (im *immunizationMemory) ByPatients(patientIds []bson.ObjectId) ([]Immunization, error) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	patients := make(map[bson.ObjectId]bool, len(patientIds))
+	for _, id := range patientIds {
+		patients[id] = true
+	}
+	var immunizations []Immunization
+	for _, i := range im.immunizations {
+		if patients[i.PatientId] {
+			immunizations = append(immunizations, i)
+		}
+	}
+	return immunizations, nil
+}
+
+func (im *immunizationMemory) Create(immunization *Immunization) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	immunization.Id = bson.NewObjectId()
+	im.immunizations[immunization.Id] = *immunization
+	return nil
+}
+
+func (im *immunizationMemory) Delete(id string) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if _, ok := im.immunizations[bson.ObjectIdHex(id)]; !ok {
+		return MongoErrNotFound
+	}
+	delete(im.immunizations, bson.ObjectIdHex(id))
+	return nil
+}
@@ -0,0 +1,554 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	InvoiceCollection = "invoice"
+
+	// InvoicePrefix starts every invoice number, followed by a sequential number.
+	InvoicePrefix = "INV"
+	// invoiceCounter is the name of the counter the sequential part of invoice numbers is taken from.
+	invoiceCounter = "invoice_number"
+)
+
+type InvoiceStatus string
+
+const (
+	InvoiceUnpaid        InvoiceStatus = "unpaid"
+	InvoicePartiallyPaid InvoiceStatus = "partially_paid"
+	InvoicePaid          InvoiceStatus = "paid"
+	InvoiceCancelled     InvoiceStatus = "cancelled"
+)
+
+// InvoiceLine is a service billed on an invoice. The code, description, price and tax rate are copied from the
+// catalogue when the invoice is created.
+type InvoiceLine struct {
+	ItemId      bson.ObjectId `json:"item_id" bson:"item_id"`
+	Code        string        `json:"code" bson:"code"`
+	Description string        `json:"description" bson:"description"`
+	Quantity    int           `json:"quantity" bson:"quantity"`
+	UnitPrice   Money         `json:"unit_price" bson:"unit_price"`
+	// Discount is the amount taken off the line before tax.
+	Discount Money   `json:"discount,omitempty" bson:"discount,omitempty"`
+	TaxRate  float64 `json:"tax_rate,omitempty" bson:"tax_rate,omitempty"`
+}
+
+// Gross returns the price of the line before discount and tax.
+func (l *InvoiceLine) Gross() Money {
+	return l.UnitPrice * Money(l.Quantity)
+}
+
+// Taxable returns the price of the line after the discount.
+func (l *InvoiceLine) Taxable() Money {
+	return l.Gross() - l.Discount
+}
+
+func (l *InvoiceLine) Tax() Money {
+	return l.Taxable().Percent(l.TaxRate)
+}
+
+func (l *InvoiceLine) Total() Money {
+	return l.Taxable() + l.Tax()
+}
+
+// Invoice bills the services of an encounter to the patient. Invoices are not changed once issued,
+// except for the amount paid and a cancellation.
+type Invoice struct {
+	Id bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	// Number is assigned on creation and never reused, also not when the invoice is cancelled.
+	Number      string        `json:"number" bson:"number"`
+	PatientId   bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	EncounterId bson.ObjectId `json:"encounter_id" bson:"encounter_id"`
+	// BillTo is the billing address of the patient when the invoice was created, or the home address.
+	BillTo Address       `json:"bill_to" bson:"bill_to"`
+	Lines  []InvoiceLine `json:"lines" bson:"lines"`
+	Notes  string        `json:"notes,omitempty" bson:"notes,omitempty"`
+	// Total is the sum of the totals of the lines. It is stored, so that payments can be checked against it.
+	Total        Money         `json:"total" bson:"total"`
+	Paid         Money         `json:"paid" bson:"paid"`
+	Cancelled    bool          `json:"cancelled" bson:"cancelled"`
+	CancelReason string        `json:"cancel_reason,omitempty" bson:"cancel_reason,omitempty"`
+	CancelledBy  bson.ObjectId `json:"cancelled_by,omitempty" bson:"cancelled_by,omitempty"`
+	CancelledAt  time.Time     `json:"cancelled_at,omitempty" bson:"cancelled_at,omitempty"`
+	Created      time.Time     `json:"created" bson:"created"`
+	CreatedBy    bson.ObjectId `json:"created_by,omitempty" bson:"created_by,omitempty"`
+}
+
+// Subtotal returns the sum of the lines before discounts and tax.
+func (i *Invoice) Subtotal() Money {
+	var sum Money
+	for _, l := range i.Lines {
+		sum += l.Gross()
+	}
+	return sum
+}
+
+func (i *Invoice) DiscountTotal() Money {
+	var sum Money
+	for _, l := range i.Lines {
+		sum += l.Discount
+	}
+	return sum
+}
+
+func (i *Invoice) TaxTotal() Money {
+	var sum Money
+	for _, l := range i.Lines {
+		sum += l.Tax()
+	}
+	return sum
+}
+
+// Balance returns the amount still to be paid.
+func (i *Invoice) Balance() Money {
+	if i.Cancelled {
+		return 0
+	}
+	return i.Total - i.Paid
+}
+
+func (i *Invoice) Status() InvoiceStatus {
+	switch {
+	case i.Cancelled:
+		return InvoiceCancelled
+	case i.Paid >= i.Total:
+		return InvoicePaid
+	case i.Paid > 0:
+		return InvoicePartiallyPaid
+	default:
+		return InvoiceUnpaid
+	}
+}
+
+type InvoiceDB interface {
+	ById(id string) (*Invoice, error)
+	// ByPatient and ByEncounter return invoices newest first.
+	ByPatient(patientId string) ([]Invoice, error)
+	ByEncounter(encounterId string) ([]Invoice, error)
+	// ByDay returns the invoices created on the day of date, oldest first.
+	ByDay(date time.Time) ([]Invoice, error)
+
+	Create(invoice *Invoice) error
+	// AddPayment adds the amount to the amount paid of the invoice with the total. It fails with
+	// ErrPaymentExceedsBalance if the invoice would be paid more than its total, or is cancelled.
+	AddPayment(id string, amount, total Money) error
+	// SetCancelled cancels the invoice. It fails with ErrInvoiceNotCancellable if anything was paid or it is cancelled.
+	SetCancelled(id, reason string, by bson.ObjectId, at time.Time) error
+}
+
+type invoiceValidator struct {
+	InvoiceDB
+	encounters EncounterDB
+	patients   PatientDB
+	catalogue  CatalogueDB
+	counters   CounterDB
+	clock      Clock
+}
+
+var _ InvoiceDB = &invoiceValidator{}
+
+func (iv *invoiceValidator) ById(id string) (*Invoice, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return iv.InvoiceDB.ById(id)
+}
+
+func (iv *invoiceValidator) ByPatient(patientId string) ([]Invoice, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return iv.InvoiceDB.ByPatient(patientId)
+}
+
+func (iv *invoiceValidator) ByEncounter(encounterId string) ([]Invoice, error) {
+	if !bson.IsObjectIdHex(encounterId) {
+		return nil, ErrIDInvalid
+	}
+	return iv.InvoiceDB.ByEncounter(encounterId)
+}
+
+func (iv *invoiceValidator) ByDay(date time.Time) ([]Invoice, error) {
+	return iv.InvoiceDB.ByDay(StartOfDay(date))
+}
+
+func (iv *invoiceValidator) AddPayment(id string, amount, total Money) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return iv.InvoiceDB.AddPayment(id, amount, total)
+}
+
+func (iv *invoiceValidator) SetCancelled(id, reason string, by bson.ObjectId, at time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return ErrCancelReasonRequired
+	}
+	return iv.InvoiceDB.SetCancelled(id, reason, by, at)
+}
+
+// Create assigns the invoice number last, so that invalid invoices do not use up numbers.
+func (iv *invoiceValidator) Create(invoice *Invoice) error {
+	if err := runInvoiceValFuncs(invoice, iv.requireEncounter, iv.encounterNotInvoiced, iv.billTo,
+		iv.normalizeLines, iv.computeTotal, iv.ensureCreatedAt, iv.assignNumber); err != nil {
+		return err
+	}
+	return iv.InvoiceDB.Create(invoice)
+}
+
+// requireEncounter also sets the patient of the invoice to the patient of the encounter.
+func (iv *invoiceValidator) requireEncounter(invoice *Invoice) error {
+	if invoice.EncounterId == "" {
+		return ErrInvoiceEncounterRequired
+	}
+	encounter, err := iv.encounters.ById(invoice.EncounterId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrInvoiceEncounterRequired
+		}
+		return err
+	}
+	invoice.PatientId = encounter.PatientId
+	return nil
+}
+
+// encounterNotInvoiced gives the error before a number is used up for the invoice. Invoices created at the same
+// time are refused by the InvoiceDB.
+func (iv *invoiceValidator) encounterNotInvoiced(invoice *Invoice) error {
+	invoices, err := iv.InvoiceDB.ByEncounter(invoice.EncounterId.Hex())
+	if err != nil {
+		return err
+	}
+	for _, existing := range invoices {
+		if !existing.Cancelled {
+			return ErrEncounterInvoiced
+		}
+	}
+	return nil
+}
+
+// billTo addresses the invoice to the billing address of the patient, the home address if there is none.
+func (iv *invoiceValidator) billTo(invoice *Invoice) error {
+	patient, err := iv.patients.ById(invoice.PatientId.Hex())
+	if err != nil {
+		return err
+	}
+	address := patient.Address(AddressTypeBilling)
+	if address == nil {
+		address = patient.Address(AddressTypeHome)
+	}
+	if address != nil {
+		invoice.BillTo = *address
+	}
+	invoice.BillTo.AddressType = AddressTypeBilling
+	if invoice.BillTo.FullName == "" {
+		invoice.BillTo.FullName = patient.FullName()
+	}
+	return nil
+}
+
+// normalizeLines drops lines without a quantity, so that forms can offer every service of the catalogue,
+// and copies the details of the services from the catalogue.
+func (iv *invoiceValidator) normalizeLines(invoice *Invoice) error {
+	lines := make([]InvoiceLine, 0, len(invoice.Lines))
+	for _, l := range invoice.Lines {
+		if l.Quantity == 0 {
+			continue
+		}
+		if l.Quantity < 0 {
+			return ErrInvoiceQuantity
+		}
+		if !l.ItemId.Valid() {
+			return ErrInvoiceItemInvalid
+		}
+		item, err := iv.catalogue.ById(l.ItemId.Hex())
+		if err != nil {
+			if err.Error() == MongoErrNotFound.Error() {
+				return ErrInvoiceItemInvalid
+			}
+			return err
+		}
+		if !item.Active {
+			return ErrInvoiceItemInvalid
+		}
+		l.Code = item.Code
+		l.Description = item.Name
+		l.UnitPrice = item.Price
+		l.TaxRate = item.TaxRate
+		if l.Discount < 0 || l.Discount > l.Gross() {
+			return ErrInvoiceDiscountInvalid
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		return ErrInvoiceEmpty
+	}
+	invoice.Lines = lines
+	invoice.Notes = strings.TrimSpace(invoice.Notes)
+	return nil
+}
+
+func (iv *invoiceValidator) computeTotal(invoice *Invoice) error {
+	invoice.Total = 0
+	for _, l := range invoice.Lines {
+		invoice.Total += l.Total()
+	}
+	invoice.Paid = 0
+	invoice.Cancelled = false
+	return nil
+}
+
+func (iv *invoiceValidator) ensureCreatedAt(invoice *Invoice) error {
+	invoice.Created = iv.clock.Now()
+	return nil
+}
+
+func (iv *invoiceValidator) assignNumber(invoice *Invoice) error {
+	n, err := iv.counters.Next(invoiceCounter)
+	if err != nil {
+		return err
+	}
+	invoice.Number = fmt.Sprintf("%s%06d", InvoicePrefix, n)
+	return nil
+}
+
+// InvoiceService bills encounters and records their payments. Invoice and receipt numbers come from a CounterDB,
+// so that they are sequential and never handed out twice, also when several receptionists bill at once.
+type InvoiceService interface {
+	// Pay records the payment of the invoice and gives it the next receipt number.
+	Pay(invoice *Invoice, payment *Payment) error
+	// Cancel cancels an invoice without payments. Its number is not reused.
+	Cancel(invoice *Invoice, reason string, by *User) error
+	Payment(id string) (*Payment, error)
+	// Payments returns the payments of the invoice, oldest first.
+	Payments(invoiceId string) ([]Payment, error)
+	// CashReport sums up the payments received on the day of date.
+	CashReport(date time.Time) (*CashReport, error)
+	InvoiceDB
+}
+
+type invoiceService struct {
+	InvoiceDB
+	payments PaymentDB
+	counters CounterDB
+	clock    Clock
+	logger   *logrus.Entry
+}
+
+func NewInvoiceService(mgo *mgo.Session, encounters EncounterDB, patients PatientDB, catalogue CatalogueDB,
+	counters CounterDB, logger *logrus.Entry, dbname string) InvoiceService {
+	im := &invoiceMongo{mgo, dbname, logger}
+	pm := &paymentMongo{mgo, dbname, logger}
+	return newInvoiceService(im, pm, encounters, patients, catalogue, counters, logger)
+}
+
+// NewInMemoryInvoiceService returns an InvoiceService backed by in-memory invoice and payment stores.
+func NewInMemoryInvoiceService(encounters EncounterDB, patients PatientDB, catalogue CatalogueDB, counters CounterDB,
+	logger *logrus.Entry) InvoiceService {
+	return newInvoiceService(newInvoiceMemory(), newPaymentMemory(), encounters, patients, catalogue, counters, logger)
+}
+
+func newInvoiceService(idb InvoiceDB, pdb PaymentDB, encounters EncounterDB, patients PatientDB,
+	catalogue CatalogueDB, counters CounterDB, logger *logrus.Entry) InvoiceService {
+	return &invoiceService{
+		InvoiceDB: &invoiceValidator{
+			InvoiceDB:  idb,
+			encounters: encounters,
+			patients:   patients,
+			catalogue:  catalogue,
+			counters:   counters,
+			clock:      SystemClock(),
+		},
+		payments: &paymentValidator{pdb},
+		counters: counters,
+		clock:    SystemClock(),
+		logger:   logger,
+	}
+}
+
+func (is *invoiceService) Pay(invoice *Invoice, payment *Payment) error {
+	if invoice.Cancelled {
+		return ErrInvoiceCancelled
+	}
+	if !paymentMethodExists(payment.Method) {
+		return ErrPaymentMethodInvalid
+	}
+	if payment.Amount <= 0 {
+		return ErrPaymentAmountInvalid
+	}
+	if payment.Amount > invoice.Balance() {
+		return ErrPaymentExceedsBalance
+	}
+	// The amount is added to the invoice first, so that two payments at the same time can not overpay it.
+	if err := is.AddPayment(invoice.Id.Hex(), payment.Amount, invoice.Total); err != nil {
+		return err
+	}
+	n, err := is.counters.Next(receiptCounter)
+	if err != nil {
+		is.undoPayment(invoice, payment.Amount)
+		return err
+	}
+	payment.ReceiptNumber = fmt.Sprintf("%s%06d", ReceiptPrefix, n)
+	payment.InvoiceId = invoice.Id
+	payment.PatientId = invoice.PatientId
+	payment.Reference = strings.TrimSpace(payment.Reference)
+	payment.Received = is.clock.Now()
+	if err := is.payments.Create(payment); err != nil {
+		is.undoPayment(invoice, payment.Amount)
+		return err
+	}
+	invoice.Paid += payment.Amount
+	is.logger.Infof("Payment %s of %s received for invoice %s", payment.ReceiptNumber, payment.Amount, invoice.Number)
+	return nil
+}
+
+// undoPayment takes back the amount added to the invoice for a payment which could not be recorded.
+func (is *invoiceService) undoPayment(invoice *Invoice, amount Money) {
+	if err := is.AddPayment(invoice.Id.Hex(), -amount, invoice.Total); err != nil {
+		is.logger.Errorf("Error while taking back %s from invoice %s: %v", amount, invoice.Number, err)
+	}
+}
+
+func (is *invoiceService) Cancel(invoice *Invoice, reason string, by *User) error {
+	if invoice.Cancelled {
+		return ErrInvoiceCancelled
+	}
+	if invoice.Paid > 0 {
+		return ErrInvoiceNotCancellable
+	}
+	now := is.clock.Now()
+	if err := is.SetCancelled(invoice.Id.Hex(), reason, by.Id, now); err != nil {
+		return err
+	}
+	invoice.Cancelled = true
+	invoice.CancelReason = strings.TrimSpace(reason)
+	invoice.CancelledBy = by.Id
+	invoice.CancelledAt = now
+	is.logger.Infof("Invoice %s cancelled by %s", invoice.Number, by.Username)
+	return nil
+}
+
+func (is *invoiceService) Payment(id string) (*Payment, error) {
+	return is.payments.ById(id)
+}
+
+func (is *invoiceService) Payments(invoiceId string) ([]Payment, error) {
+	return is.payments.ByInvoice(invoiceId)
+}
+
+func (is *invoiceService) CashReport(date time.Time) (*CashReport, error) {
+	payments, err := is.payments.ByDay(date)
+	if err != nil {
+		return nil, err
+	}
+	return newCashReport(StartOfDay(date), payments), nil
+}
+
+type invoiceMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ InvoiceDB = &invoiceMongo{}
+
+func (im *invoiceMongo) ById(id string) (*Invoice, error) {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	i := Invoice{}
+	err := ses.DB(im.dbname).C(InvoiceCollection).FindId(bson.ObjectIdHex(id)).One(&i)
+	return &i, err
+}
+
+func (im *invoiceMongo) ByPatient(patientId string) ([]Invoice, error) {
+	return im.find(bson.M{"patient_id": bson.ObjectIdHex(patientId)}, "-created")
+}
+
+func (im *invoiceMongo) ByEncounter(encounterId string) ([]Invoice, error) {
+	return im.find(bson.M{"encounter_id": bson.ObjectIdHex(encounterId)}, "-created")
+}
+
+func (im *invoiceMongo) ByDay(date time.Time) ([]Invoice, error) {
+	return im.find(bson.M{"created": bson.M{"$gte": date, "$lt": date.AddDate(0, 0, 1)}}, "created")
+}
+
+func (im *invoiceMongo) find(query bson.M, sort string) ([]Invoice, error) {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	var invoices []Invoice
+	err := ses.DB(im.dbname).C(InvoiceCollection).Find(query).Sort(sort).All(&invoices)
+	return invoices, err
+}
+
+// Create fails with ErrEncounterInvoiced if the encounter got an invoice since it was checked, through the unique
+// index of EnsureInvoiceIndexes.
+func (im *invoiceMongo) Create(invoice *Invoice) error {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	invoice.Id = bson.NewObjectId()
+	err := ses.DB(im.dbname).C(InvoiceCollection).Insert(invoice)
+	if mgo.IsDup(err) {
+		return ErrEncounterInvoiced
+	}
+	return err
+}
+
+// EnsureInvoiceIndexes creates the index which allows one invoice per encounter which is not cancelled, so that
+// receptionists billing an encounter at the same time do not both create an invoice.
+func EnsureInvoiceIndexes(session *mgo.Session, dbname string) error {
+	ses := session.Copy()
+	defer ses.Close()
+	return ses.DB(dbname).C(InvoiceCollection).EnsureIndex(mgo.Index{
+		Key:           []string{"encounter_id"},
+		Unique:        true,
+		PartialFilter: bson.M{"cancelled": false},
+	})
+}
+
+func (im *invoiceMongo) AddPayment(id string, amount, total Money) error {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	err := ses.DB(im.dbname).C(InvoiceCollection).Update(
+		bson.M{"_id": bson.ObjectIdHex(id), "cancelled": false, "paid": bson.M{"$lte": total - amount}},
+		bson.M{"$inc": bson.M{"paid": amount}},
+	)
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return ErrPaymentExceedsBalance
+	}
+	return err
+}
+
+func (im *invoiceMongo) SetCancelled(id, reason string, by bson.ObjectId, at time.Time) error {
+	ses := im.mgo.Copy()
+	defer ses.Close()
+	err := ses.DB(im.dbname).C(InvoiceCollection).Update(
+		bson.M{"_id": bson.ObjectIdHex(id), "cancelled": false, "paid": 0},
+		bson.M{"$set": bson.M{"cancelled": true, "cancel_reason": reason, "cancelled_by": by, "cancelled_at": at}},
+	)
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return ErrInvoiceNotCancellable
+	}
+	return err
+}
+
+type invoiceValFunc func(invoice *Invoice) error
+
+func runInvoiceValFuncs(invoice *Invoice, fns ...invoiceValFunc) error {
+	for _, fn := range fns {
+		if err := fn(invoice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
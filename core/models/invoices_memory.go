@@ -0,0 +1,180 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// invoiceMemory is a thread safe in-memory implementation of InvoiceDB.
+type invoiceMemory struct {
+	mu       sync.RWMutex
+	invoices map[bson.ObjectId]Invoice
+}
+
+var _ InvoiceDB = &invoiceMemory{}
+
+func newInvoiceMemory() *invoiceMemory {
+	return &invoiceMemory{
+		invoices: make(map[bson.ObjectId]Invoice),
+	}
+}
+
+func (im *invoiceMemory) ById(id string) (*Invoice, error) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	i, ok := im.invoices[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyInvoice(&i)
+	return &found, nil
+}
+
+func (im *invoiceMemory) ByPatient(patientId string) ([]Invoice, error) {
+	return im.filter(func(i *Invoice) bool {
+		return i.PatientId.Hex() == patientId
+	}, true), nil
+}
+
+func (im *invoiceMemory) ByEncounter(encounterId string) ([]Invoice, error) {
+	return im.filter(func(i *Invoice) bool {
+		return i.EncounterId.Hex() == encounterId
+	}, true), nil
+}
+
+func (im *invoiceMemory) ByDay(date time.Time) ([]Invoice, error) {
+	next := date.AddDate(0, 0, 1)
+	return im.filter(func(i *Invoice) bool {
+		return !i.Created.Before(date) && i.Created.Before(next)
+	}, false), nil
+}
+
+// filter returns copies of the invoices matching the function, newest or oldest first.
+func (im *invoiceMemory) filter(match func(i *Invoice) bool, newestFirst bool) []Invoice {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	var invoices []Invoice
+	for _, i := range im.invoices {
+		if match(&i) {
+			invoices = append(invoices, copyInvoice(&i))
+		}
+	}
+	sort.Slice(invoices, func(a, b int) bool {
+		if newestFirst {
+			return invoices[a].Created.After(invoices[b].Created)
+		}
+		return invoices[a].Created.Before(invoices[b].Created)
+	})
+	return invoices
+}
+
+func (im *invoiceMemory) Create(invoice *Invoice) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	for _, existing := range im.invoices {
+		if existing.EncounterId == invoice.EncounterId && !existing.Cancelled {
+			return ErrEncounterInvoiced
+		}
+	}
+	invoice.Id = bson.NewObjectId()
+	im.invoices[invoice.Id] = copyInvoice(invoice)
+	return nil
+}
+
+func (im *invoiceMemory) AddPayment(id string, amount, total Money) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	i, ok := im.invoices[bson.ObjectIdHex(id)]
+	if !ok || i.Cancelled || i.Paid > total-amount {
+		return ErrPaymentExceedsBalance
+	}
+	i.Paid += amount
+	im.invoices[i.Id] = i
+	return nil
+}
+
+func (im *invoiceMemory) SetCancelled(id, reason string, by bson.ObjectId, at time.Time) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	i, ok := im.invoices[bson.ObjectIdHex(id)]
+	if !ok || i.Cancelled || i.Paid != 0 {
+		return ErrInvoiceNotCancellable
+	}
+	i.Cancelled = true
+	i.CancelReason = reason
+	i.CancelledBy = by
+	i.CancelledAt = at
+	im.invoices[i.Id] = i
+	return nil
+}
+
+// copyInvoice returns a copy of the invoice which does not share its lines with the original.
+func copyInvoice(invoice *Invoice) Invoice {
+	i := *invoice
+	i.Lines = append([]InvoiceLine(nil), invoice.Lines...)
+	return i
+}
+
+// paymentMemory is a thread safe in-memory implementation of PaymentDB.
+type paymentMemory struct {
+	mu       sync.RWMutex
+	payments map[bson.ObjectId]Payment
+}
+
+var _ PaymentDB = &paymentMemory{}
+
+func newPaymentMemory() *paymentMemory {
+	return &paymentMemory{
+		payments: make(map[bson.ObjectId]Payment),
+	}
+}
+
+func (pm *paymentMemory) ById(id string) (*Payment, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	p, ok := pm.payments[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &p, nil
+}
+
+func (pm *paymentMemory) ByInvoice(invoiceId string) ([]Payment, error) {
+	return pm.filter(func(p *Payment) bool {
+		return p.InvoiceId.Hex() == invoiceId
+	}), nil
+}
+
+func (pm *paymentMemory) ByDay(date time.Time) ([]Payment, error) {
+	next := date.AddDate(0, 0, 1)
+	return pm.filter(func(p *Payment) bool {
+		return !p.Received.Before(date) && p.Received.Before(next)
+	}), nil
+}
+
+// filter returns the payments matching the function, oldest first.
+func (pm *paymentMemory) filter(match func(p *Payment) bool) []Payment {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	var payments []Payment
+	for _, p := range pm.payments {
+		if match(&p) {
+			payments = append(payments, p)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].Received.Before(payments[j].Received)
+	})
+	return payments
+}
+
+func (pm *paymentMemory) Create(payment *Payment) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	payment.Id = bson.NewObjectId()
+	pm.payments[payment.Id] = *payment
+	return nil
+}
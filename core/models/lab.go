@@ -0,0 +1,262 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	LabOrderCollection = "lab_order"
+
+	// LabOrderPrefix starts the number of every lab order, followed by a sequential number.
+	// The number goes on the sample and is how results of a partner lab are matched to the order.
+	LabOrderPrefix = "LAB"
+	// labOrderCounter is the name of the counter the sequential part of lab order numbers is taken from.
+	labOrderCounter = "lab_order_number"
+)
+
+type LabOrderStatus string
+
+const (
+	LabOrderOrdered    LabOrderStatus = "ordered"
+	LabOrderInProgress LabOrderStatus = "in_progress"
+	LabOrderCompleted  LabOrderStatus = "completed"
+)
+
+// LabOrderTest is a test of a lab order. The name is kept, so that the order reads the same if the test is renamed.
+type LabOrderTest struct {
+	Code string `json:"code" bson:"code"`
+	Name string `json:"name" bson:"name"`
+}
+
+// LabOrder is a request for lab tests made by a physician during an encounter.
+type LabOrder struct {
+	Id          bson.ObjectId  `json:"id,omitempty" bson:"_id,omitempty"`
+	Number      string         `json:"number" bson:"number"`
+	EncounterId bson.ObjectId  `json:"encounter_id" bson:"encounter_id"`
+	PatientId   bson.ObjectId  `json:"patient_id" bson:"patient_id"`
+	PhysicianId bson.ObjectId  `json:"physician_id" bson:"physician_id"`
+	Tests       []LabOrderTest `json:"tests" bson:"tests"`
+	Notes       string         `json:"notes,omitempty" bson:"notes,omitempty"`
+	// Status is in progress once the first result is entered, and completed when every analyte has a result.
+	Status    LabOrderStatus `json:"status" bson:"status"`
+	Created   time.Time      `json:"created" bson:"created"`
+	Completed time.Time      `json:"completed,omitempty" bson:"completed,omitempty"`
+}
+
+// Includes reports whether the test with the code is part of the order.
+func (o *LabOrder) Includes(testCode string) bool {
+	for _, t := range o.Tests {
+		if t.Code == testCode {
+			return true
+		}
+	}
+	return false
+}
+
+type LabOrderDB interface {
+	ById(id string) (*LabOrder, error)
+	ByNumber(number string) (*LabOrder, error)
+	// ByPatient and ByEncounter return orders newest first.
+	ByPatient(patientId string) ([]LabOrder, error)
+	ByEncounter(encounterId string) ([]LabOrder, error)
+	// Pending returns the orders which are not completed, oldest first.
+	Pending() ([]LabOrder, error)
+
+	Create(order *LabOrder) error
+	// SetStatus changes the status of the order. The time is recorded as its completion when it is completed.
+	SetStatus(id string, status LabOrderStatus, at time.Time) error
+}
+
+type labOrderValidator struct {
+	LabOrderDB
+	users      UserDB
+	encounters EncounterDB
+	tests      *LabTests
+	counters   CounterDB
+	clock      Clock
+}
+
+var _ LabOrderDB = &labOrderValidator{}
+
+func (ov *labOrderValidator) ById(id string) (*LabOrder, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return ov.LabOrderDB.ById(id)
+}
+
+func (ov *labOrderValidator) ByNumber(number string) (*LabOrder, error) {
+	return ov.LabOrderDB.ByNumber(strings.ToUpper(strings.TrimSpace(number)))
+}
+
+func (ov *labOrderValidator) ByPatient(patientId string) ([]LabOrder, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return ov.LabOrderDB.ByPatient(patientId)
+}
+
+func (ov *labOrderValidator) ByEncounter(encounterId string) ([]LabOrder, error) {
+	if !bson.IsObjectIdHex(encounterId) {
+		return nil, ErrIDInvalid
+	}
+	return ov.LabOrderDB.ByEncounter(encounterId)
+}
+
+func (ov *labOrderValidator) Create(order *LabOrder) error {
+	if err := runLabOrderValFuncs(order, ov.requireEncounter, ov.requirePhysician, ov.normalizeTests,
+		ov.ensureCreatedAt, ov.assignNumber); err != nil {
+		return err
+	}
+	return ov.LabOrderDB.Create(order)
+}
+
+// requireEncounter also sets the patient of the order to the patient of the encounter.
+func (ov *labOrderValidator) requireEncounter(order *LabOrder) error {
+	if order.EncounterId == "" {
+		return ErrLabOrderEncounterRequired
+	}
+	encounter, err := ov.encounters.ById(order.EncounterId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrLabOrderEncounterRequired
+		}
+		return err
+	}
+	order.PatientId = encounter.PatientId
+	return nil
+}
+
+func (ov *labOrderValidator) requirePhysician(order *LabOrder) error {
+	if order.PhysicianId == "" {
+		return ErrOrderingNotPhysician
+	}
+	physician, err := ov.users.ById(order.PhysicianId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrOrderingNotPhysician
+		}
+		return err
+	}
+	if !physician.HasRole(UserRolePhysician) || physician.Disabled {
+		return ErrOrderingNotPhysician
+	}
+	return nil
+}
+
+// normalizeTests drops duplicate tests and copies the names of the tests from the list of lab tests.
+func (ov *labOrderValidator) normalizeTests(order *LabOrder) error {
+	tests := make([]LabOrderTest, 0, len(order.Tests))
+	seen := make(map[string]bool)
+	for _, t := range order.Tests {
+		test := ov.tests.Test(t.Code)
+		if test == nil {
+			return ErrLabTestInvalid
+		}
+		if seen[test.Code] {
+			continue
+		}
+		seen[test.Code] = true
+		tests = append(tests, LabOrderTest{Code: test.Code, Name: test.Name})
+	}
+	if len(tests) == 0 {
+		return ErrLabOrderEmpty
+	}
+	order.Tests = tests
+	order.Notes = strings.TrimSpace(order.Notes)
+	order.Status = LabOrderOrdered
+	return nil
+}
+
+func (ov *labOrderValidator) ensureCreatedAt(order *LabOrder) error {
+	order.Created = ov.clock.Now()
+	return nil
+}
+
+// assignNumber runs last, so that invalid orders do not use up numbers.
+func (ov *labOrderValidator) assignNumber(order *LabOrder) error {
+	n, err := ov.counters.Next(labOrderCounter)
+	if err != nil {
+		return err
+	}
+	order.Number = fmt.Sprintf("%s%06d", LabOrderPrefix, n)
+	return nil
+}
+
+type labOrderMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ LabOrderDB = &labOrderMongo{}
+
+func (om *labOrderMongo) ById(id string) (*LabOrder, error) {
+	ses := om.mgo.Copy()
+	defer ses.Close()
+	o := LabOrder{}
+	err := ses.DB(om.dbname).C(LabOrderCollection).FindId(bson.ObjectIdHex(id)).One(&o)
+	return &o, err
+}
+
+func (om *labOrderMongo) ByNumber(number string) (*LabOrder, error) {
+	ses := om.mgo.Copy()
+	defer ses.Close()
+	o := LabOrder{}
+	err := ses.DB(om.dbname).C(LabOrderCollection).Find(bson.M{"number": number}).One(&o)
+	return &o, err
+}
+
+func (om *labOrderMongo) ByPatient(patientId string) ([]LabOrder, error) {
+	return om.find(bson.M{"patient_id": bson.ObjectIdHex(patientId)}, "-created")
+}
+
+func (om *labOrderMongo) ByEncounter(encounterId string) ([]LabOrder, error) {
+	return om.find(bson.M{"encounter_id": bson.ObjectIdHex(encounterId)}, "-created")
+}
+
+func (om *labOrderMongo) Pending() ([]LabOrder, error) {
+	return om.find(bson.M{"status": bson.M{"$ne": LabOrderCompleted}}, "created")
+}
+
+func (om *labOrderMongo) find(query bson.M, sort string) ([]LabOrder, error) {
+	ses := om.mgo.Copy()
+	defer ses.Close()
+	var orders []LabOrder
+	err := ses.DB(om.dbname).C(LabOrderCollection).Find(query).Sort(sort).All(&orders)
+	return orders, err
+}
+
+func (om *labOrderMongo) Create(order *LabOrder) error {
+	ses := om.mgo.Copy()
+	defer ses.Close()
+	order.Id = bson.NewObjectId()
+	return ses.DB(om.dbname).C(LabOrderCollection).Insert(order)
+}
+
+func (om *labOrderMongo) SetStatus(id string, status LabOrderStatus, at time.Time) error {
+	ses := om.mgo.Copy()
+	defer ses.Close()
+	set := bson.M{"status": status}
+	if status == LabOrderCompleted {
+		set["completed"] = at
+	}
+	return ses.DB(om.dbname).C(LabOrderCollection).UpdateId(bson.ObjectIdHex(id), bson.M{"$set": set})
+}
+
+type labOrderValFunc func(order *LabOrder) error
+
+func runLabOrderValFuncs(order *LabOrder, fns ...labOrderValFunc) error {
+	for _, fn := range fns {
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// labOrderMemory is a thread safe in-memory implementation of LabOrderDB.
+type labOrderMemory struct {
+	mu     sync.RWMutex
+	orders map[bson.ObjectId]LabOrder
+}
+
+var _ LabOrderDB = &labOrderMemory{}
+
+func newLabOrderMemory() *labOrderMemory {
+	return &labOrderMemory{
+		orders: make(map[bson.ObjectId]LabOrder),
+	}
+}
+
+func (om *labOrderMemory) ById(id string) (*LabOrder, error) {
+	om.mu.RLock()
+	defer om.mu.RUnlock()
+	o, ok := om.orders[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyLabOrder(&o)
+	return &found, nil
+}
+
+func (om *labOrderMemory) ByNumber(number string) (*LabOrder, error) {
+	om.mu.RLock()
+	defer om.mu.RUnlock()
+	for _, o := range om.orders {
+		if o.Number == number {
+			found := copyLabOrder(&o)
+			return &found, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+func (om *labOrderMemory) ByPatient(patientId string) ([]LabOrder, error) {
+	return om.filter(func(o *LabOrder) bool {
+		return o.PatientId.Hex() == patientId
+	}, true), nil
+}
+
+func (om *labOrderMemory) ByEncounter(encounterId string) ([]LabOrder, error) {
+	return om.filter(func(o *LabOrder) bool {
+		return o.EncounterId.Hex() == encounterId
+	}, true), nil
+}
+
+func (om *labOrderMemory) Pending() ([]LabOrder, error) {
+	return om.filter(func(o *LabOrder) bool {
+		return o.Status != LabOrderCompleted
+	}, false), nil
+}
+
+// filter returns copies of the orders matching the function, newest or oldest first.
+func (om *labOrderMemory) filter(match func(o *LabOrder) bool, newestFirst bool) []LabOrder {
+	om.mu.RLock()
+	defer om.mu.RUnlock()
+	var orders []LabOrder
+	for _, o := range om.orders {
+		if match(&o) {
+			orders = append(orders, copyLabOrder(&o))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if newestFirst {
+			return orders[i].Created.After(orders[j].Created)
+		}
+		return orders[i].Created.Before(orders[j].Created)
+	})
+	return orders
+}
+
+func (om *labOrderMemory) Create(order *LabOrder) error {
+	om.mu.Lock()
+	defer om.mu.Unlock()
+	order.Id = bson.NewObjectId()
+	om.orders[order.Id] = copyLabOrder(order)
+	return nil
+}
+
+func (om *labOrderMemory) SetStatus(id string, status LabOrderStatus, at time.Time) error {
+	om.mu.Lock()
+	defer om.mu.Unlock()
+	o, ok := om.orders[bson.ObjectIdHex(id)]
+	if !ok {
+		return MongoErrNotFound
+	}
+	o.Status = status
+	if status == LabOrderCompleted {
+		o.Completed = at
+	}
+	om.orders[o.Id] = o
+	return nil
+}
+
+// copyLabOrder returns a copy of the order which does not share its tests with the original.
+func copyLabOrder(order *LabOrder) LabOrder {
+	o := *order
+	o.Tests = append([]LabOrderTest(nil), order.Tests...)
+	return o
+}
+
+// labResultMemory is a thread safe in-memory implementation of LabResultDB.
+type labResultMemory struct {
+	mu      sync.RWMutex
+	results map[bson.ObjectId]LabResult
+}
+
+var _ LabResultDB = &labResultMemory{}
+
+func newLabResultMemory() *labResultMemory {
+	return &labResultMemory{
+		results: make(map[bson.ObjectId]LabResult),
+	}
+}
+
+func (rm *labResultMemory) ByPatient(patientId string) ([]LabResult, error) {
+	return rm.filter(func(r *LabResult) bool {
+		return r.PatientId.Hex() == patientId
+	}), nil
+}
+
+func (rm *labResultMemory) ByOrder(orderId string) ([]LabResult, error) {
+	return rm.filter(func(r *LabResult) bool {
+		return r.OrderId.Hex() == orderId
+	}), nil
+}
+
+// filter returns the results matching the function, oldest collected first.
+func (rm *labResultMemory) filter(match func(r *LabResult) bool) []LabResult {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	var results []LabResult
+	for _, r := range rm.results {
+		if match(&r) {
+			results = append(results, r)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Collected.Before(results[j].Collected)
+	})
+	return results
+}
+
+func (rm *labResultMemory) Create(result *LabResult) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	result.Id = bson.NewObjectId()
+	rm.results[result.Id] = *result
+	return nil
+}
@@ -0,0 +1,653 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const LabResultCollection = "lab_result"
+
+// LabFlag marks a result outside of its reference range.
+type LabFlag string
+
+const (
+	LabFlagLow  LabFlag = "low"
+	LabFlagHigh LabFlag = "high"
+)
+
+// LabResultSource is how a result got into the system.
+type LabResultSource string
+
+const (
+	LabResultEntered  LabResultSource = "entered"
+	LabResultImported LabResultSource = "imported"
+	// LabResultReceived results were sent by another system, like a lab analyzer, over the HL7 interface.
+	LabResultReceived LabResultSource = "received"
+)
+
+// LabResult is the value of one analyte measured in a sample of a patient. The unit and the reference range which
+// applied to the patient when the sample was collected are kept with the value.
+type LabResult struct {
+	Id        bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	// OrderId is empty for imported and received results which were not ordered in the clinic.
+	OrderId     bson.ObjectId `json:"order_id,omitempty" bson:"order_id,omitempty"`
+	TestCode    string        `json:"test_code" bson:"test_code"`
+	AnalyteCode string        `json:"analyte_code" bson:"analyte_code"`
+	Name        string        `json:"name" bson:"name"`
+	Value       float64       `json:"value" bson:"value"`
+	Unit        string        `json:"unit" bson:"unit"`
+	Low         *float64      `json:"low,omitempty" bson:"low,omitempty"`
+	High        *float64      `json:"high,omitempty" bson:"high,omitempty"`
+	// Flag is empty for results within the reference range, or without one.
+	Flag      LabFlag         `json:"flag,omitempty" bson:"flag,omitempty"`
+	Collected time.Time       `json:"collected" bson:"collected"`
+	Entered   time.Time       `json:"entered" bson:"entered"`
+	EnteredBy bson.ObjectId   `json:"entered_by" bson:"entered_by"`
+	Source    LabResultSource `json:"source" bson:"source"`
+}
+
+// ValueString returns the value without trailing zeros.
+func (r *LabResult) ValueString() string {
+	return formatValue(r.Value)
+}
+
+// Range returns the reference range like "12 - 15.5", or an empty string if there is none.
+func (r *LabResult) Range() string {
+	return formatRange(r.Low, r.High)
+}
+
+type LabResultDB interface {
+	// ByPatient and ByOrder return results oldest collected first.
+	ByPatient(patientId string) ([]LabResult, error)
+	ByOrder(orderId string) ([]LabResult, error)
+
+	Create(result *LabResult) error
+}
+
+type labResultValidator struct {
+	LabResultDB
+	patients PatientDB
+	tests    *LabTests
+	clock    Clock
+}
+
+var _ LabResultDB = &labResultValidator{}
+
+func (rv *labResultValidator) ByPatient(patientId string) ([]LabResult, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return rv.LabResultDB.ByPatient(patientId)
+}
+
+func (rv *labResultValidator) ByOrder(orderId string) ([]LabResult, error) {
+	if !bson.IsObjectIdHex(orderId) {
+		return nil, ErrIDInvalid
+	}
+	return rv.LabResultDB.ByOrder(orderId)
+}
+
+func (rv *labResultValidator) Create(result *LabResult) error {
+	if err := rv.validate(result); err != nil {
+		return err
+	}
+	return rv.LabResultDB.Create(result)
+}
+
+// validate is used on its own to check several results before any of them is saved.
+func (rv *labResultValidator) validate(result *LabResult) error {
+	return runLabResultValFuncs(result, rv.requireAnalyte, rv.collectedNotInFuture, rv.applyRange,
+		rv.ensureEnteredAt)
+}
+
+// requireAnalyte copies the name and the unit of the analyte. A unit given with the result must be the same.
+func (rv *labResultValidator) requireAnalyte(result *LabResult) error {
+	analyte := rv.tests.Analyte(result.AnalyteCode)
+	if analyte == nil {
+		return ErrLabAnalyteInvalid
+	}
+	if unit := strings.TrimSpace(result.Unit); unit != "" && !strings.EqualFold(unit, analyte.Unit) {
+		return ErrLabUnitMismatch
+	}
+	result.AnalyteCode = analyte.Code
+	result.TestCode = rv.tests.TestOf(analyte.Code).Code
+	result.Name = analyte.Name
+	result.Unit = analyte.Unit
+	return nil
+}
+
+func (rv *labResultValidator) collectedNotInFuture(result *LabResult) error {
+	now := rv.clock.Now()
+	if result.Collected.IsZero() {
+		result.Collected = now
+	}
+	if result.Collected.After(now) {
+		return ErrLabCollectedInvalid
+	}
+	return nil
+}
+
+// applyRange flags the result with the reference range for the sex of the patient and the age at collection.
+func (rv *labResultValidator) applyRange(result *LabResult) error {
+	if result.PatientId == "" {
+		return ErrPatientRequired
+	}
+	patient, err := rv.patients.ById(result.PatientId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPatientRequired
+		}
+		return err
+	}
+	result.Low, result.High, result.Flag = nil, nil, ""
+	rr := rv.tests.Analyte(result.AnalyteCode).Range(patient.Sex, patient.AgeMonths(result.Collected))
+	if rr == nil {
+		return nil
+	}
+	result.Low, result.High = rr.Low, rr.High
+	switch {
+	case rr.Low != nil && result.Value < *rr.Low:
+		result.Flag = LabFlagLow
+	case rr.High != nil && result.Value > *rr.High:
+		result.Flag = LabFlagHigh
+	}
+	return nil
+}
+
+func (rv *labResultValidator) ensureEnteredAt(result *LabResult) error {
+	result.Entered = rv.clock.Now()
+	return nil
+}
+
+// LabImport reports on a CSV file of results.
+type LabImport struct {
+	Imported int
+	// Duplicates counts results which were imported before and were skipped.
+	Duplicates int
+	// Errors are the lines which were not imported. All other lines are.
+	Errors []LabImportError
+}
+
+type LabImportError struct {
+	Line int
+	Err  error
+}
+
+// Message returns the error as shown to users.
+func (e *LabImportError) Message() string {
+	if me, ok := e.Err.(modelError); ok {
+		return me.Public()
+	}
+	return e.Err.Error()
+}
+
+// labImportColumns are the columns of a CSV file of results. Order and unit are optional.
+var labImportColumns = []string{"mrn", "order", "analyte", "value", "unit", "collected"}
+
+// labImportTimeFormats are the accepted formats of the time of collection, in local time.
+var labImportTimeFormats = []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+// LabService orders lab tests and keeps their results. Reference ranges are applied when a result is saved.
+type LabService interface {
+	// Tests returns the lab tests which can be ordered.
+	Tests() *LabTests
+	// Results returns the results of the patient, oldest collected first.
+	Results(patientId string) ([]LabResult, error)
+	// OrderResults returns the results of the order, oldest collected first.
+	OrderResults(orderId string) ([]LabResult, error)
+	// RecordResults saves the results of the order entered by the user, nothing is saved if one is invalid.
+	// The order is completed once every analyte of its tests has a result.
+	RecordResults(order *LabOrder, results []LabResult, by *User) error
+	// Import saves the results of a CSV file with a header line naming the columns mrn, analyte, value and
+	// collected, and optionally order and unit. Results already imported are skipped.
+	Import(r io.Reader, by *User) (*LabImport, error)
+	// Receive saves the results sent by another system for the patient with the medical record number, and the
+	// order with the number if it is not empty. Nothing is saved if one is invalid. Results received or imported
+	// before are skipped, so that the results can be sent again.
+	Receive(mrn, orderNumber string, results []LabResult) (*LabImport, error)
+	LabOrderDB
+}
+
+type labService struct {
+	LabOrderDB
+	results  *labResultValidator
+	patients PatientDB
+	tests    *LabTests
+	clock    Clock
+	logger   *logrus.Entry
+}
+
+func NewLabService(mgo *mgo.Session, users UserDB, encounters EncounterDB, patients PatientDB, tests *LabTests,
+	counters CounterDB, logger *logrus.Entry, dbname string) LabService {
+	om := &labOrderMongo{mgo, dbname, logger}
+	rm := &labResultMongo{mgo, dbname, logger}
+	return newLabService(om, rm, users, encounters, patients, tests, counters, logger)
+}
+
+// NewInMemoryLabService returns a LabService backed by in-memory order and result stores.
+func NewInMemoryLabService(users UserDB, encounters EncounterDB, patients PatientDB, tests *LabTests,
+	counters CounterDB, logger *logrus.Entry) LabService {
+	return newLabService(newLabOrderMemory(), newLabResultMemory(), users, encounters, patients, tests, counters,
+		logger)
+}
+
+func newLabService(odb LabOrderDB, rdb LabResultDB, users UserDB, encounters EncounterDB, patients PatientDB,
+	tests *LabTests, counters CounterDB, logger *logrus.Entry) LabService {
+	return &labService{
+		LabOrderDB: &labOrderValidator{
+			LabOrderDB: odb,
+			users:      users,
+			encounters: encounters,
+			tests:      tests,
+			counters:   counters,
+			clock:      SystemClock(),
+		},
+		results: &labResultValidator{
+			LabResultDB: rdb,
+			patients:    patients,
+			tests:       tests,
+			clock:       SystemClock(),
+		},
+		patients: patients,
+		tests:    tests,
+		clock:    SystemClock(),
+		logger:   logger,
+	}
+}
+
+func (ls *labService) Tests() *LabTests {
+	return ls.tests
+}
+
+func (ls *labService) Results(patientId string) ([]LabResult, error) {
+	return ls.results.ByPatient(patientId)
+}
+
+func (ls *labService) OrderResults(orderId string) ([]LabResult, error) {
+	return ls.results.ByOrder(orderId)
+}
+
+func (ls *labService) RecordResults(order *LabOrder, results []LabResult, by *User) error {
+	if len(results) == 0 {
+		return ErrLabResultsEmpty
+	}
+	existing, err := ls.results.ByOrder(order.Id.Hex())
+	if err != nil {
+		return err
+	}
+	resulted := make(map[string]bool)
+	for _, r := range existing {
+		resulted[r.AnalyteCode] = true
+	}
+	for i := range results {
+		r := &results[i]
+		test := ls.tests.TestOf(r.AnalyteCode)
+		if test == nil {
+			return ErrLabAnalyteInvalid
+		}
+		if !order.Includes(test.Code) {
+			return ErrLabAnalyteNotOrdered
+		}
+		r.PatientId = order.PatientId
+		r.OrderId = order.Id
+		r.EnteredBy = by.Id
+		r.Source = LabResultEntered
+		if err := ls.results.validate(r); err != nil {
+			return err
+		}
+		if resulted[r.AnalyteCode] {
+			return ErrLabAnalyteResulted
+		}
+		resulted[r.AnalyteCode] = true
+	}
+	for i := range results {
+		if err := ls.results.LabResultDB.Create(&results[i]); err != nil {
+			return err
+		}
+	}
+	ls.logger.Infof("%d results of lab order %s entered by %s", len(results), order.Number, by.Username)
+	return ls.updateStatus(order)
+}
+
+// updateStatus sets the status of the order from the analytes which have a result.
+func (ls *labService) updateStatus(order *LabOrder) error {
+	results, err := ls.results.ByOrder(order.Id.Hex())
+	if err != nil {
+		return err
+	}
+	resulted := make(map[string]bool)
+	for _, r := range results {
+		resulted[r.AnalyteCode] = true
+	}
+	status := LabOrderCompleted
+	for _, a := range ls.tests.Ordered(order) {
+		if !resulted[a.Code] {
+			status = LabOrderInProgress
+			break
+		}
+	}
+	if len(results) == 0 {
+		status = LabOrderOrdered
+	}
+	if status == order.Status {
+		return nil
+	}
+	now := ls.clock.Now()
+	if err := ls.SetStatus(order.Id.Hex(), status, now); err != nil {
+		return err
+	}
+	order.Status = status
+	if status == LabOrderCompleted {
+		order.Completed = now
+	}
+	return nil
+}
+
+func (ls *labService) Import(r io.Reader, by *User) (*LabImport, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrLabImportColumns
+		}
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"mrn", "analyte", "value", "collected"} {
+		if _, ok := columns[name]; !ok {
+			return nil, ErrLabImportColumns
+		}
+	}
+	// The values of missing optional columns are read as empty.
+	reader.FieldsPerRecord = -1
+	imp := newLabImporter(ls, by)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, err
+			}
+			imp.fail(line, err)
+			continue
+		}
+		values := make(map[string]string)
+		for _, name := range labImportColumns {
+			if i, ok := columns[name]; ok && i < len(record) {
+				values[name] = strings.TrimSpace(record[i])
+			}
+		}
+		if err := imp.importRow(values); err != nil {
+			if _, ok := err.(modelError); !ok {
+				return nil, err
+			}
+			imp.fail(line, err)
+		}
+	}
+	for _, order := range imp.orders {
+		if err := ls.updateStatus(order); err != nil {
+			return nil, err
+		}
+	}
+	ls.logger.Infof("%d lab results imported by %s, %d duplicates skipped, %d lines with errors",
+		imp.Imported, by.Username, imp.Duplicates, len(imp.Errors))
+	return imp.LabImport, nil
+}
+
+func (ls *labService) Receive(mrn, orderNumber string, results []LabResult) (*LabImport, error) {
+	if len(results) == 0 {
+		return nil, ErrLabResultsEmpty
+	}
+	imp := newLabImporter(ls, nil)
+	patient, err := imp.patient(mrn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		r := &results[i]
+		r.PatientId = patient.Id
+		r.Source = LabResultReceived
+		if err := imp.attachOrder(r, patient, orderNumber); err != nil {
+			return nil, err
+		}
+		if err := ls.results.validate(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := imp.loadResults(patient); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if err := imp.save(&results[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, order := range imp.orders {
+		if err := ls.updateStatus(order); err != nil {
+			return nil, err
+		}
+	}
+	ls.logger.Infof("%d lab results of %s received, %d duplicates skipped", imp.Imported, patient.MRN,
+		imp.Duplicates)
+	return imp.LabImport, nil
+}
+
+// labImporter keeps the patients and orders of an import, and the results already known, across its lines.
+type labImporter struct {
+	*LabImport
+	service *labService
+	// by is nil for results received from other systems.
+	by       *User
+	patients map[string]*Patient
+	orders   map[string]*LabOrder
+	// seen holds the keys of the results of the patients in loaded, and of the results imported.
+	seen   map[string]bool
+	loaded map[bson.ObjectId]bool
+}
+
+func newLabImporter(ls *labService, by *User) *labImporter {
+	return &labImporter{
+		LabImport: &LabImport{},
+		service:   ls,
+		by:        by,
+		patients:  make(map[string]*Patient),
+		orders:    make(map[string]*LabOrder),
+		seen:      make(map[string]bool),
+		loaded:    make(map[bson.ObjectId]bool),
+	}
+}
+
+func (imp *labImporter) fail(line int, err error) {
+	imp.Errors = append(imp.Errors, LabImportError{Line: line, Err: err})
+}
+
+// importRow saves the result of a line. Errors which are not a modelError stop the import.
+func (imp *labImporter) importRow(values map[string]string) error {
+	patient, err := imp.patient(values["mrn"])
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseFloat(values["value"], 64)
+	if err != nil {
+		return ErrLabValueInvalid
+	}
+	collected, err := parseCollected(values["collected"])
+	if err != nil {
+		return err
+	}
+	result := LabResult{
+		PatientId:   patient.Id,
+		AnalyteCode: values["analyte"],
+		Value:       value,
+		Unit:        values["unit"],
+		Collected:   collected,
+		EnteredBy:   imp.by.Id,
+		Source:      LabResultImported,
+	}
+	if err := imp.attachOrder(&result, patient, values["order"]); err != nil {
+		return err
+	}
+	if err := imp.service.results.validate(&result); err != nil {
+		return err
+	}
+	if err := imp.loadResults(patient); err != nil {
+		return err
+	}
+	return imp.save(&result)
+}
+
+// attachOrder adds the result to the order of the patient with the number, if the number is not empty.
+func (imp *labImporter) attachOrder(result *LabResult, patient *Patient, number string) error {
+	if number == "" {
+		return nil
+	}
+	order, err := imp.order(number)
+	if err != nil {
+		return err
+	}
+	if order.PatientId != patient.Id {
+		return ErrLabOrderPatient
+	}
+	if test := imp.service.tests.TestOf(result.AnalyteCode); test != nil && !order.Includes(test.Code) {
+		return ErrLabAnalyteNotOrdered
+	}
+	result.OrderId = order.Id
+	return nil
+}
+
+// save creates the validated result, unless it is known already. The results of its patient must be loaded.
+func (imp *labImporter) save(result *LabResult) error {
+	key := labResultKey(result)
+	if imp.seen[key] {
+		imp.Duplicates++
+		return nil
+	}
+	if err := imp.service.results.LabResultDB.Create(result); err != nil {
+		return err
+	}
+	imp.seen[key] = true
+	imp.Imported++
+	return nil
+}
+
+func (imp *labImporter) patient(mrn string) (*Patient, error) {
+	mrn = strings.ToUpper(mrn)
+	if p, ok := imp.patients[mrn]; ok {
+		return p, nil
+	}
+	if mrn == "" {
+		return nil, ErrMRNRequired
+	}
+	p, err := imp.service.patients.ByMRN(mrn)
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return nil, ErrLabPatientUnknown
+		}
+		return nil, err
+	}
+	imp.patients[mrn] = p
+	return p, nil
+}
+
+func (imp *labImporter) order(number string) (*LabOrder, error) {
+	number = strings.ToUpper(number)
+	if o, ok := imp.orders[number]; ok {
+		return o, nil
+	}
+	o, err := imp.service.ByNumber(number)
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return nil, ErrLabOrderPatient
+		}
+		return nil, err
+	}
+	imp.orders[number] = o
+	return o, nil
+}
+
+// loadResults marks the results the patient already has as seen, once per import.
+func (imp *labImporter) loadResults(patient *Patient) error {
+	if imp.loaded[patient.Id] {
+		return nil
+	}
+	results, err := imp.service.results.ByPatient(patient.Id.Hex())
+	if err != nil {
+		return err
+	}
+	for i := range results {
+		imp.seen[labResultKey(&results[i])] = true
+	}
+	imp.loaded[patient.Id] = true
+	return nil
+}
+
+// labResultKey identifies a result by patient, analyte and time of collection.
+func labResultKey(r *LabResult) string {
+	return fmt.Sprintf("%s/%s/%d", r.PatientId.Hex(), r.AnalyteCode, r.Collected.Unix())
+}
+
+func parseCollected(value string) (time.Time, error) {
+	for _, format := range labImportTimeFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrLabCollectedFormat
+}
+
+type labResultMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ LabResultDB = &labResultMongo{}
+
+func (rm *labResultMongo) ByPatient(patientId string) ([]LabResult, error) {
+	return rm.find(bson.M{"patient_id": bson.ObjectIdHex(patientId)})
+}
+
+func (rm *labResultMongo) ByOrder(orderId string) ([]LabResult, error) {
+	return rm.find(bson.M{"order_id": bson.ObjectIdHex(orderId)})
+}
+
+func (rm *labResultMongo) find(query bson.M) ([]LabResult, error) {
+	ses := rm.mgo.Copy()
+	defer ses.Close()
+	var results []LabResult
+	err := ses.DB(rm.dbname).C(LabResultCollection).Find(query).Sort("collected").All(&results)
+	return results, err
+}
+
+func (rm *labResultMongo) Create(result *LabResult) error {
+	ses := rm.mgo.Copy()
+	defer ses.Close()
+	result.Id = bson.NewObjectId()
+	return ses.DB(rm.dbname).C(LabResultCollection).Insert(result)
+}
+
+type labResultValFunc func(result *LabResult) error
+
+func runLabResultValFuncs(result *LabResult, fns ...labResultValFunc) error {
+	for _, fn := range fns {
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultLabTestsFile lists the lab tests shipped with the system, relative to the directory the server runs in.
+const DefaultLabTestsFile = "core/data/lab_tests.json"
+
+// ReferenceRange is the normal range of an analyte for patients of a sex and an age band.
+type ReferenceRange struct {
+	// Sex is empty for ranges which apply to patients of any sex.
+	Sex Sex `json:"sex,omitempty"`
+	// MinAgeMonths and MaxAgeMonths bound the age of the patient, the maximum is exclusive.
+	// A maximum of zero has no upper bound.
+	MinAgeMonths int `json:"min_age_months,omitempty"`
+	MaxAgeMonths int `json:"max_age_months,omitempty"`
+	// Low and High are nil for ranges bounded on one side only.
+	Low  *float64 `json:"low,omitempty"`
+	High *float64 `json:"high,omitempty"`
+}
+
+// matches reports whether the range applies to patients of the sex and age.
+func (rr *ReferenceRange) matches(sex Sex, ageMonths int) bool {
+	if rr.Sex != "" && rr.Sex != sex {
+		return false
+	}
+	if ageMonths < rr.MinAgeMonths {
+		return false
+	}
+	return rr.MaxAgeMonths == 0 || ageMonths < rr.MaxAgeMonths
+}
+
+// LabAnalyte is a value measured by a lab test, like haemoglobin in a complete blood count.
+type LabAnalyte struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+	// Ranges are tried in order, the first one matching the patient applies.
+	Ranges []ReferenceRange `json:"ranges"`
+}
+
+// Range returns the reference range for patients of the sex and age, or nil if there is none.
+func (a *LabAnalyte) Range(sex Sex, ageMonths int) *ReferenceRange {
+	for i := range a.Ranges {
+		if a.Ranges[i].matches(sex, ageMonths) {
+			return &a.Ranges[i]
+		}
+	}
+	return nil
+}
+
+// LabTest is a test which can be ordered, with the analytes it reports.
+type LabTest struct {
+	Code     string       `json:"code"`
+	Name     string       `json:"name"`
+	Analytes []LabAnalyte `json:"analytes"`
+}
+
+// LabTests are the lab tests offered by the clinic, loaded from a JSON file.
+type LabTests struct {
+	tests    []LabTest
+	analytes map[string]*LabAnalyte
+	// testOf maps the code of every analyte to the code of its test.
+	testOf map[string]string
+}
+
+type labTestsFile struct {
+	Tests []LabTest `json:"tests"`
+}
+
+// LoadLabTests reads the lab tests from the JSON file. Codes are not case sensitive, and the code of every analyte
+// must be unique across all tests so that results can be imported by analyte.
+func LoadLabTests(file string) (*LabTests, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var content labTestsFile
+	if err := json.NewDecoder(f).Decode(&content); err != nil {
+		return nil, fmt.Errorf("models: reading lab tests from %s: %v", file, err)
+	}
+	return newLabTests(content.Tests)
+}
+
+func newLabTests(tests []LabTest) (*LabTests, error) {
+	lt := &LabTests{
+		analytes: make(map[string]*LabAnalyte),
+		testOf:   make(map[string]string),
+	}
+	codes := make(map[string]bool)
+	for _, t := range tests {
+		t.Code = strings.ToUpper(strings.TrimSpace(t.Code))
+		if t.Code == "" || codes[t.Code] {
+			return nil, fmt.Errorf("models: lab test code %q is empty or not unique", t.Code)
+		}
+		codes[t.Code] = true
+		t.Analytes = append([]LabAnalyte(nil), t.Analytes...)
+		for i := range t.Analytes {
+			a := &t.Analytes[i]
+			a.Code = strings.ToUpper(strings.TrimSpace(a.Code))
+			if a.Code == "" || lt.analytes[a.Code] != nil {
+				return nil, fmt.Errorf("models: analyte code %q of lab test %s is empty or not unique", a.Code, t.Code)
+			}
+			lt.analytes[a.Code] = a
+			lt.testOf[a.Code] = t.Code
+		}
+		lt.tests = append(lt.tests, t)
+	}
+	return lt, nil
+}
+
+// All returns the lab tests in the order of the file.
+func (lt *LabTests) All() []LabTest {
+	return lt.tests
+}
+
+// Test returns the lab test with the code, or nil.
+func (lt *LabTests) Test(code string) *LabTest {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for i := range lt.tests {
+		if lt.tests[i].Code == code {
+			return &lt.tests[i]
+		}
+	}
+	return nil
+}
+
+// Analyte returns the analyte with the code, or nil.
+func (lt *LabTests) Analyte(code string) *LabAnalyte {
+	return lt.analytes[strings.ToUpper(strings.TrimSpace(code))]
+}
+
+// TestOf returns the lab test which reports the analyte with the code, or nil.
+func (lt *LabTests) TestOf(analyteCode string) *LabTest {
+	return lt.Test(lt.testOf[strings.ToUpper(strings.TrimSpace(analyteCode))])
+}
+
+// Ordered returns the analytes of the tests of the order.
+func (lt *LabTests) Ordered(order *LabOrder) []LabAnalyte {
+	var analytes []LabAnalyte
+	for _, t := range order.Tests {
+		if test := lt.Test(t.Code); test != nil {
+			analytes = append(analytes, test.Analytes...)
+		}
+	}
+	return analytes
+}
+
+// formatRange returns a reference range like "12 - 15.5", "< 5.7" or "> 40".
+func formatRange(low, high *float64) string {
+	switch {
+	case low != nil && high != nil:
+		return formatValue(*low) + " - " + formatValue(*high)
+	case high != nil:
+		return "< " + formatValue(*high)
+	case low != nil:
+		return "> " + formatValue(*low)
+	}
+	return ""
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in paise, the hundredth part of a rupee, so that sums of amounts are exact.
+type Money int64
+
+// String formats the amount with two decimals, like 1250.50.
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, int64(m)/100, int64(m)%100)
+}
+
+// Percent returns the percentage of the amount, rounded to the nearest paisa.
+func (m Money) Percent(rate float64) Money {
+	return Money(math.Round(float64(m) * rate / 100))
+}
+
+// ParseMoney parses an amount of rupees with at most two decimals, like 250 or 250.50.
+// Thousands separators are ignored, an empty string is zero.
+func ParseMoney(s string) (Money, error) {
+	s = strings.Replace(strings.TrimSpace(s), ",", "", -1)
+	if s == "" {
+		return 0, nil
+	}
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	if len(fraction) > 2 || (whole == "" && fraction == "") {
+		return 0, ErrAmountInvalid
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	rupees, err := strconv.ParseUint(whole, 10, 32)
+	if err != nil {
+		return 0, ErrAmountInvalid
+	}
+	paise, err := strconv.ParseUint(fraction, 10, 8)
+	if err != nil {
+		return 0, ErrAmountInvalid
+	}
+	m := Money(rupees*100 + paise)
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultBannedPasswordsFile is the list of common passwords shipped with the system,
+// relative to the directory the server is started from.
+const DefaultBannedPasswordsFile = "core/data/banned_passwords.txt"
+
+// PasswordPolicy configures the rules a new password has to satisfy.
+type PasswordPolicy struct {
+	MinLength     int  `json:"min_length"`
+	RequireLower  bool `json:"require_lower"`
+	RequireUpper  bool `json:"require_upper"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+	// RejectPersonalInfo rejects passwords containing the username or a part of the name of the user.
+	RejectPersonalInfo bool `json:"reject_personal_info"`
+	// BannedPasswordsFile lists passwords which may not be used, one per line. Leave empty to allow all.
+	BannedPasswordsFile string `json:"banned_passwords_file"`
+	// HistorySize is the number of previous passwords of a user which can not be used again.
+	HistorySize int `json:"history_size"`
+
+	banned map[string]bool
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:           8,
+		RequireLower:        true,
+		RequireUpper:        true,
+		RequireDigit:        true,
+		RequireSymbol:       false,
+		RejectPersonalInfo:  true,
+		BannedPasswordsFile: DefaultBannedPasswordsFile,
+		HistorySize:         5,
+	}
+}
+
+// Load reads the banned passwords file of the policy.
+func (p PasswordPolicy) Load() (PasswordPolicy, error) {
+	if p.MinLength <= 0 {
+		p.MinLength = DefaultPasswordPolicy().MinLength
+	}
+	p.banned = map[string]bool{}
+	if p.BannedPasswordsFile == "" {
+		return p, nil
+	}
+	f, err := os.Open(p.BannedPasswordsFile)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.banned[strings.ToLower(line)] = true
+	}
+	return p, scanner.Err()
+}
+
+// Banned reports whether the password is on the banned passwords list, ignoring case.
+func (p PasswordPolicy) Banned(password string) bool {
+	return p.banned[strings.ToLower(password)]
+}
+
+func errPasswordTooShort(min int) modelError {
+	return modelError(fmt.Sprintf("models: password must be at least %d characters long", min))
+}
+
+func (uv *userValidator) passwordMinLength(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	if len([]rune(user.Password)) < uv.passwords.MinLength {
+		return errPasswordTooShort(uv.passwords.MinLength)
+	}
+	return nil
+}
+
+func (uv *userValidator) passwordCharClasses(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	var lower, upper, digit, symbol bool
+	for _, r := range user.Password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	switch {
+	case uv.passwords.RequireLower && !lower:
+		return ErrPasswordNoLower
+	case uv.passwords.RequireUpper && !upper:
+		return ErrPasswordNoUpper
+	case uv.passwords.RequireDigit && !digit:
+		return ErrPasswordNoDigit
+	case uv.passwords.RequireSymbol && !symbol:
+		return ErrPasswordNoSymbol
+	}
+	return nil
+}
+
+// passwordNoPersonalInfo rejects passwords containing the username,
+// or a word of the name with at least 3 letters.
+func (uv *userValidator) passwordNoPersonalInfo(user *User) error {
+	if user.Password == "" || !uv.passwords.RejectPersonalInfo {
+		return nil
+	}
+	password := strings.ToLower(user.Password)
+	parts := strings.Fields(strings.ToLower(user.Name))
+	parts = append(parts, strings.ToLower(user.Username))
+	for _, part := range parts {
+		if len([]rune(part)) >= 3 && strings.Contains(password, part) {
+			return ErrPasswordPersonalInfo
+		}
+	}
+	return nil
+}
+
+func (uv *userValidator) passwordNotBanned(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	if uv.passwords.Banned(user.Password) {
+		return ErrPasswordBanned
+	}
+	return nil
+}
+
+// passwordNotReused rejects the current password and the passwords kept in the history of the user.
+func (uv *userValidator) passwordNotReused(user *User) error {
+	if user.Password == "" || uv.passwords.HistorySize <= 0 {
+		return nil
+	}
+	hashes := append([]string{user.PasswordHash}, user.PasswordHistory...)
+	for _, h := range hashes {
+		if h != "" && uv.passwordMatches(h, user.Password) {
+			return ErrPasswordReused
+		}
+	}
+	return nil
+}
+
+// rememberPassword adds the current password hash to the history before it is replaced,
+// keeping at most HistorySize hashes.
+func (uv *userValidator) rememberPassword(user *User) error {
+	if user.Password == "" || user.PasswordHash == "" {
+		return nil
+	}
+	if uv.passwords.HistorySize <= 0 {
+		user.PasswordHistory = nil
+		return nil
+	}
+	history := append([]string{user.PasswordHash}, user.PasswordHistory...)
+	if len(history) > uv.passwords.HistorySize {
+		history = history[:uv.passwords.HistorySize]
+	}
+	user.PasswordHistory = history
+	return nil
+}
+
+func (uv *userValidator) passwordMatches(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password+uv.pepper)) == nil
+}
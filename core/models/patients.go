@@ -0,0 +1,638 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	PatientCollection = "patient"
+
+	// MRNPrefix starts every medical record number assigned by the system, followed by a sequential number.
+	MRNPrefix = "GC"
+	// mrnCounter is the name of the counter the sequential part of medical record numbers is taken from.
+	mrnCounter = "patient_mrn"
+
+	// AdultAge is the age from which a patient does not need a guardian.
+	AdultAge = 18
+
+	// DefaultPatientSearchLimit is the number of patients returned by a search if no limit is given.
+	DefaultPatientSearchLimit = 50
+	// DefaultPatientPageSize is the number of patients on a page of filtered patients if no page size is given.
+	DefaultPatientPageSize = 20
+)
+
+type Sex string
+
+const (
+	SexMale    Sex = "male"
+	SexFemale  Sex = "female"
+	SexOther   Sex = "other"
+	SexUnknown Sex = "unknown"
+)
+
+func SexList() []Sex {
+	return []Sex{SexMale, SexFemale, SexOther, SexUnknown}
+}
+
+// IdentifierSystem is the issuer of an identifier of a patient.
+type IdentifierSystem string
+
+const (
+	IdentifierAadhaar   IdentifierSystem = "aadhaar"
+	IdentifierPassport  IdentifierSystem = "passport"
+	IdentifierInsurance IdentifierSystem = "insurance"
+	IdentifierOther     IdentifierSystem = "other"
+)
+
+// IdentifierMRN selects the medical record number in a PatientFilter. It is not one of the identifier systems of
+// patients, as the medical record number is kept apart from their other identifiers.
+const IdentifierMRN IdentifierSystem = "mrn"
+
+func IdentifierSystemsList() []IdentifierSystem {
+	return []IdentifierSystem{IdentifierAadhaar, IdentifierPassport, IdentifierInsurance, IdentifierOther}
+}
+
+// Identifier is a number issued to the patient outside of the clinic, like a national id or an insurance policy number.
+type Identifier struct {
+	System IdentifierSystem `json:"system" bson:"system"`
+	Value  string           `json:"value" bson:"value"`
+}
+
+// RelatedPerson is someone responsible for, or to be contacted about, a patient.
+type RelatedPerson struct {
+	Name         string  `json:"name,omitempty" bson:"name,omitempty"`
+	Relationship string  `json:"relationship,omitempty" bson:"relationship,omitempty"`
+	Contact      Contact `json:"contact,omitempty" bson:"contact,omitempty"`
+}
+
+// Empty reports whether no details of the person are known.
+func (p RelatedPerson) Empty() bool {
+	return p.Name == "" && p.Relationship == "" && p.Contact == Contact{}
+}
+
+type Patient struct {
+	Id bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	// MRN is the medical record number, assigned on registration unless one is given.
+	MRN         string    `json:"mrn" bson:"mrn"`
+	FirstName   string    `json:"first_name" bson:"first_name"`
+	LastName    string    `json:"last_name,omitempty" bson:"last_name,omitempty"`
+	DateOfBirth time.Time `json:"date_of_birth" bson:"date_of_birth"`
+	Sex         Sex       `json:"sex" bson:"sex"`
+	BloodGroup  string    `json:"blood_group,omitempty" bson:"blood_group,omitempty"`
+	Occupation  string    `json:"occupation,omitempty" bson:"occupation,omitempty"`
+	Contact     Contact   `json:"contact,omitempty" bson:"contact,omitempty"`
+	Addresses   []Address `json:"addresses,omitempty" bson:"addresses,omitempty"`
+	// Guardian is required for patients younger than AdultAge.
+	Guardian         RelatedPerson `json:"guardian,omitempty" bson:"guardian,omitempty"`
+	EmergencyContact RelatedPerson `json:"emergency_contact,omitempty" bson:"emergency_contact,omitempty"`
+	Identifiers      []Identifier  `json:"identifiers,omitempty" bson:"identifiers,omitempty"`
+	Notes            string        `json:"notes,omitempty" bson:"notes,omitempty"`
+	Created          time.Time     `json:"created" bson:"created"`
+	Updated          time.Time     `json:"updated,omitempty" bson:"updated,omitempty"`
+	// RegisteredBy is the user who registered the patient.
+	RegisteredBy bson.ObjectId `json:"registered_by,omitempty" bson:"registered_by,omitempty"`
+}
+
+func (p *Patient) FullName() string {
+	return strings.TrimSpace(p.FirstName + " " + p.LastName)
+}
+
+// Age returns the age of the patient in completed years at the time t.
+func (p *Patient) Age(t time.Time) int {
+	if p.DateOfBirth.IsZero() {
+		return 0
+	}
+	years := t.Year() - p.DateOfBirth.Year()
+	// Month and day are compared rather than the day of the year, which differs by one after February 28th in
+	// leap years.
+	if t.Month() < p.DateOfBirth.Month() || t.Month() == p.DateOfBirth.Month() && t.Day() < p.DateOfBirth.Day() {
+		years--
+	}
+	return years
+}
+
+// AgeMonths returns the age of the patient in completed months at the time t.
+func (p *Patient) AgeMonths(t time.Time) int {
+	if p.DateOfBirth.IsZero() {
+		return 0
+	}
+	months := (t.Year()-p.DateOfBirth.Year())*12 + int(t.Month()-p.DateOfBirth.Month())
+	if t.Day() < p.DateOfBirth.Day() {
+		months--
+	}
+	return months
+}
+
+// CurrentAge returns the age of the patient today.
+func (p *Patient) CurrentAge() int {
+	return p.Age(time.Now())
+}
+
+// Minor reports whether the patient is younger than AdultAge at the time t.
+func (p *Patient) Minor(t time.Time) bool {
+	return p.Age(t) < AdultAge
+}
+
+// Address returns the first address of the type, or nil if the patient has none.
+func (p *Patient) Address(addressType AddressType) *Address {
+	for i := range p.Addresses {
+		if p.Addresses[i].AddressType == addressType {
+			return &p.Addresses[i]
+		}
+	}
+	return nil
+}
+
+// Identifier returns the value of the identifier issued by the system, or an empty string.
+func (p *Patient) Identifier(system IdentifierSystem) string {
+	for _, id := range p.Identifiers {
+		if id.System == system {
+			return id.Value
+		}
+	}
+	return ""
+}
+
+// PatientFilter selects patients. Empty fields match all patients.
+type PatientFilter struct {
+	Id bson.ObjectId
+	// Identifier matches the medical record number or an identifier of the patients. An empty system matches any of
+	// them, IdentifierMRN only the medical record number.
+	Identifier Identifier
+	// Name matches patients with a first or last name, or a word of them, starting with it, ignoring case.
+	Name string
+	// BornFrom and BornTo limit the date of birth, BornTo excluded.
+	BornFrom time.Time
+	BornTo   time.Time
+	// Page starts at 1.
+	Page    int
+	PerPage int
+}
+
+func (f PatientFilter) withDefaults() PatientFilter {
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage < 1 {
+		f.PerPage = DefaultPatientPageSize
+	}
+	f.Identifier.Value = strings.TrimSpace(f.Identifier.Value)
+	f.Name = strings.TrimSpace(f.Name)
+	return f
+}
+
+// NameStartsWith reports whether the name, or a word of it, starts with the prefix, ignoring case.
+func NameStartsWith(name, prefix string) bool {
+	prefix = strings.ToLower(prefix)
+	name = strings.ToLower(name)
+	for i := 0; i < len(name); i++ {
+		if (i == 0 || name[i-1] == ' ') && strings.HasPrefix(name[i:], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type PatientDB interface {
+	// Single patient fetch methods
+	ById(id string) (*Patient, error)
+	ByMRN(mrn string) (*Patient, error)
+
+	// Search returns up to limit patients whose name, medical record number, phone number or identifier
+	// contains the query, ignoring case. An empty query returns the most recently registered patients.
+	Search(query string, limit int) ([]Patient, error)
+	// BornSince returns the patients born on or after the day, youngest first.
+	BornSince(day time.Time) ([]Patient, error)
+	// Find returns the page of patients matching the filter, in the order they were registered, and the number of
+	// all matching patients.
+	Find(filter PatientFilter) ([]Patient, int, error)
+
+	// Data modifying methods
+	Create(patient *Patient) error
+	Update(patient *Patient) error
+	Delete(id string) error
+}
+
+type patientValidator struct {
+	PatientDB
+	counters   CounterDB
+	emailRegex *regexp.Regexp
+	clock      Clock
+	logger     *logrus.Entry
+}
+
+var _ PatientDB = &patientValidator{}
+
+func newPatientValidator(pdb PatientDB, counters CounterDB, logger *logrus.Entry) *patientValidator {
+	return &patientValidator{
+		PatientDB:  pdb,
+		counters:   counters,
+		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		clock:      SystemClock(),
+		logger:     logger,
+	}
+}
+
+func (pv *patientValidator) Create(patient *Patient) error {
+	if err := runPatientValFuncs(patient, pv.trimNames, pv.requireFirstName, pv.requireDateOfBirth, pv.requireSex,
+		pv.normalizeEmails, pv.emailFormat, pv.normalizeIdentifiers, pv.requireGuardianForMinor, pv.normalizeMRN,
+		pv.assignMRN, pv.mrnIsAvailable, pv.ensureCreatedAt); err != nil {
+		return err
+	}
+	return pv.PatientDB.Create(patient)
+}
+
+func (pv *patientValidator) Update(patient *Patient) error {
+	if err := runPatientValFuncs(patient, pv.trimNames, pv.requireFirstName, pv.requireDateOfBirth, pv.requireSex,
+		pv.normalizeEmails, pv.emailFormat, pv.normalizeIdentifiers, pv.requireGuardianForMinor, pv.normalizeMRN,
+		pv.requireMRN, pv.mrnIsAvailable, pv.ensureUpdatedAt); err != nil {
+		return err
+	}
+	return pv.PatientDB.Update(patient)
+}
+
+func (pv *patientValidator) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return pv.PatientDB.Delete(id)
+}
+
+func (pv *patientValidator) ById(id string) (*Patient, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return pv.PatientDB.ById(id)
+}
+
+func (pv *patientValidator) ByMRN(mrn string) (*Patient, error) {
+	patient := Patient{MRN: mrn}
+	if err := runPatientValFuncs(&patient, pv.normalizeMRN, pv.requireMRN); err != nil {
+		return nil, err
+	}
+	return pv.PatientDB.ByMRN(patient.MRN)
+}
+
+func (pv *patientValidator) Search(query string, limit int) ([]Patient, error) {
+	if limit < 1 {
+		limit = DefaultPatientSearchLimit
+	}
+	return pv.PatientDB.Search(strings.TrimSpace(query), limit)
+}
+
+func (pv *patientValidator) Find(filter PatientFilter) ([]Patient, int, error) {
+	return pv.PatientDB.Find(filter.withDefaults())
+}
+
+func (pv *patientValidator) trimNames(patient *Patient) error {
+	patient.FirstName = strings.TrimSpace(patient.FirstName)
+	patient.LastName = strings.TrimSpace(patient.LastName)
+	patient.Guardian.Name = strings.TrimSpace(patient.Guardian.Name)
+	patient.EmergencyContact.Name = strings.TrimSpace(patient.EmergencyContact.Name)
+	return nil
+}
+
+func (pv *patientValidator) requireFirstName(patient *Patient) error {
+	if patient.FirstName == "" {
+		return ErrPatientNameRequired
+	}
+	return nil
+}
+
+func (pv *patientValidator) requireDateOfBirth(patient *Patient) error {
+	if patient.DateOfBirth.IsZero() {
+		return ErrDateOfBirthRequired
+	}
+	if patient.DateOfBirth.After(pv.clock.Now()) {
+		return ErrDateOfBirthInvalid
+	}
+	return nil
+}
+
+func (pv *patientValidator) requireSex(patient *Patient) error {
+	if patient.Sex == "" {
+		return ErrSexRequired
+	}
+	for _, s := range SexList() {
+		if s == patient.Sex {
+			return nil
+		}
+	}
+	return ErrSexInvalid
+}
+
+func (pv *patientValidator) normalizeEmails(patient *Patient) error {
+	for _, c := range []*Contact{&patient.Contact, &patient.Guardian.Contact, &patient.EmergencyContact.Contact} {
+		c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	}
+	return nil
+}
+
+func (pv *patientValidator) emailFormat(patient *Patient) error {
+	for _, c := range []Contact{patient.Contact, patient.Guardian.Contact, patient.EmergencyContact.Contact} {
+		if c.Email != "" && !pv.emailRegex.MatchString(c.Email) {
+			return ErrEmailInvalid
+		}
+	}
+	return nil
+}
+
+// normalizeIdentifiers drops identifiers without a value, so that forms can offer empty rows.
+func (pv *patientValidator) normalizeIdentifiers(patient *Patient) error {
+	identifiers := make([]Identifier, 0, len(patient.Identifiers))
+	for _, id := range patient.Identifiers {
+		id.Value = strings.TrimSpace(id.Value)
+		if id.Value == "" {
+			continue
+		}
+		if !identifierSystemExists(id.System) {
+			return ErrIdentifierSystemInvalid
+		}
+		identifiers = append(identifiers, id)
+	}
+	patient.Identifiers = identifiers
+	return nil
+}
+
+func (pv *patientValidator) requireGuardianForMinor(patient *Patient) error {
+	if patient.Minor(pv.clock.Now()) && patient.Guardian.Name == "" {
+		return ErrGuardianRequired
+	}
+	return nil
+}
+
+func (pv *patientValidator) normalizeMRN(patient *Patient) error {
+	patient.MRN = strings.ToUpper(strings.TrimSpace(patient.MRN))
+	return nil
+}
+
+func (pv *patientValidator) requireMRN(patient *Patient) error {
+	if patient.MRN == "" {
+		return ErrMRNRequired
+	}
+	return nil
+}
+
+// assignMRN takes the next medical record number from the counter if the patient does not have one yet.
+func (pv *patientValidator) assignMRN(patient *Patient) error {
+	if patient.MRN != "" {
+		return nil
+	}
+	n, err := pv.counters.Next(mrnCounter)
+	if err != nil {
+		return err
+	}
+	patient.MRN = fmt.Sprintf("%s%06d", MRNPrefix, n)
+	return nil
+}
+
+func (pv *patientValidator) mrnIsAvailable(patient *Patient) error {
+	existing, err := pv.PatientDB.ByMRN(patient.MRN)
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if patient.Id != existing.Id {
+		return ErrMRNTaken
+	}
+	return nil
+}
+
+func (pv *patientValidator) ensureCreatedAt(patient *Patient) error {
+	if patient.Created.IsZero() {
+		patient.Created = pv.clock.Now()
+	}
+	return nil
+}
+
+func (pv *patientValidator) ensureUpdatedAt(patient *Patient) error {
+	patient.Updated = pv.clock.Now()
+	return nil
+}
+
+func identifierSystemExists(system IdentifierSystem) bool {
+	for _, s := range IdentifierSystemsList() {
+		if s == system {
+			return true
+		}
+	}
+	return false
+}
+
+// PatientRecordsFunc reports whether records of one kind, like encounters, refer to the patient with the id.
+type PatientRecordsFunc func(patientId string) (bool, error)
+
+type PatientService interface {
+	// KeepRecords registers records which refer to patients. Delete fails with ErrPatientHasRecords for patients
+	// with any of them, so that the records are not left without their patient.
+	KeepRecords(kind string, has PatientRecordsFunc)
+	PatientDB
+}
+
+type patientService struct {
+	PatientDB
+	records []patientRecords
+	logger  *logrus.Entry
+}
+
+type patientRecords struct {
+	kind string
+	has  PatientRecordsFunc
+}
+
+func (ps *patientService) KeepRecords(kind string, has PatientRecordsFunc) {
+	ps.records = append(ps.records, patientRecords{kind: kind, has: has})
+}
+
+func (ps *patientService) Delete(id string) error {
+	for _, records := range ps.records {
+		has, err := records.has(id)
+		if err != nil {
+			return err
+		}
+		if has {
+			ps.logger.Infof("Patient %s not deleted, the patient has %s", id, records.kind)
+			return ErrPatientHasRecords
+		}
+	}
+	return ps.PatientDB.Delete(id)
+}
+
+func NewPatientService(mgo *mgo.Session, counters CounterDB, logger *logrus.Entry, dbname string) PatientService {
+	pm := &patientMongo{mgo, dbname, logger}
+	return newPatientService(pm, counters, logger)
+}
+
+// NewInMemoryPatientService returns a PatientService backed by an in-memory PatientDB.
+func NewInMemoryPatientService(counters CounterDB, logger *logrus.Entry) PatientService {
+	return newPatientService(newPatientMemory(), counters, logger)
+}
+
+func newPatientService(pdb PatientDB, counters CounterDB, logger *logrus.Entry) PatientService {
+	return &patientService{
+		PatientDB: newPatientValidator(pdb, counters, logger),
+		logger:    logger,
+	}
+}
+
+type patientMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ PatientDB = &patientMongo{}
+
+func (pm *patientMongo) Create(patient *Patient) error {
+	pm.logger.Infoln("creating patient with MRN: ", patient.MRN)
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	if patient.Id == "" {
+		patient.Id = bson.NewObjectId()
+	}
+	return mrnError(ses.DB(pm.dbname).C(PatientCollection).Insert(patient))
+}
+
+func (pm *patientMongo) Update(patient *Patient) error {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	return mrnError(ses.DB(pm.dbname).C(PatientCollection).UpdateId(patient.Id, patient))
+}
+
+// EnsurePatientIndexes creates the unique index on the medical record number. mrnIsAvailable only checks before
+// saving, the index keeps two patients saved at the same time from getting the same number.
+func EnsurePatientIndexes(session *mgo.Session, dbname string) error {
+	ses := session.Copy()
+	defer ses.Close()
+	return ses.DB(dbname).C(PatientCollection).EnsureIndex(mgo.Index{Key: []string{"mrn"}, Unique: true})
+}
+
+// mrnError returns ErrMRNTaken for errors of the unique index on the medical record number.
+func mrnError(err error) error {
+	if mgo.IsDup(err) {
+		return ErrMRNTaken
+	}
+	return err
+}
+
+func (pm *patientMongo) Delete(id string) error {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(pm.dbname).C(PatientCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+func (pm *patientMongo) ById(id string) (*Patient, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	p := Patient{}
+	err := ses.DB(pm.dbname).C(PatientCollection).FindId(bson.ObjectIdHex(id)).One(&p)
+	return &p, err
+}
+
+func (pm *patientMongo) ByMRN(mrn string) (*Patient, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	p := Patient{}
+	err := ses.DB(pm.dbname).C(PatientCollection).Find(bson.M{"mrn": mrn}).One(&p)
+	return &p, err
+}
+
+func (pm *patientMongo) Search(query string, limit int) ([]Patient, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	filter := bson.M{}
+	if query != "" {
+		pattern := bson.RegEx{Pattern: regexp.QuoteMeta(query), Options: "i"}
+		filter["$or"] = []bson.M{
+			{"first_name": pattern},
+			{"last_name": pattern},
+			{"mrn": pattern},
+			{"contact.mobile_phone": pattern},
+			{"contact.home_phone": pattern},
+			{"identifiers.value": pattern},
+		}
+	}
+	var patients []Patient
+	err := ses.DB(pm.dbname).C(PatientCollection).Find(filter).Sort("-created").Limit(limit).All(&patients)
+	return patients, err
+}
+
+func (pm *patientMongo) BornSince(day time.Time) ([]Patient, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	var patients []Patient
+	query := bson.M{"date_of_birth": bson.M{"$gte": day}}
+	err := ses.DB(pm.dbname).C(PatientCollection).Find(query).Sort("-date_of_birth").All(&patients)
+	return patients, err
+}
+
+func (pm *patientMongo) Find(filter PatientFilter) ([]Patient, int, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	var and []bson.M
+	if filter.Id != "" {
+		and = append(and, bson.M{"_id": filter.Id})
+	}
+	if value := filter.Identifier.Value; value != "" {
+		switch filter.Identifier.System {
+		case "":
+			and = append(and, bson.M{"$or": []bson.M{
+				{"mrn": strings.ToUpper(value)},
+				{"identifiers.value": value},
+			}})
+		case IdentifierMRN:
+			and = append(and, bson.M{"mrn": strings.ToUpper(value)})
+		default:
+			and = append(and, bson.M{"identifiers": bson.M{"$elemMatch": bson.M{
+				"system": filter.Identifier.System,
+				"value":  value,
+			}}})
+		}
+	}
+	if filter.Name != "" {
+		pattern := bson.RegEx{Pattern: `(^|\s)` + regexp.QuoteMeta(filter.Name), Options: "i"}
+		and = append(and, bson.M{"$or": []bson.M{{"first_name": pattern}, {"last_name": pattern}}})
+	}
+	if !filter.BornFrom.IsZero() || !filter.BornTo.IsZero() {
+		span := bson.M{}
+		if !filter.BornFrom.IsZero() {
+			span["$gte"] = filter.BornFrom
+		}
+		if !filter.BornTo.IsZero() {
+			span["$lt"] = filter.BornTo
+		}
+		and = append(and, bson.M{"date_of_birth": span})
+	}
+	query := bson.M{}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	q := ses.DB(pm.dbname).C(PatientCollection).Find(query)
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	var patients []Patient
+	err = q.Sort("_id").Skip((filter.Page - 1) * filter.PerPage).Limit(filter.PerPage).All(&patients)
+	return patients, total, err
+}
+
+type patientValFunc func(patient *Patient) error
+
+func runPatientValFuncs(patient *Patient, fns ...patientValFunc) error {
+	for _, fn := range fns {
+		if err := fn(patient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// patientMemory is a thread safe in-memory implementation of PatientDB.
+type patientMemory struct {
+	mu       sync.RWMutex
+	patients map[bson.ObjectId]Patient
+}
+
+var _ PatientDB = &patientMemory{}
+
+func newPatientMemory() *patientMemory {
+	return &patientMemory{
+		patients: make(map[bson.ObjectId]Patient),
+	}
+}
+
+func (pm *patientMemory) Create(patient *Patient) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if patient.Id == "" {
+		patient.Id = bson.NewObjectId()
+	}
+	if _, ok := pm.patients[patient.Id]; ok {
+		return ErrIDInvalid
+	}
+	if pm.mrnTaken(patient) {
+		return ErrMRNTaken
+	}
+	pm.patients[patient.Id] = copyPatient(patient)
+	return nil
+}
+
+func (pm *patientMemory) Update(patient *Patient) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if _, ok := pm.patients[patient.Id]; !ok {
+		return MongoErrNotFound
+	}
+	if pm.mrnTaken(patient) {
+		return ErrMRNTaken
+	}
+	pm.patients[patient.Id] = copyPatient(patient)
+	return nil
+}
+
+func (pm *patientMemory) Delete(id string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	if _, ok := pm.patients[oid]; !ok {
+		return MongoErrNotFound
+	}
+	delete(pm.patients, oid)
+	return nil
+}
+
+func (pm *patientMemory) ById(id string) (*Patient, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	p, ok := pm.patients[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyPatient(&p)
+	return &found, nil
+}
+
+func (pm *patientMemory) ByMRN(mrn string) (*Patient, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	for _, p := range pm.patients {
+		if p.MRN == mrn {
+			found := copyPatient(&p)
+			return &found, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+func (pm *patientMemory) Search(query string, limit int) ([]Patient, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	query = strings.ToLower(query)
+	var patients []Patient
+	for _, p := range pm.patients {
+		if query == "" || patientMatches(&p, query) {
+			patients = append(patients, copyPatient(&p))
+		}
+	}
+	sort.Slice(patients, func(i, j int) bool {
+		return patients[i].Created.After(patients[j].Created)
+	})
+	if len(patients) > limit {
+		patients = patients[:limit]
+	}
+	return patients, nil
+}
+
+func (pm *patientMemory) BornSince(day time.Time) ([]Patient, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	var patients []Patient
+	for _, p := range pm.patients {
+		if !p.DateOfBirth.Before(day) {
+			patients = append(patients, copyPatient(&p))
+		}
+	}
+	sort.Slice(patients, func(i, j int) bool {
+		return patients[i].DateOfBirth.After(patients[j].DateOfBirth)
+	})
+	return patients, nil
+}
+
+// patientMatches reports whether one of the searched fields of the patient contains the lower case query.
+func patientMatches(p *Patient, query string) bool {
+	fields := []string{p.FirstName, p.LastName, p.MRN, p.Contact.MobilePhone, p.Contact.HomePhone}
+	for _, id := range p.Identifiers {
+		fields = append(fields, id.Value)
+	}
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), query) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pm *patientMemory) Find(filter PatientFilter) ([]Patient, int, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	var matching []Patient
+	for _, p := range pm.patients {
+		if patientMatchesFilter(&p, filter) {
+			matching = append(matching, p)
+		}
+	}
+	// Object ids start with the time they were made, so this is the order the patients were registered in.
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Id < matching[j].Id
+	})
+	total := len(matching)
+	start := (filter.Page - 1) * filter.PerPage
+	if start >= total {
+		return nil, total, nil
+	}
+	end := start + filter.PerPage
+	if end > total {
+		end = total
+	}
+	patients := make([]Patient, 0, end-start)
+	for i := start; i < end; i++ {
+		patients = append(patients, copyPatient(&matching[i]))
+	}
+	return patients, total, nil
+}
+
+func patientMatchesFilter(p *Patient, filter PatientFilter) bool {
+	if filter.Id != "" && p.Id != filter.Id {
+		return false
+	}
+	if value := filter.Identifier.Value; value != "" {
+		found := false
+		if filter.Identifier.System == "" || filter.Identifier.System == IdentifierMRN {
+			found = p.MRN == strings.ToUpper(value)
+		}
+		for _, id := range p.Identifiers {
+			if filter.Identifier.System != IdentifierMRN && id.Value == value &&
+				(filter.Identifier.System == "" || filter.Identifier.System == id.System) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Name != "" && !NameStartsWith(p.FirstName, filter.Name) && !NameStartsWith(p.LastName, filter.Name) {
+		return false
+	}
+	if !filter.BornFrom.IsZero() && p.DateOfBirth.Before(filter.BornFrom) {
+		return false
+	}
+	if !filter.BornTo.IsZero() && !p.DateOfBirth.Before(filter.BornTo) {
+		return false
+	}
+	return true
+}
+
+// mrnTaken must be called with the lock held.
+func (pm *patientMemory) mrnTaken(patient *Patient) bool {
+	for id, p := range pm.patients {
+		if p.MRN == patient.MRN && id != patient.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// copyPatient returns a copy of the patient which does not share any slices with the original.
+func copyPatient(patient *Patient) Patient {
+	p := *patient
+	p.Addresses = append([]Address(nil), patient.Addresses...)
+	p.Identifiers = append([]Identifier(nil), patient.Identifiers...)
+	return p
+}
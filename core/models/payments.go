@@ -0,0 +1,158 @@
+package models
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	PaymentCollection = "payment"
+
+	// ReceiptPrefix starts every receipt number, followed by a sequential number.
+	ReceiptPrefix = "RCP"
+	// receiptCounter is the name of the counter the sequential part of receipt numbers is taken from.
+	receiptCounter = "receipt_number"
+)
+
+type PaymentMethod string
+
+const (
+	PaymentCash PaymentMethod = "cash"
+	PaymentCard PaymentMethod = "card"
+	PaymentUPI  PaymentMethod = "upi"
+)
+
+func PaymentMethodsList() []PaymentMethod {
+	return []PaymentMethod{PaymentCash, PaymentCard, PaymentUPI}
+}
+
+func paymentMethodExists(method PaymentMethod) bool {
+	for _, m := range PaymentMethodsList() {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Payment is an amount received for an invoice. An invoice can be paid in several payments.
+type Payment struct {
+	Id            bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	ReceiptNumber string        `json:"receipt_number" bson:"receipt_number"`
+	InvoiceId     bson.ObjectId `json:"invoice_id" bson:"invoice_id"`
+	PatientId     bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	Amount        Money         `json:"amount" bson:"amount"`
+	Method        PaymentMethod `json:"method" bson:"method"`
+	// Reference is the approval code of a card payment or the transaction id of a UPI payment.
+	Reference  string        `json:"reference,omitempty" bson:"reference,omitempty"`
+	Received   time.Time     `json:"received" bson:"received"`
+	ReceivedBy bson.ObjectId `json:"received_by,omitempty" bson:"received_by,omitempty"`
+}
+
+// CashReport sums up the payments received on a day, for closing the cash register.
+type CashReport struct {
+	Day time.Time
+	// Payments are ordered by the time they were received.
+	Payments []Payment
+	// Methods has a line for every payment method, also for methods without payments.
+	Methods []CashReportLine
+	Total   Money
+}
+
+type CashReportLine struct {
+	Method PaymentMethod
+	Count  int
+	Total  Money
+}
+
+func newCashReport(day time.Time, payments []Payment) *CashReport {
+	report := CashReport{Day: day, Payments: payments}
+	for _, method := range PaymentMethodsList() {
+		line := CashReportLine{Method: method}
+		for _, p := range payments {
+			if p.Method == method {
+				line.Count++
+				line.Total += p.Amount
+			}
+		}
+		report.Methods = append(report.Methods, line)
+		report.Total += line.Total
+	}
+	return &report
+}
+
+type PaymentDB interface {
+	ById(id string) (*Payment, error)
+	// ByInvoice and ByDay return payments oldest first.
+	ByInvoice(invoiceId string) ([]Payment, error)
+	// ByDay returns the payments received on the day of date.
+	ByDay(date time.Time) ([]Payment, error)
+
+	Create(payment *Payment) error
+}
+
+type paymentValidator struct {
+	PaymentDB
+}
+
+var _ PaymentDB = &paymentValidator{}
+
+func (pv *paymentValidator) ById(id string) (*Payment, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return pv.PaymentDB.ById(id)
+}
+
+func (pv *paymentValidator) ByInvoice(invoiceId string) ([]Payment, error) {
+	if !bson.IsObjectIdHex(invoiceId) {
+		return nil, ErrIDInvalid
+	}
+	return pv.PaymentDB.ByInvoice(invoiceId)
+}
+
+func (pv *paymentValidator) ByDay(date time.Time) ([]Payment, error) {
+	return pv.PaymentDB.ByDay(StartOfDay(date))
+}
+
+type paymentMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ PaymentDB = &paymentMongo{}
+
+func (pm *paymentMongo) ById(id string) (*Payment, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	p := Payment{}
+	err := ses.DB(pm.dbname).C(PaymentCollection).FindId(bson.ObjectIdHex(id)).One(&p)
+	return &p, err
+}
+
+func (pm *paymentMongo) ByInvoice(invoiceId string) ([]Payment, error) {
+	return pm.find(bson.M{"invoice_id": bson.ObjectIdHex(invoiceId)})
+}
+
+func (pm *paymentMongo) ByDay(date time.Time) ([]Payment, error) {
+	return pm.find(bson.M{"received": bson.M{"$gte": date, "$lt": date.AddDate(0, 0, 1)}})
+}
+
+func (pm *paymentMongo) find(query bson.M) ([]Payment, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	var payments []Payment
+	err := ses.DB(pm.dbname).C(PaymentCollection).Find(query).Sort("received").All(&payments)
+	return payments, err
+}
+
+func (pm *paymentMongo) Create(payment *Payment) error {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	payment.Id = bson.NewObjectId()
+	return ses.DB(pm.dbname).C(PaymentCollection).Insert(payment)
+}
@@ -0,0 +1,294 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const PrescriptionCollection = "prescription"
+
+// Route is how a medication is administered.
+type Route string
+
+const (
+	RouteOral          Route = "oral"
+	RouteSublingual    Route = "sublingual"
+	RouteTopical       Route = "topical"
+	RouteInhaled       Route = "inhaled"
+	RouteIntravenous   Route = "intravenous"
+	RouteIntramuscular Route = "intramuscular"
+	RouteSubcutaneous  Route = "subcutaneous"
+	RouteRectal        Route = "rectal"
+	RouteOphthalmic    Route = "ophthalmic"
+	RouteOtic          Route = "otic"
+	RouteNasal         Route = "nasal"
+)
+
+func RoutesList() []Route {
+	return []Route{RouteOral, RouteSublingual, RouteTopical, RouteInhaled, RouteIntravenous, RouteIntramuscular,
+		RouteSubcutaneous, RouteRectal, RouteOphthalmic, RouteOtic, RouteNasal}
+}
+
+// Medication is one line of a prescription.
+type Medication struct {
+	Name      string `json:"name" bson:"name"`
+	Dose      string `json:"dose" bson:"dose"`
+	Route     Route  `json:"route" bson:"route"`
+	Frequency string `json:"frequency" bson:"frequency"`
+	Duration  string `json:"duration,omitempty" bson:"duration,omitempty"`
+	// Quantity is the number of units to dispense, zero if not stated.
+	Quantity     int    `json:"quantity,omitempty" bson:"quantity,omitempty"`
+	Instructions string `json:"instructions,omitempty" bson:"instructions,omitempty"`
+}
+
+// Empty reports whether the line was left blank.
+func (m *Medication) Empty() bool {
+	return m.Name == "" && m.Dose == "" && m.Frequency == "" && m.Duration == "" && m.Quantity == 0 &&
+		m.Instructions == ""
+}
+
+// Prescription is a list of medications prescribed during an encounter. Prescriptions are not changed once written,
+// a renewal is a new prescription.
+type Prescription struct {
+	Id          bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	EncounterId bson.ObjectId `json:"encounter_id" bson:"encounter_id"`
+	PatientId   bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	PhysicianId bson.ObjectId `json:"physician_id" bson:"physician_id"`
+	Medications []Medication  `json:"medications" bson:"medications"`
+	Notes       string        `json:"notes,omitempty" bson:"notes,omitempty"`
+	// RenewedFrom is the prescription this one renews.
+	RenewedFrom bson.ObjectId `json:"renewed_from,omitempty" bson:"renewed_from,omitempty"`
+	Created     time.Time     `json:"created" bson:"created"`
+}
+
+type PrescriptionDB interface {
+	ById(id string) (*Prescription, error)
+	// ByEncounter and ByPatient return prescriptions newest first.
+	ByEncounter(encounterId string) ([]Prescription, error)
+	ByPatient(patientId string) ([]Prescription, error)
+
+	Create(prescription *Prescription) error
+}
+
+type prescriptionValidator struct {
+	PrescriptionDB
+	users      UserDB
+	encounters EncounterDB
+	clock      Clock
+}
+
+var _ PrescriptionDB = &prescriptionValidator{}
+
+func (pv *prescriptionValidator) ById(id string) (*Prescription, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return pv.PrescriptionDB.ById(id)
+}
+
+func (pv *prescriptionValidator) ByEncounter(encounterId string) ([]Prescription, error) {
+	if !bson.IsObjectIdHex(encounterId) {
+		return nil, ErrIDInvalid
+	}
+	return pv.PrescriptionDB.ByEncounter(encounterId)
+}
+
+func (pv *prescriptionValidator) ByPatient(patientId string) ([]Prescription, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return pv.PrescriptionDB.ByPatient(patientId)
+}
+
+func (pv *prescriptionValidator) Create(prescription *Prescription) error {
+	if err := runPrescriptionValFuncs(prescription, pv.requireEncounter, pv.requirePhysician,
+		pv.normalizeMedications, pv.ensureCreatedAt); err != nil {
+		return err
+	}
+	return pv.PrescriptionDB.Create(prescription)
+}
+
+// requireEncounter also sets the patient of the prescription to the patient of the encounter.
+func (pv *prescriptionValidator) requireEncounter(prescription *Prescription) error {
+	if prescription.EncounterId == "" {
+		return ErrEncounterRequired
+	}
+	encounter, err := pv.encounters.ById(prescription.EncounterId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrEncounterRequired
+		}
+		return err
+	}
+	prescription.PatientId = encounter.PatientId
+	return nil
+}
+
+func (pv *prescriptionValidator) requirePhysician(prescription *Prescription) error {
+	if prescription.PhysicianId == "" {
+		return ErrPrescriberNotPhysician
+	}
+	physician, err := pv.users.ById(prescription.PhysicianId.Hex())
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPrescriberNotPhysician
+		}
+		return err
+	}
+	if !physician.HasRole(UserRolePhysician) || physician.Disabled {
+		return ErrPrescriberNotPhysician
+	}
+	return nil
+}
+
+// normalizeMedications drops empty lines, so that forms can offer empty rows.
+func (pv *prescriptionValidator) normalizeMedications(prescription *Prescription) error {
+	medications := make([]Medication, 0, len(prescription.Medications))
+	for _, m := range prescription.Medications {
+		m.Name = strings.TrimSpace(m.Name)
+		m.Dose = strings.TrimSpace(m.Dose)
+		m.Frequency = strings.TrimSpace(m.Frequency)
+		m.Duration = strings.TrimSpace(m.Duration)
+		m.Instructions = strings.TrimSpace(m.Instructions)
+		if m.Empty() {
+			continue
+		}
+		if m.Name == "" || m.Dose == "" || m.Frequency == "" {
+			return ErrMedicationIncomplete
+		}
+		if m.Route == "" {
+			m.Route = RouteOral
+		}
+		if !routeExists(m.Route) {
+			return ErrMedicationRouteInvalid
+		}
+		if m.Quantity < 0 {
+			return ErrMedicationQuantity
+		}
+		medications = append(medications, m)
+	}
+	if len(medications) == 0 {
+		return ErrPrescriptionEmpty
+	}
+	prescription.Medications = medications
+	prescription.Notes = strings.TrimSpace(prescription.Notes)
+	return nil
+}
+
+func (pv *prescriptionValidator) ensureCreatedAt(prescription *Prescription) error {
+	prescription.Created = pv.clock.Now()
+	return nil
+}
+
+func routeExists(route Route) bool {
+	for _, r := range RoutesList() {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+type PrescriptionService interface {
+	// Renew writes a new prescription with the medications of the prescription, prescribed by the physician.
+	Renew(prescription *Prescription, physician *User) (*Prescription, error)
+	PrescriptionDB
+}
+
+type prescriptionService struct {
+	PrescriptionDB
+	logger *logrus.Entry
+}
+
+func NewPrescriptionService(mgo *mgo.Session, users UserDB, encounters EncounterDB, logger *logrus.Entry,
+	dbname string) PrescriptionService {
+	pm := &prescriptionMongo{mgo, dbname, logger}
+	return newPrescriptionService(pm, users, encounters, logger)
+}
+
+// NewInMemoryPrescriptionService returns a PrescriptionService backed by an in-memory PrescriptionDB.
+func NewInMemoryPrescriptionService(users UserDB, encounters EncounterDB, logger *logrus.Entry) PrescriptionService {
+	return newPrescriptionService(newPrescriptionMemory(), users, encounters, logger)
+}
+
+func newPrescriptionService(pdb PrescriptionDB, users UserDB, encounters EncounterDB,
+	logger *logrus.Entry) PrescriptionService {
+	return &prescriptionService{
+		PrescriptionDB: &prescriptionValidator{
+			PrescriptionDB: pdb,
+			users:          users,
+			encounters:     encounters,
+			clock:          SystemClock(),
+		},
+		logger: logger,
+	}
+}
+
+func (ps *prescriptionService) Renew(prescription *Prescription, physician *User) (*Prescription, error) {
+	renewal := Prescription{
+		EncounterId: prescription.EncounterId,
+		PhysicianId: physician.Id,
+		Medications: append([]Medication(nil), prescription.Medications...),
+		Notes:       prescription.Notes,
+		RenewedFrom: prescription.Id,
+	}
+	if err := ps.Create(&renewal); err != nil {
+		return nil, err
+	}
+	ps.logger.Infof("Prescription %s renewed as %s by %s", prescription.Id.Hex(), renewal.Id.Hex(), physician.Username)
+	return &renewal, nil
+}
+
+type prescriptionMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ PrescriptionDB = &prescriptionMongo{}
+
+func (pm *prescriptionMongo) ById(id string) (*Prescription, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	p := Prescription{}
+	err := ses.DB(pm.dbname).C(PrescriptionCollection).FindId(bson.ObjectIdHex(id)).One(&p)
+	return &p, err
+}
+
+func (pm *prescriptionMongo) ByEncounter(encounterId string) ([]Prescription, error) {
+	return pm.find(bson.M{"encounter_id": bson.ObjectIdHex(encounterId)})
+}
+
+func (pm *prescriptionMongo) ByPatient(patientId string) ([]Prescription, error) {
+	return pm.find(bson.M{"patient_id": bson.ObjectIdHex(patientId)})
+}
+
+func (pm *prescriptionMongo) find(query bson.M) ([]Prescription, error) {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	var prescriptions []Prescription
+	err := ses.DB(pm.dbname).C(PrescriptionCollection).Find(query).Sort("-created").All(&prescriptions)
+	return prescriptions, err
+}
+
+func (pm *prescriptionMongo) Create(prescription *Prescription) error {
+	ses := pm.mgo.Copy()
+	defer ses.Close()
+	prescription.Id = bson.NewObjectId()
+	return ses.DB(pm.dbname).C(PrescriptionCollection).Insert(prescription)
+}
+
+type prescriptionValFunc func(prescription *Prescription) error
+
+func runPrescriptionValFuncs(prescription *Prescription, fns ...prescriptionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(prescription); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// prescriptionMemory is a thread safe in-memory implementation of PrescriptionDB.
+type prescriptionMemory struct {
+	mu            sync.RWMutex
+	prescriptions map[bson.ObjectId]Prescription
+}
+
+var _ PrescriptionDB = &prescriptionMemory{}
+
+func newPrescriptionMemory() *prescriptionMemory {
+	return &prescriptionMemory{
+		prescriptions: make(map[bson.ObjectId]Prescription),
+	}
+}
+
+func (pm *prescriptionMemory) ById(id string) (*Prescription, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	p, ok := pm.prescriptions[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyPrescription(&p)
+	return &found, nil
+}
+
+func (pm *prescriptionMemory) ByEncounter(encounterId string) ([]Prescription, error) {
+	return pm.filter(func(p *Prescription) bool {
+		return p.EncounterId.Hex() == encounterId
+	}), nil
+}
+
+func (pm *prescriptionMemory) ByPatient(patientId string) ([]Prescription, error) {
+	return pm.filter(func(p *Prescription) bool {
+		return p.PatientId.Hex() == patientId
+	}), nil
+}
+
+// filter returns copies of the prescriptions matching the function, newest first.
+func (pm *prescriptionMemory) filter(match func(p *Prescription) bool) []Prescription {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	var prescriptions []Prescription
+	for _, p := range pm.prescriptions {
+		if match(&p) {
+			prescriptions = append(prescriptions, copyPrescription(&p))
+		}
+	}
+	sort.Slice(prescriptions, func(i, j int) bool {
+		return prescriptions[i].Created.After(prescriptions[j].Created)
+	})
+	return prescriptions
+}
+
+func (pm *prescriptionMemory) Create(prescription *Prescription) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	prescription.Id = bson.NewObjectId()
+	pm.prescriptions[prescription.Id] = copyPrescription(prescription)
+	return nil
+}
+
+// copyPrescription returns a copy of the prescription which does not share its medications with the original.
+func copyPrescription(prescription *Prescription) Prescription {
+	p := *prescription
+	p.Medications = append([]Medication(nil), prescription.Medications...)
+	return p
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const QueueCollection = "queue_entry"
+
+type QueueStatus string
+
+const (
+	QueueWaiting        QueueStatus = "waiting"
+	QueueCalled         QueueStatus = "called"
+	QueueInConsultation QueueStatus = "in_consultation"
+	QueueDone           QueueStatus = "done"
+)
+
+// queueTransitions are the states a queue entry can change to from each state.
+// A called patient who does not come can be sent back to waiting.
+var queueTransitions = map[QueueStatus][]QueueStatus{
+	QueueWaiting:        {QueueCalled, QueueDone},
+	QueueCalled:         {QueueWaiting, QueueInConsultation, QueueDone},
+	QueueInConsultation: {QueueDone},
+}
+
+// CanChangeTo reports whether an entry in the state can change to the other state.
+func (s QueueStatus) CanChangeTo(to QueueStatus) bool {
+	for _, next := range queueTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// QueueEntry is a walk-in patient in the queue of a physician on one day.
+type QueueEntry struct {
+	Id          bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PhysicianId bson.ObjectId `json:"physician_id" bson:"physician_id"`
+	PatientId   bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	// Date is midnight of the day of the queue.
+	Date time.Time `json:"date" bson:"date"`
+	// Token is the number called out in the waiting room, starting at 1 per physician and day.
+	Token       int64         `json:"token" bson:"token"`
+	Status      QueueStatus   `json:"status" bson:"status"`
+	CheckedIn   time.Time     `json:"checked_in" bson:"checked_in"`
+	CheckedInBy bson.ObjectId `json:"checked_in_by,omitempty" bson:"checked_in_by,omitempty"`
+	// Updated is the time of the last change of the status.
+	Updated time.Time `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+// Active reports whether the patient is still in the queue.
+func (e *QueueEntry) Active() bool {
+	return e.Status != QueueDone
+}
+
+type QueueDB interface {
+	ById(id string) (*QueueEntry, error)
+	// Day returns the queue of the physician on the day of date, ordered by token.
+	Day(physicianId string, date time.Time) ([]QueueEntry, error)
+	// Today returns the queues of all physicians on the day of date, ordered by token.
+	Today(date time.Time) ([]QueueEntry, error)
+	// ByPatient returns the entries of the patient on all days, oldest day first.
+	ByPatient(patientId string) ([]QueueEntry, error)
+
+	Create(entry *QueueEntry) error
+	// SetStatus changes the status of the entry from one state to another at the time.
+	// It fails with ErrQueueStatusChanged if the entry is not in the state from anymore.
+	SetStatus(id string, from, to QueueStatus, at time.Time) error
+}
+
+type queueValidator struct {
+	QueueDB
+}
+
+var _ QueueDB = &queueValidator{}
+
+func (qv *queueValidator) ById(id string) (*QueueEntry, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return qv.QueueDB.ById(id)
+}
+
+func (qv *queueValidator) Day(physicianId string, date time.Time) ([]QueueEntry, error) {
+	if !bson.IsObjectIdHex(physicianId) {
+		return nil, ErrIDInvalid
+	}
+	return qv.QueueDB.Day(physicianId, StartOfDay(date))
+}
+
+func (qv *queueValidator) Today(date time.Time) ([]QueueEntry, error) {
+	return qv.QueueDB.Today(StartOfDay(date))
+}
+
+func (qv *queueValidator) ByPatient(patientId string) ([]QueueEntry, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return qv.QueueDB.ByPatient(patientId)
+}
+
+func (qv *queueValidator) SetStatus(id string, from, to QueueStatus, at time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	if !from.CanChangeTo(to) {
+		return ErrQueueStatusInvalid
+	}
+	return qv.QueueDB.SetStatus(id, from, to, at)
+}
+
+// QueueService runs the walk-in queues of the physicians. Tokens come from a CounterDB, so that receptionists
+// checking in patients at the same time never hand out the same token.
+type QueueService interface {
+	// CheckIn adds the patient to today's queue of the physician with the next token.
+	CheckIn(physicianId, patientId string, by *User) (*QueueEntry, error)
+	// CallNext calls the waiting patient with the lowest token of today's queue of the physician.
+	CallNext(physicianId string) (*QueueEntry, error)
+	// Advance changes the status of the entry.
+	Advance(entry *QueueEntry, to QueueStatus) error
+	QueueDB
+}
+
+type queueService struct {
+	QueueDB
+	users    UserDB
+	patients PatientDB
+	counters CounterDB
+	clock    Clock
+	logger   *logrus.Entry
+}
+
+func NewQueueService(mgo *mgo.Session, users UserDB, patients PatientDB, counters CounterDB, logger *logrus.Entry,
+	dbname string) QueueService {
+	qm := &queueMongo{mgo, dbname, logger}
+	return newQueueService(qm, users, patients, counters, logger)
+}
+
+// NewInMemoryQueueService returns a QueueService backed by an in-memory QueueDB.
+func NewInMemoryQueueService(users UserDB, patients PatientDB, counters CounterDB, logger *logrus.Entry) QueueService {
+	return newQueueService(newQueueMemory(), users, patients, counters, logger)
+}
+
+func newQueueService(qdb QueueDB, users UserDB, patients PatientDB, counters CounterDB,
+	logger *logrus.Entry) QueueService {
+	return &queueService{
+		QueueDB:  &queueValidator{qdb},
+		users:    users,
+		patients: patients,
+		counters: counters,
+		clock:    SystemClock(),
+		logger:   logger,
+	}
+}
+
+func (qs *queueService) CheckIn(physicianId, patientId string, by *User) (*QueueEntry, error) {
+	if !bson.IsObjectIdHex(physicianId) {
+		return nil, ErrPhysicianInvalid
+	}
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrPatientRequired
+	}
+	physician, err := qs.users.ById(physicianId)
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return nil, ErrPhysicianInvalid
+		}
+		return nil, err
+	}
+	if !physician.HasRole(UserRolePhysician) || physician.Disabled {
+		return nil, ErrPhysicianInvalid
+	}
+	patient, err := qs.patients.ById(patientId)
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return nil, ErrPatientRequired
+		}
+		return nil, err
+	}
+	now := qs.clock.Now()
+	today := StartOfDay(now)
+	entries, err := qs.Day(physicianId, today)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.PatientId == patient.Id && e.Active() {
+			return nil, ErrAlreadyInQueue
+		}
+	}
+	token, err := qs.counters.Next(queueCounter(physician.Id, today))
+	if err != nil {
+		return nil, err
+	}
+	entry := QueueEntry{
+		PhysicianId: physician.Id,
+		PatientId:   patient.Id,
+		Date:        today,
+		Token:       token,
+		Status:      QueueWaiting,
+		CheckedIn:   now,
+	}
+	if by != nil {
+		entry.CheckedInBy = by.Id
+	}
+	if err := qs.Create(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (qs *queueService) CallNext(physicianId string) (*QueueEntry, error) {
+	entries, err := qs.Day(physicianId, qs.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Status != QueueWaiting {
+			continue
+		}
+		err := qs.Advance(entry, QueueCalled)
+		if err == nil {
+			return entry, nil
+		}
+		// Called from another screen in the meantime, try the next one.
+		if err != ErrQueueStatusChanged {
+			return nil, err
+		}
+	}
+	return nil, ErrQueueEmpty
+}
+
+func (qs *queueService) Advance(entry *QueueEntry, to QueueStatus) error {
+	now := qs.clock.Now()
+	if err := qs.SetStatus(entry.Id.Hex(), entry.Status, to, now); err != nil {
+		return err
+	}
+	entry.Status = to
+	entry.Updated = now
+	return nil
+}
+
+// queueCounter returns the name of the counter of the tokens of the physician on the day.
+func queueCounter(physicianId bson.ObjectId, day time.Time) string {
+	return fmt.Sprintf("queue_%s_%s", physicianId.Hex(), day.Format("20060102"))
+}
+
+type queueMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ QueueDB = &queueMongo{}
+
+func (qm *queueMongo) ById(id string) (*QueueEntry, error) {
+	ses := qm.mgo.Copy()
+	defer ses.Close()
+	e := QueueEntry{}
+	err := ses.DB(qm.dbname).C(QueueCollection).FindId(bson.ObjectIdHex(id)).One(&e)
+	return &e, err
+}
+
+func (qm *queueMongo) Day(physicianId string, date time.Time) ([]QueueEntry, error) {
+	return qm.find(bson.M{"physician_id": bson.ObjectIdHex(physicianId), "date": date})
+}
+
+func (qm *queueMongo) Today(date time.Time) ([]QueueEntry, error) {
+	return qm.find(bson.M{"date": date})
+}
+
+func (qm *queueMongo) ByPatient(patientId string) ([]QueueEntry, error) {
+	ses := qm.mgo.Copy()
+	defer ses.Close()
+	var entries []QueueEntry
+	err := ses.DB(qm.dbname).C(QueueCollection).Find(bson.M{"patient_id": bson.ObjectIdHex(patientId)}).
+		Sort("date", "token").All(&entries)
+	return entries, err
+}
+
+func (qm *queueMongo) find(query bson.M) ([]QueueEntry, error) {
+	ses := qm.mgo.Copy()
+	defer ses.Close()
+	var entries []QueueEntry
+	err := ses.DB(qm.dbname).C(QueueCollection).Find(query).Sort("token").All(&entries)
+	return entries, err
+}
+
+func (qm *queueMongo) Create(entry *QueueEntry) error {
+	ses := qm.mgo.Copy()
+	defer ses.Close()
+	entry.Id = bson.NewObjectId()
+	return ses.DB(qm.dbname).C(QueueCollection).Insert(entry)
+}
+
+func (qm *queueMongo) SetStatus(id string, from, to QueueStatus, at time.Time) error {
+	ses := qm.mgo.Copy()
+	defer ses.Close()
+	err := ses.DB(qm.dbname).C(QueueCollection).Update(
+		bson.M{"_id": bson.ObjectIdHex(id), "status": from},
+		bson.M{"$set": bson.M{"status": to, "updated": at}},
+	)
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return ErrQueueStatusChanged
+	}
+	return err
+}
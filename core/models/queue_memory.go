@@ -0,0 +1,96 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// queueMemory is a thread safe in-memory implementation of QueueDB.
+type queueMemory struct {
+	mu      sync.RWMutex
+	entries map[bson.ObjectId]QueueEntry
+}
+
+var _ QueueDB = &queueMemory{}
+
+func newQueueMemory() *queueMemory {
+	return &queueMemory{
+		entries: make(map[bson.ObjectId]QueueEntry),
+	}
+}
+
+func (qm *queueMemory) ById(id string) (*QueueEntry, error) {
+	qm.mu.RLock()
+	defer qm.mu.RUnlock()
+	e, ok := qm.entries[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &e, nil
+}
+
+func (qm *queueMemory) Day(physicianId string, date time.Time) ([]QueueEntry, error) {
+	return qm.filter(func(e *QueueEntry) bool {
+		return e.PhysicianId.Hex() == physicianId && e.Date.Equal(date)
+	}), nil
+}
+
+func (qm *queueMemory) Today(date time.Time) ([]QueueEntry, error) {
+	return qm.filter(func(e *QueueEntry) bool {
+		return e.Date.Equal(date)
+	}), nil
+}
+
+func (qm *queueMemory) ByPatient(patientId string) ([]QueueEntry, error) {
+	entries := qm.filter(func(e *QueueEntry) bool {
+		return e.PatientId.Hex() == patientId
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date.Before(entries[j].Date)
+	})
+	return entries, nil
+}
+
+// filter returns the entries matching the function, ordered by token.
+func (qm *queueMemory) filter(match func(e *QueueEntry) bool) []QueueEntry {
+	qm.mu.RLock()
+	defer qm.mu.RUnlock()
+	var entries []QueueEntry
+	for _, e := range qm.entries {
+		if match(&e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Token < entries[j].Token
+	})
+	return entries
+}
+
+func (qm *queueMemory) Create(entry *QueueEntry) error {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	entry.Id = bson.NewObjectId()
+	qm.entries[entry.Id] = *entry
+	return nil
+}
+
+func (qm *queueMemory) SetStatus(id string, from, to QueueStatus, at time.Time) error {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	e, ok := qm.entries[oid]
+	if !ok {
+		return MongoErrNotFound
+	}
+	if e.Status != from {
+		return ErrQueueStatusChanged
+	}
+	e.Status = to
+	e.Updated = at
+	qm.entries[oid] = e
+	return nil
+}
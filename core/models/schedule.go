@@ -0,0 +1,311 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	AvailabilityCollection      = "availability"
+	ScheduleExceptionCollection = "schedule_exception"
+
+	// DefaultSlotMinutes is the length of appointment slots if the availability of a physician does not set one.
+	DefaultSlotMinutes = 15
+)
+
+// TimeOfDay is a wall clock time as minutes after midnight.
+type TimeOfDay int
+
+// ParseTimeOfDay parses times like "09:30".
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrTimeOfDayInvalid
+	}
+	return TimeOfDay(t.Hour()*60 + t.Minute()), nil
+}
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", int(t)/60, int(t)%60)
+}
+
+// On returns the time t on the day of date, in the location of date.
+func (t TimeOfDay) On(date time.Time) time.Time {
+	y, m, d := date.Date()
+	return time.Date(y, m, d, int(t)/60, int(t)%60, 0, 0, date.Location())
+}
+
+// WeeklySession is a recurring period in which a physician sees patients, like monday mornings.
+type WeeklySession struct {
+	Weekday time.Weekday `json:"weekday" bson:"weekday"`
+	Start   TimeOfDay    `json:"start" bson:"start"`
+	End     TimeOfDay    `json:"end" bson:"end"`
+}
+
+// Availability is the weekly template of the sessions of a physician.
+type Availability struct {
+	// PhysicianId is also the id of the availability, every physician has at most one.
+	PhysicianId bson.ObjectId   `json:"physician_id" bson:"_id"`
+	Sessions    []WeeklySession `json:"sessions" bson:"sessions"`
+	SlotMinutes int             `json:"slot_minutes" bson:"slot_minutes"`
+	Updated     time.Time       `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+// SlotLength returns the length of an appointment slot.
+func (a *Availability) SlotLength() time.Duration {
+	if a.SlotMinutes < 1 {
+		return DefaultSlotMinutes * time.Minute
+	}
+	return time.Duration(a.SlotMinutes) * time.Minute
+}
+
+// SessionsOn returns the sessions on the weekday of date, ordered by their start.
+func (a *Availability) SessionsOn(date time.Time) []WeeklySession {
+	var sessions []WeeklySession
+	for _, s := range a.Sessions {
+		if s.Weekday == date.Weekday() {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start < sessions[j].Start
+	})
+	return sessions
+}
+
+// Covers reports whether the period from start to end lies within one session.
+func (a *Availability) Covers(start, end time.Time) bool {
+	for _, s := range a.SessionsOn(start) {
+		if !start.Before(s.Start.On(start)) && !end.After(s.End.On(start)) {
+			return true
+		}
+	}
+	return false
+}
+
+type ScheduleExceptionKind string
+
+const (
+	// ScheduleExceptionLeave is a leave of one physician.
+	ScheduleExceptionLeave ScheduleExceptionKind = "leave"
+	// ScheduleExceptionHoliday closes the clinic for all physicians.
+	ScheduleExceptionHoliday ScheduleExceptionKind = "holiday"
+)
+
+// ScheduleException is a period of whole days in which appointments can not be booked, despite the weekly template.
+type ScheduleException struct {
+	Id   bson.ObjectId         `json:"id,omitempty" bson:"_id,omitempty"`
+	Kind ScheduleExceptionKind `json:"kind" bson:"kind"`
+	// PhysicianId is empty for holidays.
+	PhysicianId bson.ObjectId `json:"physician_id,omitempty" bson:"physician_id,omitempty"`
+	// From and To are the first and last day of the exception, at midnight.
+	From      time.Time     `json:"from" bson:"from"`
+	To        time.Time     `json:"to" bson:"to"`
+	Reason    string        `json:"reason,omitempty" bson:"reason,omitempty"`
+	CreatedBy bson.ObjectId `json:"created_by,omitempty" bson:"created_by,omitempty"`
+}
+
+// Includes reports whether the day of t is one of the days of the exception.
+func (e *ScheduleException) Includes(t time.Time) bool {
+	day := StartOfDay(t)
+	return !day.Before(StartOfDay(e.From)) && !day.After(StartOfDay(e.To))
+}
+
+// SingleDay reports whether the exception is only one day long.
+func (e *ScheduleException) SingleDay() bool {
+	return e.From.Equal(e.To)
+}
+
+// StartOfDay returns midnight at the start of the day of t, in the location of t.
+func StartOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+type ScheduleDB interface {
+	// Availability returns the weekly template of the physician, or an empty one if none was saved yet.
+	Availability(physicianId string) (*Availability, error)
+	SaveAvailability(availability *Availability) error
+
+	// Exceptions returns the leaves of the physician and the holidays overlapping the days from and to.
+	// An empty physicianId only returns holidays.
+	Exceptions(physicianId string, from, to time.Time) ([]ScheduleException, error)
+	ExceptionById(id string) (*ScheduleException, error)
+	CreateException(exception *ScheduleException) error
+	DeleteException(id string) error
+}
+
+type scheduleValidator struct {
+	ScheduleDB
+}
+
+var _ ScheduleDB = &scheduleValidator{}
+
+func (sv *scheduleValidator) Availability(physicianId string) (*Availability, error) {
+	if !bson.IsObjectIdHex(physicianId) {
+		return nil, ErrIDInvalid
+	}
+	return sv.ScheduleDB.Availability(physicianId)
+}
+
+func (sv *scheduleValidator) SaveAvailability(availability *Availability) error {
+	if availability.PhysicianId == "" {
+		return ErrUserIDRequired
+	}
+	if availability.SlotMinutes < 5 || availability.SlotMinutes > 240 {
+		return ErrSlotLengthInvalid
+	}
+	for i, s := range availability.Sessions {
+		if s.Weekday < time.Sunday || s.Weekday > time.Saturday || s.Start < 0 || s.End > 24*60 || s.End <= s.Start {
+			return ErrSessionTimesInvalid
+		}
+		for _, other := range availability.Sessions[:i] {
+			if other.Weekday == s.Weekday && other.Start < s.End && s.Start < other.End {
+				return ErrSessionsOverlap
+			}
+		}
+	}
+	availability.Updated = time.Now()
+	return sv.ScheduleDB.SaveAvailability(availability)
+}
+
+func (sv *scheduleValidator) Exceptions(physicianId string, from, to time.Time) ([]ScheduleException, error) {
+	if physicianId != "" && !bson.IsObjectIdHex(physicianId) {
+		return nil, ErrIDInvalid
+	}
+	return sv.ScheduleDB.Exceptions(physicianId, StartOfDay(from), StartOfDay(to))
+}
+
+func (sv *scheduleValidator) ExceptionById(id string) (*ScheduleException, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return sv.ScheduleDB.ExceptionById(id)
+}
+
+func (sv *scheduleValidator) CreateException(exception *ScheduleException) error {
+	switch exception.Kind {
+	case ScheduleExceptionLeave:
+		if exception.PhysicianId == "" {
+			return ErrUserIDRequired
+		}
+	case ScheduleExceptionHoliday:
+		exception.PhysicianId = ""
+	default:
+		return ErrScheduleExceptionInvalid
+	}
+	if exception.From.IsZero() || exception.To.IsZero() || exception.To.Before(exception.From) {
+		return ErrScheduleExceptionDates
+	}
+	exception.From = StartOfDay(exception.From)
+	exception.To = StartOfDay(exception.To)
+	return sv.ScheduleDB.CreateException(exception)
+}
+
+func (sv *scheduleValidator) DeleteException(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return sv.ScheduleDB.DeleteException(id)
+}
+
+// ScheduleService manages the weekly availability of physicians and the days they are not available.
+type ScheduleService interface {
+	// Closed returns the exception which makes the physician unavailable on the day of t, or nil.
+	Closed(physicianId string, t time.Time) (*ScheduleException, error)
+	ScheduleDB
+}
+
+type scheduleService struct {
+	ScheduleDB
+}
+
+func NewScheduleService(mgo *mgo.Session, logger *logrus.Entry, dbname string) ScheduleService {
+	return &scheduleService{
+		ScheduleDB: &scheduleValidator{&scheduleMongo{mgo, dbname, logger}},
+	}
+}
+
+// NewInMemoryScheduleService returns a ScheduleService backed by an in-memory ScheduleDB.
+func NewInMemoryScheduleService() ScheduleService {
+	return &scheduleService{
+		ScheduleDB: &scheduleValidator{newScheduleMemory()},
+	}
+}
+
+func (ss *scheduleService) Closed(physicianId string, t time.Time) (*ScheduleException, error) {
+	exceptions, err := ss.Exceptions(physicianId, t, t)
+	if err != nil || len(exceptions) == 0 {
+		return nil, err
+	}
+	return &exceptions[0], nil
+}
+
+type scheduleMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ ScheduleDB = &scheduleMongo{}
+
+func (sm *scheduleMongo) Availability(physicianId string) (*Availability, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	a := Availability{}
+	err := ses.DB(sm.dbname).C(AvailabilityCollection).FindId(bson.ObjectIdHex(physicianId)).One(&a)
+	if err != nil && err.Error() == MongoErrNotFound.Error() {
+		return &Availability{PhysicianId: bson.ObjectIdHex(physicianId), SlotMinutes: DefaultSlotMinutes}, nil
+	}
+	return &a, err
+}
+
+func (sm *scheduleMongo) SaveAvailability(availability *Availability) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	_, err := ses.DB(sm.dbname).C(AvailabilityCollection).UpsertId(availability.PhysicianId, availability)
+	return err
+}
+
+func (sm *scheduleMongo) Exceptions(physicianId string, from, to time.Time) ([]ScheduleException, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	kinds := []bson.M{{"kind": ScheduleExceptionHoliday}}
+	if physicianId != "" {
+		kinds = append(kinds, bson.M{"physician_id": bson.ObjectIdHex(physicianId)})
+	}
+	query := bson.M{
+		"$or":  kinds,
+		"from": bson.M{"$lte": to},
+		"to":   bson.M{"$gte": from},
+	}
+	var exceptions []ScheduleException
+	err := ses.DB(sm.dbname).C(ScheduleExceptionCollection).Find(query).Sort("from").All(&exceptions)
+	return exceptions, err
+}
+
+func (sm *scheduleMongo) ExceptionById(id string) (*ScheduleException, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	e := ScheduleException{}
+	err := ses.DB(sm.dbname).C(ScheduleExceptionCollection).FindId(bson.ObjectIdHex(id)).One(&e)
+	return &e, err
+}
+
+func (sm *scheduleMongo) CreateException(exception *ScheduleException) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	exception.Id = bson.NewObjectId()
+	return ses.DB(sm.dbname).C(ScheduleExceptionCollection).Insert(exception)
+}
+
+func (sm *scheduleMongo) DeleteException(id string) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(sm.dbname).C(ScheduleExceptionCollection).RemoveId(bson.ObjectIdHex(id))
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// scheduleMemory is a thread safe in-memory implementation of ScheduleDB.
+type scheduleMemory struct {
+	mu             sync.RWMutex
+	availabilities map[bson.ObjectId]Availability
+	exceptions     map[bson.ObjectId]ScheduleException
+}
+
+var _ ScheduleDB = &scheduleMemory{}
+
+func newScheduleMemory() *scheduleMemory {
+	return &scheduleMemory{
+		availabilities: make(map[bson.ObjectId]Availability),
+		exceptions:     make(map[bson.ObjectId]ScheduleException),
+	}
+}
+
+func (sm *scheduleMemory) Availability(physicianId string) (*Availability, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	oid := bson.ObjectIdHex(physicianId)
+	a, ok := sm.availabilities[oid]
+	if !ok {
+		return &Availability{PhysicianId: oid, SlotMinutes: DefaultSlotMinutes}, nil
+	}
+	a.Sessions = append([]WeeklySession(nil), a.Sessions...)
+	return &a, nil
+}
+
+func (sm *scheduleMemory) SaveAvailability(availability *Availability) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	a := *availability
+	a.Sessions = append([]WeeklySession(nil), availability.Sessions...)
+	sm.availabilities[a.PhysicianId] = a
+	return nil
+}
+
+func (sm *scheduleMemory) Exceptions(physicianId string, from, to time.Time) ([]ScheduleException, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var exceptions []ScheduleException
+	for _, e := range sm.exceptions {
+		if e.Kind != ScheduleExceptionHoliday && (physicianId == "" || e.PhysicianId.Hex() != physicianId) {
+			continue
+		}
+		if e.From.After(to) || e.To.Before(from) {
+			continue
+		}
+		exceptions = append(exceptions, e)
+	}
+	sort.Slice(exceptions, func(i, j int) bool {
+		return exceptions[i].From.Before(exceptions[j].From)
+	})
+	return exceptions, nil
+}
+
+func (sm *scheduleMemory) ExceptionById(id string) (*ScheduleException, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	e, ok := sm.exceptions[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &e, nil
+}
+
+func (sm *scheduleMemory) CreateException(exception *ScheduleException) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	exception.Id = bson.NewObjectId()
+	sm.exceptions[exception.Id] = *exception
+	return nil
+}
+
+func (sm *scheduleMemory) DeleteException(id string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	if _, ok := sm.exceptions[oid]; !ok {
+		return MongoErrNotFound
+	}
+	delete(sm.exceptions, oid)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"log"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/globalsign/mgo"
@@ -13,12 +14,38 @@ import (
 type Services struct {
 	mgoSession   *mgo.Session
 	databaseName string
+	inMemory     bool
 	logger       *logrus.Logger
 	User         UserService
+	Session      SessionService
+	Settings     SettingsService
+	TwoFactor    TwoFactorService
+	Audit        AuditService
+	APIToken     APITokenService
+	Patient      PatientService
+	Schedule     ScheduleService
+	Appointment  AppointmentService
+	Diagnosis    DiagnosisCodeService
+	Encounter    EncounterService
+	Prescription PrescriptionService
+	Queue        QueueService
+	Catalogue    CatalogueService
+	Invoice      InvoiceService
+	Lab          LabService
+	Document     DocumentService
+	Chart        ChartService
+	Immunization ImmunizationService
+	Vitals       VitalsService
+	HL7Message   HL7MessageService
+
+	// counters are shared by the services which number their records sequentially.
+	counters CounterDB
 }
 
 func (s *Services) Close() {
-	s.mgoSession.Close()
+	if s.mgoSession != nil {
+		s.mgoSession.Close()
+	}
 }
 
 func NewServices(configs ...ServicesConfig) (*Services, error) {
@@ -28,9 +55,86 @@ func NewServices(configs ...ServicesConfig) (*Services, error) {
 			return nil, err
 		}
 	}
+	s.keepPatientRecords()
 	return &s, nil
 }
 
+// keepPatientRecords registers the records of the configured services which refer to patients with the patient
+// service, so that patients with records are not deleted.
+func (s *Services) keepPatientRecords() {
+	if s.Patient == nil {
+		return
+	}
+	if s.Appointment != nil {
+		s.Patient.KeepRecords("appointments", func(id string) (bool, error) {
+			appointments, err := s.Appointment.ByPatient(id)
+			return len(appointments) > 0, err
+		})
+	}
+	if s.Queue != nil {
+		s.Patient.KeepRecords("queue entries", func(id string) (bool, error) {
+			entries, err := s.Queue.ByPatient(id)
+			return len(entries) > 0, err
+		})
+	}
+	if s.Encounter != nil {
+		s.Patient.KeepRecords("encounters", func(id string) (bool, error) {
+			encounters, err := s.Encounter.ByPatient(id)
+			return len(encounters) > 0, err
+		})
+	}
+	if s.Prescription != nil {
+		s.Patient.KeepRecords("prescriptions", func(id string) (bool, error) {
+			prescriptions, err := s.Prescription.ByPatient(id)
+			return len(prescriptions) > 0, err
+		})
+	}
+	if s.Invoice != nil {
+		s.Patient.KeepRecords("invoices", func(id string) (bool, error) {
+			invoices, err := s.Invoice.ByPatient(id)
+			return len(invoices) > 0, err
+		})
+	}
+	if s.Lab != nil {
+		s.Patient.KeepRecords("lab orders", func(id string) (bool, error) {
+			orders, err := s.Lab.ByPatient(id)
+			return len(orders) > 0, err
+		})
+		s.Patient.KeepRecords("lab results", func(id string) (bool, error) {
+			results, err := s.Lab.Results(id)
+			return len(results) > 0, err
+		})
+	}
+	if s.Document != nil {
+		s.Patient.KeepRecords("documents", func(id string) (bool, error) {
+			documents, err := s.Document.ByPatient(id)
+			return len(documents) > 0, err
+		})
+	}
+	if s.Chart != nil {
+		s.Patient.KeepRecords("chart entries", func(id string) (bool, error) {
+			chart, err := s.Chart.Chart(id)
+			if err != nil {
+				return false, err
+			}
+			return len(chart.Allergies) > 0 || len(chart.Problems) > 0 || len(chart.Resolved) > 0 ||
+				len(chart.Medications) > 0 || len(chart.Stopped) > 0, nil
+		})
+	}
+	if s.Immunization != nil {
+		s.Patient.KeepRecords("immunizations", func(id string) (bool, error) {
+			immunizations, err := s.Immunization.ByPatient(id)
+			return len(immunizations) > 0, err
+		})
+	}
+	if s.Vitals != nil {
+		s.Patient.KeepRecords("vitals", func(id string) (bool, error) {
+			vitals, err := s.Vitals.ByPatient(id)
+			return len(vitals) > 0, err
+		})
+	}
+}
+
 type ServicesConfig func(*Services) error
 
 func WithMongoDB(dbConfig DatabaseConfig) ServicesConfig {
@@ -62,6 +166,15 @@ func WithMongoDB(dbConfig DatabaseConfig) ServicesConfig {
 	}
 }
 
+// WithInMemoryStore configures the services to keep all data in memory instead of MongoDB.
+// Data is lost when the process exits, so this is only meant for tests and local development.
+func WithInMemoryStore() ServicesConfig {
+	return func(s *Services) error {
+		s.inMemory = true
+		return nil
+	}
+}
+
 func WithLogger(config LogConfig) ServicesConfig {
 	return func(s *Services) error {
 		var logRoot = logrus.New()
@@ -89,13 +202,343 @@ func WithLogger(config LogConfig) ServicesConfig {
 	}
 }
 
-func WithUserService(pepper, hmacKey string) ServicesConfig {
+func WithUserService(pepper, hmacKey string, loginPolicy LoginPolicy, passwordPolicy PasswordPolicy) ServicesConfig {
+	return func(s *Services) error {
+		passwords, err := passwordPolicy.Load()
+		if err != nil {
+			return err
+		}
+		if s.inMemory {
+			s.User = NewInMemoryUserService(s.GetContextLogger("UserService"), pepper, hmacKey, loginPolicy, passwords)
+			return nil
+		}
+		s.User = NewUserService(s.mgoSession, s.GetContextLogger("UserService"), s.databaseName, pepper, hmacKey, loginPolicy, passwords)
+		return nil
+	}
+}
+
+// WithAuditService records logins and changes to users in the audit log.
+// It requires the user service to be configured first, and services configured after it use the audited user service.
+func WithAuditService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Audit = NewInMemoryAuditService()
+		} else {
+			s.Audit = NewAuditService(s.mgoSession, s.GetContextLogger("AuditService"), s.databaseName)
+		}
+		s.User = NewAuditedUserService(s.User, s.Audit, s.GetContextLogger("AuditService"))
+		return nil
+	}
+}
+
+// WithSessionService requires the user service to be configured first.
+func WithSessionService(hmacKey string, lifetime time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Session = NewInMemorySessionService(s.User, s.GetContextLogger("SessionService"), hmacKey, lifetime)
+			return nil
+		}
+		s.Session = NewSessionService(s.mgoSession, s.User, s.GetContextLogger("SessionService"), s.databaseName, hmacKey, lifetime)
+		return nil
+	}
+}
+
+// WithAPITokenService requires the user service to be configured first.
+func WithAPITokenService(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.APIToken = NewInMemoryAPITokenService(s.User, s.GetContextLogger("APITokenService"), hmacKey)
+			return nil
+		}
+		s.APIToken = NewAPITokenService(s.mgoSession, s.User, s.GetContextLogger("APITokenService"), s.databaseName, hmacKey)
+		return nil
+	}
+}
+
+func WithSettingsService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Settings = NewInMemorySettingsService()
+			return nil
+		}
+		s.Settings = NewSettingsService(s.mgoSession, s.GetContextLogger("SettingsService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithTwoFactorService requires the user and settings services to be configured first.
+// The encryption key of the TOTP secrets must not be empty.
+func WithTwoFactorService(encryptionKey, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		if encryptionKey == "" {
+			return ErrEncryptionKeyRequired
+		}
+		s.TwoFactor = NewTwoFactorService(s.User, s.Settings, s.GetContextLogger("TwoFactorService"),
+			encryptionKey, hmacKey, "GCCHR", SystemClock())
+		return nil
+	}
+}
+
+func WithPatientService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Patient = NewInMemoryPatientService(s.counterDB(), s.GetContextLogger("PatientService"))
+			return nil
+		}
+		if err := EnsurePatientIndexes(s.mgoSession, s.databaseName); err != nil {
+			return err
+		}
+		s.Patient = NewPatientService(s.mgoSession, s.counterDB(), s.GetContextLogger("PatientService"), s.databaseName)
+		return nil
+	}
+}
+
+func WithScheduleService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Schedule = NewInMemoryScheduleService()
+			return nil
+		}
+		s.Schedule = NewScheduleService(s.mgoSession, s.GetContextLogger("ScheduleService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithAppointmentService requires the user, patient and schedule services to be configured first.
+func WithAppointmentService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Appointment = NewInMemoryAppointmentService(s.User, s.Patient, s.Schedule,
+				s.GetContextLogger("AppointmentService"))
+			return nil
+		}
+		s.Appointment = NewAppointmentService(s.mgoSession, s.User, s.Patient, s.Schedule,
+			s.GetContextLogger("AppointmentService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithDiagnosisCodeService loads the ICD-10 code table from the file, the default file if it is empty.
+func WithDiagnosisCodeService(codesFile string) ServicesConfig {
+	return func(s *Services) error {
+		if codesFile == "" {
+			codesFile = DefaultDiagnosisCodesFile
+		}
+		diagnosis, err := NewDiagnosisCodeService(codesFile, s.GetContextLogger("DiagnosisCodeService"))
+		if err != nil {
+			return err
+		}
+		s.Diagnosis = diagnosis
+		return nil
+	}
+}
+
+// WithEncounterService requires the user, patient and diagnosis code services to be configured first.
+func WithEncounterService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Encounter = NewInMemoryEncounterService(s.User, s.Patient, s.Diagnosis,
+				s.GetContextLogger("EncounterService"))
+			return nil
+		}
+		s.Encounter = NewEncounterService(s.mgoSession, s.User, s.Patient, s.Diagnosis,
+			s.GetContextLogger("EncounterService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithPrescriptionService requires the user and encounter services to be configured first.
+func WithPrescriptionService() ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.mgoSession, s.GetContextLogger("UserService"), s.databaseName, pepper, hmacKey)
+		if s.inMemory {
+			s.Prescription = NewInMemoryPrescriptionService(s.User, s.Encounter, s.GetContextLogger("PrescriptionService"))
+			return nil
+		}
+		s.Prescription = NewPrescriptionService(s.mgoSession, s.User, s.Encounter,
+			s.GetContextLogger("PrescriptionService"), s.databaseName)
 		return nil
 	}
 }
 
+// WithQueueService requires the user and patient services to be configured first.
+func WithQueueService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Queue = NewInMemoryQueueService(s.User, s.Patient, s.counterDB(), s.GetContextLogger("QueueService"))
+			return nil
+		}
+		s.Queue = NewQueueService(s.mgoSession, s.User, s.Patient, s.counterDB(), s.GetContextLogger("QueueService"),
+			s.databaseName)
+		return nil
+	}
+}
+
+func WithCatalogueService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Catalogue = NewInMemoryCatalogueService()
+			return nil
+		}
+		s.Catalogue = NewCatalogueService(s.mgoSession, s.GetContextLogger("CatalogueService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithInvoiceService requires the encounter, patient and catalogue services to be configured first.
+func WithInvoiceService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.Invoice = NewInMemoryInvoiceService(s.Encounter, s.Patient, s.Catalogue, s.counterDB(),
+				s.GetContextLogger("InvoiceService"))
+			return nil
+		}
+		if err := EnsureInvoiceIndexes(s.mgoSession, s.databaseName); err != nil {
+			return err
+		}
+		s.Invoice = NewInvoiceService(s.mgoSession, s.Encounter, s.Patient, s.Catalogue, s.counterDB(),
+			s.GetContextLogger("InvoiceService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithLabService loads the lab tests from the file, the default file if it is empty.
+// It requires the user, encounter and patient services to be configured first.
+func WithLabService(labTestsFile string) ServicesConfig {
+	return func(s *Services) error {
+		if labTestsFile == "" {
+			labTestsFile = DefaultLabTestsFile
+		}
+		tests, err := LoadLabTests(labTestsFile)
+		if err != nil {
+			return err
+		}
+		if s.inMemory {
+			s.Lab = NewInMemoryLabService(s.User, s.Encounter, s.Patient, tests, s.counterDB(),
+				s.GetContextLogger("LabService"))
+			return nil
+		}
+		s.Lab = NewLabService(s.mgoSession, s.User, s.Encounter, s.Patient, tests, s.counterDB(),
+			s.GetContextLogger("LabService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithDocumentService keeps the content of documents as configured by the storage, in memory if the services
+// run without a database. It requires the patient and encounter services to be configured first.
+func WithDocumentService(storage DocumentStorage) ServicesConfig {
+	return func(s *Services) error {
+		storage = storage.withDefaults()
+		logger := s.GetContextLogger("DocumentService")
+		if s.inMemory {
+			s.Document = NewInMemoryDocumentService(s.Patient, s.Encounter, NewMemoryBlobStore(), storage.MaxSize(),
+				logger)
+			return nil
+		}
+		var blobs BlobStore
+		switch storage.Backend {
+		case BlobStorageFilesystem:
+			fs, err := NewFileBlobStore(storage.Directory)
+			if err != nil {
+				return err
+			}
+			blobs = fs
+		case BlobStorageGridFS:
+			blobs = NewGridFSBlobStore(s.mgoSession, s.databaseName, documentsGridFSPrefix)
+		default:
+			return fmt.Errorf("models: unknown document storage %q", storage.Backend)
+		}
+		s.Document = NewDocumentService(s.mgoSession, s.Patient, s.Encounter, blobs, storage.MaxSize(), logger,
+			s.databaseName)
+		return nil
+	}
+}
+
+// WithChartService loads the drug classes allergies are checked against from the file, the default file if it is
+// empty. It requires the patient service to be configured first.
+func WithChartService(drugClassesFile string) ServicesConfig {
+	return func(s *Services) error {
+		if drugClassesFile == "" {
+			drugClassesFile = DefaultDrugClassesFile
+		}
+		classes, err := LoadDrugClasses(drugClassesFile)
+		if err != nil {
+			return err
+		}
+		if s.inMemory {
+			s.Chart = NewInMemoryChartService(s.Patient, classes, s.GetContextLogger("ChartService"))
+			return nil
+		}
+		s.Chart = NewChartService(s.mgoSession, s.Patient, classes, s.GetContextLogger("ChartService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithImmunizationService loads the immunization schedule from the file, the default file if it is empty. It
+// requires the patient and user services to be configured first.
+func WithImmunizationService(scheduleFile string) ServicesConfig {
+	return func(s *Services) error {
+		if scheduleFile == "" {
+			scheduleFile = DefaultImmunizationScheduleFile
+		}
+		schedule, err := LoadImmunizationSchedule(scheduleFile)
+		if err != nil {
+			return err
+		}
+		if s.inMemory {
+			s.Immunization = NewInMemoryImmunizationService(s.Patient, s.User, schedule,
+				s.GetContextLogger("ImmunizationService"))
+			return nil
+		}
+		s.Immunization = NewImmunizationService(s.mgoSession, s.Patient, s.User, schedule,
+			s.GetContextLogger("ImmunizationService"), s.databaseName)
+		return nil
+	}
+}
+
+// WithVitalsService loads the growth reference tables from the directory, the default directory if it is empty.
+// It requires the patient and encounter services to be configured first.
+func WithVitalsService(growthReferenceDir string) ServicesConfig {
+	return func(s *Services) error {
+		if growthReferenceDir == "" {
+			growthReferenceDir = DefaultGrowthReferenceDir
+		}
+		growth, err := LoadGrowthReference(growthReferenceDir)
+		if err != nil {
+			return err
+		}
+		if s.inMemory {
+			s.Vitals = NewInMemoryVitalsService(s.Patient, s.Encounter, growth, s.GetContextLogger("VitalsService"))
+			return nil
+		}
+		s.Vitals = NewVitalsService(s.mgoSession, s.Patient, s.Encounter, growth, s.GetContextLogger("VitalsService"),
+			s.databaseName)
+		return nil
+	}
+}
+
+func WithHL7MessageService() ServicesConfig {
+	return func(s *Services) error {
+		if s.inMemory {
+			s.HL7Message = NewInMemoryHL7MessageService(s.GetContextLogger("HL7MessageService"))
+			return nil
+		}
+		s.HL7Message = NewHL7MessageService(s.mgoSession, s.GetContextLogger("HL7MessageService"), s.databaseName)
+		return nil
+	}
+}
+
+// counterDB returns the counters of the services, creating them on first use.
+func (s *Services) counterDB() CounterDB {
+	if s.counters == nil {
+		if s.inMemory {
+			s.counters = NewCounterMemory()
+		} else {
+			s.counters = NewCounterMongo(s.mgoSession, s.GetContextLogger("Counters"), s.databaseName)
+		}
+	}
+	return s.counters
+}
+
 func (s *Services) GetContextLogger(context string) *logrus.Entry {
 	return s.logger.WithField("context", context)
 }
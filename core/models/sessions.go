@@ -0,0 +1,408 @@
+package models
+
+import (
+	"time"
+
+	"gcchr-system/core/hash"
+	"gcchr-system/core/rand"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	SessionCollection = "session"
+
+	// DefaultSessionLifetime is used when no session lifetime is configured.
+	DefaultSessionLifetime = 12 * time.Hour
+
+	// sessionTouchInterval limits how often LastSeen is written back for a session.
+	sessionTouchInterval = time.Minute
+
+	// pendingSessionLifetime is the time a user has to provide their second factor after the password.
+	pendingSessionLifetime = 5 * time.Minute
+)
+
+// Session is a single signed in device of a user.
+// Only the HMAC of the token is stored, the token itself is only known to the client.
+type Session struct {
+	Id        bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	UserId    bson.ObjectId `json:"user_id" bson:"user_id"`
+	Token     string        `json:"-" bson:"-"`
+	TokenHash string        `json:"-" bson:"token_hash"`
+	Created   time.Time     `json:"created" bson:"created"`
+	LastSeen  time.Time     `json:"last_seen" bson:"last_seen"`
+	Expires   time.Time     `json:"expires" bson:"expires"`
+	IP        string        `json:"ip" bson:"ip"`
+	UserAgent string        `json:"user_agent" bson:"user_agent"`
+
+	// Pending sessions have passed the password check, but still need the second factor.
+	// They can not be used to access anything else.
+	// Wrong second factors are counted on the user, see TwoFactorService.Verify.
+	Pending bool `json:"pending,omitempty" bson:"pending,omitempty"`
+}
+
+// Expired reports whether the session can no longer be used.
+func (s *Session) Expired() bool {
+	return !time.Now().Before(s.Expires)
+}
+
+type SessionDB interface {
+	// Single session fetch methods
+	ById(id string) (*Session, error)
+	ByToken(token string) (*Session, error)
+
+	// List of sessions fetch methods
+	ByUserId(userId string) ([]Session, error)
+
+	// Data modifying methods
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id string) error
+	DeleteByUserId(userId string) error
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac     hash.HMAC
+	lifetime time.Duration
+}
+
+var _ SessionDB = &sessionValidator{}
+
+func newSessionValidator(sdb SessionDB, hmac hash.HMAC, lifetime time.Duration) *sessionValidator {
+	return &sessionValidator{
+		SessionDB: sdb,
+		hmac:      hmac,
+		lifetime:  lifetime,
+	}
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	if err := runSessionValFuncs(session, sv.requireUserId, sv.setTokenIfUnset, sv.tokenMinBytes, sv.hmacToken,
+		sv.tokenHashRequired, sv.ensureTimes); err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	if err := runSessionValFuncs(session, sv.requireUserId, sv.tokenHashRequired); err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+func (sv *sessionValidator) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserId(userId string) error {
+	if !bson.IsObjectIdHex(userId) {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.DeleteByUserId(userId)
+}
+
+func (sv *sessionValidator) ById(id string) (*Session, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return sv.SessionDB.ById(id)
+}
+
+// ByToken hashes the token and looks up the matching session.
+// Expired sessions are removed and ErrSessionExpired is returned.
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{
+		Token: token,
+	}
+	if err := runSessionValFuncs(&session, sv.hmacToken, sv.tokenHashRequired); err != nil {
+		return nil, err
+	}
+	found, err := sv.SessionDB.ByToken(session.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if found.Expired() {
+		sv.SessionDB.Delete(found.Id.Hex())
+		return nil, ErrSessionExpired
+	}
+	return found, nil
+}
+
+// ByUserId returns only the sessions of the user which have not expired and are not pending.
+func (sv *sessionValidator) ByUserId(userId string) ([]Session, error) {
+	if !bson.IsObjectIdHex(userId) {
+		return nil, ErrIDInvalid
+	}
+	sessions, err := sv.SessionDB.ByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+	var active []Session
+	for _, s := range sessions {
+		if !s.Expired() && !s.Pending {
+			active = append(active, s)
+		}
+	}
+	return active, nil
+}
+
+func (sv *sessionValidator) requireUserId(session *Session) error {
+	if session.UserId == "" {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RemeberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(session *Session) error {
+	n, err := rand.NBytes(session.Token)
+	if err != nil {
+		return err
+	}
+	if n < rand.RemeberTokenBytes {
+		return ErrSessionTokenTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(session *Session) error {
+	if session.TokenHash == "" {
+		return ErrSessionTokenRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) ensureTimes(session *Session) error {
+	now := time.Now()
+	if session.Created.IsZero() {
+		session.Created = now
+	}
+	if session.LastSeen.IsZero() {
+		session.LastSeen = now
+	}
+	if session.Expires.IsZero() {
+		session.Expires = session.Created.Add(sv.lifetime)
+	}
+	return nil
+}
+
+type SessionService interface {
+	// Start signs the user in on a new device. The returned session has its Token set.
+	Start(user *User, ip, userAgent string) (*Session, error)
+	// StartPending starts a short lived session for a user who still has to provide a second factor.
+	StartPending(user *User, ip, userAgent string) (*Session, error)
+	// Resolve looks up the session and its user for a token provided by a client.
+	Resolve(token string) (*Session, *User, error)
+	// ResolvePending looks up a pending session and its user for a token provided by a client.
+	ResolvePending(token string) (*Session, *User, error)
+	// Revoke ends a session of the user with the provided user Id.
+	Revoke(userId, sessionId string) error
+	SessionDB
+}
+
+type sessionService struct {
+	SessionDB
+	users  UserDB
+	logger *logrus.Entry
+}
+
+func NewSessionService(mgo *mgo.Session, users UserDB, logger *logrus.Entry, dbname, hmacKey string, lifetime time.Duration) SessionService {
+	sm := &sessionMongo{mgo, dbname, logger}
+	return newSessionService(sm, users, logger, hmacKey, lifetime)
+}
+
+// NewInMemorySessionService returns a SessionService backed by an in-memory SessionDB.
+func NewInMemorySessionService(users UserDB, logger *logrus.Entry, hmacKey string, lifetime time.Duration) SessionService {
+	return newSessionService(newSessionMemory(), users, logger, hmacKey, lifetime)
+}
+
+func newSessionService(sdb SessionDB, users UserDB, logger *logrus.Entry, hmacKey string, lifetime time.Duration) SessionService {
+	if lifetime <= 0 {
+		lifetime = DefaultSessionLifetime
+	}
+	sv := newSessionValidator(sdb, hash.NewHMAC(hmacKey), lifetime)
+	return &sessionService{
+		SessionDB: sv,
+		users:     users,
+		logger:    logger,
+	}
+}
+
+func (ss *sessionService) Start(user *User, ip, userAgent string) (*Session, error) {
+	session := Session{
+		UserId:    user.Id,
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+	if err := ss.Create(&session); err != nil {
+		return nil, err
+	}
+	ss.logger.Debugf("Started session %s for user %s", session.Id.Hex(), user.Username)
+	return &session, nil
+}
+
+func (ss *sessionService) StartPending(user *User, ip, userAgent string) (*Session, error) {
+	session := Session{
+		UserId:    user.Id,
+		IP:        ip,
+		UserAgent: userAgent,
+		Pending:   true,
+		Expires:   time.Now().Add(pendingSessionLifetime),
+	}
+	if err := ss.Create(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (ss *sessionService) Resolve(token string) (*Session, *User, error) {
+	session, user, err := ss.resolve(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.Pending {
+		return nil, nil, ErrSessionPending
+	}
+	if time.Since(session.LastSeen) > sessionTouchInterval {
+		session.LastSeen = time.Now()
+		if err := ss.Update(session); err != nil {
+			ss.logger.Errorf("Error while updating last seen of session %s: %v", session.Id.Hex(), err)
+		}
+	}
+	return session, user, nil
+}
+
+func (ss *sessionService) ResolvePending(token string) (*Session, *User, error) {
+	session, user, err := ss.resolve(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.Pending {
+		return nil, nil, MongoErrNotFound
+	}
+	return session, user, nil
+}
+
+func (ss *sessionService) resolve(token string) (*Session, *User, error) {
+	session, err := ss.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := ss.users.ById(session.UserId.Hex())
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+	return session, user, nil
+}
+
+func (ss *sessionService) Revoke(userId, sessionId string) error {
+	session, err := ss.ById(sessionId)
+	if err != nil {
+		return err
+	}
+	if session.UserId.Hex() != userId {
+		return MongoErrNotFound
+	}
+	return ss.Delete(sessionId)
+}
+
+type sessionMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ SessionDB = &sessionMongo{}
+
+func (sm *sessionMongo) Create(session *Session) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	if session.Id == "" {
+		session.Id = bson.NewObjectId()
+	}
+	return ses.DB(sm.dbname).C(SessionCollection).Insert(session)
+}
+
+func (sm *sessionMongo) Update(session *Session) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(sm.dbname).C(SessionCollection).UpdateId(session.Id, session)
+}
+
+func (sm *sessionMongo) Delete(id string) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(sm.dbname).C(SessionCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+func (sm *sessionMongo) DeleteByUserId(userId string) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	_, err := ses.DB(sm.dbname).C(SessionCollection).RemoveAll(bson.M{"user_id": bson.ObjectIdHex(userId)})
+	return err
+}
+
+func (sm *sessionMongo) ById(id string) (*Session, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	s := Session{}
+	err := ses.DB(sm.dbname).C(SessionCollection).FindId(bson.ObjectIdHex(id)).One(&s)
+	return &s, err
+}
+
+func (sm *sessionMongo) ByToken(tokenHash string) (*Session, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	s := Session{}
+	err := ses.DB(sm.dbname).C(SessionCollection).Find(bson.M{"token_hash": tokenHash}).One(&s)
+	return &s, err
+}
+
+func (sm *sessionMongo) ByUserId(userId string) ([]Session, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	var sessions []Session
+	err := ses.DB(sm.dbname).C(SessionCollection).Find(bson.M{"user_id": bson.ObjectIdHex(userId)}).
+		Sort("-last_seen").All(&sessions)
+	return sessions, err
+}
+
+type sessionValFunc func(session *Session) error
+
+func runSessionValFuncs(session *Session, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// sessionMemory is a thread safe in-memory implementation of SessionDB.
+type sessionMemory struct {
+	mu       sync.RWMutex
+	sessions map[bson.ObjectId]Session
+}
+
+var _ SessionDB = &sessionMemory{}
+
+func newSessionMemory() *sessionMemory {
+	return &sessionMemory{
+		sessions: make(map[bson.ObjectId]Session),
+	}
+}
+
+func (sm *sessionMemory) Create(session *Session) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if session.Id == "" {
+		session.Id = bson.NewObjectId()
+	}
+	s := *session
+	s.Token = ""
+	sm.sessions[s.Id] = s
+	return nil
+}
+
+func (sm *sessionMemory) Update(session *Session) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, ok := sm.sessions[session.Id]; !ok {
+		return MongoErrNotFound
+	}
+	s := *session
+	s.Token = ""
+	sm.sessions[s.Id] = s
+	return nil
+}
+
+func (sm *sessionMemory) Delete(id string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	if _, ok := sm.sessions[oid]; !ok {
+		return MongoErrNotFound
+	}
+	delete(sm.sessions, oid)
+	return nil
+}
+
+func (sm *sessionMemory) DeleteByUserId(userId string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	uid := bson.ObjectIdHex(userId)
+	for id, s := range sm.sessions {
+		if s.UserId == uid {
+			delete(sm.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (sm *sessionMemory) ById(id string) (*Session, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	s, ok := sm.sessions[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &s, nil
+}
+
+func (sm *sessionMemory) ByToken(tokenHash string) (*Session, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for _, s := range sm.sessions {
+		if s.TokenHash == tokenHash {
+			found := s
+			return &found, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+func (sm *sessionMemory) ByUserId(userId string) ([]Session, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	uid := bson.ObjectIdHex(userId)
+	var sessions []Session
+	for _, s := range sm.sessions {
+		if s.UserId == uid {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+)
+
+const (
+	SettingsCollection = "settings"
+
+	securitySettingsId = "security"
+	clinicSettingsId   = "clinic"
+)
+
+// SecuritySettings are the security options admins can change at runtime.
+type SecuritySettings struct {
+	Id             string     `json:"-" bson:"_id"`
+	TwoFactorRoles []UserRole `json:"two_factor_roles" bson:"two_factor_roles"`
+	Updated        time.Time  `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+// RequiresTwoFactor reports whether a user with the provided roles has to use two factor authentication.
+func (s *SecuritySettings) RequiresTwoFactor(roles []UserRole) bool {
+	for _, role := range roles {
+		if UserRoleExists(role, s.TwoFactorRoles) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClinicSettings are the details of the clinic printed on the header of prescriptions and other documents.
+type ClinicSettings struct {
+	Id      string  `json:"-" bson:"_id"`
+	Name    string  `json:"name" bson:"name"`
+	Address Address `json:"address" bson:"address"`
+	Contact Contact `json:"contact" bson:"contact"`
+	// TaxNumber is the GSTIN of the clinic, printed on invoices.
+	TaxNumber string    `json:"tax_number,omitempty" bson:"tax_number,omitempty"`
+	Updated   time.Time `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+type SettingsDB interface {
+	// Security returns the stored security settings, or the defaults if none were saved yet.
+	Security() (*SecuritySettings, error)
+	SaveSecurity(settings *SecuritySettings) error
+
+	// Clinic returns the stored clinic details, or the defaults if none were saved yet.
+	Clinic() (*ClinicSettings, error)
+	SaveClinic(settings *ClinicSettings) error
+}
+
+type SettingsService interface {
+	SettingsDB
+}
+
+type settingsService struct {
+	SettingsDB
+}
+
+func NewSettingsService(mgo *mgo.Session, logger *logrus.Entry, dbname string) SettingsService {
+	return &settingsService{
+		SettingsDB: &settingsMongo{mgo, dbname, logger},
+	}
+}
+
+// NewInMemorySettingsService returns a SettingsService backed by an in-memory SettingsDB.
+func NewInMemorySettingsService() SettingsService {
+	return &settingsService{
+		SettingsDB: newSettingsMemory(),
+	}
+}
+
+func (ss *settingsService) SaveSecurity(settings *SecuritySettings) error {
+	for _, role := range settings.TwoFactorRoles {
+		if !UserRoleExists(role, UserRolesList()) {
+			return ErrUserRoleInvalid
+		}
+	}
+	settings.Id = securitySettingsId
+	settings.Updated = time.Now()
+	return ss.SettingsDB.SaveSecurity(settings)
+}
+
+func (ss *settingsService) SaveClinic(settings *ClinicSettings) error {
+	settings.Name = strings.TrimSpace(settings.Name)
+	if settings.Name == "" {
+		return ErrClinicNameRequired
+	}
+	settings.TaxNumber = strings.ToUpper(strings.TrimSpace(settings.TaxNumber))
+	settings.Id = clinicSettingsId
+	settings.Updated = time.Now()
+	return ss.SettingsDB.SaveClinic(settings)
+}
+
+// defaultClinicSettings are used until an admin saved the details of the clinic.
+func defaultClinicSettings() ClinicSettings {
+	return ClinicSettings{Id: clinicSettingsId, Name: "GCCHR Clinic"}
+}
+
+type settingsMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ SettingsDB = &settingsMongo{}
+
+func (sm *settingsMongo) Security() (*SecuritySettings, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	s := SecuritySettings{}
+	err := ses.DB(sm.dbname).C(SettingsCollection).FindId(securitySettingsId).One(&s)
+	if err == mgo.ErrNotFound {
+		return &SecuritySettings{Id: securitySettingsId}, nil
+	}
+	return &s, err
+}
+
+func (sm *settingsMongo) SaveSecurity(settings *SecuritySettings) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	_, err := ses.DB(sm.dbname).C(SettingsCollection).UpsertId(settings.Id, settings)
+	return err
+}
+
+func (sm *settingsMongo) Clinic() (*ClinicSettings, error) {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	s := ClinicSettings{}
+	err := ses.DB(sm.dbname).C(SettingsCollection).FindId(clinicSettingsId).One(&s)
+	if err == mgo.ErrNotFound {
+		s = defaultClinicSettings()
+		return &s, nil
+	}
+	return &s, err
+}
+
+func (sm *settingsMongo) SaveClinic(settings *ClinicSettings) error {
+	ses := sm.mgo.Copy()
+	defer ses.Close()
+	_, err := ses.DB(sm.dbname).C(SettingsCollection).UpsertId(settings.Id, settings)
+	return err
+}
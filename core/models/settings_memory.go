@@ -0,0 +1,49 @@
+package models
+
+import "sync"
+
+// settingsMemory is a thread safe in-memory implementation of SettingsDB.
+type settingsMemory struct {
+	mu       sync.RWMutex
+	security SecuritySettings
+	clinic   ClinicSettings
+}
+
+var _ SettingsDB = &settingsMemory{}
+
+func newSettingsMemory() *settingsMemory {
+	return &settingsMemory{
+		security: SecuritySettings{Id: securitySettingsId},
+		clinic:   defaultClinicSettings(),
+	}
+}
+
+func (sm *settingsMemory) Security() (*SecuritySettings, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	s := sm.security
+	s.TwoFactorRoles = append([]UserRole(nil), sm.security.TwoFactorRoles...)
+	return &s, nil
+}
+
+func (sm *settingsMemory) SaveSecurity(settings *SecuritySettings) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.security = *settings
+	sm.security.TwoFactorRoles = append([]UserRole(nil), settings.TwoFactorRoles...)
+	return nil
+}
+
+func (sm *settingsMemory) Clinic() (*ClinicSettings, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	s := sm.clinic
+	return &s, nil
+}
+
+func (sm *settingsMemory) SaveClinic(settings *ClinicSettings) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.clinic = *settings
+	return nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// throttlePruneInterval is how often keys without attempts in their window are dropped.
+const throttlePruneInterval = time.Minute
+
+// loginThrottle counts failed login attempts per key within a sliding window.
+// It is kept in memory, so counts are reset when the server restarts. Keys are dropped once their window passed
+// without attempts, so the keys of unknown usernames do not pile up; as attempts are limited per IP address, the
+// number of keys is limited too.
+type loginThrottle struct {
+	mu        sync.Mutex
+	failures  map[string]*throttleEntry
+	lastPrune time.Time
+}
+
+// throttleEntry holds the attempts of a key, with the window they were counted in.
+type throttleEntry struct {
+	attempts []time.Time
+	window   time.Duration
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		failures:  make(map[string]*throttleEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+// Fail records a failed attempt for the key and returns the number of failures within the window.
+func (lt *loginThrottle) Fail(key string, window time.Duration) int {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	now := time.Now()
+	lt.prune(now)
+	recent := lt.recent(key, now, window)
+	lt.set(key, append(recent, now), window)
+	return len(recent) + 1
+}
+
+// Attempt records an attempt for the key, unless max attempts were recorded within the window already. It reports
+// whether the attempt was recorded. Checking and recording under one lock makes sure that parallel attempts can not
+// all pass the check before any of them is recorded.
+func (lt *loginThrottle) Attempt(key string, window time.Duration, max int) bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	now := time.Now()
+	lt.prune(now)
+	recent := lt.recent(key, now, window)
+	if len(recent) >= max {
+		lt.set(key, recent, window)
+		return false
+	}
+	lt.set(key, append(recent, now), window)
+	return true
+}
+
+// Forgive takes back the last attempt recorded for the key, once it turned out to be successful.
+func (lt *loginThrottle) Forgive(key string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	entry, ok := lt.failures[key]
+	if !ok {
+		return
+	}
+	lt.set(key, entry.attempts[:len(entry.attempts)-1], entry.window)
+}
+
+// Reset forgets all failures of the key.
+func (lt *loginThrottle) Reset(key string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	delete(lt.failures, key)
+}
+
+// recent must be called with the lock held.
+func (lt *loginThrottle) recent(key string, now time.Time, window time.Duration) []time.Time {
+	var recent []time.Time
+	if entry, ok := lt.failures[key]; ok {
+		for _, t := range entry.attempts {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+	}
+	return recent
+}
+
+// set stores the attempts of the key, or drops the key if there are none. It must be called with the lock held.
+func (lt *loginThrottle) set(key string, attempts []time.Time, window time.Duration) {
+	if len(attempts) == 0 {
+		delete(lt.failures, key)
+		return
+	}
+	lt.failures[key] = &throttleEntry{attempts: attempts, window: window}
+}
+
+// prune drops the keys whose last attempt is older than their window, at most once per throttlePruneInterval. It
+// must be called with the lock held.
+func (lt *loginThrottle) prune(now time.Time) {
+	if now.Sub(lt.lastPrune) < throttlePruneInterval {
+		return
+	}
+	lt.lastPrune = now
+	for key, entry := range lt.failures {
+		if now.Sub(entry.attempts[len(entry.attempts)-1]) >= entry.window {
+			delete(lt.failures, key)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleAttempt(t *testing.T) {
+	lt := newLoginThrottle()
+	for i := 0; i < 3; i++ {
+		if !lt.Attempt("ip:10.0.0.1", time.Minute, 3) {
+			t.Fatalf("attempt %d refused, want 3 attempts allowed", i+1)
+		}
+	}
+	if lt.Attempt("ip:10.0.0.1", time.Minute, 3) {
+		t.Error("the fourth attempt was allowed")
+	}
+	lt.Forgive("ip:10.0.0.1")
+	if !lt.Attempt("ip:10.0.0.1", time.Minute, 3) {
+		t.Error("the attempt after a forgiven one was refused")
+	}
+}
+
+// TestLoginThrottleDropsKeys checks that keys go away once their attempts are out of the window, so that sprayed
+// usernames do not fill the memory.
+func TestLoginThrottleDropsKeys(t *testing.T) {
+	lt := newLoginThrottle()
+	for i := 0; i < 100; i++ {
+		lt.Fail(fmt.Sprintf("user:sprayed%d", i), time.Minute)
+	}
+	lt.Fail("user:recent", time.Hour)
+	if len(lt.failures) != 101 {
+		t.Fatalf("got %d keys, want 101", len(lt.failures))
+	}
+
+	// Age the attempts past the window of the sprayed keys, and the last prune past the interval.
+	past := time.Now().Add(-2 * time.Minute)
+	for _, entry := range lt.failures {
+		for i := range entry.attempts {
+			entry.attempts[i] = past
+		}
+	}
+	lt.lastPrune = past
+	lt.Fail("user:other", time.Minute)
+	if len(lt.failures) != 2 {
+		t.Errorf("got %d keys after pruning, want the recent key of the hour window and the new one", len(lt.failures))
+	}
+
+	lt.Forgive("user:other")
+	if _, ok := lt.failures["user:other"]; ok {
+		t.Error("the key is kept after its only attempt was forgiven")
+	}
+}
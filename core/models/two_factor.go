@@ -0,0 +1,287 @@
+package models
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gcchr-system/core/hash"
+	"gcchr-system/core/rand"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	totpStep        = 30 * time.Second
+	totpDigits      = 6
+	totpSecretBytes = 20
+	// totpSkew is the number of time steps before and after the current one for which codes are accepted,
+	// to allow for clock drift between the server and the authenticator app.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+// TwoFactorEnrollment holds what a user needs to add their TOTP secret to an authenticator app.
+type TwoFactorEnrollment struct {
+	// Secret is the base32 encoded secret for manual entry.
+	Secret string
+	// URI is the otpauth:// key URI, which authenticator apps can import.
+	URI string
+}
+
+// TwoFactorService manages RFC 6238 TOTP second factors and recovery codes of users.
+type TwoFactorService interface {
+	// Required reports whether the roles of the user require two factor authentication.
+	Required(user *User) (bool, error)
+	// Enroll generates a new secret for the user. It only has to be provided at login after Confirm.
+	Enroll(user *User) (*TwoFactorEnrollment, error)
+	// Enrollment returns the enrollment details of the secret stored for the user.
+	Enrollment(user *User) (*TwoFactorEnrollment, error)
+	// Confirm activates the enrolled secret if the code is valid and returns new recovery codes.
+	Confirm(user *User, code string) ([]string, error)
+	// Verify checks a TOTP code or an unused recovery code of the user. Wrong codes count as failed logins, like
+	// wrong passwords, and lock the user once there are too many.
+	Verify(user *User, code string) error
+	// RegenerateRecoveryCodes replaces the recovery codes of the user after verifying the code.
+	RegenerateRecoveryCodes(user *User, code string) ([]string, error)
+	// Disable turns off two factor authentication for the user after verifying the code.
+	Disable(user *User, code string) error
+	// Reset removes the second factor of the user without a code, for admins helping a user who lost their device.
+	Reset(user *User) error
+	// WithActor returns a TwoFactorService which records the changes to users as made by the actor, see
+	// UserService.WithActor.
+	WithActor(actor Actor) TwoFactorService
+}
+
+type twoFactorService struct {
+	users    UserService
+	settings SettingsDB
+	cipher   hash.AES
+	hmac     hash.HMAC
+	issuer   string
+	clock    Clock
+	logger   *logrus.Entry
+}
+
+func NewTwoFactorService(users UserService, settings SettingsDB, logger *logrus.Entry, encryptionKey, hmacKey, issuer string, clock Clock) TwoFactorService {
+	return &twoFactorService{
+		users:    users,
+		settings: settings,
+		cipher:   hash.NewAES(encryptionKey),
+		hmac:     hash.NewHMAC(hmacKey),
+		issuer:   issuer,
+		clock:    clock,
+		logger:   logger,
+	}
+}
+
+func (tfs *twoFactorService) WithActor(actor Actor) TwoFactorService {
+	c := *tfs
+	c.users = tfs.users.WithActor(actor)
+	return &c
+}
+
+func (tfs *twoFactorService) Required(user *User) (bool, error) {
+	security, err := tfs.settings.Security()
+	if err != nil {
+		return false, err
+	}
+	return security.RequiresTwoFactor(user.UserRoles), nil
+}
+
+func (tfs *twoFactorService) Enroll(user *User) (*TwoFactorEnrollment, error) {
+	secret, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := tfs.cipher.Encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = encrypted
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodeHashes = nil
+	if err := tfs.users.Update(user); err != nil {
+		return nil, err
+	}
+	tfs.logger.Infoln("Started two factor enrollment for user: ", user.Username)
+	return tfs.enrollment(user, secret), nil
+}
+
+func (tfs *twoFactorService) Enrollment(user *User) (*TwoFactorEnrollment, error) {
+	secret, err := tfs.secret(user)
+	if err != nil {
+		return nil, err
+	}
+	return tfs.enrollment(user, secret), nil
+}
+
+func (tfs *twoFactorService) Confirm(user *User, code string) ([]string, error) {
+	if err := tfs.verifyTOTP(user, code); err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	codes, err := tfs.newRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := tfs.users.Update(user); err != nil {
+		return nil, err
+	}
+	tfs.logger.Infoln("Enabled two factor authentication for user: ", user.Username)
+	return codes, nil
+}
+
+func (tfs *twoFactorService) Verify(user *User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnrolled
+	}
+	if user.Locked() {
+		return ErrTooManyLoginAttempts
+	}
+	code = strings.TrimSpace(code)
+	var err error
+	if len(code) == totpDigits {
+		if err = tfs.verifyTOTP(user, code); err == nil {
+			err = tfs.users.Update(user)
+		}
+	} else {
+		err = tfs.useRecoveryCode(user, code)
+	}
+	if err == ErrTwoFactorCodeInvalid {
+		if ferr := tfs.users.FailLogin(user); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if user.FailedLogins > 0 {
+		if err := tfs.users.ClearFailedLogins(user.Id); err != nil {
+			return err
+		}
+		user.FailedLogins = 0
+	}
+	return nil
+}
+
+func (tfs *twoFactorService) RegenerateRecoveryCodes(user *User, code string) ([]string, error) {
+	if err := tfs.Verify(user, code); err != nil {
+		return nil, err
+	}
+	codes, err := tfs.newRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := tfs.users.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (tfs *twoFactorService) Disable(user *User, code string) error {
+	required, err := tfs.Required(user)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrTwoFactorRequired
+	}
+	if err := tfs.Verify(user, code); err != nil {
+		return err
+	}
+	return tfs.Reset(user)
+}
+
+func (tfs *twoFactorService) Reset(user *User) error {
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodeHashes = nil
+	tfs.logger.Infoln("Removed two factor authentication of user: ", user.Username)
+	return tfs.users.Update(user)
+}
+
+// verifyTOTP checks the code against the time steps around the current time.
+// A code for a time step which was already used is rejected, so a code can not be replayed.
+func (tfs *twoFactorService) verifyTOTP(user *User, code string) error {
+	secret, err := tfs.secret(user)
+	if err != nil {
+		return err
+	}
+	code = strings.TrimSpace(code)
+	current := tfs.clock.Now().Unix() / int64(totpStep/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+		if hash.HOTP(secret, uint64(step), totpDigits) == code {
+			user.TOTPLastStep = step
+			return nil
+		}
+	}
+	return ErrTwoFactorCodeInvalid
+}
+
+func (tfs *twoFactorService) useRecoveryCode(user *User, code string) error {
+	h := tfs.hmac.Hash(normalizeRecoveryCode(code))
+	for i, stored := range user.RecoveryCodeHashes {
+		if stored == h {
+			user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+			tfs.logger.Infof("User %s used a recovery code, %d left", user.Username, len(user.RecoveryCodeHashes))
+			return tfs.users.Update(user)
+		}
+	}
+	return ErrTwoFactorCodeInvalid
+}
+
+// newRecoveryCodes replaces the recovery codes of the user. Only their hashes are kept on the user.
+func (tfs *twoFactorService) newRecoveryCodes(user *User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = tfs.hmac.Hash(code)
+	}
+	user.RecoveryCodeHashes = hashes
+	return codes, nil
+}
+
+func (tfs *twoFactorService) secret(user *User) ([]byte, error) {
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	return tfs.cipher.Decrypt(user.TOTPSecret)
+}
+
+func (tfs *twoFactorService) enrollment(user *User, secret []byte) *TwoFactorEnrollment {
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	label := url.PathEscape(fmt.Sprintf("%s:%s", tfs.issuer, user.Username))
+	params := url.Values{}
+	params.Set("secret", encoded)
+	params.Set("issuer", tfs.issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpStep/time.Second)))
+	return &TwoFactorEnrollment{
+		Secret: encoded,
+		URI:    "otpauth://totp/" + label + "?" + params.Encode(),
+	}
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.Replace(code, "-", "", -1)
+}
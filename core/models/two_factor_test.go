@@ -0,0 +1,170 @@
+package models
+
+import (
+	"encoding/base32"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"gcchr-system/core/hash"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// fakeClock is a Clock which reads a time set by the test.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// twoFactorTest holds a user with a confirmed second factor, the decoded secret and the clock of the service.
+type twoFactorTest struct {
+	tfs           TwoFactorService
+	users         UserService
+	user          *User
+	secret        []byte
+	clock         *fakeClock
+	recoveryCodes []string
+}
+
+func newTwoFactorTest(t *testing.T) *twoFactorTest {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	entry := logrus.NewEntry(logger)
+	passwords, err := PasswordPolicy{MinLength: 8}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := NewInMemoryUserService(entry, "pepper", "hmac-key", DefaultLoginPolicy(), passwords)
+	user := &User{
+		Name:      "Asha Menon",
+		Username:  "drasha",
+		Password:  "Heal-Well-42z",
+		UserRoles: []UserRole{UserRolePhysician},
+	}
+	if err := users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	tfs := NewTwoFactorService(users, NewInMemorySettingsService(), entry, "encryption-key", "hmac-key", "GCCHR",
+		clock)
+
+	enrollment, err := tfs.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &twoFactorTest{tfs: tfs, users: users, user: user, secret: secret, clock: clock}
+	test.recoveryCodes, err = tfs.Confirm(user, test.code(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test
+}
+
+// step returns the current time step of the clock.
+func (test *twoFactorTest) step() int64 {
+	return test.clock.now.Unix() / int64(totpStep/time.Second)
+}
+
+// code returns the code of the authenticator app for the time step offset from the current one.
+func (test *twoFactorTest) code(offset int64) string {
+	return hash.HOTP(test.secret, uint64(test.step()+offset), totpDigits)
+}
+
+// stored returns the user as saved, so that checks do not depend on the changes Verify made to its argument.
+func (test *twoFactorTest) stored(t *testing.T) *User {
+	user, err := test.users.ById(test.user.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestTwoFactorSkew(t *testing.T) {
+	test := newTwoFactorTest(t)
+	test.clock.now = test.clock.now.Add(10 * totpStep)
+
+	if err := test.tfs.Verify(test.stored(t), test.code(-1)); err != nil {
+		t.Errorf("the code of the previous time step was rejected: %v", err)
+	}
+	if err := test.tfs.Verify(test.stored(t), test.code(0)); err != nil {
+		t.Errorf("the code of the current time step was rejected: %v", err)
+	}
+	if err := test.tfs.Verify(test.stored(t), test.code(1)); err != nil {
+		t.Errorf("the code of the next time step was rejected: %v", err)
+	}
+	if err := test.tfs.Verify(test.stored(t), test.code(2)); err != ErrTwoFactorCodeInvalid {
+		t.Errorf("got %v for the code two time steps ahead, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+	test.clock.now = test.clock.now.Add(10 * totpStep)
+	if err := test.tfs.Verify(test.stored(t), test.code(-2)); err != ErrTwoFactorCodeInvalid {
+		t.Errorf("got %v for the code two time steps behind, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+}
+
+func TestTwoFactorReplay(t *testing.T) {
+	test := newTwoFactorTest(t)
+	if err := test.tfs.Verify(test.stored(t), test.code(0)); err != ErrTwoFactorCodeInvalid {
+		t.Errorf("got %v for the code used to confirm the secret, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+
+	test.clock.now = test.clock.now.Add(totpStep)
+	code := test.code(0)
+	if err := test.tfs.Verify(test.stored(t), code); err != nil {
+		t.Fatalf("the code of the next time step was rejected: %v", err)
+	}
+	if last := test.stored(t).TOTPLastStep; last != test.step() {
+		t.Errorf("got TOTPLastStep %d, want the time step %d of the used code", last, test.step())
+	}
+	if err := test.tfs.Verify(test.stored(t), code); err != ErrTwoFactorCodeInvalid {
+		t.Errorf("got %v for the replayed code, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+	// The code of the previous step is within the skew, but older than the code used.
+	if err := test.tfs.Verify(test.stored(t), test.code(-1)); err != ErrTwoFactorCodeInvalid {
+		t.Errorf("got %v for the code before the used one, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	test := newTwoFactorTest(t)
+	if len(test.recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(test.recoveryCodes), recoveryCodeCount)
+	}
+	code := test.recoveryCodes[0]
+	if err := test.tfs.Verify(test.stored(t), code); err != nil {
+		t.Fatalf("the recovery code was rejected: %v", err)
+	}
+	if left := len(test.stored(t).RecoveryCodeHashes); left != recoveryCodeCount-1 {
+		t.Errorf("got %d recovery codes left, want %d", left, recoveryCodeCount-1)
+	}
+	if err := test.tfs.Verify(test.stored(t), code); err != ErrTwoFactorCodeInvalid {
+		t.Errorf("got %v for the used recovery code, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+	if err := test.tfs.Verify(test.stored(t), " "+test.recoveryCodes[1]+" "); err != nil {
+		t.Errorf("another recovery code was rejected: %v", err)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	test := newTwoFactorTest(t)
+	test.clock.now = test.clock.now.Add(10 * totpStep)
+	wrong := test.code(5)
+	for i := 1; i < DefaultLoginPolicy().MaxFailedAttempts; i++ {
+		if err := test.tfs.Verify(test.stored(t), wrong); err != ErrTwoFactorCodeInvalid {
+			t.Fatalf("got %v for wrong code %d, want %v", err, i, ErrTwoFactorCodeInvalid)
+		}
+	}
+	if err := test.tfs.Verify(test.stored(t), wrong); err != ErrTooManyLoginAttempts {
+		t.Fatalf("got %v for the last wrong code, want %v", err, ErrTooManyLoginAttempts)
+	}
+	if err := test.tfs.Verify(test.stored(t), test.code(0)); err != ErrTooManyLoginAttempts {
+		t.Errorf("got %v for a valid code of a locked user, want %v", err, ErrTooManyLoginAttempts)
+	}
+}
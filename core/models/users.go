@@ -4,12 +4,11 @@ import (
 	"time"
 
 	"gcchr-system/core/hash"
+	"gcchr-system/core/rand"
 	"regexp"
 
 	"strings"
 
-	"gcchr-system/core/rand"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
@@ -17,17 +16,32 @@ import (
 )
 
 const (
+	// PasswordResetLifetime is how long a password reset token stays valid.
+	PasswordResetLifetime = 24 * time.Hour
+
 	UserCollection             = "user"
 	UserRoleAdmin     UserRole = "admin"
 	UserRolePhysician UserRole = "physician"
 	UserRoleStaff     UserRole = "staff"
 	UserRoleReception UserRole = "reception"
+	// UserRoleService is for accounts of scripts and other systems, which use API tokens issued by an admin.
+	UserRoleService UserRole = "service"
 )
 
 type UserRole string
 
 func UserRolesList() []UserRole {
-	return []UserRole{UserRoleAdmin, UserRolePhysician, UserRoleStaff, UserRoleReception}
+	return []UserRole{UserRoleAdmin, UserRolePhysician, UserRoleStaff, UserRoleReception, UserRoleService}
+}
+
+// UserRoleExists reports whether role is one of roles.
+func UserRoleExists(role UserRole, roles []UserRole) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 type User struct {
@@ -37,29 +51,70 @@ type User struct {
 	Username     string        `json:"username" bson:"username"`
 	Password     string        `json:"password" bson:"-"`
 	PasswordHash string        `json:"password_hash" bson:"password_hash"`
-	Remember     string        `json:"remember" bson:"-"`
-	RememberHash string        `json:"remember_hash" bson:"remember_hash"`
 	Created      time.Time     `json:"created" bson:"created"`
 	Updated      time.Time     `json:"updated,omitempty" bson:"updated,omitempty"`
 	LastLogin    time.Time     `json:"lastLogin,omitempty" bson:"lastLogin,omitempty"`
 	Contact      Contact       `json:"contact,omitempty" bson:"contact,omitempty"`
 	Addresses    []Address     `json:"addresses,omitempty" bson:"addresses,omitempty"`
 	ProfileId    string        `json:"profileId,omitempty" bson:"profileId,omitempty"`
+	// RegistrationNumber is the medical council registration of physicians, printed on prescriptions.
+	RegistrationNumber string    `json:"registration_number,omitempty" bson:"registration_number,omitempty"`
+	Disabled           bool      `json:"disabled" bson:"disabled"`
+	FailedLogins       int       `json:"failed_logins" bson:"failed_logins"`
+	LockedUntil        time.Time `json:"locked_until,omitempty" bson:"locked_until,omitempty"`
+
+	// MustChangePassword forces the user to choose a new password before using the system.
+	MustChangePassword bool      `json:"must_change_password" bson:"must_change_password"`
+	ResetToken         string    `json:"-" bson:"-"`
+	ResetTokenHash     string    `json:"-" bson:"reset_token_hash,omitempty"`
+	ResetTokenExpires  time.Time `json:"-" bson:"reset_token_expires,omitempty"`
+	// PasswordHistory holds the hashes of previous passwords, newest first, see PasswordPolicy.
+	PasswordHistory []string `json:"-" bson:"password_history,omitempty"`
+
+	// Two factor authentication, see TwoFactorService.
+	TOTPSecret         string   `json:"-" bson:"totp_secret,omitempty"`
+	TOTPEnabled        bool     `json:"totp_enabled" bson:"totp_enabled"`
+	TOTPLastStep       int64    `json:"-" bson:"totp_last_step,omitempty"`
+	RecoveryCodeHashes []string `json:"-" bson:"recovery_code_hashes,omitempty"`
+}
+
+// HasRole reports whether the user has at least one of the provided roles.
+func (u *User) HasRole(roles ...UserRole) bool {
+	for _, role := range roles {
+		if UserRoleExists(role, u.UserRoles) {
+			return true
+		}
+	}
+	return false
+}
+
+// Locked reports whether the user is locked out after too many failed login attempts.
+func (u *User) Locked() bool {
+	return time.Now().Before(u.LockedUntil)
 }
 
 type UserDB interface {
 	// Single user fetch methods
 	ByUsername(username string) (*User, error)
 	ById(id string) (*User, error)
-	ByRemember(token string) (*User, error)
+	ByResetToken(token string) (*User, error)
 
 	// List of users fetch methods
 	ByUserRole(userRole UserRole) ([]User, error)
+	// All returns all users ordered by their Id.
+	All() ([]User, error)
 
 	// Data modifying methods
 	Create(user *User) error
 	Update(user *User) error
 	Delete(id string) error
+
+	// AddFailedLogin counts a failed login of the user without touching the other fields of the user. Once
+	// maxAttempts failures are counted, the count is cleared and the user is locked until lockedUntil.
+	// It reports whether the user is locked.
+	AddFailedLogin(id bson.ObjectId, maxAttempts int, lockedUntil time.Time) (bool, error)
+	// ClearFailedLogins removes the failed logins and the lockout of the user.
+	ClearFailedLogins(id bson.ObjectId) error
 }
 
 type userValidator struct {
@@ -67,25 +122,27 @@ type userValidator struct {
 	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
 	pepper     string
+	passwords  PasswordPolicy
 	logger     *logrus.Entry
 }
 
 var _ UserDB = &userValidator{}
 
-func newUserValidator(udb UserDB, logger *logrus.Entry, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, logger *logrus.Entry, hmac hash.HMAC, pepper string, passwords PasswordPolicy) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
 		hmac:       hmac,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 		pepper:     pepper,
+		passwords:  passwords,
 		logger:     logger,
 	}
 }
 
 func (uv *userValidator) Create(user *User) error {
-	if err := runUserValFuncs(user, uv.passwordRequired, uv.passwordMinLength, uv.bcryptPassword,
-		uv.passwordHashRequired, uv.setRememberIfUnset, uv.rememberMinBytes, uv.hmacRemember, uv.rememberHashRequired,
-		uv.requireUsername, uv.usernameIsAvailable, uv.requireUserRoles, uv.ensureCreatedAt); err != nil {
+	if err := runUserValFuncs(user, uv.passwordRequired, uv.passwordMinLength, uv.passwordCharClasses,
+		uv.passwordNoPersonalInfo, uv.passwordNotBanned, uv.bcryptPassword, uv.passwordHashRequired, uv.requireUsername, uv.usernameIsAvailable, uv.requireUserRoles, uv.normalizeEmail,
+		uv.emailFormat, uv.ensureCreatedAt); err != nil {
 		return err
 	}
 	return uv.UserDB.Create(user)
@@ -94,8 +151,10 @@ func (uv *userValidator) Create(user *User) error {
 // Update will update the provided the user with all of the data
 // provided in the user object.
 func (uv *userValidator) Update(user *User) error {
-	if err := runUserValFuncs(user, uv.passwordMinLength, uv.bcryptPassword, uv.passwordHashRequired, uv.rememberMinBytes,
-		uv.hmacRemember, uv.rememberHashRequired, uv.usernameIsAvailable, uv.requireUserRoles, uv.ensureUpdatedAt); err != nil {
+	if err := runUserValFuncs(user, uv.passwordMinLength, uv.passwordCharClasses, uv.passwordNoPersonalInfo,
+		uv.passwordNotBanned, uv.passwordNotReused, uv.rememberPassword, uv.bcryptPassword, uv.passwordHashRequired,
+		uv.hmacResetToken, uv.usernameIsAvailable, uv.requireUserRoles, uv.normalizeEmail, uv.emailFormat, uv.keepLastAdmin,
+		uv.ensureUpdatedAt); err != nil {
 		return err
 	}
 	user.Updated = time.Now()
@@ -103,10 +162,20 @@ func (uv *userValidator) Update(user *User) error {
 }
 
 // Delete will delete the user with provided user Id.
+// The last active admin can not be deleted.
 func (uv *userValidator) Delete(id string) error {
 	if err := uv.isValidId(id); err != nil {
 		return err
 	}
+	existing, err := uv.UserDB.ById(id)
+	if err != nil {
+		return err
+	}
+	if existing.HasRole(UserRoleAdmin) && !existing.Disabled {
+		if err := uv.otherAdminExists(existing.Id); err != nil {
+			return err
+		}
+	}
 	return uv.UserDB.Delete(id)
 }
 
@@ -127,14 +196,18 @@ func (uv *userValidator) ById(id string) (*User, error) {
 	return uv.UserDB.ById(id)
 }
 
-func (uv *userValidator) ByRemember(token string) (*User, error) {
+// ByResetToken hashes the token and looks up the user it was issued for.
+func (uv *userValidator) ByResetToken(token string) (*User, error) {
 	user := User{
-		Remember: token,
+		ResetToken: token,
 	}
-	if err := runUserValFuncs(&user, uv.hmacRemember); err != nil {
+	if err := runUserValFuncs(&user, uv.hmacResetToken); err != nil {
 		return nil, err
 	}
-	return uv.UserDB.ByRemember(user.RememberHash)
+	if user.ResetTokenHash == "" {
+		return nil, ErrResetTokenInvalid
+	}
+	return uv.UserDB.ByResetToken(user.ResetTokenHash)
 }
 
 func (uv *userValidator) isValidId(id string) error {
@@ -171,6 +244,9 @@ func (uv *userValidator) requireUserRoles(user *User) error {
 }
 
 func (uv *userValidator) emailFormat(user *User) error {
+	if user.Contact.Email == "" {
+		return nil
+	}
 	if !uv.emailRegex.MatchString(user.Contact.Email) {
 		return ErrEmailInvalid
 	}
@@ -201,6 +277,36 @@ func (uv *userValidator) usernameIsAvailable(user *User) error {
 	return nil
 }
 
+// keepLastAdmin makes sure that an update does not remove the admin role from,
+// or disable, the last active admin.
+func (uv *userValidator) keepLastAdmin(user *User) error {
+	if user.HasRole(UserRoleAdmin) && !user.Disabled {
+		return nil
+	}
+	existing, err := uv.UserDB.ById(user.Id.Hex())
+	if err != nil {
+		return err
+	}
+	if !existing.HasRole(UserRoleAdmin) || existing.Disabled {
+		return nil
+	}
+	return uv.otherAdminExists(user.Id)
+}
+
+// otherAdminExists returns ErrLastAdmin if there is no active admin other than the user with the provided id.
+func (uv *userValidator) otherAdminExists(id bson.ObjectId) error {
+	admins, err := uv.UserDB.ByUserRole(UserRoleAdmin)
+	if err != nil {
+		return err
+	}
+	for _, admin := range admins {
+		if admin.Id != id && !admin.Disabled {
+			return nil
+		}
+	}
+	return ErrLastAdmin
+}
+
 //func (uv *userValidator) emailIsAvailable(user *User) error {
 //	existing, err := uv.ByEmail(user.Email)
 //	if err != nil && err.Error() == MongoErrNotFound.Error() {
@@ -235,6 +341,15 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	return nil
 }
 
+func (uv *userValidator) hmacResetToken(user *User) error {
+	if user.ResetToken == "" {
+		return nil
+	}
+	user.ResetTokenHash = uv.hmac.Hash(user.ResetToken)
+	user.ResetToken = ""
+	return nil
+}
+
 func (uv *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
 		return ErrPasswordRequired
@@ -249,84 +364,74 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) passwordMinLength(user *User) error {
-	if user.Password == "" {
-		return nil
-	}
-	if len(user.Password) < 8 {
-		return ErrPasswordTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-
-	token, err := rand.RemeberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return ErrRememberTokenTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberTokenRequired
-	}
-	return nil
-}
-
 type UserService interface {
-	Authenticate(email, password string) (*User, error)
+	// Authenticate checks the credentials of a login attempt from the client with the provided ip.
+	Authenticate(username, password, ip string) (*User, error)
+	// FailLogin counts a failed login of the user, like a wrong second factor, and returns ErrTooManyLoginAttempts
+	// once the user is locked.
+	FailLogin(user *User) error
+	// Unlock clears the failed login attempts and lockout of the user.
+	Unlock(user *User) error
+	// ChangePassword sets a new password for the user after checking their current password.
+	ChangePassword(user *User, current, password string) error
+	// CreateResetToken issues a single use password reset token for the user, valid for PasswordResetLifetime.
+	// Only the HMAC of the token is stored.
+	CreateResetToken(user *User) (string, error)
+	// ResetPassword sets a new password for the user the token was issued for, and invalidates the token.
+	ResetPassword(token, password string) (*User, error)
 	EnsureAdmin() error
+	// WithActor returns a UserService which records changes as made by the actor, see NewAuditedUserService.
+	WithActor(actor Actor) UserService
 	UserDB
 }
 
 type userService struct {
 	UserDB
 	pepper string
-	logger *logrus.Entry
+	// dummyHash is compared with the password of unknown usernames, so that they take as long to check as
+	// existing ones.
+	dummyHash []byte
+	policy    LoginPolicy
+	throttle  *loginThrottle
+	logger    *logrus.Entry
 }
 
-func NewUserService(mgo *mgo.Session, logger *logrus.Entry, dbname, pepper, hmacKey string) UserService {
+func NewUserService(mgo *mgo.Session, logger *logrus.Entry, dbname, pepper, hmacKey string, policy LoginPolicy, passwords PasswordPolicy) UserService {
 	um := &userMongo{mgo, dbname, logger}
+	return newUserService(um, logger, pepper, hmacKey, policy, passwords)
+}
+
+// NewInMemoryUserService returns a UserService backed by an in-memory UserDB,
+// for use in tests and for running without MongoDB.
+func NewInMemoryUserService(logger *logrus.Entry, pepper, hmacKey string, policy LoginPolicy, passwords PasswordPolicy) UserService {
+	return newUserService(newUserMemory(), logger, pepper, hmacKey, policy, passwords)
+}
+
+func newUserService(udb UserDB, logger *logrus.Entry, pepper, hmacKey string, policy LoginPolicy, passwords PasswordPolicy) UserService {
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(um, logger, hmac, pepper)
+	uv := newUserValidator(udb, logger, hmac, pepper, passwords)
 
 	// Returns an instance of UserService which calls its methods from UserDB which is actually an instance of
-	// userValidator, which in turn calls its methods of UserDB which is actually an instance of um.
+	// userValidator, which in turn calls its methods of UserDB which is actually an instance of udb.
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"+pepper), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Errorf("Error while hashing the dummy password: %v", err)
+	}
 	return &userService{
-		UserDB: uv,
-		pepper: pepper,
-		logger: logger,
+		UserDB:    uv,
+		pepper:    pepper,
+		dummyHash: dummyHash,
+		policy:    policy.withDefaults(),
+		throttle:  newLoginThrottle(),
+		logger:    logger,
 	}
 }
 
+// WithActor returns the service itself, changes are only recorded by an audited user service.
+func (us *userService) WithActor(actor Actor) UserService {
+	return us
+}
+
 func (us *userService) EnsureAdmin() error {
 	us.logger.Debugln("Ensuring Admin with username: admin")
 	username := "admin"
@@ -334,38 +439,181 @@ func (us *userService) EnsureAdmin() error {
 		UserRoles: []UserRole{UserRoleAdmin},
 		Username:  username,
 		Name:      "GCCHR Admin",
-		Password:  "adminPass",
+		Password:  seededAdminPasswords[0],
 		Created:   time.Now(),
+		// The default password is well known, so it has to be replaced on the first login.
+		MustChangePassword: true,
 	}
-	_, err := us.UserDB.ByUsername(username)
+	existing, err := us.UserDB.ByUsername(username)
 	if err != nil {
 		us.logger.Debugln("Creating default admin user with username: ", username)
 		return us.UserDB.Create(u)
-	} else {
-		us.logger.Debugln("Admin exists with username: ", username)
+	}
+	us.logger.Debugln("Admin exists with username: ", username)
+	// Admins seeded before the password had to be changed may still have the well known password.
+	if !existing.MustChangePassword && us.hasSeededPassword(existing) {
+		us.logger.Warnln("Admin still has the seeded password, it has to be changed on the next login")
+		existing.MustChangePassword = true
+		return us.UserDB.Update(existing)
 	}
 	return nil
 }
 
+// seededAdminPasswords are the passwords the admin was created with, the current one first.
+var seededAdminPasswords = []string{"Welcome-2Clinic", "adminPass"}
+
+func (us *userService) hasSeededPassword(user *User) bool {
+	for _, password := range seededAdminPasswords {
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+us.pepper)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Authenticate user with provided username and password.
-func (us *userService) Authenticate(username, password string) (*User, error) {
+// Unknown usernames and wrong passwords both return ErrInvalidCredentials, so that a client can not find out
+// which usernames exist. Too many failures for a username or from an ip return ErrTooManyLoginAttempts.
+func (us *userService) Authenticate(username, password, ip string) (*User, error) {
+	// Every attempt is counted for the ip before the password is checked, so that parallel attempts can not all
+	// pass the limit before their failures are counted. Successful attempts are taken back.
+	ipKey := "ip:" + ip
+	if !us.throttle.Attempt(ipKey, us.policy.ipWindow(), us.policy.MaxFailedPerIP) {
+		us.logger.Warnf("Login from %s blocked, too many failed attempts", ip)
+		return nil, ErrTooManyLoginAttempts
+	}
+
 	foundUser, err := us.ByUsername(username)
 	if err != nil {
-		return nil, err
+		if err.Error() != MongoErrNotFound.Error() {
+			return nil, err
+		}
+		// Unknown usernames take as long as wrong passwords and are locked in memory just like existing ones,
+		// otherwise the response time or the lockout message would reveal that the username exists.
+		bcrypt.CompareHashAndPassword(us.dummyHash, []byte(password+us.pepper))
+		userKey := "user:" + username
+		if us.throttle.Fail(userKey, us.policy.lockout()) >= us.policy.MaxFailedAttempts {
+			return nil, ErrTooManyLoginAttempts
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if foundUser.Locked() {
+		bcrypt.CompareHashAndPassword(us.dummyHash, []byte(password+us.pepper))
+		return nil, ErrTooManyLoginAttempts
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+us.pepper))
 	if err != nil {
 		switch err {
 		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
+			if err := us.FailLogin(foundUser); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidCredentials
 		default:
 			return nil, err
 		}
 	}
+	us.throttle.Forgive(ipKey)
+	if foundUser.Disabled {
+		return nil, ErrUserDisabled
+	}
+	// The failures of users with a second factor are cleared once it is verified, otherwise a correct password
+	// would allow to guess the second factor without limit.
+	if foundUser.TOTPEnabled {
+		return foundUser, nil
+	}
+	if foundUser.FailedLogins > 0 || !foundUser.LockedUntil.IsZero() {
+		if err := us.Unlock(foundUser); err != nil {
+			return nil, err
+		}
+	}
 	return foundUser, nil
 }
 
+// FailLogin changes the count on its own, so parallel failures are all counted and changes made to the user in the
+// meantime are kept.
+func (us *userService) FailLogin(user *User) error {
+	locked, err := us.UserDB.AddFailedLogin(user.Id, us.policy.MaxFailedAttempts, time.Now().Add(us.policy.lockout()))
+	if err != nil {
+		return err
+	}
+	if locked {
+		us.logger.Warnf("Locking user %s after %d failed login attempts", user.Username, us.policy.MaxFailedAttempts)
+		return ErrTooManyLoginAttempts
+	}
+	return nil
+}
+
+func (us *userService) Unlock(user *User) error {
+	if err := us.UserDB.ClearFailedLogins(user.Id); err != nil {
+		return err
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+	us.throttle.Reset("user:" + user.Username)
+	return nil
+}
+
+func (us *userService) ChangePassword(user *User, current, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(current+us.pepper))
+	if err != nil {
+		switch err {
+		case bcrypt.ErrMismatchedHashAndPassword:
+			return ErrPasswordIncorrect
+		default:
+			return err
+		}
+	}
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	user.Password = password
+	user.MustChangePassword = false
+	return us.UserDB.Update(user)
+}
+
+func (us *userService) CreateResetToken(user *User) (string, error) {
+	token, err := rand.RemeberToken()
+	if err != nil {
+		return "", err
+	}
+	user.ResetToken = token
+	user.ResetTokenExpires = time.Now().Add(PasswordResetLifetime)
+	if err := us.UserDB.Update(user); err != nil {
+		return "", err
+	}
+	us.logger.Infoln("Created password reset token for user: ", user.Username)
+	return token, nil
+}
+
+func (us *userService) ResetPassword(token, password string) (*User, error) {
+	user, err := us.UserDB.ByResetToken(token)
+	if err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return nil, ErrResetTokenInvalid
+		}
+		return nil, err
+	}
+	if !time.Now().Before(user.ResetTokenExpires) {
+		return nil, ErrResetTokenInvalid
+	}
+	if password == "" {
+		return nil, ErrPasswordRequired
+	}
+	user.Password = password
+	user.MustChangePassword = false
+	user.ResetTokenHash = ""
+	user.ResetTokenExpires = time.Time{}
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+	if err := us.UserDB.Update(user); err != nil {
+		return nil, err
+	}
+	us.logger.Infoln("Password reset with token for user: ", user.Username)
+	return user, nil
+}
+
 type userMongo struct {
 	mgo    *mgo.Session
 	dbname string
@@ -380,6 +628,9 @@ func (um *userMongo) Create(user *User) error {
 	um.logger.Infoln("creating user with username: ", user.Username)
 	ses := um.mgo.Copy()
 	defer ses.Close()
+	if user.Id == "" {
+		user.Id = bson.NewObjectId()
+	}
 	return ses.DB(um.dbname).C(UserCollection).Insert(user)
 }
 
@@ -395,6 +646,35 @@ func (um *userMongo) Update(user *User) error {
 	return ses.DB(um.dbname).C(UserCollection).UpdateId(user.Id, user)
 }
 
+func (um *userMongo) AddFailedLogin(id bson.ObjectId, maxAttempts int, lockedUntil time.Time) (bool, error) {
+	ses := um.mgo.Copy()
+	defer ses.Close()
+	c := ses.DB(um.dbname).C(UserCollection)
+	u := User{}
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"failed_logins": 1}}, ReturnNew: true}
+	if _, err := c.FindId(id).Apply(change, &u); err != nil {
+		return false, err
+	}
+	if u.FailedLogins < maxAttempts {
+		return false, nil
+	}
+	// Of the failures reaching the limit at the same time, the first one locks the user and clears the count,
+	// the others do not find the count any more.
+	err := c.Update(bson.M{"_id": id, "failed_logins": bson.M{"$gte": maxAttempts}},
+		bson.M{"$set": bson.M{"failed_logins": 0, "locked_until": lockedUntil}})
+	if err != nil && err != mgo.ErrNotFound {
+		return false, err
+	}
+	return true, nil
+}
+
+func (um *userMongo) ClearFailedLogins(id bson.ObjectId) error {
+	ses := um.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(um.dbname).C(UserCollection).UpdateId(id,
+		bson.M{"$set": bson.M{"failed_logins": 0}, "$unset": bson.M{"locked_until": ""}})
+}
+
 func (um *userMongo) ById(id string) (*User, error) {
 	ses := um.mgo.Copy()
 	defer ses.Close()
@@ -403,20 +683,20 @@ func (um *userMongo) ById(id string) (*User, error) {
 	return &u, err
 }
 
-func (um *userMongo) ByUsername(username string) (*User, error) {
-	um.logger.Debugln("Fetching user by username: ", username)
+func (um *userMongo) ByResetToken(tokenHash string) (*User, error) {
 	ses := um.mgo.Copy()
 	defer ses.Close()
 	u := User{}
-	err := ses.DB(um.dbname).C(UserCollection).Find(bson.M{"username": username}).One(&u)
+	err := ses.DB(um.dbname).C(UserCollection).Find(bson.M{"reset_token_hash": tokenHash}).One(&u)
 	return &u, err
 }
 
-func (um *userMongo) ByRemember(token string) (*User, error) {
+func (um *userMongo) ByUsername(username string) (*User, error) {
+	um.logger.Debugln("Fetching user by username: ", username)
 	ses := um.mgo.Copy()
 	defer ses.Close()
 	u := User{}
-	err := ses.DB(um.dbname).C(UserCollection).Find(bson.M{"remember_hash": token}).One(&u)
+	err := ses.DB(um.dbname).C(UserCollection).Find(bson.M{"username": username}).One(&u)
 	return &u, err
 }
 
@@ -431,6 +711,15 @@ func (um *userMongo) ByUserRole(userRole UserRole) ([]User, error) {
 	return users, err
 }
 
+// TODO: implement paging
+func (um *userMongo) All() ([]User, error) {
+	ses := um.mgo.Copy()
+	defer ses.Close()
+	var users []User
+	err := ses.DB(um.dbname).C(UserCollection).Find(nil).Sort("_id").All(&users)
+	return users, err
+}
+
 type userValFunc func(user *User) error
 
 func runUserValFuncs(user *User, fns ...userValFunc) error {
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo/bson"
+)
+
+// redactedUserFields are secrets of which only the fact that they changed is recorded, by their audit field name.
+// All other fields with a json:"-" tag are left out of the audit log.
+var redactedUserFields = map[string]string{
+	"PasswordHash":       "password",
+	"ResetTokenHash":     "reset_token",
+	"RecoveryCodeHashes": "recovery_codes",
+}
+
+// ignoredUserFields change on their own and would only add noise to the audit log.
+var ignoredUserFields = map[string]bool{
+	"Password": true,
+	"Updated":  true,
+	// Successful logins are recorded as AuditLogin entries.
+	"LastLogin": true,
+}
+
+// auditedUserService is a UserService which records logins and changes to users in the audit log.
+type auditedUserService struct {
+	UserService
+	audit  AuditService
+	actor  Actor
+	logger *logrus.Entry
+}
+
+// NewAuditedUserService wraps the user service so that logins and changes to users are recorded.
+// Use WithActor to record who made a change.
+func NewAuditedUserService(us UserService, audit AuditService, logger *logrus.Entry) UserService {
+	return &auditedUserService{
+		UserService: us,
+		audit:       audit,
+		logger:      logger,
+	}
+}
+
+func (aus *auditedUserService) WithActor(actor Actor) UserService {
+	c := *aus
+	c.actor = actor
+	return &c
+}
+
+// Authenticate records failed logins. Successful logins are recorded once the session is started, after the
+// second factor.
+func (aus *auditedUserService) Authenticate(username, password, ip string) (*User, error) {
+	user, err := aus.UserService.Authenticate(username, password, ip)
+	if err != nil {
+		aus.record(Actor{Username: username, IP: ip}, AuditLoginFailed, nil, nil, auditDetail(err))
+		return nil, err
+	}
+	return user, nil
+}
+
+func (aus *auditedUserService) Create(user *User) error {
+	if err := aus.UserService.Create(user); err != nil {
+		return err
+	}
+	aus.record(aus.actor, AuditUserCreate, user, diffUsers(&User{}, user), "")
+	return nil
+}
+
+func (aus *auditedUserService) Update(user *User) error {
+	before, err := aus.UserService.ById(user.Id.Hex())
+	if err != nil {
+		before = &User{}
+	}
+	if err := aus.UserService.Update(user); err != nil {
+		return err
+	}
+	aus.recordUpdate(before, user, "")
+	return nil
+}
+
+func (aus *auditedUserService) Delete(id string) error {
+	before, err := aus.UserService.ById(id)
+	if err != nil {
+		return err
+	}
+	if err := aus.UserService.Delete(id); err != nil {
+		return err
+	}
+	aus.record(aus.actor, AuditUserDelete, before, diffUsers(before, &User{}), "")
+	return nil
+}
+
+func (aus *auditedUserService) Unlock(user *User) error {
+	before := *user
+	if err := aus.UserService.Unlock(user); err != nil {
+		return err
+	}
+	aus.recordUpdate(&before, user, "unlocked")
+	return nil
+}
+
+func (aus *auditedUserService) ChangePassword(user *User, current, password string) error {
+	before := *user
+	if err := aus.UserService.ChangePassword(user, current, password); err != nil {
+		return err
+	}
+	aus.recordUpdate(&before, user, "password changed")
+	return nil
+}
+
+func (aus *auditedUserService) CreateResetToken(user *User) (string, error) {
+	before := *user
+	token, err := aus.UserService.CreateResetToken(user)
+	if err != nil {
+		return "", err
+	}
+	aus.recordUpdate(&before, user, "password reset link created")
+	return token, nil
+}
+
+// ResetPassword is recorded as done by the user the reset link was issued for.
+func (aus *auditedUserService) ResetPassword(token, password string) (*User, error) {
+	user, err := aus.UserService.ResetPassword(token, password)
+	if err != nil {
+		return nil, err
+	}
+	changes := []FieldChange{{Field: "password", After: "changed"}}
+	aus.record(ActorOf(user, aus.actor.IP), AuditUserUpdate, user, changes, "password reset with link")
+	return user, nil
+}
+
+// recordUpdate records the changes to the user, unless only ignored fields changed.
+func (aus *auditedUserService) recordUpdate(before, after *User, detail string) {
+	changes := diffUsers(before, after)
+	if len(changes) == 0 {
+		return
+	}
+	aus.record(aus.actor, AuditUserUpdate, after, changes, detail)
+}
+
+// record adds an entry to the audit log. Failures are logged, they do not fail the audited action.
+func (aus *auditedUserService) record(actor Actor, action AuditAction, target *User, changes []FieldChange, detail string) {
+	if err := aus.audit.Record(actor, action, target, changes, detail); err != nil {
+		aus.logger.Errorf("Error while recording audit entry %s: %v", action, err)
+	}
+}
+
+// auditDetail returns the message of the error as shown to users where possible.
+func auditDetail(err error) string {
+	if pe, ok := err.(modelError); ok {
+		return pe.Public()
+	}
+	return err.Error()
+}
+
+// diffUsers returns the fields which differ between the two users.
+// Password hashes and other secrets are never included, see redactedUserFields.
+func diffUsers(before, after *User) []FieldChange {
+	var changes []FieldChange
+	diffFields("", reflect.ValueOf(*before), reflect.ValueOf(*after), &changes)
+	return changes
+}
+
+func diffFields(prefix string, before, after reflect.Value, changes *[]FieldChange) {
+	t := before.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if ignoredUserFields[field.Name] {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		b, a := before.Field(i), after.Field(i)
+		if redacted, ok := redactedUserFields[field.Name]; ok {
+			if !reflect.DeepEqual(b.Interface(), a.Interface()) {
+				*changes = append(*changes, FieldChange{Field: redacted, After: "changed"})
+			}
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			diffFields(prefix+name+".", b, a, changes)
+			continue
+		}
+		bs, as := formatAuditValue(b), formatAuditValue(a)
+		if bs != as {
+			*changes = append(*changes, FieldChange{Field: prefix + name, Before: bs, After: as})
+		}
+	}
+}
+
+func formatAuditValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Time:
+		if value.IsZero() {
+			return ""
+		}
+		return value.Format("2006-01-02 15:04:05")
+	case bson.ObjectId:
+		if value == "" {
+			return ""
+		}
+		return value.Hex()
+	}
+	if v.Kind() == reflect.Slice {
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = fmt.Sprintf("%+v", v.Index(i).Interface())
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprint(v.Interface())
+}
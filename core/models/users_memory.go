@@ -0,0 +1,187 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// userMemory is a thread safe in-memory implementation of UserDB.
+// It mirrors the behaviour of userMongo closely enough to be used in tests
+// and for running the core without a MongoDB instance.
+type userMemory struct {
+	mu    sync.RWMutex
+	users map[bson.ObjectId]User
+}
+
+// To ensure that userMemory is implementing UserDB interface.
+var _ UserDB = &userMemory{}
+
+func newUserMemory() *userMemory {
+	return &userMemory{
+		users: make(map[bson.ObjectId]User),
+	}
+}
+
+func (um *userMemory) Create(user *User) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if user.Id == "" {
+		user.Id = bson.NewObjectId()
+	}
+	if _, ok := um.users[user.Id]; ok {
+		return ErrIDInvalid
+	}
+	if um.usernameTaken(user) {
+		return ErrUsernameTaken
+	}
+	um.users[user.Id] = copyUser(user)
+	return nil
+}
+
+func (um *userMemory) Update(user *User) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if _, ok := um.users[user.Id]; !ok {
+		return MongoErrNotFound
+	}
+	if um.usernameTaken(user) {
+		return ErrUsernameTaken
+	}
+	um.users[user.Id] = copyUser(user)
+	return nil
+}
+
+func (um *userMemory) AddFailedLogin(id bson.ObjectId, maxAttempts int, lockedUntil time.Time) (bool, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	u, ok := um.users[id]
+	if !ok {
+		return false, MongoErrNotFound
+	}
+	u.FailedLogins++
+	locked := u.FailedLogins >= maxAttempts
+	if locked {
+		u.FailedLogins = 0
+		u.LockedUntil = lockedUntil
+	}
+	um.users[id] = u
+	return locked, nil
+}
+
+func (um *userMemory) ClearFailedLogins(id bson.ObjectId) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	u, ok := um.users[id]
+	if !ok {
+		return MongoErrNotFound
+	}
+	u.FailedLogins = 0
+	u.LockedUntil = time.Time{}
+	um.users[id] = u
+	return nil
+}
+
+func (um *userMemory) Delete(id string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	oid := bson.ObjectIdHex(id)
+	if _, ok := um.users[oid]; !ok {
+		return MongoErrNotFound
+	}
+	delete(um.users, oid)
+	return nil
+}
+
+func (um *userMemory) ById(id string) (*User, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	u, ok := um.users[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	found := copyUser(&u)
+	return &found, nil
+}
+
+func (um *userMemory) ByUsername(username string) (*User, error) {
+	return um.findOne(func(u *User) bool {
+		return u.Username == username
+	})
+}
+
+func (um *userMemory) ByResetToken(tokenHash string) (*User, error) {
+	return um.findOne(func(u *User) bool {
+		return u.ResetTokenHash == tokenHash
+	})
+}
+
+func (um *userMemory) ByUserRole(userRole UserRole) ([]User, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	var users []User
+	for _, u := range um.users {
+		for _, role := range u.UserRoles {
+			if role == userRole {
+				users = append(users, copyUser(&u))
+				break
+			}
+		}
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+func (um *userMemory) All() ([]User, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	users := make([]User, 0, len(um.users))
+	for _, u := range um.users {
+		users = append(users, copyUser(&u))
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+func (um *userMemory) findOne(match func(u *User) bool) (*User, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	for _, u := range um.users {
+		if match(&u) {
+			found := copyUser(&u)
+			return &found, nil
+		}
+	}
+	return nil, MongoErrNotFound
+}
+
+// usernameTaken must be called with the lock held.
+func (um *userMemory) usernameTaken(user *User) bool {
+	for id, u := range um.users {
+		if u.Username == user.Username && id != user.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUser returns a copy of the user which does not share any slices with the original,
+// so that callers can not modify the stored users without calling Update.
+func copyUser(user *User) User {
+	u := *user
+	u.Password = ""
+	u.UserRoles = append([]UserRole(nil), user.UserRoles...)
+	u.Addresses = append([]Address(nil), user.Addresses...)
+	u.RecoveryCodeHashes = append([]string(nil), user.RecoveryCodeHashes...)
+	u.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	return u
+}
+
+// sortUsers orders users by their Id, which matches the insertion order.
+func sortUsers(users []User) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+}
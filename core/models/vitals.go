@@ -0,0 +1,394 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const VitalsCollection = "vitals"
+
+// VitalsRecord is a set of vitals taken of a patient, usually by the staff at check-in before the physician sees
+// the patient.
+type VitalsRecord struct {
+	Id         bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientId  bson.ObjectId `json:"patient_id" bson:"patient_id"`
+	Taken      time.Time     `json:"taken" bson:"taken"`
+	Vitals     `json:"vitals" bson:",inline"`
+	Recorded   time.Time     `json:"recorded" bson:"recorded"`
+	RecordedBy bson.ObjectId `json:"recorded_by" bson:"recorded_by"`
+	// EncounterId is set on the vitals of encounters, which are kept with the encounter.
+	EncounterId bson.ObjectId `json:"encounter_id,omitempty" bson:"-"`
+}
+
+// BloodPressure returns the blood pressure like 120/80, or an empty string if it was not taken.
+func (v Vitals) BloodPressure() string {
+	if v.SystolicBP == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", v.SystolicBP, v.DiastolicBP)
+}
+
+// vitalsRange is the range of plausible values of a measurement, to catch typing mistakes like a weight in grams.
+type vitalsRange struct {
+	min, max float64
+	err      modelError
+}
+
+var (
+	heightRange      = vitalsRange{20, 250, ErrVitalsHeightInvalid}
+	weightRange      = vitalsRange{0.3, 350, ErrVitalsWeightInvalid}
+	systolicRange    = vitalsRange{40, 300, ErrVitalsBloodPressureInvalid}
+	diastolicRange   = vitalsRange{20, 200, ErrVitalsBloodPressureInvalid}
+	pulseRange       = vitalsRange{20, 250, ErrVitalsPulseInvalid}
+	respiratoryRange = vitalsRange{4, 80, ErrVitalsRespiratoryRateInvalid}
+	temperatureRange = vitalsRange{30, 45, ErrVitalsTemperatureInvalid}
+	spO2Range        = vitalsRange{50, 100, ErrVitalsSpO2Invalid}
+	headRange        = vitalsRange{20, 70, ErrVitalsHeadInvalid}
+)
+
+// check returns the error of the range if the value was taken and is outside of it.
+func (r vitalsRange) check(value float64) error {
+	if value != 0 && (value < r.min || value > r.max) {
+		return r.err
+	}
+	return nil
+}
+
+// check rejects implausible measurements and blood pressures missing a value.
+func (v *Vitals) check() error {
+	if (v.SystolicBP == 0) != (v.DiastolicBP == 0) || v.DiastolicBP > v.SystolicBP {
+		return ErrVitalsBloodPressureInvalid
+	}
+	checks := []struct {
+		r     vitalsRange
+		value float64
+	}{
+		{heightRange, v.HeightCm},
+		{weightRange, v.WeightKg},
+		{systolicRange, float64(v.SystolicBP)},
+		{diastolicRange, float64(v.DiastolicBP)},
+		{pulseRange, float64(v.Pulse)},
+		{respiratoryRange, float64(v.RespiratoryRate)},
+		{temperatureRange, v.TemperatureC},
+		{spO2Range, float64(v.SpO2)},
+		{headRange, v.HeadCm},
+	}
+	for _, c := range checks {
+		if err := c.r.check(c.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// computeBMI sets the BMI from the height and weight, or clears it if one of them was not measured.
+func (v *Vitals) computeBMI() {
+	v.BMI = 0
+	if v.HeightCm > 0 && v.WeightKg > 0 {
+		m := v.HeightCm / 100
+		v.BMI = math.Round(v.WeightKg/(m*m)*10) / 10
+	}
+}
+
+type VitalsDB interface {
+	ById(id string) (*VitalsRecord, error)
+	// ByPatient returns the vitals of the patient in the order they were taken.
+	ByPatient(patientId string) ([]VitalsRecord, error)
+
+	Create(record *VitalsRecord) error
+	Delete(id string) error
+}
+
+type vitalsValidator struct {
+	VitalsDB
+	patients PatientDB
+	clock    Clock
+}
+
+var _ VitalsDB = &vitalsValidator{}
+
+func (vv *vitalsValidator) ById(id string) (*VitalsRecord, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrIDInvalid
+	}
+	return vv.VitalsDB.ById(id)
+}
+
+func (vv *vitalsValidator) ByPatient(patientId string) ([]VitalsRecord, error) {
+	if !bson.IsObjectIdHex(patientId) {
+		return nil, ErrIDInvalid
+	}
+	return vv.VitalsDB.ByPatient(patientId)
+}
+
+func (vv *vitalsValidator) Create(record *VitalsRecord) error {
+	if err := runVitalsValFuncs(record, vv.requirePatient, vv.requireMeasurement, vv.checkVitals,
+		vv.checkTaken); err != nil {
+		return err
+	}
+	return vv.VitalsDB.Create(record)
+}
+
+func (vv *vitalsValidator) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrIDInvalid
+	}
+	return vv.VitalsDB.Delete(id)
+}
+
+type vitalsValFunc func(record *VitalsRecord) error
+
+func runVitalsValFuncs(record *VitalsRecord, fns ...vitalsValFunc) error {
+	for _, fn := range fns {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vv *vitalsValidator) requirePatient(record *VitalsRecord) error {
+	if record.PatientId == "" {
+		return ErrPatientRequired
+	}
+	if _, err := vv.patients.ById(record.PatientId.Hex()); err != nil {
+		if err.Error() == MongoErrNotFound.Error() {
+			return ErrPatientRequired
+		}
+		return err
+	}
+	return nil
+}
+
+func (vv *vitalsValidator) requireMeasurement(record *VitalsRecord) error {
+	if record.Vitals.Empty() {
+		return ErrVitalsEmpty
+	}
+	return nil
+}
+
+func (vv *vitalsValidator) checkVitals(record *VitalsRecord) error {
+	if err := record.Vitals.check(); err != nil {
+		return err
+	}
+	record.Vitals.computeBMI()
+	return nil
+}
+
+// checkTaken sets the time the vitals were taken to now if it is not known, and rejects times in the future.
+func (vv *vitalsValidator) checkTaken(record *VitalsRecord) error {
+	now := vv.clock.Now()
+	record.Recorded = now
+	if record.Taken.IsZero() {
+		record.Taken = now
+	}
+	if record.Taken.After(now) {
+		return ErrVitalsTakenInvalid
+	}
+	return nil
+}
+
+// Percentile is the percentile of a growth measurement, if the growth reference covers it.
+type Percentile struct {
+	Value float64
+	Known bool
+}
+
+// String returns the percentile like P42, or an empty string if it is not known.
+func (p Percentile) String() string {
+	switch {
+	case !p.Known:
+		return ""
+	case p.Value < 1:
+		return "<P1"
+	case p.Value > 99:
+		return ">P99"
+	}
+	return fmt.Sprintf("P%.0f", p.Value)
+}
+
+// Outside reports whether the percentile is below the 3rd or above the 97th.
+func (p Percentile) Outside() bool {
+	return p.Known && (p.Value < 3 || p.Value > 97)
+}
+
+// GrowthPercentiles are the percentiles of the growth measurements of the vitals of a child.
+type GrowthPercentiles struct {
+	Weight Percentile
+	Height Percentile
+	Head   Percentile
+	BMI    Percentile
+}
+
+type VitalsService interface {
+	Growth() *GrowthReference
+	// Percentiles returns the percentiles of the measurements for the age and sex of the patient when they were
+	// taken.
+	Percentiles(patient *Patient, record *VitalsRecord) GrowthPercentiles
+	// Latest returns the most recent vitals of the patient taken since the time, or nil if there are none.
+	Latest(patientId string, since time.Time) (*VitalsRecord, error)
+	// History returns the vitals taken of the patient at check-in and during encounters, oldest first.
+	History(patientId string) ([]VitalsRecord, error)
+	VitalsDB
+}
+
+type vitalsService struct {
+	VitalsDB
+	encounters EncounterDB
+	growth     *GrowthReference
+	logger     *logrus.Entry
+}
+
+func NewVitalsService(mgo *mgo.Session, patients PatientDB, encounters EncounterDB, growth *GrowthReference,
+	logger *logrus.Entry, dbname string) VitalsService {
+	vm := &vitalsMongo{mgo, dbname, logger}
+	return newVitalsService(vm, patients, encounters, growth, logger)
+}
+
+// NewInMemoryVitalsService returns a VitalsService backed by an in-memory VitalsDB.
+func NewInMemoryVitalsService(patients PatientDB, encounters EncounterDB, growth *GrowthReference,
+	logger *logrus.Entry) VitalsService {
+	return newVitalsService(newVitalsMemory(), patients, encounters, growth, logger)
+}
+
+func newVitalsService(vdb VitalsDB, patients PatientDB, encounters EncounterDB, growth *GrowthReference,
+	logger *logrus.Entry) VitalsService {
+	return &vitalsService{
+		VitalsDB: &vitalsValidator{
+			VitalsDB: vdb,
+			patients: patients,
+			clock:    SystemClock(),
+		},
+		encounters: encounters,
+		growth:     growth,
+		logger:     logger,
+	}
+}
+
+func (vs *vitalsService) Growth() *GrowthReference {
+	return vs.growth
+}
+
+func (vs *vitalsService) Percentiles(patient *Patient, record *VitalsRecord) GrowthPercentiles {
+	month := AgeInMonths(patient.DateOfBirth, record.Taken)
+	percentile := func(measure GrowthMeasure, value float64) Percentile {
+		p, ok := vs.growth.Percentile(measure, patient.Sex, month, value)
+		return Percentile{Value: p, Known: ok}
+	}
+	return GrowthPercentiles{
+		Weight: percentile(GrowthWeight, record.WeightKg),
+		Height: percentile(GrowthHeight, record.HeightCm),
+		Head:   percentile(GrowthHead, record.HeadCm),
+		BMI:    percentile(GrowthBMI, record.BMI),
+	}
+}
+
+func (vs *vitalsService) Latest(patientId string, since time.Time) (*VitalsRecord, error) {
+	records, err := vs.ByPatient(patientId)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[len(records)-1].Taken.Before(since) {
+		return nil, nil
+	}
+	return &records[len(records)-1], nil
+}
+
+// History adds the vitals of the encounters of the patient to the ones taken at check-in. Encounter vitals copied
+// from a check-in the same day are left out, so that they are not counted twice.
+func (vs *vitalsService) History(patientId string) ([]VitalsRecord, error) {
+	records, err := vs.ByPatient(patientId)
+	if err != nil {
+		return nil, err
+	}
+	encounters, err := vs.encounters.ByPatient(patientId)
+	if err != nil {
+		return nil, err
+	}
+	checkIns := make(map[Vitals][]time.Time)
+	for _, r := range records {
+		checkIns[r.Vitals] = append(checkIns[r.Vitals], StartOfDay(r.Taken))
+	}
+	for _, e := range encounters {
+		if e.Vitals.Empty() || sameDay(checkIns[e.Vitals], StartOfDay(e.Date)) {
+			continue
+		}
+		records = append(records, VitalsRecord{
+			PatientId:   e.PatientId,
+			Taken:       e.Date,
+			Vitals:      e.Vitals,
+			EncounterId: e.Id,
+		})
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Taken.Before(records[j].Taken)
+	})
+	return records, nil
+}
+
+func sameDay(days []time.Time, day time.Time) bool {
+	for _, d := range days {
+		if d.Equal(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// AgeInMonths returns the age in months, with the fraction, of someone born on the day of birth at the time t,
+// the way growth reference tables count ages.
+func AgeInMonths(dateOfBirth, t time.Time) float64 {
+	birth := time.Date(dateOfBirth.Year(), dateOfBirth.Month(), dateOfBirth.Day(), 0, 0, 0, 0, t.Location())
+	return t.Sub(birth).Hours() / 24 / daysPerMonth
+}
+
+// AtAgeInMonths returns the time someone born on the day of birth reaches the age in months, the inverse of
+// AgeInMonths.
+func AtAgeInMonths(dateOfBirth time.Time, months float64, loc *time.Location) time.Time {
+	birth := time.Date(dateOfBirth.Year(), dateOfBirth.Month(), dateOfBirth.Day(), 0, 0, 0, 0, loc)
+	return birth.Add(time.Duration(months * daysPerMonth * 24 * float64(time.Hour)))
+}
+
+type vitalsMongo struct {
+	mgo    *mgo.Session
+	dbname string
+	logger *logrus.Entry
+}
+
+var _ VitalsDB = &vitalsMongo{}
+
+func (vm *vitalsMongo) ById(id string) (*VitalsRecord, error) {
+	ses := vm.mgo.Copy()
+	defer ses.Close()
+	record := VitalsRecord{}
+	err := ses.DB(vm.dbname).C(VitalsCollection).FindId(bson.ObjectIdHex(id)).One(&record)
+	return &record, err
+}
+
+func (vm *vitalsMongo) ByPatient(patientId string) ([]VitalsRecord, error) {
+	ses := vm.mgo.Copy()
+	defer ses.Close()
+	var records []VitalsRecord
+	query := bson.M{"patient_id": bson.ObjectIdHex(patientId)}
+	err := ses.DB(vm.dbname).C(VitalsCollection).Find(query).Sort("taken").All(&records)
+	return records, err
+}
+
+func (vm *vitalsMongo) Create(record *VitalsRecord) error {
+	ses := vm.mgo.Copy()
+	defer ses.Close()
+	record.Id = bson.NewObjectId()
+	return ses.DB(vm.dbname).C(VitalsCollection).Insert(record)
+}
+
+func (vm *vitalsMongo) Delete(id string) error {
+	ses := vm.mgo.Copy()
+	defer ses.Close()
+	return ses.DB(vm.dbname).C(VitalsCollection).RemoveId(bson.ObjectIdHex(id))
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// vitalsMemory is a thread safe in-memory implementation of VitalsDB.
+type vitalsMemory struct {
+	mu     sync.RWMutex
+	vitals map[bson.ObjectId]VitalsRecord
+}
+
+var _ VitalsDB = &vitalsMemory{}
+
+func newVitalsMemory() *vitalsMemory {
+	return &vitalsMemory{vitals: make(map[bson.ObjectId]VitalsRecord)}
+}
+
+func (vm *vitalsMemory) ById(id string) (*VitalsRecord, error) {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	v, ok := vm.vitals[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, MongoErrNotFound
+	}
+	return &v, nil
+}
+
+func (vm *vitalsMemory) ByPatient(patientId string) ([]VitalsRecord, error) {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	var vitals []VitalsRecord
+	for _, v := range vm.vitals {
+		if v.PatientId.Hex() == patientId {
+			vitals = append(vitals, v)
+		}
+	}
+	sort.Slice(vitals, func(i, j int) bool {
+		return vitals[i].Taken.Before(vitals[j].Taken)
+	})
+	return vitals, nil
+}
+
+func (vm *vitalsMemory) Create(vitals *VitalsRecord) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vitals.Id = bson.NewObjectId()
+	vm.vitals[vitals.Id] = *vitals
+	return nil
+}
+
+func (vm *vitalsMemory) Delete(id string) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if _, ok := vm.vitals[bson.ObjectIdHex(id)]; !ok {
+		return MongoErrNotFound
+	}
+	delete(vm.vitals, bson.ObjectIdHex(id))
+	return nil
+}
@@ -0,0 +1,33 @@
+package views
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"gcchr-system/core/fhir"
+)
+
+// FHIRPrefix is the path prefix of the FHIR API.
+const FHIRPrefix = "/fhir/"
+
+// IsFHIRRequest reports whether the request was sent to the FHIR API, which answers errors with OperationOutcomes.
+func IsFHIRRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, FHIRPrefix)
+}
+
+// RenderFHIR writes the FHIR resource as the body of a response with the status code.
+func RenderFHIR(w http.ResponseWriter, status int, resource interface{}) {
+	w.Header().Set("Content-Type", fhir.ContentType+"; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		log.Println(err)
+	}
+}
+
+// RenderOperationOutcome writes an OperationOutcome with a single error of the issue type. Only messages which are
+// safe to show to clients may be passed.
+func RenderOperationOutcome(w http.ResponseWriter, status int, code, message string) {
+	RenderFHIR(w, status, fhir.NewOperationOutcome(code, message))
+}
@@ -0,0 +1,56 @@
+package views
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"gcchr-system/core/fhir"
+)
+
+// ErrorBody is the body of all error responses of the JSON API.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// RenderJSON writes v as the JSON body of a response with the status code.
+func RenderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// RenderJSONError writes an error response. Only messages which are safe to show to clients may be passed.
+func RenderJSONError(w http.ResponseWriter, status int, message string) {
+	RenderJSON(w, status, ErrorBody{Error: ErrorDetail{Status: status, Message: message}})
+}
+
+// RenderAPIError writes an error response of the JSON API, or an OperationOutcome for requests to the FHIR API.
+// Only messages which are safe to show to clients may be passed.
+func RenderAPIError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if IsFHIRRequest(r) {
+		RenderOperationOutcome(w, status, fhir.IssueForStatus(status), message)
+		return
+	}
+	RenderJSONError(w, status, message)
+}
+
+// IsAPIRequest reports whether the request was sent to the JSON or the FHIR API, which answer with JSON instead of
+// pages.
+func IsAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, APIPrefix) || IsFHIRRequest(r)
+}
+
+// APIPrefix is the path prefix of the JSON API.
+const APIPrefix = "/api/"
@@ -29,6 +29,11 @@ func (v *View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Render is used to render the view with predefined layout.
 func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
+	v.RenderStatus(w, r, http.StatusOK, data)
+}
+
+// RenderStatus renders the view like Render, but responds with the provided HTTP status code.
+func (v *View) RenderStatus(w http.ResponseWriter, r *http.Request, code int, data interface{}) {
 	w.Header().Set("Content-Type", "text/html")
 	var vd Data
 	switch d := data.(type) {
@@ -62,6 +67,7 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 		return
 	}
 
+	w.WriteHeader(code)
 	// this throws an error, we really have no way to recover from this error, so it is not required here
 	// to check and handle the error. We will let it panic.
 	io.Copy(w, &buf)